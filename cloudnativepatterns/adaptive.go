@@ -0,0 +1,254 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrLimitExceeded is returned by a function wrapped with AdaptiveLimit when the calls in flight already reach the limit.
+// It means that the service is overloaded, i.e. 503 Service Unavailable over HTTP.
+var ErrLimitExceeded = errors.New("concurrency limit exceeded")
+
+// AdaptiveAlgorithm is the algorithm an AdaptiveLimiter adjusts its limit with.
+type AdaptiveAlgorithm int
+
+const (
+	// AdaptiveAIMD increases the limit by one after every good call made while the limit was being used,
+	// and multiplies it by AdaptiveLimiterSettings.BackoffRatio after a failed call or one slower than
+	// AdaptiveLimiterSettings.LatencyThreshold.
+	AdaptiveAIMD AdaptiveAlgorithm = iota
+	// AdaptiveGradient compares the latency of every call with the long-term average latency:
+	// the limit shrinks as the latency grows (queueing), and grows by the square root of the limit otherwise.
+	// It needs no latency threshold. See https://github.com/Netflix/concurrency-limits (Gradient2Limit).
+	AdaptiveGradient
+)
+
+// AdaptiveLimiterSettings configures an AdaptiveLimiter.
+type AdaptiveLimiterSettings struct {
+	// Name identifies the limiter, e.g. "http".
+	Name      string
+	Algorithm AdaptiveAlgorithm
+	// InitialLimit is the limit before any call was measured. Defaults to 20.
+	InitialLimit int
+	// MinLimit and MaxLimit bound the limit. They default to 1 and 1000.
+	MinLimit int
+	MaxLimit int
+	// LatencyThreshold is the latency above which a call is considered failed by AdaptiveAIMD. Defaults to 1s.
+	LatencyThreshold time.Duration
+	// BackoffRatio is the factor AdaptiveAIMD multiplies the limit with after a failed call. Defaults to 0.9.
+	BackoffRatio float64
+	// Tolerance is how much the latency may exceed the long-term average before AdaptiveGradient shrinks the limit. Defaults to 1.5.
+	Tolerance float64
+	// Smoothing is the weight of every new limit computed by AdaptiveGradient (0 < Smoothing <= 1). Defaults to 0.2.
+	Smoothing float64
+	// Window is the number of calls the long-term average latency of AdaptiveGradient is computed on. Defaults to 600.
+	Window int
+	// IsFailure decides which errors mean that the dependency is overloaded. Defaults to every error that is
+	// neither permanent (see Permanent) nor a rejection (see IsRejection) nor context.Canceled.
+	IsFailure func(err error) bool
+}
+
+// AdaptiveLimiter caps the concurrent calls to a limit that adapts to the measured latency,
+// instead of a static size like Bulkhead that is hard to tune.
+// It is shared by every function wrapped with it, so create it once (e.g. per service) and reuse it.
+type AdaptiveLimiter struct {
+	settings AdaptiveLimiterSettings
+	cnp      *CNP
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	longRTT  float64
+}
+
+// NewAdaptiveLimiter creates an AdaptiveLimiter whose latencies are measured with cnp.Clock.
+func (cnp *CNP) NewAdaptiveLimiter(settings AdaptiveLimiterSettings) *AdaptiveLimiter {
+	if settings.MinLimit <= 0 {
+		settings.MinLimit = 1
+	}
+
+	if settings.MaxLimit <= 0 {
+		settings.MaxLimit = 1000
+	}
+
+	if settings.InitialLimit <= 0 {
+		settings.InitialLimit = 20
+	}
+
+	if settings.LatencyThreshold <= 0 {
+		settings.LatencyThreshold = time.Second
+	}
+
+	if settings.BackoffRatio <= 0 || settings.BackoffRatio >= 1 {
+		settings.BackoffRatio = 0.9
+	}
+
+	if settings.Tolerance < 1 {
+		settings.Tolerance = 1.5
+	}
+
+	if settings.Smoothing <= 0 || settings.Smoothing > 1 {
+		settings.Smoothing = 0.2
+	}
+
+	if settings.Window <= 0 {
+		settings.Window = 600
+	}
+
+	if settings.IsFailure == nil {
+		settings.IsFailure = func(err error) bool {
+			return !IsPermanent(err) && !IsRejection(err) && !errors.Is(err, context.Canceled)
+		}
+	}
+
+	l := &AdaptiveLimiter{
+		settings: settings,
+		cnp:      cnp,
+	}
+	l.limit = l.clamp(float64(settings.InitialLimit))
+
+	return l
+}
+
+// Limit returns the current limit.
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.limit)
+}
+
+// InFlight returns the number of calls currently running.
+func (l *AdaptiveLimiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.inFlight
+}
+
+// errPanicked makes a call that panicked count as a failure for the AdaptiveLimiter.
+var errPanicked = errors.New("panicked")
+
+// AdaptiveLimit wraps cnf so that it is rejected with ErrLimitExceeded when the calls in flight reach the limit of limiter.
+// The latency and the error of every call adjust the limit, a panic counting as a failure. Rejections and limit changes
+// are reported to the listener of cnp, see Listener.
+func (cnp *CNP) AdaptiveLimit(cnf CloudNativeFunction, limiter *AdaptiveLimiter) CloudNativeFunction {
+	return func(ctx context.Context) (err error) {
+		if !limiter.acquire() {
+			cnp.emit(ctx, Event{Type: EventLimitExceeded, Operation: limiter.settings.Name, Limit: limiter.Limit(), Err: ErrLimitExceeded})
+			return ErrLimitExceeded
+		}
+
+		// Deferred, so that a call that panics releases its slot too: it would be lost for good otherwise
+		start := cnp.Clock.Now()
+		panicked := true
+		defer func() {
+			measured := err
+			if panicked {
+				measured = errPanicked
+			}
+			limiter.release(ctx, cnp.Clock.Since(start), measured)
+		}()
+
+		err = cnf(ctx)
+		panicked = false
+
+		return err
+	}
+}
+
+// AdaptiveLimitT is the TypedFunction variant of CNP.AdaptiveLimit.
+func AdaptiveLimitT[T any](cnp CloudNativePatterns, fn TypedFunction[T], limiter *AdaptiveLimiter) TypedFunction[T] {
+	return typed(fn, func(cnf CloudNativeFunction) CloudNativeFunction {
+		return cnp.AdaptiveLimit(cnf, limiter)
+	})
+}
+
+func (l *AdaptiveLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight >= int(l.limit) {
+		return false
+	}
+
+	l.inFlight++
+	return true
+}
+
+// release ends a call that took latency and failed with err (nil on success), and adjusts the limit.
+func (l *AdaptiveLimiter) release(ctx context.Context, latency time.Duration, err error) {
+	l.mu.Lock()
+
+	// The number of calls in flight while this one was running, this one included
+	inFlight := l.inFlight
+	l.inFlight--
+
+	before := int(l.limit)
+	if err == nil || l.settings.IsFailure(err) {
+		failed := err != nil
+
+		switch l.settings.Algorithm {
+		case AdaptiveGradient:
+			l.gradient(latency, failed, inFlight)
+		default:
+			l.aimd(latency, failed, inFlight)
+		}
+	}
+	after := int(l.limit)
+
+	l.mu.Unlock()
+
+	if after != before {
+		l.cnp.emit(ctx, Event{Type: EventLimitChanged, Operation: l.settings.Name, Limit: after})
+	}
+}
+
+// aimd must be called with l.mu held.
+func (l *AdaptiveLimiter) aimd(latency time.Duration, failed bool, inFlight int) {
+	if failed || latency > l.settings.LatencyThreshold {
+		l.limit = l.clamp(math.Floor(l.limit * l.settings.BackoffRatio))
+		return
+	}
+
+	// Only grow a limit that is being used, otherwise it would grow forever under a light load
+	if float64(inFlight)*2 >= l.limit {
+		l.limit = l.clamp(l.limit + 1)
+	}
+}
+
+// gradient must be called with l.mu held.
+func (l *AdaptiveLimiter) gradient(latency time.Duration, failed bool, inFlight int) {
+	rtt := float64(latency)
+	if rtt <= 0 {
+		rtt = 1
+	}
+
+	if l.longRTT == 0 {
+		l.longRTT = rtt
+	} else {
+		l.longRTT += (rtt - l.longRTT) / float64(l.settings.Window)
+	}
+
+	// An unused limit says nothing about the capacity
+	if !failed && float64(inFlight)*2 < l.limit {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1, l.settings.Tolerance*l.longRTT/rtt))
+	if failed {
+		gradient = 0.5
+	}
+
+	queue := math.Sqrt(l.limit)
+	next := l.limit*gradient + queue
+
+	l.limit = l.clamp(l.limit*(1-l.settings.Smoothing) + next*l.settings.Smoothing)
+}
+
+func (l *AdaptiveLimiter) clamp(limit float64) float64 {
+	return math.Max(float64(l.settings.MinLimit), math.Min(float64(l.settings.MaxLimit), limit))
+}
@@ -0,0 +1,50 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// errServerError makes a response with a 5xx status count as a failure for the AdaptiveLimiter.
+var errServerError = errors.New("server error")
+
+// statusWriter records the status code written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying http.ResponseWriter.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// AdaptiveLimitMiddleware returns a chi (net/http) middleware that rejects the requests over the limit of limiter
+// with 503 Service Unavailable and a Retry-After header. The latency of every request adjusts the limit,
+// and a response with a 5xx status counts as a failure.
+func (cnp *CNP) AdaptiveLimitMiddleware(limiter *AdaptiveLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := cnp.AdaptiveLimit(func(ctx context.Context) error {
+				sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+				next.ServeHTTP(sw, r)
+
+				if sw.status >= http.StatusInternalServerError {
+					return errServerError
+				}
+				return nil
+			}, limiter)(r.Context())
+
+			if errors.Is(err, ErrLimitExceeded) {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("AdaptiveLimit", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+	)
+
+	dummyError := errors.New("dummy error")
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+	})
+
+	// call makes a call that takes latency and fails with err
+	call := func(limiter *cnp.AdaptiveLimiter, latency time.Duration, err error) error {
+		return CNP.AdaptiveLimit(func(ctx context.Context) error {
+			mockclock.Add(latency)
+			return err
+		}, limiter)(context.Background())
+	}
+
+	// burst makes limit concurrent calls that all take latency
+	burst := func(limiter *cnp.AdaptiveLimiter, latency time.Duration) {
+		n := limiter.Limit()
+		gate := make(chan struct{})
+
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				Expect(CNP.AdaptiveLimit(func(ctx context.Context) error {
+					<-gate
+					return nil
+				}, limiter)(context.Background())).To(Succeed())
+			}()
+		}
+
+		Eventually(limiter.InFlight).Should(Equal(n))
+		mockclock.Add(latency)
+		close(gate)
+		wg.Wait()
+	}
+
+	It("should reject the calls over the limit", func() {
+		limiter := CNP.NewAdaptiveLimiter(cnp.AdaptiveLimiterSettings{InitialLimit: 1})
+
+		var nested error
+		Expect(CNP.AdaptiveLimit(func(ctx context.Context) error {
+			nested = call(limiter, 0, nil)
+			return nil
+		}, limiter)(context.Background())).To(Succeed())
+
+		Expect(nested).To(MatchError(cnp.ErrLimitExceeded))
+		Expect(cnp.IsRejection(nested)).To(BeTrue())
+		Expect(limiter.InFlight()).To(Equal(0))
+	})
+
+	Context("AIMD", func() {
+		var limiter *cnp.AdaptiveLimiter
+
+		BeforeEach(func() {
+			limiter = CNP.NewAdaptiveLimiter(cnp.AdaptiveLimiterSettings{
+				Name:             "test",
+				Algorithm:        cnp.AdaptiveAIMD,
+				InitialLimit:     10,
+				MaxLimit:         20,
+				LatencyThreshold: 100 * time.Millisecond,
+				BackoffRatio:     0.5,
+			})
+		})
+
+		It("should increase the limit additively while it is being used", func() {
+			burst(limiter, 10*time.Millisecond)
+			Expect(limiter.Limit()).To(BeNumerically(">", 10))
+			Expect(limiter.Limit()).To(BeNumerically("<=", 20))
+		})
+
+		It("should not increase a limit that is not being used", func() {
+			Expect(call(limiter, 10*time.Millisecond, nil)).To(Succeed())
+			Expect(limiter.Limit()).To(Equal(10))
+		})
+
+		It("should decrease the limit multiplicatively after a slow or a failed call", func() {
+			Expect(call(limiter, time.Second, nil)).To(Succeed())
+			Expect(limiter.Limit()).To(Equal(5))
+
+			Expect(call(limiter, 0, dummyError)).To(MatchError(dummyError))
+			Expect(limiter.Limit()).To(Equal(2))
+		})
+
+		It("should ignore the permanent errors", func() {
+			Expect(call(limiter, 0, cnp.Permanent(dummyError))).To(MatchError(dummyError))
+			Expect(limiter.Limit()).To(Equal(10))
+		})
+
+		It("should release the slot of a call that panicked, and count it as a failure", func() {
+			Expect(func() {
+				_ = CNP.AdaptiveLimit(func(ctx context.Context) error {
+					panic("handler bug")
+				}, limiter)(context.Background())
+			}).To(PanicWith("handler bug"))
+
+			Expect(limiter.InFlight()).To(Equal(0))
+			Expect(limiter.Limit()).To(Equal(5))
+		})
+
+		It("should not go below the minimum limit", func() {
+			for i := 0; i < 10; i++ {
+				_ = call(limiter, 0, dummyError)
+			}
+			Expect(limiter.Limit()).To(Equal(1))
+		})
+	})
+
+	Context("Gradient", func() {
+		var limiter *cnp.AdaptiveLimiter
+
+		BeforeEach(func() {
+			limiter = CNP.NewAdaptiveLimiter(cnp.AdaptiveLimiterSettings{
+				Name:         "test",
+				Algorithm:    cnp.AdaptiveGradient,
+				InitialLimit: 10,
+			})
+		})
+
+		It("should grow the limit while the latency is stable", func() {
+			burst(limiter, 10*time.Millisecond)
+			Expect(limiter.Limit()).To(BeNumerically(">", 10))
+		})
+
+		It("should shrink the limit when the latency grows", func() {
+			burst(limiter, 10*time.Millisecond)
+			before := limiter.Limit()
+
+			burst(limiter, 200*time.Millisecond)
+			Expect(limiter.Limit()).To(BeNumerically("<", before))
+		})
+	})
+
+	Context("AdaptiveLimitMiddleware", func() {
+		It("should reject the requests over the limit with 503", func() {
+			limiter := CNP.NewAdaptiveLimiter(cnp.AdaptiveLimiterSettings{InitialLimit: 1})
+
+			gate := make(chan struct{})
+			ts := httptest.NewServer(CNP.AdaptiveLimitMiddleware(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-gate
+				w.WriteHeader(http.StatusOK)
+			})))
+			defer ts.Close()
+
+			first := make(chan int, 1)
+			go func() {
+				defer GinkgoRecover()
+				res, err := http.Get(ts.URL)
+				Expect(err).ShouldNot(HaveOccurred())
+				res.Body.Close()
+				first <- res.StatusCode
+			}()
+			Eventually(limiter.InFlight).Should(Equal(1))
+
+			res, err := http.Get(ts.URL)
+			Expect(err).ShouldNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(res).To(HaveHTTPHeaderWithValue("Retry-After", "1"))
+
+			close(gate)
+			Eventually(first).Should(Receive(Equal(http.StatusOK)))
+		})
+
+		It("should count the server errors as failures", func() {
+			limiter := CNP.NewAdaptiveLimiter(cnp.AdaptiveLimiterSettings{InitialLimit: 10, BackoffRatio: 0.5})
+
+			ts := httptest.NewServer(CNP.AdaptiveLimitMiddleware(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			})))
+			defer ts.Close()
+
+			res, err := http.Get(ts.URL)
+			Expect(err).ShouldNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusInternalServerError))
+			Expect(limiter.Limit()).To(Equal(5))
+		})
+
+		It("should not leak the slots of the requests that panicked", func() {
+			limiter := CNP.NewAdaptiveLimiter(cnp.AdaptiveLimiterSettings{InitialLimit: 2, MinLimit: 2})
+
+			// The recoverer sits outside the middleware, like chi's middleware.Recoverer
+			recoverer := func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					defer func() {
+						if recover() != nil {
+							w.WriteHeader(http.StatusInternalServerError)
+						}
+					}()
+					next.ServeHTTP(w, r)
+				})
+			}
+
+			ts := httptest.NewServer(recoverer(CNP.AdaptiveLimitMiddleware(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic("handler bug")
+			}))))
+			defer ts.Close()
+
+			// Far more panics than slots, none of them is rejected
+			for i := 0; i < 5; i++ {
+				res, err := http.Get(ts.URL)
+				Expect(err).ShouldNot(HaveOccurred())
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusInternalServerError))
+			}
+
+			Expect(limiter.InFlight()).To(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,94 @@
+package cloudnativepatterns
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff decides how long Retry waits before the next attempt.
+// attempt starts at 1 for the wait after the first failed attempt,
+// previous is the wait returned for the preceding attempt (0 for the first one).
+type Backoff interface {
+	Delay(attempt int, previous time.Duration) time.Duration
+}
+
+// ConstantBackoff waits the same Interval between every attempt.
+type ConstantBackoff struct {
+	Interval time.Duration
+}
+
+func (b ConstantBackoff) Delay(attempt int, previous time.Duration) time.Duration {
+	return b.Interval
+}
+
+// ExponentialBackoff waits Base * Multiplier^(attempt-1), capped at Max.
+// Multiplier defaults to 2 and a zero Max means no cap.
+type ExponentialBackoff struct {
+	Base       time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+func (b ExponentialBackoff) Delay(attempt int, previous time.Duration) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	return capDelay(float64(b.Base)*math.Pow(multiplier, float64(attempt-1)), b.Max)
+}
+
+// FullJitterBackoff waits a random duration in [0, min(Max, Base * 2^(attempt-1))).
+// See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+type FullJitterBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+	// Rand returns a pseudo-random number in [0.0, 1.0). Defaults to math/rand.Float64.
+	// Inject a deterministic one for tests.
+	Rand func() float64
+}
+
+func (b FullJitterBackoff) Delay(attempt int, previous time.Duration) time.Duration {
+	ceiling := ExponentialBackoff{Base: b.Base, Max: b.Max}.Delay(attempt, previous)
+
+	return time.Duration(randFloat(b.Rand) * float64(ceiling))
+}
+
+// DecorrelatedJitterBackoff waits a random duration in [Base, previous * 3), capped at Max.
+// See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+type DecorrelatedJitterBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+	// Rand returns a pseudo-random number in [0.0, 1.0). Defaults to math/rand.Float64.
+	// Inject a deterministic one for tests.
+	Rand func() float64
+}
+
+func (b DecorrelatedJitterBackoff) Delay(attempt int, previous time.Duration) time.Duration {
+	if previous < b.Base {
+		previous = b.Base
+	}
+
+	upper := float64(previous) * 3
+	delay := float64(b.Base) + randFloat(b.Rand)*(upper-float64(b.Base))
+
+	return capDelay(delay, b.Max)
+}
+
+func randFloat(r func() float64) float64 {
+	if r == nil {
+		return rand.Float64()
+	}
+	return r()
+}
+
+func capDelay(delay float64, max time.Duration) time.Duration {
+	if max > 0 && delay > float64(max) {
+		return max
+	}
+	if delay > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(delay)
+}
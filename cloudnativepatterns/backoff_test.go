@@ -0,0 +1,51 @@
+package cloudnativepatterns_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("Backoff", func() {
+	// half always returns 0.5, so the jittered delays are deterministic
+	half := func() float64 { return 0.5 }
+
+	It("ConstantBackoff should always return the interval", func() {
+		b := cnp.ConstantBackoff{Interval: 2 * time.Second}
+
+		Expect(b.Delay(1, 0)).To(Equal(2 * time.Second))
+		Expect(b.Delay(5, 2*time.Second)).To(Equal(2 * time.Second))
+	})
+
+	It("ExponentialBackoff should double the delay up to the cap", func() {
+		b := cnp.ExponentialBackoff{Base: time.Second, Max: 5 * time.Second}
+
+		Expect(b.Delay(1, 0)).To(Equal(1 * time.Second))
+		Expect(b.Delay(2, 0)).To(Equal(2 * time.Second))
+		Expect(b.Delay(3, 0)).To(Equal(4 * time.Second))
+		Expect(b.Delay(4, 0)).To(Equal(5 * time.Second))
+		Expect(b.Delay(100, 0)).To(Equal(5 * time.Second))
+	})
+
+	It("FullJitterBackoff should pick a delay below the exponential ceiling", func() {
+		b := cnp.FullJitterBackoff{Base: time.Second, Max: 5 * time.Second, Rand: half}
+
+		Expect(b.Delay(1, 0)).To(Equal(500 * time.Millisecond))
+		Expect(b.Delay(3, 0)).To(Equal(2 * time.Second))
+		Expect(b.Delay(10, 0)).To(Equal(2500 * time.Millisecond))
+	})
+
+	It("DecorrelatedJitterBackoff should grow from the previous delay up to the cap", func() {
+		b := cnp.DecorrelatedJitterBackoff{Base: time.Second, Max: 5 * time.Second, Rand: half}
+
+		first := b.Delay(1, 0)
+		Expect(first).To(Equal(2 * time.Second)) // between 1s and 3s
+
+		second := b.Delay(2, first)
+		Expect(second).To(Equal(3500 * time.Millisecond)) // between 1s and 6s
+
+		Expect(b.Delay(3, second)).To(Equal(5 * time.Second)) // capped
+	})
+})
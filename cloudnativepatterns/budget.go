@@ -0,0 +1,118 @@
+package cloudnativepatterns
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRetryBudgetExhausted is wrapped, together with the last error, by Retry when it gave up
+// because its RetryBudget did not allow another retry.
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// budgetBuckets is the number of buckets the window of a RetryBudget is divided into.
+const budgetBuckets = 10
+
+// budgetBucket counts the calls and the retries of a slice of the window.
+type budgetBucket struct {
+	calls   int
+	retries int
+}
+
+// RetryBudgetSettings configures a RetryBudget.
+type RetryBudgetSettings struct {
+	// Ratio is the share of retries allowed relative to the calls, e.g. 0.1 allows 1 retry for every 10 calls.
+	Ratio float64
+	// MinRetries is the number of retries allowed in every window regardless of Ratio,
+	// so that a dependency with little traffic is still retried.
+	MinRetries int
+	// Window is the sliding window over which the calls and the retries are counted. Defaults to 10s.
+	// It is divided into 10 buckets of at least 1ns each, so a window shorter than 10ns lasts 10ns.
+	Window time.Duration
+}
+
+// RetryBudget caps the retries of every function retried with it to a share of their calls,
+// so that retries cannot multiply the load on a dependency that is already failing:
+// with 3 retries per call and no budget, every failing call makes 4 calls to the dependency.
+//
+// It is shared by every function retried with it (see RetryPolicy.Budget), so create it once (e.g. per dependency) and reuse it.
+type RetryBudget struct {
+	settings RetryBudgetSettings
+	cnp      *CNP
+	width    time.Duration
+
+	mu        sync.Mutex
+	buckets   [budgetBuckets]budgetBucket
+	head      int
+	headStart time.Time
+}
+
+// NewRetryBudget creates a RetryBudget whose window slides with cnp.Clock.
+func (cnp *CNP) NewRetryBudget(settings RetryBudgetSettings) *RetryBudget {
+	if settings.Window <= 0 {
+		settings.Window = 10 * time.Second
+	}
+
+	// A zero width would divide by zero in advance
+	width := settings.Window / budgetBuckets
+	if width <= 0 {
+		width = 1
+	}
+
+	return &RetryBudget{
+		settings:  settings,
+		cnp:       cnp,
+		width:     width,
+		headStart: cnp.Clock.Now(),
+	}
+}
+
+// recordCall counts a call, i.e. a first attempt.
+func (b *RetryBudget) recordCall() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(b.cnp.Clock.Now())
+	b.buckets[b.head].calls++
+}
+
+// withdraw counts a retry and returns true if the budget allows it.
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(b.cnp.Clock.Now())
+
+	calls, retries := 0, 0
+	for _, bucket := range b.buckets {
+		calls += bucket.calls
+		retries += bucket.retries
+	}
+
+	if float64(retries+1) > float64(b.settings.MinRetries)+b.settings.Ratio*float64(calls) {
+		return false
+	}
+
+	b.buckets[b.head].retries++
+	return true
+}
+
+// advance moves the head to the bucket of now, clearing the buckets that slid out of the window.
+// Must be called with b.mu held.
+func (b *RetryBudget) advance(now time.Time) {
+	elapsed := int(now.Sub(b.headStart) / b.width)
+	if elapsed <= 0 {
+		return
+	}
+
+	if elapsed > budgetBuckets {
+		elapsed = budgetBuckets
+	}
+
+	for i := 0; i < elapsed; i++ {
+		b.head = (b.head + 1) % budgetBuckets
+		b.buckets[b.head] = budgetBucket{}
+	}
+
+	b.headStart = b.headStart.Add(time.Duration(now.Sub(b.headStart)/b.width) * b.width)
+}
@@ -0,0 +1,103 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("RetryBudget", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+		budget    *cnp.RetryBudget
+		calls     int
+		failing   cnp.CloudNativeFunction
+		succeed   cnp.CloudNativeFunction
+	)
+
+	dummyError := errors.New("dummy error")
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+		calls = 0
+
+		// 1 retry for every 2 calls, on top of 1 retry per window
+		budget = CNP.NewRetryBudget(cnp.RetryBudgetSettings{
+			Ratio:      0.5,
+			MinRetries: 1,
+			Window:     10 * time.Second,
+		})
+
+		policy := cnp.RetryPolicy{Retries: 3, Budget: budget}
+
+		failing = CNP.RetryWithPolicy(func(ctx context.Context) error {
+			calls++
+			return dummyError
+		}, policy)
+
+		succeed = CNP.RetryWithPolicy(func(ctx context.Context) error {
+			return nil
+		}, policy)
+	})
+
+	It("should stop retrying once the retries exceed the ratio of the calls", func() {
+		// 1 call allows 1 + 0.5 retries
+		err := failing(context.Background())
+		Expect(err).To(MatchError(cnp.ErrRetryBudgetExhausted))
+		Expect(err).To(MatchError(dummyError))
+		Expect(calls).To(Equal(2))
+	})
+
+	It("should be shared by every function retried with it", func() {
+		for i := 0; i < 2; i++ {
+			Expect(succeed(context.Background())).To(Succeed())
+		}
+
+		// 3 calls allow 1 + 1.5 retries
+		_ = failing(context.Background())
+		Expect(calls).To(Equal(3))
+	})
+
+	It("should refill once the retries have slid out of the window", func() {
+		_ = failing(context.Background())
+		_ = failing(context.Background())
+		Expect(calls).To(Equal(4)) // 2 calls allow 1 + 1 retries, one for each call
+
+		mockclock.Add(10 * time.Second)
+
+		calls = 0
+		_ = failing(context.Background())
+		Expect(calls).To(Equal(2))
+	})
+
+	It("should not panic with a window shorter than its buckets", func() {
+		short := CNP.NewRetryBudget(cnp.RetryBudgetSettings{MinRetries: 1, Window: 5 * time.Nanosecond})
+		retried := CNP.RetryWithPolicy(func(ctx context.Context) error {
+			calls++
+			return dummyError
+		}, cnp.RetryPolicy{Retries: 3, Budget: short})
+
+		Expect(retried(context.Background())).To(MatchError(cnp.ErrRetryBudgetExhausted))
+		Expect(calls).To(Equal(2))
+
+		// The window lasts 10ns
+		mockclock.Add(10 * time.Nanosecond)
+
+		calls = 0
+		Expect(retried(context.Background())).To(MatchError(cnp.ErrRetryBudgetExhausted))
+		Expect(calls).To(Equal(2))
+	})
+
+	It("should not be retried by an outer retry", func() {
+		err := fmt.Errorf("%w: %w", cnp.ErrRetryBudgetExhausted, dummyError)
+		Expect(cnp.DefaultClassifier(err)).To(BeFalse())
+	})
+})
@@ -0,0 +1,148 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrBulkheadFull is returned when all the slots of a compartment are taken and its wait queue is full.
+	ErrBulkheadFull = errors.New("bulkhead is full")
+	// ErrBulkheadTimeout is returned when a call waited BulkheadSettings.QueueTimeout without getting a slot.
+	ErrBulkheadTimeout = errors.New("bulkhead queue timeout")
+	// ErrBulkheadSettingsIgnored is reported with EventBulkheadSettingsIgnored when NewBulkhead is called with the name
+	// of an existing compartment and other settings.
+	ErrBulkheadSettingsIgnored = errors.New("bulkhead already exists with other settings")
+)
+
+// BulkheadSettings configures a Bulkhead compartment.
+type BulkheadSettings struct {
+	// Name identifies the compartment, e.g. "user-repo".
+	Name string
+	// MaxConcurrent is the number of calls that can run at the same time. Defaults to 1.
+	MaxConcurrent int
+	// MaxQueue is the number of calls that can wait for a slot. Further calls are rejected with ErrBulkheadFull.
+	// 0 rejects every call that cannot run right away.
+	MaxQueue int
+	// QueueTimeout is how long a call waits for a slot before failing with ErrBulkheadTimeout. 0 waits until ctx is done.
+	QueueTimeout time.Duration
+}
+
+// Bulkhead is a compartment that caps the number of concurrent calls to a dependency,
+// so that a slow dependency cannot exhaust shared resources (e.g. a connection pool) for everyone else.
+type Bulkhead struct {
+	settings BulkheadSettings
+	cnp      *CNP
+	slots    chan struct{}
+	waiting  int64
+}
+
+// NewBulkhead returns the compartment named settings.Name, creating it if needed.
+// Compartments are shared by name: calling it again with the same name returns the existing compartment
+// and ignores the new settings. If they differ from the settings of the compartment, it emits an
+// EventBulkheadSettingsIgnored, so that the listener can report the misconfiguration.
+func (cnp *CNP) NewBulkhead(settings BulkheadSettings) *Bulkhead {
+	if settings.MaxConcurrent <= 0 {
+		settings.MaxConcurrent = 1
+	}
+
+	b, existed := cnp.bulkhead(settings)
+	if existed && b.settings != settings {
+		// Emitted without holding cnp.mu, as the listener may use cnp
+		cnp.emit(context.Background(), Event{
+			Type:      EventBulkheadSettingsIgnored,
+			Operation: settings.Name,
+			Err:       fmt.Errorf("%w: %+v kept, %+v ignored", ErrBulkheadSettingsIgnored, b.settings, settings),
+		})
+	}
+
+	return b
+}
+
+// bulkhead returns the compartment named settings.Name, and true if it existed, or creates it with settings.
+func (cnp *CNP) bulkhead(settings BulkheadSettings) (*Bulkhead, bool) {
+	cnp.mu.Lock()
+	defer cnp.mu.Unlock()
+
+	if b, ok := cnp.bulkheads[settings.Name]; ok {
+		return b, true
+	}
+
+	b := &Bulkhead{
+		settings: settings,
+		cnp:      cnp,
+		slots:    make(chan struct{}, settings.MaxConcurrent),
+	}
+
+	if cnp.bulkheads == nil {
+		cnp.bulkheads = make(map[string]*Bulkhead)
+	}
+	cnp.bulkheads[settings.Name] = b
+
+	return b, false
+}
+
+// InFlight returns the number of calls currently running in the compartment.
+func (b *Bulkhead) InFlight() int {
+	return len(b.slots)
+}
+
+// Waiting returns the number of calls currently waiting for a slot.
+func (b *Bulkhead) Waiting() int {
+	return int(atomic.LoadInt64(&b.waiting))
+}
+
+// Bulkhead wraps cnf so that it runs only once a slot in the compartment is available.
+// Calls wait in a bounded queue for at most BulkheadSettings.QueueTimeout and are rejected when the queue is full.
+// Rejections are reported to the listener of cnp, see Listener.
+func (cnp *CNP) Bulkhead(cnf CloudNativeFunction, bulkhead *Bulkhead) CloudNativeFunction {
+	return func(ctx context.Context) error {
+		if err := bulkhead.acquire(ctx); err != nil {
+			if errors.Is(err, ErrBulkheadFull) || errors.Is(err, ErrBulkheadTimeout) {
+				cnp.emit(ctx, Event{Type: EventBulkheadRejected, Operation: bulkhead.settings.Name, Err: err})
+			}
+			return err
+		}
+		defer bulkhead.release()
+
+		return cnf(ctx)
+	}
+}
+
+func (b *Bulkhead) acquire(ctx context.Context) error {
+	// Fast path, a slot is free
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if atomic.AddInt64(&b.waiting, 1) > int64(b.settings.MaxQueue) {
+		atomic.AddInt64(&b.waiting, -1)
+		return ErrBulkheadFull
+	}
+	defer atomic.AddInt64(&b.waiting, -1)
+
+	var timeout <-chan time.Time
+	if b.settings.QueueTimeout > 0 {
+		timer := b.cnp.Clock.Timer(b.settings.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return ErrBulkheadTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *Bulkhead) release() {
+	<-b.slots
+}
@@ -0,0 +1,130 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("Bulkhead", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+		bulkhead  *cnp.Bulkhead
+		release   chan struct{}
+		wrapped   cnp.CloudNativeFunction
+	)
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+		release = make(chan struct{})
+
+		bulkhead = CNP.NewBulkhead(cnp.BulkheadSettings{
+			Name:          "test",
+			MaxConcurrent: 2,
+			MaxQueue:      1,
+			QueueTimeout:  time.Second,
+		})
+
+		// blocks until release is closed
+		releaseCh := release
+		wrapped = CNP.Bulkhead(func(ctx context.Context) error {
+			<-releaseCh
+			return nil
+		}, bulkhead)
+	})
+
+	// fill takes all the slots of the bulkhead
+	fill := func() {
+		for i := 0; i < 2; i++ {
+			go wrapped(context.Background())
+		}
+		Eventually(bulkhead.InFlight).Should(Equal(2))
+	}
+
+	It("should return the same compartment for the same name", func() {
+		Expect(CNP.NewBulkhead(cnp.BulkheadSettings{Name: "test"})).To(BeIdenticalTo(bulkhead))
+		Expect(CNP.NewBulkhead(cnp.BulkheadSettings{Name: "other"})).NotTo(BeIdenticalTo(bulkhead))
+	})
+
+	It("should report the settings it ignores for an existing name", func() {
+		var events []cnp.Event
+		CNP.WithListener(cnp.ListenerFunc(func(ctx context.Context, event cnp.Event) {
+			events = append(events, event)
+		}))
+
+		same := cnp.BulkheadSettings{Name: "test", MaxConcurrent: 2, MaxQueue: 1, QueueTimeout: time.Second}
+		Expect(CNP.NewBulkhead(same)).To(BeIdenticalTo(bulkhead))
+		Expect(events).To(BeEmpty())
+
+		other := same
+		other.MaxConcurrent = 10
+		Expect(CNP.NewBulkhead(other)).To(BeIdenticalTo(bulkhead))
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Type).To(Equal(cnp.EventBulkheadSettingsIgnored))
+		Expect(events[0].Operation).To(Equal("test"))
+		Expect(events[0].Err).To(MatchError(cnp.ErrBulkheadSettingsIgnored))
+
+		// The compartment keeps its settings
+		fill()
+		go wrapped(context.Background())
+		Eventually(bulkhead.Waiting).Should(Equal(1))
+		Expect(wrapped(context.Background())).To(MatchError(cnp.ErrBulkheadFull))
+		close(release)
+	})
+
+	It("should reject calls once the slots and the queue are full", func() {
+		fill()
+
+		go wrapped(context.Background())
+		Eventually(bulkhead.Waiting).Should(Equal(1))
+
+		Expect(wrapped(context.Background())).To(MatchError(cnp.ErrBulkheadFull))
+
+		close(release)
+		Eventually(bulkhead.InFlight).Should(Equal(0))
+	})
+
+	It("should time out calls waiting in the queue", func() {
+		fill()
+
+		errCh := make(chan error)
+		go func() { errCh <- wrapped(context.Background()) }()
+		Eventually(bulkhead.Waiting).Should(Equal(1))
+
+		mockclock.Add(time.Second)
+		Eventually(errCh).Should(Receive(MatchError(cnp.ErrBulkheadTimeout)))
+
+		close(release)
+	})
+
+	It("should stop waiting when the context is cancelled", func() {
+		fill()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error)
+		go func() { errCh <- wrapped(ctx) }()
+		Eventually(bulkhead.Waiting).Should(Equal(1))
+
+		cancel()
+		Eventually(errCh).Should(Receive(MatchError(context.Canceled)))
+
+		close(release)
+	})
+
+	It("should let a queued call run once a slot is released", func() {
+		fill()
+
+		errCh := make(chan error)
+		go func() { errCh <- wrapped(context.Background()) }()
+		Eventually(bulkhead.Waiting).Should(Equal(1))
+
+		close(release)
+		Eventually(errCh).Should(Receive(BeNil()))
+	})
+})
@@ -0,0 +1,267 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by a function wrapped with CircuitBreaker while the breaker is open
+// (or half-open with all trial calls already in flight). The wrapped function is not called.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// StateClosed lets every call through and counts the failures.
+	StateClosed BreakerState = iota
+	// StateOpen rejects every call until the cool-down has elapsed.
+	StateOpen
+	// StateHalfOpen lets a limited number of trial calls through to probe the dependency.
+	StateHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerSettings configures a Breaker.
+// A zero threshold disables that trip condition.
+type BreakerSettings struct {
+	// Name identifies the breaker, e.g. "user-repo".
+	Name string
+	// ConsecutiveFailures trips the breaker after this many failures in a row.
+	ConsecutiveFailures int
+	// FailureRate trips the breaker when failures/requests reaches this ratio (0 < FailureRate <= 1).
+	FailureRate float64
+	// MinRequests is the number of calls that must be observed before FailureRate is evaluated.
+	MinRequests int
+	// Interval is the period after which the counts are reset while closed. 0 never resets.
+	Interval time.Duration
+	// CoolDown is how long the breaker stays open before moving to half-open.
+	CoolDown time.Duration
+	// HalfOpenMaxCalls is the number of trial calls allowed in half-open state.
+	// All of them must succeed for the breaker to close again. Defaults to 1.
+	HalfOpenMaxCalls int
+	// IsFailure decides which errors count as a failure of the dependency.
+	// Defaults to every error that is neither permanent (see Permanent), nor a rejection (see IsRejection),
+	// nor context.Canceled, e.g. a "not found", a full bulkhead or the cancelled loser of a hedged call
+	// is not a failure of the dependency.
+	IsFailure func(err error) bool
+}
+
+// Breaker holds the state of a circuit breaker.
+// It is shared by every function wrapped with it, so create it once (e.g. per dependency) and reuse it.
+type Breaker struct {
+	settings BreakerSettings
+	cnp      *CNP
+
+	mu            sync.Mutex
+	state         BreakerState
+	requests      int
+	failures      int
+	consecutive   int
+	halfOpenCalls int
+	halfOpenOK    int
+	openedAt      time.Time
+	countsSince   time.Time
+	// transitions are the state changes not yet sent to the listener, see flush
+	transitions []Event
+}
+
+// NewBreaker creates a closed Breaker whose cool-down is measured with cnp.Clock.
+func (cnp *CNP) NewBreaker(settings BreakerSettings) *Breaker {
+	if settings.HalfOpenMaxCalls <= 0 {
+		settings.HalfOpenMaxCalls = 1
+	}
+
+	if settings.IsFailure == nil {
+		settings.IsFailure = isBreakerFailure
+	}
+
+	return &Breaker{
+		settings:    settings,
+		cnp:         cnp,
+		state:       StateClosed,
+		countsSince: cnp.Clock.Now(),
+	}
+}
+
+// isBreakerFailure is the default BreakerSettings.IsFailure.
+func isBreakerFailure(err error) bool {
+	return !IsPermanent(err) && !IsRejection(err) && !errors.Is(err, context.Canceled)
+}
+
+// setIsFailure replaces BreakerSettings.IsFailure, see Pipeline.WithClassifier.
+func (b *Breaker) setIsFailure(isFailure func(err error) bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.settings.IsFailure = isFailure
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() BreakerState {
+	defer b.flush(context.Background())
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.currentState(b.cnp.Clock.Now())
+}
+
+// CircuitBreaker wraps cnf so that it fails fast with ErrCircuitOpen once the breaker has tripped.
+//
+//   - closed: calls go through. The breaker trips when either threshold in BreakerSettings is reached.
+//   - open: calls are rejected until BreakerSettings.CoolDown has elapsed.
+//   - half-open: up to BreakerSettings.HalfOpenMaxCalls trial calls go through.
+//     If all of them succeed the breaker closes, a single failure opens it again.
+//
+// Every state change is reported to the listener of cnp, see Listener.
+func (cnp *CNP) CircuitBreaker(cnf CloudNativeFunction, breaker *Breaker) CloudNativeFunction {
+	return func(ctx context.Context) error {
+		err := breaker.before()
+		breaker.flush(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = cnf(ctx)
+
+		breaker.after(err)
+		breaker.flush(ctx)
+
+		return err
+	}
+}
+
+// currentState moves an open breaker to half-open once the cool-down has elapsed,
+// and resets the closed counts once the interval has elapsed. Must be called with b.mu held.
+func (b *Breaker) currentState(now time.Time) BreakerState {
+	switch b.state {
+	case StateOpen:
+		if now.Sub(b.openedAt) >= b.settings.CoolDown {
+			b.setState(StateHalfOpen, now)
+		}
+	case StateClosed:
+		if b.settings.Interval > 0 && now.Sub(b.countsSince) >= b.settings.Interval {
+			b.resetCounts(now)
+		}
+	}
+
+	return b.state
+}
+
+func (b *Breaker) before() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.currentState(b.cnp.Clock.Now()) {
+	case StateOpen:
+		return ErrCircuitOpen
+	case StateHalfOpen:
+		if b.halfOpenCalls >= b.settings.HalfOpenMaxCalls {
+			return ErrCircuitOpen
+		}
+		b.halfOpenCalls++
+	}
+
+	return nil
+}
+
+func (b *Breaker) after(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.cnp.Clock.Now()
+	failed := err != nil && b.settings.IsFailure(err)
+
+	switch b.state {
+	case StateClosed:
+		b.requests++
+		if !failed {
+			b.consecutive = 0
+			return
+		}
+
+		b.failures++
+		b.consecutive++
+
+		if b.shouldTrip() {
+			b.setState(StateOpen, now)
+		}
+
+	case StateHalfOpen:
+		if failed {
+			b.setState(StateOpen, now)
+			return
+		}
+
+		b.halfOpenOK++
+		if b.halfOpenOK >= b.settings.HalfOpenMaxCalls {
+			b.setState(StateClosed, now)
+		}
+	}
+}
+
+func (b *Breaker) shouldTrip() bool {
+	if b.settings.ConsecutiveFailures > 0 && b.consecutive >= b.settings.ConsecutiveFailures {
+		return true
+	}
+
+	if b.settings.FailureRate > 0 && b.requests >= b.settings.MinRequests {
+		return float64(b.failures)/float64(b.requests) >= b.settings.FailureRate
+	}
+
+	return false
+}
+
+func (b *Breaker) setState(state BreakerState, now time.Time) {
+	b.transitions = append(b.transitions, Event{
+		Type:      EventBreakerStateChanged,
+		Operation: b.settings.Name,
+		From:      b.state,
+		To:        state,
+	})
+
+	b.state = state
+	b.halfOpenCalls = 0
+	b.halfOpenOK = 0
+
+	if state == StateOpen {
+		b.openedAt = now
+	}
+
+	b.resetCounts(now)
+}
+
+func (b *Breaker) resetCounts(now time.Time) {
+	b.requests = 0
+	b.failures = 0
+	b.consecutive = 0
+	b.countsSince = now
+}
+
+// flush sends the recorded state changes to the listener.
+// It is called without b.mu held, so that the listener may call State.
+func (b *Breaker) flush(ctx context.Context) {
+	b.mu.Lock()
+	transitions := b.transitions
+	b.transitions = nil
+	b.mu.Unlock()
+
+	for _, event := range transitions {
+		b.cnp.emit(ctx, event)
+	}
+}
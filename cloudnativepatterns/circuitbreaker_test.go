@@ -0,0 +1,114 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("CircuitBreaker", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+		breaker   *cnp.Breaker
+		calls     int
+		failing   bool
+		wrapped   cnp.CloudNativeFunction
+	)
+
+	dummyError := errors.New("dummy error")
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+
+		calls = 0
+		failing = true
+
+		breaker = CNP.NewBreaker(cnp.BreakerSettings{
+			Name:                "test",
+			ConsecutiveFailures: 3,
+			CoolDown:            10 * time.Second,
+		})
+
+		wrapped = CNP.CircuitBreaker(func(ctx context.Context) error {
+			calls++
+			if failing {
+				return dummyError
+			}
+			return nil
+		}, breaker)
+	})
+
+	It("should open after consecutive failures and fail fast", func() {
+		for i := 0; i < 3; i++ {
+			Expect(wrapped(context.Background())).To(MatchError(dummyError))
+		}
+		Expect(breaker.State()).To(Equal(cnp.StateOpen))
+
+		Expect(wrapped(context.Background())).To(MatchError(cnp.ErrCircuitOpen))
+		Expect(calls).To(Equal(3))
+	})
+
+	It("should close again after a successful trial call once the cool-down has elapsed", func() {
+		for i := 0; i < 3; i++ {
+			_ = wrapped(context.Background())
+		}
+
+		mockclock.Add(10 * time.Second)
+		Expect(breaker.State()).To(Equal(cnp.StateHalfOpen))
+
+		failing = false
+		Expect(wrapped(context.Background())).To(Succeed())
+		Expect(breaker.State()).To(Equal(cnp.StateClosed))
+	})
+
+	It("should open again when the trial call fails", func() {
+		for i := 0; i < 3; i++ {
+			_ = wrapped(context.Background())
+		}
+
+		mockclock.Add(10 * time.Second)
+		Expect(wrapped(context.Background())).To(MatchError(dummyError))
+		Expect(breaker.State()).To(Equal(cnp.StateOpen))
+	})
+
+	It("should open when the failure rate is reached", func() {
+		breaker = CNP.NewBreaker(cnp.BreakerSettings{
+			FailureRate: 0.5,
+			MinRequests: 4,
+			CoolDown:    10 * time.Second,
+		})
+		i := 0
+		wrapped = CNP.CircuitBreaker(func(ctx context.Context) error {
+			i++
+			if i%2 == 0 {
+				return dummyError
+			}
+			return nil
+		}, breaker)
+
+		for j := 0; j < 3; j++ {
+			_ = wrapped(context.Background())
+		}
+		Expect(breaker.State()).To(Equal(cnp.StateClosed))
+
+		_ = wrapped(context.Background())
+		Expect(breaker.State()).To(Equal(cnp.StateOpen))
+	})
+	It("should not count permanent errors as failures", func() {
+		wrapped = CNP.CircuitBreaker(func(ctx context.Context) error {
+			return cnp.Permanent(dummyError)
+		}, breaker)
+
+		for i := 0; i < 5; i++ {
+			Expect(wrapped(context.Background())).To(MatchError(dummyError))
+		}
+		Expect(breaker.State()).To(Equal(cnp.StateClosed))
+	})
+})
@@ -0,0 +1,13 @@
+package cloudnativepatterns_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestCloudNativePatterns(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CloudNativePatterns Suite")
+}
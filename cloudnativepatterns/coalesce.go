@@ -0,0 +1,140 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"sync"
+)
+
+// Coalescer collapses the concurrent calls made with the same key into a single call (a.k.a. singleflight),
+// e.g. concurrent reads of the same row.
+// It is shared by every function wrapped with it, so create it once (e.g. per dependency) and reuse it.
+type Coalescer struct {
+	name string
+	cnp  *CNP
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is a call in flight and the callers waiting for its result.
+type coalescedCall struct {
+	done    chan struct{}
+	value   any
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// NewCoalescer creates a Coalescer. name identifies it in the events sent to the listener.
+func (cnp *CNP) NewCoalescer(name string) *Coalescer {
+	return &Coalescer{
+		name:  name,
+		cnp:   cnp,
+		calls: make(map[string]*coalescedCall),
+	}
+}
+
+// InFlight returns the number of keys with a call in flight.
+func (c *Coalescer) InFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.calls)
+}
+
+// Coalesce wraps cnf so that a call made while another call with the same key is in flight does not call cnf,
+// but waits for the call in flight and returns its error. Joining a call in flight is reported to the listener
+// of cnp, see Listener.
+//
+// The shared call runs with the values of the context of the caller that started it, but not with its cancellation
+// or deadline: a caller whose context is done stops waiting and returns ctx.Err(), and the shared call is cancelled
+// only once every caller waiting for it has gone away. Bound it with a timeout inside the coalescer if needed.
+func (cnp *CNP) Coalesce(cnf CloudNativeFunction, coalescer *Coalescer, key string) CloudNativeFunction {
+	return func(ctx context.Context) error {
+		_, err := coalescer.do(ctx, key, func(ctx context.Context) (any, error) {
+			return nil, cnf(ctx)
+		})
+		return err
+	}
+}
+
+// CoalesceT is the TypedFunction variant of CNP.Coalesce.
+// Every caller gets the result of the shared call, so T must not be mutated by the callers if it holds pointers.
+func CoalesceT[T any](fn TypedFunction[T], coalescer *Coalescer, key string) TypedFunction[T] {
+	return func(ctx context.Context) (T, error) {
+		v, err := coalescer.do(ctx, key, func(ctx context.Context) (any, error) {
+			return fn(ctx)
+		})
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+
+		// v is nil when fn returned a nil interface
+		result, _ := v.(T)
+		return result, nil
+	}
+}
+
+func (c *Coalescer) do(ctx context.Context, key string, fn func(ctx context.Context) (any, error)) (any, error) {
+	c.mu.Lock()
+	call, joined := c.calls[key]
+	if !joined {
+		call = c.start(ctx, key, fn)
+	}
+	call.waiters++
+	c.mu.Unlock()
+
+	if joined {
+		c.cnp.emit(ctx, Event{Type: EventCoalesced, Operation: c.name})
+	}
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Nobody is waiting any more: cancel the call, and let the next caller start a new one
+			call.cancel()
+			c.forget(key, call)
+		}
+		c.mu.Unlock()
+
+		return nil, ctx.Err()
+	}
+}
+
+// start runs fn in the background as the call in flight for key. Must be called with c.mu held.
+func (c *Coalescer) start(ctx context.Context, key string, fn func(ctx context.Context) (any, error)) *coalescedCall {
+	callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+	call := &coalescedCall{
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	c.calls[key] = call
+
+	go func() {
+		defer cancel()
+
+		value, err := fn(callCtx)
+
+		c.mu.Lock()
+		c.forget(key, call)
+		c.mu.Unlock()
+
+		call.value, call.err = value, err
+		close(call.done)
+	}()
+
+	return call
+}
+
+// forget removes call from the calls in flight, unless it has already been replaced. Must be called with c.mu held.
+func (c *Coalescer) forget(key string, call *coalescedCall) {
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+}
@@ -0,0 +1,133 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("Coalesce", func() {
+	var (
+		CNP       *cnp.CNP
+		coalescer *cnp.Coalescer
+		calls     int64
+		started   chan struct{}
+		release   chan struct{}
+		cancelled chan struct{}
+		joined    chan struct{}
+		get       cnp.TypedFunction[string]
+	)
+
+	BeforeEach(func() {
+		joined = make(chan struct{}, 10)
+		joinedCh := joined
+		CNP = cnp.NewCloudNativePatterns(clock.NewMock()).
+			WithListener(cnp.ListenerFunc(func(ctx context.Context, event cnp.Event) {
+				if event.Type == cnp.EventCoalesced {
+					joinedCh <- struct{}{}
+				}
+			}))
+		coalescer = CNP.NewCoalescer("test")
+		calls = 0
+		started = make(chan struct{}, 10)
+		release = make(chan struct{})
+		cancelled = make(chan struct{})
+
+		// blocks until release is closed, or until its context is cancelled
+		startedCh, releaseCh, cancelledCh := started, release, cancelled
+		get = cnp.CoalesceT(func(ctx context.Context) (string, error) {
+			n := atomic.AddInt64(&calls, 1)
+			startedCh <- struct{}{}
+			select {
+			case <-releaseCh:
+				if n > 1 {
+					return "", errors.New("called more than once")
+				}
+				return "shared", nil
+			case <-ctx.Done():
+				close(cancelledCh)
+				return "", ctx.Err()
+			}
+		}, coalescer, "key")
+	})
+
+	// wait calls get in the background and returns the channel of its result
+	wait := func(ctx context.Context) chan string {
+		resCh := make(chan string, 1)
+		go func() {
+			defer GinkgoRecover()
+			v, err := get(ctx)
+			if err != nil {
+				v = err.Error()
+			}
+			resCh <- v
+		}()
+		return resCh
+	}
+
+	It("should make a single call for the concurrent callers and give them its result", func() {
+		first := wait(context.Background())
+		Eventually(started).Should(Receive())
+
+		second := wait(context.Background())
+		Eventually(joined).Should(Receive())
+		Consistently(started).ShouldNot(Receive())
+
+		close(release)
+
+		Eventually(first).Should(Receive(Equal("shared")))
+		Eventually(second).Should(Receive(Equal("shared")))
+		Expect(atomic.LoadInt64(&calls)).To(Equal(int64(1)))
+		Expect(coalescer.InFlight()).To(Equal(0))
+	})
+
+	It("should not cancel the shared call when one of the callers goes away", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		first := wait(ctx)
+		Eventually(started).Should(Receive())
+		second := wait(context.Background())
+		Eventually(joined).Should(Receive())
+
+		cancel()
+		Eventually(first).Should(Receive(Equal(context.Canceled.Error())))
+		Consistently(cancelled).ShouldNot(BeClosed())
+
+		close(release)
+		Eventually(second).Should(Receive(Equal("shared")))
+	})
+
+	It("should cancel the shared call once every caller has gone away", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		first := wait(ctx)
+		Eventually(started).Should(Receive())
+		second := wait(ctx)
+		Eventually(joined).Should(Receive())
+
+		cancel()
+		Eventually(first).Should(Receive(Equal(context.Canceled.Error())))
+		Eventually(second).Should(Receive(Equal(context.Canceled.Error())))
+		Eventually(cancelled).Should(BeClosed())
+		Expect(coalescer.InFlight()).To(Equal(0))
+	})
+
+	It("should keep the calls with different keys apart", func() {
+		var calls int64
+		f := func(key string) error {
+			return CNP.Coalesce(func(ctx context.Context) error {
+				atomic.AddInt64(&calls, 1)
+				return nil
+			}, coalescer, key)(context.Background())
+		}
+
+		Expect(f("a")).To(Succeed())
+		Expect(f("b")).To(Succeed())
+		Expect(atomic.LoadInt64(&calls)).To(Equal(int64(2)))
+	})
+})
@@ -0,0 +1,195 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sethvargo/go-envconfig"
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyConfig is the tunable part of a Pipeline, so that operators can change it without recompiling.
+// See LoadPolicyConfig.
+type PolicyConfig struct {
+	Timeout        time.Duration        `yaml:"timeout" env:"TIMEOUT,overwrite"`
+	Retry          RetryConfig          `yaml:"retry" env:",prefix=RETRY_"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker" env:",prefix=CIRCUIT_BREAKER_"`
+	Bulkhead       BulkheadConfig       `yaml:"bulkhead" env:",prefix=BULKHEAD_"`
+	Hedge          HedgeConfig          `yaml:"hedge" env:",prefix=HEDGE_"`
+}
+
+type RetryConfig struct {
+	Enabled bool `yaml:"enabled" env:"ENABLED,overwrite"`
+	Retries int  `yaml:"retries" env:"RETRIES,overwrite"`
+	// Backoff is one of constant, exponential, full-jitter or decorrelated-jitter.
+	Backoff   string            `yaml:"backoff" env:"BACKOFF,overwrite"`
+	BaseDelay time.Duration     `yaml:"base_delay" env:"BASE_DELAY,overwrite"`
+	MaxDelay  time.Duration     `yaml:"max_delay" env:"MAX_DELAY,overwrite"`
+	Budget    RetryBudgetConfig `yaml:"budget" env:",prefix=BUDGET_"`
+	// AttemptTimeout bounds every attempt, 0 does not bound them.
+	AttemptTimeout time.Duration `yaml:"attempt_timeout" env:"ATTEMPT_TIMEOUT,overwrite"`
+}
+
+type RetryBudgetConfig struct {
+	Enabled    bool          `yaml:"enabled" env:"ENABLED,overwrite"`
+	Ratio      float64       `yaml:"ratio" env:"RATIO,overwrite"`
+	MinRetries int           `yaml:"min_retries" env:"MIN_RETRIES,overwrite"`
+	Window     time.Duration `yaml:"window" env:"WINDOW,overwrite"`
+}
+
+type CircuitBreakerConfig struct {
+	Enabled             bool          `yaml:"enabled" env:"ENABLED,overwrite"`
+	ConsecutiveFailures int           `yaml:"consecutive_failures" env:"CONSECUTIVE_FAILURES,overwrite"`
+	FailureRate         float64       `yaml:"failure_rate" env:"FAILURE_RATE,overwrite"`
+	MinRequests         int           `yaml:"min_requests" env:"MIN_REQUESTS,overwrite"`
+	Interval            time.Duration `yaml:"interval" env:"INTERVAL,overwrite"`
+	CoolDown            time.Duration `yaml:"cool_down" env:"COOL_DOWN,overwrite"`
+	HalfOpenMaxCalls    int           `yaml:"half_open_max_calls" env:"HALF_OPEN_MAX_CALLS,overwrite"`
+}
+
+type BulkheadConfig struct {
+	Enabled       bool          `yaml:"enabled" env:"ENABLED,overwrite"`
+	MaxConcurrent int           `yaml:"max_concurrent" env:"MAX_CONCURRENT,overwrite"`
+	MaxQueue      int           `yaml:"max_queue" env:"MAX_QUEUE,overwrite"`
+	QueueTimeout  time.Duration `yaml:"queue_timeout" env:"QUEUE_TIMEOUT,overwrite"`
+}
+
+type HedgeConfig struct {
+	Enabled    bool          `yaml:"enabled" env:"ENABLED,overwrite"`
+	Delay      time.Duration `yaml:"delay" env:"DELAY,overwrite"`
+	Percentile float64       `yaml:"percentile" env:"PERCENTILE,overwrite"`
+	Window     int           `yaml:"window" env:"WINDOW,overwrite"`
+	MinSamples int           `yaml:"min_samples" env:"MIN_SAMPLES,overwrite"`
+	MaxHedges  int           `yaml:"max_hedges" env:"MAX_HEDGES,overwrite"`
+}
+
+// policiesFile is the layout of the YAML file read by LoadPolicyConfig:
+//
+//	policies:
+//	  user-repo:
+//	    timeout: 10s
+//	    retry:
+//	      enabled: true
+//	      retries: 3
+//	      backoff: decorrelated-jitter
+//	      base_delay: 500ms
+//	      max_delay: 5s
+type policiesFile struct {
+	Policies map[string]yaml.Node `yaml:"policies"`
+}
+
+// EnvPrefix returns the prefix of the env vars of the policy named name, e.g. CNP_USER_REPO_ for "user-repo".
+func EnvPrefix(name string) string {
+	return "CNP_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_", " ", "_").Replace(name)) + "_"
+}
+
+// LoadPolicyConfig returns defaults overridden by the policy named name in the YAML file at path (skipped when path is empty),
+// then by the env vars prefixed with EnvPrefix(name), e.g. CNP_USER_REPO_RETRY_RETRIES=5.
+// Uses https://github.com/sethvargo/go-envconfig
+func LoadPolicyConfig(name string, path string, defaults PolicyConfig) (PolicyConfig, error) {
+	config := defaults
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return config, fmt.Errorf("failed to read policies from %s: %w", path, err)
+		}
+
+		var file policiesFile
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return config, fmt.Errorf("failed to parse policies from %s: %w", path, err)
+		}
+
+		// Decode on top of the defaults, so that the file only needs to contain what it changes
+		if node, ok := file.Policies[name]; ok {
+			if err := node.Decode(&config); err != nil {
+				return config, fmt.Errorf("failed to parse policy %s from %s: %w", name, path, err)
+			}
+		}
+	}
+
+	lookuper := envconfig.PrefixLookuper(EnvPrefix(name), envconfig.OsLookuper())
+	if err := envconfig.ProcessWith(context.Background(), &config, lookuper); err != nil {
+		return config, fmt.Errorf("failed to override policy %s from env vars: %w", name, err)
+	}
+
+	return config, nil
+}
+
+// NewPipelineFromConfig creates a pipeline named name with the stages enabled in config.
+// Like NewPipeline, it is not registered until Register is called.
+func (cnp *CNP) NewPipelineFromConfig(name string, config PolicyConfig) (*Pipeline, error) {
+	p := cnp.NewPipeline(name).WithTimeout(config.Timeout)
+
+	if config.Retry.Enabled {
+		backoff, err := config.Retry.backoff()
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %w", name, err)
+		}
+
+		policy := RetryPolicy{
+			Retries:        config.Retry.Retries,
+			Backoff:        backoff,
+			AttemptTimeout: config.Retry.AttemptTimeout,
+		}
+
+		if config.Retry.Budget.Enabled {
+			policy.Budget = cnp.NewRetryBudget(RetryBudgetSettings{
+				Ratio:      config.Retry.Budget.Ratio,
+				MinRetries: config.Retry.Budget.MinRetries,
+				Window:     config.Retry.Budget.Window,
+			})
+		}
+
+		p.WithRetry(policy)
+	}
+
+	if config.CircuitBreaker.Enabled {
+		p.WithCircuitBreaker(BreakerSettings{
+			ConsecutiveFailures: config.CircuitBreaker.ConsecutiveFailures,
+			FailureRate:         config.CircuitBreaker.FailureRate,
+			MinRequests:         config.CircuitBreaker.MinRequests,
+			Interval:            config.CircuitBreaker.Interval,
+			CoolDown:            config.CircuitBreaker.CoolDown,
+			HalfOpenMaxCalls:    config.CircuitBreaker.HalfOpenMaxCalls,
+		})
+	}
+
+	if config.Bulkhead.Enabled {
+		p.WithBulkhead(BulkheadSettings{
+			MaxConcurrent: config.Bulkhead.MaxConcurrent,
+			MaxQueue:      config.Bulkhead.MaxQueue,
+			QueueTimeout:  config.Bulkhead.QueueTimeout,
+		})
+	}
+
+	if config.Hedge.Enabled {
+		p.WithHedge(HedgeSettings{
+			Delay:      config.Hedge.Delay,
+			Percentile: config.Hedge.Percentile,
+			Window:     config.Hedge.Window,
+			MinSamples: config.Hedge.MinSamples,
+			MaxHedges:  config.Hedge.MaxHedges,
+		})
+	}
+
+	return p, nil
+}
+
+func (c RetryConfig) backoff() (Backoff, error) {
+	switch c.Backoff {
+	case "", "constant":
+		return ConstantBackoff{Interval: c.BaseDelay}, nil
+	case "exponential":
+		return ExponentialBackoff{Base: c.BaseDelay, Max: c.MaxDelay}, nil
+	case "full-jitter":
+		return FullJitterBackoff{Base: c.BaseDelay, Max: c.MaxDelay}, nil
+	case "decorrelated-jitter":
+		return DecorrelatedJitterBackoff{Base: c.BaseDelay, Max: c.MaxDelay}, nil
+	default:
+		return nil, fmt.Errorf("unknown backoff %q", c.Backoff)
+	}
+}
@@ -0,0 +1,70 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrRetriesExhausted is wrapped, together with the last error, by Retry when every attempt has failed.
+var ErrRetriesExhausted = errors.New("exceeded maximum number of retries")
+
+// ErrRetryDeadline is wrapped, together with the last error, by Retry when the next attempt could not finish
+// before the deadline of the context.
+var ErrRetryDeadline = errors.New("not enough time left before the deadline to retry")
+
+// PermanentError marks an error as non-retryable. See Permanent.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err so that Retry returns it immediately instead of retrying,
+// and CircuitBreaker does not count it as a failure of the dependency.
+// The wrapped error is still reachable with errors.Is and errors.As.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err, or any error it wraps, was marked with Permanent.
+func IsPermanent(err error) bool {
+	var perr *PermanentError
+	return errors.As(err, &perr)
+}
+
+// Classifier reports whether an error is worth retrying.
+type Classifier func(err error) bool
+
+// DefaultClassifier retries every error except permanent errors, context cancellation/deadline errors,
+// rejections (see IsRejection) and ErrRetryBudgetExhausted: retrying an open breaker, a full bulkhead
+// or a dependency whose retry budget is spent only adds load.
+func DefaultClassifier(err error) bool {
+	switch {
+	case IsPermanent(err),
+		IsRejection(err),
+		errors.Is(err, ErrRetryBudgetExhausted),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return true
+}
+
+// IsRejection reports whether err means that a pattern refused to call the function at all,
+// e.g. ErrCircuitOpen, ErrBulkheadFull, ErrRateLimited or ErrLimitExceeded.
+func IsRejection(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) ||
+		errors.Is(err, ErrBulkheadFull) ||
+		errors.Is(err, ErrBulkheadTimeout) ||
+		errors.Is(err, ErrRateLimited) ||
+		errors.Is(err, ErrLimitExceeded)
+}
@@ -0,0 +1,31 @@
+package cloudnativepatterns
+
+import (
+	"context"
+)
+
+// FallbackFunc is called with the error of the primary function and returns the error of the call,
+// e.g. nil once it has served a degraded result, or err itself when err should not be masked.
+type FallbackFunc func(ctx context.Context, err error) error
+
+// Fallback wraps cnf so that fallback is called when cnf fails, including when it is rejected
+// (e.g. ErrCircuitOpen while the breaker is open). The error of fallback is returned.
+func (cnp *CNP) Fallback(cnf CloudNativeFunction, fallback FallbackFunc) CloudNativeFunction {
+	return func(ctx context.Context) error {
+		if err := cnf(ctx); err != nil {
+			return fallback(ctx, err)
+		}
+		return nil
+	}
+}
+
+// FallbackT is the TypedFunction variant of CNP.Fallback. The result of fallback is returned when fn fails.
+func FallbackT[T any](fn TypedFunction[T], fallback func(ctx context.Context, err error) (T, error)) TypedFunction[T] {
+	return func(ctx context.Context) (T, error) {
+		v, err := fn(ctx)
+		if err != nil {
+			return fallback(ctx, err)
+		}
+		return v, nil
+	}
+}
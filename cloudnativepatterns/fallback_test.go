@@ -0,0 +1,148 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("Fallback", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+	)
+
+	dummyError := errors.New("dummy error")
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+	})
+
+	It("should run the fallback when the breaker is open", func() {
+		breaker := CNP.NewBreaker(cnp.BreakerSettings{ConsecutiveFailures: 1, CoolDown: time.Minute})
+
+		var fallbackErrs []error
+		f := CNP.Fallback(CNP.CircuitBreaker(func(ctx context.Context) error {
+			return dummyError
+		}, breaker), func(ctx context.Context, err error) error {
+			fallbackErrs = append(fallbackErrs, err)
+			return nil
+		})
+
+		Expect(f(context.Background())).To(Succeed())
+		Expect(f(context.Background())).To(Succeed())
+		Expect(fallbackErrs).To(HaveLen(2))
+		Expect(fallbackErrs[0]).To(MatchError(dummyError))
+		Expect(fallbackErrs[1]).To(MatchError(cnp.ErrCircuitOpen))
+	})
+
+	It("should not run the fallback when the call succeeds", func() {
+		f := cnp.FallbackT(func(ctx context.Context) (string, error) {
+			return "primary", nil
+		}, func(ctx context.Context, err error) (string, error) {
+			return "fallback", nil
+		})
+
+		Expect(f(context.Background())).To(Equal("primary"))
+	})
+})
+
+var _ = Describe("StaleCache", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+		cache     *cnp.StaleCache
+		failing   bool
+		get       func(key string) cnp.TypedFunction[string]
+	)
+
+	dummyError := errors.New("dummy error")
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+		failing = false
+
+		cache = CNP.NewStaleCache(cnp.StaleCacheSettings{
+			Name:       "test",
+			TTL:        time.Minute,
+			MaxEntries: 2,
+		})
+
+		get = func(key string) cnp.TypedFunction[string] {
+			return cnp.ServeStale(cache, key, func(ctx context.Context) (string, error) {
+				if failing {
+					return "", dummyError
+				}
+				return "value-" + key + "-" + fmt.Sprint(mockclock.Now().Unix()), nil
+			})
+		}
+	})
+
+	It("should serve the last successful result when the call fails", func() {
+		fresh, err := get("a")(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		failing = true
+		mockclock.Add(30 * time.Second)
+
+		stale, err := get("a")(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stale).To(Equal(fresh))
+	})
+
+	It("should return the error without a remembered result", func() {
+		failing = true
+
+		_, err := get("a")(context.Background())
+		Expect(err).To(MatchError(dummyError))
+	})
+
+	It("should not serve a result older than the TTL", func() {
+		_, _ = get("a")(context.Background())
+
+		failing = true
+		mockclock.Add(time.Minute + time.Second)
+
+		_, err := get("a")(context.Background())
+		Expect(err).To(MatchError(dummyError))
+		Expect(cache.Len()).To(Equal(0))
+	})
+
+	It("should not mask a permanent error", func() {
+		_, _ = get("a")(context.Background())
+
+		_, err := cnp.ServeStale(cache, "a", func(ctx context.Context) (string, error) {
+			return "", cnp.Permanent(dummyError)
+		})(context.Background())
+		Expect(err).To(MatchError(dummyError))
+	})
+
+	It("should evict the least recently used result once full", func() {
+		for _, key := range []string{"a", "b", "c"} {
+			_, _ = get(key)(context.Background())
+		}
+		Expect(cache.Len()).To(Equal(2))
+
+		_, ok := cache.Get("a")
+		Expect(ok).To(BeFalse())
+		_, ok = cache.Get("c")
+		Expect(ok).To(BeTrue())
+	})
+
+	It("should forget a deleted result", func() {
+		_, _ = get("a")(context.Background())
+		cache.Delete("a")
+
+		failing = true
+		_, err := get("a")(context.Background())
+		Expect(err).To(MatchError(dummyError))
+	})
+})
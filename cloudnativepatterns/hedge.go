@@ -0,0 +1,157 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgeSettings configures a Hedger.
+type HedgeSettings struct {
+	// Name identifies the hedged operation, e.g. "user-repo".
+	Name string
+	// Delay is how long to wait for an attempt before launching a hedged one.
+	// It is used as long as the delay cannot be learned from Percentile. 0 launches the hedged attempts right away.
+	Delay time.Duration
+	// Percentile learns the delay from the latency of the recent successful calls (0 < Percentile < 1),
+	// e.g. 0.95 hedges the calls slower than 95% of the recent ones. 0 always waits Delay.
+	Percentile float64
+	// Window is the number of recent latencies Percentile is computed on. Defaults to 100.
+	Window int
+	// MinSamples is the number of latencies that must be observed before Percentile is used. Defaults to 10.
+	MinSamples int
+	// MaxHedges is the number of hedged attempts that can be launched on top of the first one. Defaults to 1.
+	MaxHedges int
+}
+
+// Hedger holds the settings and the learned latencies of hedged calls.
+// It is shared by every function wrapped with it, so create it once (e.g. per dependency) and reuse it.
+type Hedger struct {
+	settings HedgeSettings
+	cnp      *CNP
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+// NewHedger creates a Hedger whose latencies are measured with cnp.Clock.
+func (cnp *CNP) NewHedger(settings HedgeSettings) *Hedger {
+	if settings.Window <= 0 {
+		settings.Window = 100
+	}
+
+	if settings.MinSamples <= 0 {
+		settings.MinSamples = 10
+	}
+
+	if settings.MaxHedges <= 0 {
+		settings.MaxHedges = 1
+	}
+
+	return &Hedger{
+		settings:  settings,
+		cnp:       cnp,
+		latencies: make([]time.Duration, 0, settings.Window),
+	}
+}
+
+// Delay returns how long the next call waits before launching a hedged attempt:
+// the Percentile of the recent latencies once enough of them are known, HedgeSettings.Delay otherwise.
+func (h *Hedger) Delay() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.settings.Percentile <= 0 || len(h.latencies) < h.settings.MinSamples {
+		return h.settings.Delay
+	}
+
+	sorted := make([]time.Duration, len(h.latencies))
+	copy(sorted, h.latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	i := int(math.Ceil(h.settings.Percentile*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return sorted[i]
+}
+
+// observe records the latency of a successful attempt, replacing the oldest one once Window is reached.
+func (h *Hedger) observe(latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.latencies) < h.settings.Window {
+		h.latencies = append(h.latencies, latency)
+		return
+	}
+
+	h.latencies[h.next] = latency
+	h.next = (h.next + 1) % h.settings.Window
+}
+
+// Hedge wraps cnf so that, when an attempt has not returned after hedger.Delay(), a duplicate attempt is launched
+// in parallel, up to HedgeSettings.MaxHedges times. The first success is returned and the context of the other
+// attempts is cancelled. When every launched attempt has failed, the last error is returned.
+//
+// The attempts run concurrently, so cnf must be idempotent (e.g. a read) and must not write to shared state
+// (see TypedFunction). Every hedged attempt is reported to the listener of cnp, see Listener.
+func (cnp *CNP) Hedge(cnf CloudNativeFunction, hedger *Hedger) CloudNativeFunction {
+	return func(ctx context.Context) error {
+		// Cancels the attempts still running once we return
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		delay := hedger.Delay()
+
+		// Buffered, so that the losers can send their result and exit
+		errCh := make(chan error, hedger.settings.MaxHedges+1)
+		launch := func() {
+			go func() {
+				start := cnp.Clock.Now()
+				err := cnf(ctx)
+				if err == nil {
+					hedger.observe(cnp.Clock.Since(start))
+				}
+				errCh <- err
+			}()
+		}
+
+		timer := cnp.Clock.Timer(delay)
+		defer timer.Stop()
+
+		launch()
+		launched, failed := 1, 0
+
+		for {
+			select {
+			case err := <-errCh:
+				if err == nil {
+					return nil
+				}
+
+				failed++
+				if failed == launched {
+					return err
+				}
+
+			case <-timer.C:
+				if launched > hedger.settings.MaxHedges {
+					continue
+				}
+
+				cnp.emit(ctx, Event{Type: EventHedgeLaunched, Operation: hedger.settings.Name, Attempt: launched + 1, Delay: delay})
+				launch()
+				launched++
+				timer.Reset(delay)
+
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("Hedge", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+		hedger    *cnp.Hedger
+	)
+
+	dummyError := errors.New("dummy error")
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+		hedger = CNP.NewHedger(cnp.HedgeSettings{
+			Name:  "test",
+			Delay: 100 * time.Millisecond,
+		})
+	})
+
+	It("should not hedge a call that returns before the delay", func() {
+		var calls int64
+		err := CNP.Hedge(func(ctx context.Context) error {
+			atomic.AddInt64(&calls, 1)
+			return nil
+		}, hedger)(context.Background())
+
+		Expect(err).To(Succeed())
+		Expect(atomic.LoadInt64(&calls)).To(Equal(int64(1)))
+	})
+
+	It("should return the first success of a hedged attempt and cancel the slow one", func() {
+		var calls int64
+		started := make(chan struct{}, 2)
+		cancelled := make(chan struct{})
+
+		hedged := cnp.HedgeT(CNP, func(ctx context.Context) (string, error) {
+			started <- struct{}{}
+			if atomic.AddInt64(&calls, 1) == 1 {
+				// The slow replica, until it is cancelled
+				<-ctx.Done()
+				close(cancelled)
+				return "", ctx.Err()
+			}
+			return "fast", nil
+		}, hedger)
+
+		resCh := make(chan string)
+		go func() {
+			v, err := hedged(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			resCh <- v
+		}()
+
+		<-started
+		mockclock.Add(100 * time.Millisecond)
+
+		Eventually(resCh).Should(Receive(Equal("fast")))
+		Eventually(cancelled).Should(BeClosed())
+		Expect(atomic.LoadInt64(&calls)).To(Equal(int64(2)))
+	})
+
+	It("should return the last error once every attempt has failed", func() {
+		started := make(chan struct{}, 2)
+		release := make(chan struct{})
+
+		errCh := make(chan error)
+		go func() {
+			errCh <- CNP.Hedge(func(ctx context.Context) error {
+				started <- struct{}{}
+				<-release
+				return dummyError
+			}, hedger)(context.Background())
+		}()
+
+		<-started
+		mockclock.Add(100 * time.Millisecond)
+		<-started
+		close(release)
+
+		Eventually(errCh).Should(Receive(MatchError(dummyError)))
+	})
+
+	It("should stop waiting when the context is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		errCh := make(chan error)
+		go func() {
+			errCh <- CNP.Hedge(func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}, hedger)(ctx)
+		}()
+
+		cancel()
+		Eventually(errCh).Should(Receive(MatchError(context.Canceled)))
+	})
+
+	It("should learn the delay from the latency percentile of the recent calls", func() {
+		hedger = CNP.NewHedger(cnp.HedgeSettings{
+			Delay:      time.Second,
+			Percentile: 0.9,
+			Window:     10,
+			MinSamples: 10,
+		})
+		Expect(hedger.Delay()).To(Equal(time.Second))
+
+		// 10 calls taking 10ms, 20ms ... 100ms
+		for i := 1; i <= 10; i++ {
+			latency := time.Duration(i) * 10 * time.Millisecond
+			Expect(CNP.Hedge(func(ctx context.Context) error {
+				mockclock.Add(latency)
+				return nil
+			}, hedger)(context.Background())).To(Succeed())
+		}
+
+		Expect(hedger.Delay()).To(Equal(90 * time.Millisecond))
+	})
+})
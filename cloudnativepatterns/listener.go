@@ -0,0 +1,138 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"time"
+)
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventAttemptStarted is emitted by Retry before every attempt.
+	EventAttemptStarted EventType = iota
+	// EventAttemptSucceeded is emitted by Retry when an attempt succeeds.
+	EventAttemptSucceeded
+	// EventAttemptFailed is emitted by Retry when an attempt fails.
+	EventAttemptFailed
+	// EventRetryScheduled is emitted by Retry once it has decided to retry, before waiting.
+	EventRetryScheduled
+	// EventGaveUp is emitted by Retry when it returns an error: not retryable, retries exhausted or ctx done.
+	EventGaveUp
+	// EventBreakerStateChanged is emitted when a circuit breaker moves from one state to another.
+	EventBreakerStateChanged
+	// EventBulkheadRejected is emitted when a bulkhead rejects a call with ErrBulkheadFull or ErrBulkheadTimeout.
+	EventBulkheadRejected
+	// EventHedgeLaunched is emitted when Hedge launches a duplicate attempt.
+	EventHedgeLaunched
+	// EventStaleServed is emitted when ServeStale masks an error with a stale result.
+	EventStaleServed
+	// EventCoalesced is emitted when Coalesce makes a call wait for the call in flight with the same key.
+	EventCoalesced
+	// EventLimitExceeded is emitted when AdaptiveLimit rejects a call with ErrLimitExceeded.
+	EventLimitExceeded
+	// EventLimitChanged is emitted when an AdaptiveLimiter changes its limit.
+	EventLimitChanged
+	// EventBulkheadSettingsIgnored is emitted when NewBulkhead returns an existing compartment whose settings differ
+	// from the requested ones.
+	EventBulkheadSettingsIgnored
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAttemptStarted:
+		return "attempt-started"
+	case EventAttemptSucceeded:
+		return "attempt-succeeded"
+	case EventAttemptFailed:
+		return "attempt-failed"
+	case EventRetryScheduled:
+		return "retry-scheduled"
+	case EventGaveUp:
+		return "gave-up"
+	case EventBreakerStateChanged:
+		return "breaker-state-changed"
+	case EventBulkheadRejected:
+		return "bulkhead-rejected"
+	case EventHedgeLaunched:
+		return "hedge-launched"
+	case EventStaleServed:
+		return "stale-served"
+	case EventCoalesced:
+		return "coalesced"
+	case EventLimitExceeded:
+		return "limit-exceeded"
+	case EventLimitChanged:
+		return "limit-changed"
+	case EventBulkheadSettingsIgnored:
+		return "bulkhead-settings-ignored"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes something that happened in a pattern. Only the fields relevant to its Type are set.
+type Event struct {
+	Type EventType
+	// Operation is the name of the retry policy, breaker, bulkhead, hedger, stale cache, coalescer or adaptive limiter,
+	// i.e. the pipeline name when built by a Pipeline.
+	Operation string
+	// Time is when the event happened, according to CNP.Clock.
+	Time time.Time
+	// Attempt is the 1-based attempt the event refers to. For EventRetryScheduled it is the upcoming attempt,
+	// for EventHedgeLaunched the hedged attempt.
+	Attempt int
+	// Err is the error of the failed attempt, of the give-up, of the rejection or the one masked by a stale result.
+	// For EventBulkheadSettingsIgnored, it is an ErrBulkheadSettingsIgnored describing the ignored settings.
+	Err error
+	// Duration is how long the attempt ran. Set for EventAttemptSucceeded and EventAttemptFailed.
+	Duration time.Duration
+	// Delay is the wait before the upcoming attempt. Set for EventRetryScheduled and EventHedgeLaunched.
+	Delay time.Duration
+	// From and To are the previous and the new state. Set for EventBreakerStateChanged.
+	From BreakerState
+	To   BreakerState
+	// Limit is the limit of the adaptive limiter. Set for EventLimitExceeded and EventLimitChanged.
+	Limit int
+}
+
+// Listener receives the events of the patterns, e.g. to log them or to export metrics.
+// ctx is the context of the call that caused the event, so it carries e.g. the request ID.
+//
+// OnEvent is called synchronously on the path of the call: it must be fast and must not block.
+type Listener interface {
+	OnEvent(ctx context.Context, event Event)
+}
+
+// ListenerFunc adapts a function to a Listener.
+type ListenerFunc func(ctx context.Context, event Event)
+
+func (f ListenerFunc) OnEvent(ctx context.Context, event Event) {
+	f(ctx, event)
+}
+
+// Listeners returns a Listener that forwards every event to each of listeners, in order.
+func Listeners(listeners ...Listener) Listener {
+	return ListenerFunc(func(ctx context.Context, event Event) {
+		for _, l := range listeners {
+			l.OnEvent(ctx, event)
+		}
+	})
+}
+
+// WithListener sets the listener that receives the events of every pattern created from cnp.
+// Set it before wrapping any function: it is not safe to change it while calls are running.
+func (cnp *CNP) WithListener(listener Listener) *CNP {
+	cnp.listener = listener
+	return cnp
+}
+
+// emit sends event to the listener, if any, stamped with the current time.
+func (cnp *CNP) emit(ctx context.Context, event Event) {
+	if cnp.listener == nil {
+		return
+	}
+
+	event.Time = cnp.Clock.Now()
+	cnp.listener.OnEvent(ctx, event)
+}
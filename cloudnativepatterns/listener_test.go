@@ -0,0 +1,138 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+// recorder is a Listener that keeps the events it receives
+type recorder struct {
+	mu     sync.Mutex
+	events []cnp.Event
+}
+
+func (r *recorder) OnEvent(ctx context.Context, event cnp.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) types() []cnp.EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	types := make([]cnp.EventType, 0, len(r.events))
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+var _ = Describe("Listener", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+		rec       *recorder
+	)
+
+	dummyError := errors.New("dummy error")
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		rec = &recorder{}
+		CNP = cnp.NewCloudNativePatterns(mockclock).WithListener(rec)
+	})
+
+	It("should report the attempts, the retries and the give-up of Retry", func() {
+		r := CNP.RetryWithPolicy(func(ctx context.Context) error {
+			return dummyError
+		}, cnp.RetryPolicy{Name: "test", Retries: 1})
+
+		Expect(r(context.Background())).To(MatchError(cnp.ErrRetriesExhausted))
+
+		Expect(rec.types()).To(Equal([]cnp.EventType{
+			cnp.EventAttemptStarted,
+			cnp.EventAttemptFailed,
+			cnp.EventRetryScheduled,
+			cnp.EventAttemptStarted,
+			cnp.EventAttemptFailed,
+			cnp.EventGaveUp,
+		}))
+		for _, e := range rec.events {
+			Expect(e.Operation).To(Equal("test"))
+		}
+		Expect(rec.events[2].Attempt).To(Equal(2))
+		Expect(rec.events[5].Err).To(MatchError(dummyError))
+	})
+
+	It("should report a successful attempt", func() {
+		r := CNP.Retry(func(ctx context.Context) error {
+			return nil
+		}, 1, 0)
+
+		Expect(r(context.Background())).To(Succeed())
+		Expect(rec.types()).To(Equal([]cnp.EventType{cnp.EventAttemptStarted, cnp.EventAttemptSucceeded}))
+	})
+
+	It("should report the state changes of a breaker", func() {
+		breaker := CNP.NewBreaker(cnp.BreakerSettings{Name: "test", ConsecutiveFailures: 1, CoolDown: time.Second})
+		wrapped := CNP.CircuitBreaker(func(ctx context.Context) error {
+			return dummyError
+		}, breaker)
+
+		_ = wrapped(context.Background())
+		mockclock.Add(time.Second)
+		Expect(breaker.State()).To(Equal(cnp.StateHalfOpen))
+
+		Expect(rec.types()).To(Equal([]cnp.EventType{cnp.EventBreakerStateChanged, cnp.EventBreakerStateChanged}))
+		Expect(rec.events[0].From).To(Equal(cnp.StateClosed))
+		Expect(rec.events[0].To).To(Equal(cnp.StateOpen))
+		Expect(rec.events[1].From).To(Equal(cnp.StateOpen))
+		Expect(rec.events[1].To).To(Equal(cnp.StateHalfOpen))
+	})
+
+	It("should report the rejections of a bulkhead", func() {
+		bulkhead := CNP.NewBulkhead(cnp.BulkheadSettings{Name: "test"})
+		release := make(chan struct{})
+		wrapped := CNP.Bulkhead(func(ctx context.Context) error {
+			<-release
+			return nil
+		}, bulkhead)
+
+		go wrapped(context.Background())
+		Eventually(bulkhead.InFlight).Should(Equal(1))
+
+		Expect(wrapped(context.Background())).To(MatchError(cnp.ErrBulkheadFull))
+		close(release)
+
+		Expect(rec.types()).To(Equal([]cnp.EventType{cnp.EventBulkheadRejected}))
+		Expect(rec.events[0].Operation).To(Equal("test"))
+	})
+
+	It("should name the events of a pipeline after the pipeline", func() {
+		p := CNP.NewPipeline("user-repo").WithRetry(cnp.RetryPolicy{})
+
+		Expect(p.Wrap(func(ctx context.Context) error { return nil })(context.Background())).To(Succeed())
+		Expect(rec.events).NotTo(BeEmpty())
+		for _, e := range rec.events {
+			Expect(e.Operation).To(Equal("user-repo"))
+		}
+	})
+
+	It("should forward the events to every listener", func() {
+		other := &recorder{}
+		CNP.WithListener(cnp.Listeners(rec, other))
+
+		_ = CNP.Retry(func(ctx context.Context) error { return nil }, 0, 0)(context.Background())
+
+		Expect(rec.types()).To(HaveLen(2))
+		Expect(other.types()).To(Equal(rec.types()))
+	})
+})
@@ -0,0 +1,76 @@
+// Package observability provides cloudnativepatterns listeners that log the events of the patterns
+// with zerolog or slog, and export them as Prometheus metrics.
+//
+// Combine them with cloudnativepatterns.Listeners:
+//
+//	CNP.WithListener(cnp.Listeners(
+//		observability.NewZerologListener(logger, middleware.GetReqID),
+//		metrics,
+//	))
+package observability
+
+import (
+	"context"
+
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+// RequestIDFunc returns the request ID carried by ctx, or "" if there is none, e.g. chi's middleware.GetReqID.
+type RequestIDFunc func(ctx context.Context) string
+
+// level is the severity at which an event is logged.
+type level int
+
+const (
+	levelDebug level = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// levelOf returns the severity of event: the attempts are noise unless something goes wrong,
+// a give-up is the error that the caller gets. A give-up on an error that is not retried (e.g. a permanent error,
+// or a record that is not found) is the answer of the dependency rather than a failure of it, so it is only info.
+func levelOf(event cnp.Event) level {
+	switch event.Type {
+	case cnp.EventAttemptStarted, cnp.EventAttemptSucceeded, cnp.EventCoalesced:
+		return levelDebug
+	case cnp.EventAttemptFailed, cnp.EventRetryScheduled, cnp.EventHedgeLaunched, cnp.EventLimitChanged:
+		return levelInfo
+	case cnp.EventGaveUp:
+		if giveUpReason(event.Err) == "not_retryable" {
+			return levelInfo
+		}
+		return levelError
+	default:
+		return levelWarn
+	}
+}
+
+// fields returns the fields of event that are relevant to its type, as key/value pairs.
+func fields(ctx context.Context, event cnp.Event, requestID RequestIDFunc) []any {
+	kv := []any{"event", event.Type.String(), "operation", event.Operation}
+
+	if requestID != nil {
+		if id := requestID(ctx); id != "" {
+			kv = append(kv, "request_id", id)
+		}
+	}
+
+	switch event.Type {
+	case cnp.EventAttemptStarted:
+		kv = append(kv, "attempt", event.Attempt)
+	case cnp.EventAttemptSucceeded, cnp.EventAttemptFailed:
+		kv = append(kv, "attempt", event.Attempt, "duration", event.Duration)
+	case cnp.EventRetryScheduled, cnp.EventHedgeLaunched:
+		kv = append(kv, "attempt", event.Attempt, "delay", event.Delay)
+	case cnp.EventGaveUp:
+		kv = append(kv, "attempt", event.Attempt)
+	case cnp.EventBreakerStateChanged:
+		kv = append(kv, "from", event.From.String(), "to", event.To.String())
+	case cnp.EventLimitExceeded, cnp.EventLimitChanged:
+		kv = append(kv, "limit", event.Limit)
+	}
+
+	return kv
+}
@@ -0,0 +1,185 @@
+package observability_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/patilchinmay/go-experiments/cloudnativepatterns/observability"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+type keyType struct{}
+
+// requestID reads the request ID stored in ctx by withRequestID
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(keyType{}).(string)
+	return id
+}
+
+func withRequestID(id string) context.Context {
+	return context.WithValue(context.Background(), keyType{}, id)
+}
+
+var dummyError = errors.New("dummy error")
+
+var retryScheduled = cnp.Event{
+	Type:      cnp.EventRetryScheduled,
+	Operation: "user-repo",
+	Attempt:   2,
+	Delay:     500 * time.Millisecond,
+}
+
+// decode returns the single JSON line written to buf
+func decode(buf *bytes.Buffer) map[string]any {
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	Expect(lines).To(HaveLen(1))
+
+	var entry map[string]any
+	Expect(json.Unmarshal([]byte(lines[0]), &entry)).To(Succeed())
+	return entry
+}
+
+var _ = Describe("ZerologListener", func() {
+	It("should log the event with the operation and the request ID", func() {
+		buf := &bytes.Buffer{}
+		l := observability.NewZerologListener(zerolog.New(buf), requestID)
+
+		l.OnEvent(withRequestID("req-1"), retryScheduled)
+
+		entry := decode(buf)
+		Expect(entry).To(HaveKeyWithValue("level", "info"))
+		Expect(entry).To(HaveKeyWithValue("event", "retry-scheduled"))
+		Expect(entry).To(HaveKeyWithValue("operation", "user-repo"))
+		Expect(entry).To(HaveKeyWithValue("request_id", "req-1"))
+		Expect(entry).To(HaveKeyWithValue("attempt", BeNumerically("==", 2)))
+	})
+
+	It("should log a give-up on exhausted retries as an error", func() {
+		buf := &bytes.Buffer{}
+		l := observability.NewZerologListener(zerolog.New(buf), nil)
+
+		l.OnEvent(context.Background(), cnp.Event{Type: cnp.EventGaveUp, Operation: "user-repo", Err: fmt.Errorf("%w: 3: %w", cnp.ErrRetriesExhausted, dummyError)})
+
+		entry := decode(buf)
+		Expect(entry).To(HaveKeyWithValue("level", "error"))
+		Expect(entry).To(HaveKeyWithValue("error", ContainSubstring("dummy error")))
+		Expect(entry).NotTo(HaveKey("request_id"))
+	})
+
+	DescribeTable("should log a give-up on an error that is not retried as info",
+		func(err error) {
+			buf := &bytes.Buffer{}
+			l := observability.NewZerologListener(zerolog.New(buf), nil)
+
+			l.OnEvent(context.Background(), cnp.Event{Type: cnp.EventGaveUp, Operation: "user-repo", Err: err})
+
+			Expect(decode(buf)).To(HaveKeyWithValue("level", "info"))
+		},
+		Entry("not retryable", dummyError),
+		Entry("permanent", cnp.Permanent(dummyError)),
+	)
+})
+
+var _ = Describe("SlogListener", func() {
+	It("should log the event with the operation and the request ID", func() {
+		buf := &bytes.Buffer{}
+		l := observability.NewSlogListener(slog.New(slog.NewJSONHandler(buf, nil)), requestID)
+
+		l.OnEvent(withRequestID("req-1"), cnp.Event{
+			Type:      cnp.EventBreakerStateChanged,
+			Operation: "user-repo",
+			From:      cnp.StateClosed,
+			To:        cnp.StateOpen,
+		})
+
+		entry := decode(buf)
+		Expect(entry).To(HaveKeyWithValue("level", "WARN"))
+		Expect(entry).To(HaveKeyWithValue("event", "breaker-state-changed"))
+		Expect(entry).To(HaveKeyWithValue("request_id", "req-1"))
+		Expect(entry).To(HaveKeyWithValue("from", "closed"))
+		Expect(entry).To(HaveKeyWithValue("to", "open"))
+	})
+})
+
+var _ = Describe("PrometheusListener", func() {
+	var (
+		registry *prometheus.Registry
+		l        *observability.PrometheusListener
+	)
+
+	BeforeEach(func() {
+		var err error
+		registry = prometheus.NewRegistry()
+		l, err = observability.NewPrometheusListener(registry)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should count the retries per operation", func() {
+		l.OnEvent(context.Background(), retryScheduled)
+		l.OnEvent(context.Background(), retryScheduled)
+		l.OnEvent(context.Background(), cnp.Event{Type: cnp.EventRetryScheduled, Operation: "other"})
+
+		Expect(testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP cnp_retries_total Retries scheduled by Retry.
+# TYPE cnp_retries_total counter
+cnp_retries_total{operation="other"} 1
+cnp_retries_total{operation="user-repo"} 2
+`), "cnp_retries_total")).To(Succeed())
+	})
+
+	It("should export the breaker state and the bulkhead rejections", func() {
+		l.OnEvent(context.Background(), cnp.Event{Type: cnp.EventBreakerStateChanged, Operation: "user-repo", From: cnp.StateClosed, To: cnp.StateOpen})
+		l.OnEvent(context.Background(), cnp.Event{Type: cnp.EventBulkheadRejected, Operation: "user-repo", Err: cnp.ErrBulkheadTimeout})
+
+		Expect(testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP cnp_breaker_state Current state of the circuit breaker: 0 closed, 1 open, 2 half-open.
+# TYPE cnp_breaker_state gauge
+cnp_breaker_state{operation="user-repo"} 1
+# HELP cnp_bulkhead_rejections_total Calls rejected by the bulkhead, by reason.
+# TYPE cnp_bulkhead_rejections_total counter
+cnp_bulkhead_rejections_total{operation="user-repo",reason="timeout"} 1
+`), "cnp_breaker_state", "cnp_bulkhead_rejections_total")).To(Succeed())
+	})
+
+	It("should count the give-ups by reason", func() {
+		l.OnEvent(context.Background(), cnp.Event{Type: cnp.EventGaveUp, Operation: "user-repo", Err: fmt.Errorf("%w: %w", cnp.ErrRetryBudgetExhausted, dummyError)})
+		l.OnEvent(context.Background(), cnp.Event{Type: cnp.EventGaveUp, Operation: "user-repo", Err: dummyError})
+
+		Expect(testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP cnp_give_ups_total Calls for which Retry gave up and returned an error, by reason.
+# TYPE cnp_give_ups_total counter
+cnp_give_ups_total{operation="user-repo",reason="budget_exhausted"} 1
+cnp_give_ups_total{operation="user-repo",reason="not_retryable"} 1
+`), "cnp_give_ups_total")).To(Succeed())
+	})
+
+	It("should export the adaptive limit and its rejections", func() {
+		l.OnEvent(context.Background(), cnp.Event{Type: cnp.EventLimitChanged, Operation: "http", Limit: 21})
+		l.OnEvent(context.Background(), cnp.Event{Type: cnp.EventLimitExceeded, Operation: "http", Limit: 18, Err: cnp.ErrLimitExceeded})
+
+		Expect(testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP cnp_adaptive_limit Current limit of the adaptive concurrency limiter.
+# TYPE cnp_adaptive_limit gauge
+cnp_adaptive_limit{operation="http"} 18
+# HELP cnp_adaptive_limit_rejections_total Calls rejected by the adaptive concurrency limiter.
+# TYPE cnp_adaptive_limit_rejections_total counter
+cnp_adaptive_limit_rejections_total{operation="http"} 1
+`), "cnp_adaptive_limit", "cnp_adaptive_limit_rejections_total")).To(Succeed())
+	})
+
+	It("should fail to register twice with the same registry", func() {
+		_, err := observability.NewPrometheusListener(registry)
+		Expect(err).To(HaveOccurred())
+	})
+})
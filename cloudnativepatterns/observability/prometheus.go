@@ -0,0 +1,165 @@
+package observability
+
+import (
+	"context"
+	"errors"
+
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusListener exports the events as Prometheus metrics, labelled by operation.
+// Request IDs are deliberately not used as labels, every one of them would create new time series:
+// correlate with the logs of ZerologListener or SlogListener instead.
+type PrometheusListener struct {
+	attempts           *prometheus.CounterVec
+	attemptDuration    *prometheus.HistogramVec
+	retries            *prometheus.CounterVec
+	retryDelay         *prometheus.HistogramVec
+	giveUps            *prometheus.CounterVec
+	breakerState       *prometheus.GaugeVec
+	breakerTransitions *prometheus.CounterVec
+	bulkheadRejections *prometheus.CounterVec
+	hedges             *prometheus.CounterVec
+	staleServed        *prometheus.CounterVec
+	coalesced          *prometheus.CounterVec
+	limit              *prometheus.GaugeVec
+	limitRejections    *prometheus.CounterVec
+}
+
+// NewPrometheusListener creates a PrometheusListener and registers its metrics with registerer.
+func NewPrometheusListener(registerer prometheus.Registerer) (*PrometheusListener, error) {
+	l := &PrometheusListener{
+		attempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cnp",
+			Name:      "attempts_total",
+			Help:      "Attempts made by Retry, by result.",
+		}, []string{"operation", "result"}),
+		attemptDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "cnp",
+			Name:      "attempt_duration_seconds",
+			Help:      "Duration of the attempts made by Retry, by result.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation", "result"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cnp",
+			Name:      "retries_total",
+			Help:      "Retries scheduled by Retry.",
+		}, []string{"operation"}),
+		retryDelay: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "cnp",
+			Name:      "retry_delay_seconds",
+			Help:      "Wait before the retries scheduled by Retry.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"operation"}),
+		giveUps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cnp",
+			Name:      "give_ups_total",
+			Help:      "Calls for which Retry gave up and returned an error, by reason.",
+		}, []string{"operation", "reason"}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "cnp",
+			Name:      "breaker_state",
+			Help:      "Current state of the circuit breaker: 0 closed, 1 open, 2 half-open.",
+		}, []string{"operation"}),
+		breakerTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cnp",
+			Name:      "breaker_transitions_total",
+			Help:      "State changes of the circuit breaker.",
+		}, []string{"operation", "from", "to"}),
+		bulkheadRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cnp",
+			Name:      "bulkhead_rejections_total",
+			Help:      "Calls rejected by the bulkhead, by reason.",
+		}, []string{"operation", "reason"}),
+		hedges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cnp",
+			Name:      "hedges_total",
+			Help:      "Hedged attempts launched by Hedge.",
+		}, []string{"operation"}),
+		staleServed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cnp",
+			Name:      "stale_served_total",
+			Help:      "Errors masked by ServeStale with a stale result.",
+		}, []string{"operation"}),
+		coalesced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cnp",
+			Name:      "coalesced_total",
+			Help:      "Calls that waited for the call in flight with the same key instead of calling the dependency.",
+		}, []string{"operation"}),
+		limit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "cnp",
+			Name:      "adaptive_limit",
+			Help:      "Current limit of the adaptive concurrency limiter.",
+		}, []string{"operation"}),
+		limitRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cnp",
+			Name:      "adaptive_limit_rejections_total",
+			Help:      "Calls rejected by the adaptive concurrency limiter.",
+		}, []string{"operation"}),
+	}
+
+	for _, c := range []prometheus.Collector{
+		l.attempts, l.attemptDuration, l.retries, l.retryDelay, l.giveUps,
+		l.breakerState, l.breakerTransitions, l.bulkheadRejections, l.hedges, l.staleServed, l.coalesced,
+		l.limit, l.limitRejections,
+	} {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func (l *PrometheusListener) OnEvent(ctx context.Context, event cnp.Event) {
+	switch event.Type {
+	case cnp.EventAttemptSucceeded:
+		l.attempts.WithLabelValues(event.Operation, "success").Inc()
+		l.attemptDuration.WithLabelValues(event.Operation, "success").Observe(event.Duration.Seconds())
+	case cnp.EventAttemptFailed:
+		l.attempts.WithLabelValues(event.Operation, "failure").Inc()
+		l.attemptDuration.WithLabelValues(event.Operation, "failure").Observe(event.Duration.Seconds())
+	case cnp.EventRetryScheduled:
+		l.retries.WithLabelValues(event.Operation).Inc()
+		l.retryDelay.WithLabelValues(event.Operation).Observe(event.Delay.Seconds())
+	case cnp.EventGaveUp:
+		l.giveUps.WithLabelValues(event.Operation, giveUpReason(event.Err)).Inc()
+	case cnp.EventBreakerStateChanged:
+		l.breakerState.WithLabelValues(event.Operation).Set(float64(event.To))
+		l.breakerTransitions.WithLabelValues(event.Operation, event.From.String(), event.To.String()).Inc()
+	case cnp.EventBulkheadRejected:
+		reason := "full"
+		if errors.Is(event.Err, cnp.ErrBulkheadTimeout) {
+			reason = "timeout"
+		}
+		l.bulkheadRejections.WithLabelValues(event.Operation, reason).Inc()
+	case cnp.EventHedgeLaunched:
+		l.hedges.WithLabelValues(event.Operation).Inc()
+	case cnp.EventStaleServed:
+		l.staleServed.WithLabelValues(event.Operation).Inc()
+	case cnp.EventCoalesced:
+		l.coalesced.WithLabelValues(event.Operation).Inc()
+	case cnp.EventLimitExceeded:
+		l.limit.WithLabelValues(event.Operation).Set(float64(event.Limit))
+		l.limitRejections.WithLabelValues(event.Operation).Inc()
+	case cnp.EventLimitChanged:
+		l.limit.WithLabelValues(event.Operation).Set(float64(event.Limit))
+	}
+}
+
+// giveUpReason tells a retry storm (retries or budget exhausted) apart from errors that are not retried.
+func giveUpReason(err error) string {
+	switch {
+	case errors.Is(err, cnp.ErrRetryBudgetExhausted):
+		return "budget_exhausted"
+	case errors.Is(err, cnp.ErrRetriesExhausted):
+		return "retries_exhausted"
+	case errors.Is(err, cnp.ErrRetryDeadline):
+		return "deadline"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "context"
+	default:
+		return "not_retryable"
+	}
+}
@@ -0,0 +1,44 @@
+package observability
+
+import (
+	"context"
+	"log/slog"
+
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+// SlogListener logs every event with a slog.Logger.
+type SlogListener struct {
+	logger    *slog.Logger
+	requestID RequestIDFunc
+}
+
+// NewSlogListener creates a SlogListener. requestID may be nil.
+func NewSlogListener(logger *slog.Logger, requestID RequestIDFunc) *SlogListener {
+	return &SlogListener{
+		logger:    logger,
+		requestID: requestID,
+	}
+}
+
+func (l *SlogListener) OnEvent(ctx context.Context, event cnp.Event) {
+	var lvl slog.Level
+
+	switch levelOf(event) {
+	case levelDebug:
+		lvl = slog.LevelDebug
+	case levelInfo:
+		lvl = slog.LevelInfo
+	case levelWarn:
+		lvl = slog.LevelWarn
+	default:
+		lvl = slog.LevelError
+	}
+
+	args := fields(ctx, event, l.requestID)
+	if event.Err != nil {
+		args = append(args, "error", event.Err.Error())
+	}
+
+	l.logger.Log(ctx, lvl, "cloud native pattern "+event.Type.String(), args...)
+}
@@ -0,0 +1,39 @@
+package observability
+
+import (
+	"context"
+
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/rs/zerolog"
+)
+
+// ZerologListener logs every event with a zerolog.Logger.
+type ZerologListener struct {
+	logger    zerolog.Logger
+	requestID RequestIDFunc
+}
+
+// NewZerologListener creates a ZerologListener. requestID may be nil.
+func NewZerologListener(logger zerolog.Logger, requestID RequestIDFunc) *ZerologListener {
+	return &ZerologListener{
+		logger:    logger,
+		requestID: requestID,
+	}
+}
+
+func (l *ZerologListener) OnEvent(ctx context.Context, event cnp.Event) {
+	var e *zerolog.Event
+
+	switch levelOf(event) {
+	case levelDebug:
+		e = l.logger.Debug()
+	case levelInfo:
+		e = l.logger.Info()
+	case levelWarn:
+		e = l.logger.Warn()
+	default:
+		e = l.logger.Error()
+	}
+
+	e.Fields(fields(ctx, event, l.requestID)).Err(event.Err).Msg("cloud native pattern " + event.Type.String())
+}
@@ -0,0 +1,228 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"time"
+)
+
+// Pipeline composes the patterns for a dependency and is registered on CNP under a name, e.g. "user-repo".
+//
+// A call goes through the stages in this order, from the outermost to the innermost, each of them being optional:
+//
+//	timeout → retry → hedge → circuit breaker → bulkhead → function
+//
+// The fallback is not a stage: only the calls wrapped with WrapWithFallback end with it, once every stage has failed.
+// So the timeout bounds the whole call including the retries, every attempt is seen by the breaker,
+// and every attempt that the breaker lets through takes a slot in the bulkhead.
+// The hedge stage sits inside the retry stage, so that a retry is itself hedged: one attempt of the retry stage is
+// the race between the original call and its hedges, and it only fails, and is retried, once all of them have
+// failed. Outside of the retry stage, each hedge would run its own retries, multiplying the load on a dependency that
+// is already slow. The hedge stage sits outside of the breaker and the bulkhead, so that every hedge is seen by the
+// breaker and takes its own slot in the bulkhead.
+// The hedge stage duplicates attempts, so it only applies to the idempotent calls wrapped with WrapHedged,
+// and the calls wrapped with WrapOnce skip the retry stage as well.
+//
+// Build a pipeline with NewPipeline (or NewPipelineFromConfig) and its With* methods, then Register it.
+type Pipeline struct {
+	name     string
+	cnp      *CNP
+	timeout  time.Duration
+	retry    *RetryPolicy
+	breaker  *Breaker
+	bulkhead *Bulkhead
+	hedger   *Hedger
+	// classifier is set by WithClassifier, see there
+	classifier Classifier
+}
+
+// NewPipeline creates an empty pipeline named name. It is not registered until Register is called.
+func (cnp *CNP) NewPipeline(name string) *Pipeline {
+	return &Pipeline{
+		name: name,
+		cnp:  cnp,
+	}
+}
+
+// Pipeline returns the pipeline registered under name.
+func (cnp *CNP) Pipeline(name string) (*Pipeline, bool) {
+	cnp.mu.Lock()
+	defer cnp.mu.Unlock()
+
+	p, ok := cnp.pipelines[name]
+	return p, ok
+}
+
+// Name returns the name of the pipeline.
+func (p *Pipeline) Name() string {
+	return p.name
+}
+
+// WithTimeout bounds the whole call, retries included. 0 disables the stage.
+func (p *Pipeline) WithTimeout(timeout time.Duration) *Pipeline {
+	p.timeout = timeout
+	return p
+}
+
+// WithRetry retries the failed attempts as described by policy.
+// The policy is named after the pipeline unless policy.Name is set.
+func (p *Pipeline) WithRetry(policy RetryPolicy) *Pipeline {
+	if policy.Name == "" {
+		policy.Name = p.name
+	}
+	if policy.Classifier == nil {
+		policy.Classifier = p.classifier
+	}
+	p.retry = &policy
+	return p
+}
+
+// WithClassifier sets the classifier of the retry stage, and makes the circuit breaker count only the errors that
+// are both a failure by default and retryable according to classifier: an error that is not worth retrying
+// (e.g. a "not found") is an answer of the dependency, not a failure of it.
+// It applies to the stages added before and after it, unless their settings have a classifier of their own.
+func (p *Pipeline) WithClassifier(classifier Classifier) *Pipeline {
+	p.classifier = classifier
+
+	if p.retry != nil {
+		p.retry.Classifier = classifier
+	}
+	if p.breaker != nil {
+		p.breaker.setIsFailure(p.isFailure)
+	}
+	return p
+}
+
+// isFailure is the IsFailure of the breaker of a pipeline with a classifier.
+func (p *Pipeline) isFailure(err error) bool {
+	return isBreakerFailure(err) && p.classifier(err)
+}
+
+// WithCircuitBreaker guards the attempts with a breaker created from settings.
+// The breaker is named after the pipeline unless settings.Name is set.
+func (p *Pipeline) WithCircuitBreaker(settings BreakerSettings) *Pipeline {
+	if settings.Name == "" {
+		settings.Name = p.name
+	}
+	if settings.IsFailure == nil && p.classifier != nil {
+		settings.IsFailure = p.isFailure
+	}
+	p.breaker = p.cnp.NewBreaker(settings)
+	return p
+}
+
+// WithBulkhead runs the attempts in the compartment described by settings.
+// The compartment is named after the pipeline unless settings.Name is set.
+func (p *Pipeline) WithBulkhead(settings BulkheadSettings) *Pipeline {
+	if settings.Name == "" {
+		settings.Name = p.name
+	}
+	p.bulkhead = p.cnp.NewBulkhead(settings)
+	return p
+}
+
+// WithHedge hedges the slow attempts of the calls wrapped with WrapHedged, with a hedger created from settings.
+// The hedger is named after the pipeline unless settings.Name is set.
+func (p *Pipeline) WithHedge(settings HedgeSettings) *Pipeline {
+	if settings.Name == "" {
+		settings.Name = p.name
+	}
+	p.hedger = p.cnp.NewHedger(settings)
+	return p
+}
+
+// Breaker returns the breaker of the pipeline, nil without a circuit breaker stage.
+func (p *Pipeline) Breaker() *Breaker {
+	return p.breaker
+}
+
+// Bulkhead returns the bulkhead compartment of the pipeline, nil without a bulkhead stage.
+func (p *Pipeline) Bulkhead() *Bulkhead {
+	return p.bulkhead
+}
+
+// Hedger returns the hedger of the pipeline, nil without a hedge stage.
+func (p *Pipeline) Hedger() *Hedger {
+	return p.hedger
+}
+
+// Register registers the pipeline under its name, replacing any pipeline registered under the same name.
+func (p *Pipeline) Register() *Pipeline {
+	p.cnp.mu.Lock()
+	defer p.cnp.mu.Unlock()
+
+	if p.cnp.pipelines == nil {
+		p.cnp.pipelines = make(map[string]*Pipeline)
+	}
+	p.cnp.pipelines[p.name] = p
+
+	return p
+}
+
+// Wrap wraps cnf with the stages of the pipeline, except the hedge stage.
+func (p *Pipeline) Wrap(cnf CloudNativeFunction) CloudNativeFunction {
+	return p.wrap(cnf, false)
+}
+
+// WrapHedged wraps cnf with the stages of the pipeline, including the hedge stage if any.
+// cnf may run several times concurrently, so use it only for idempotent calls such as reads.
+func (p *Pipeline) WrapHedged(cnf CloudNativeFunction) CloudNativeFunction {
+	return p.wrap(cnf, true)
+}
+
+// WrapOnce wraps cnf with the stages of the pipeline, except the retry and hedge stages, so cnf runs at most once.
+// Use it for the calls that are not idempotent, such as inserts: an attempt that timed out or lost its connection
+// may still have been committed, and running it again would do it twice.
+func (p *Pipeline) WrapOnce(cnf CloudNativeFunction) CloudNativeFunction {
+	return p.wrapStages(cnf, false, false)
+}
+
+func (p *Pipeline) wrap(cnf CloudNativeFunction, hedged bool) CloudNativeFunction {
+	return p.wrapStages(cnf, hedged, true)
+}
+
+// wrapStages wraps cnf from the innermost stage to the outermost one, in the reverse of the order of the Pipeline doc.
+func (p *Pipeline) wrapStages(cnf CloudNativeFunction, hedged bool, retried bool) CloudNativeFunction {
+	if p.bulkhead != nil {
+		cnf = p.cnp.Bulkhead(cnf, p.bulkhead)
+	}
+
+	if p.breaker != nil {
+		cnf = p.cnp.CircuitBreaker(cnf, p.breaker)
+	}
+
+	if hedged && p.hedger != nil {
+		cnf = p.cnp.Hedge(cnf, p.hedger)
+	}
+
+	if retried && p.retry != nil {
+		cnf = p.cnp.RetryWithPolicy(cnf, *p.retry)
+	}
+
+	return p.cnp.Timeout(cnf, p.timeout)
+}
+
+// WrapWithFallback wraps cnf with the stages of the pipeline and calls fallback with the error when the call fails
+// (see Fallback).
+func (p *Pipeline) WrapWithFallback(cnf CloudNativeFunction, fallback FallbackFunc) CloudNativeFunction {
+	return p.cnp.Fallback(p.Wrap(cnf), fallback)
+}
+
+// WrapT is the TypedFunction variant of Pipeline.Wrap.
+func WrapT[T any](p *Pipeline, fn TypedFunction[T]) TypedFunction[T] {
+	return typed(fn, p.Wrap)
+}
+
+// WrapHedgedT is the TypedFunction variant of Pipeline.WrapHedged.
+func WrapHedgedT[T any](p *Pipeline, fn TypedFunction[T]) TypedFunction[T] {
+	return typed(fn, p.WrapHedged)
+}
+
+// WrapOnceT is the TypedFunction variant of Pipeline.WrapOnce.
+func WrapOnceT[T any](p *Pipeline, fn TypedFunction[T]) TypedFunction[T] {
+	return typed(fn, p.WrapOnce)
+}
+
+// WrapWithFallbackT is the TypedFunction variant of Pipeline.WrapWithFallback.
+func WrapWithFallbackT[T any](p *Pipeline, fn TypedFunction[T], fallback func(ctx context.Context, err error) (T, error)) TypedFunction[T] {
+	return FallbackT(WrapT(p, fn), fallback)
+}
@@ -0,0 +1,229 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("Pipeline", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+	)
+
+	dummyError := errors.New("dummy error")
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+	})
+
+	It("should register the pipeline under its name", func() {
+		p := CNP.NewPipeline("user-repo").Register()
+
+		registered, ok := CNP.Pipeline("user-repo")
+		Expect(ok).To(BeTrue())
+		Expect(registered).To(BeIdenticalTo(p))
+
+		_, ok = CNP.Pipeline("other")
+		Expect(ok).To(BeFalse())
+
+		// Every CNP has its own registry
+		_, ok = cnp.NewCloudNativePatterns(mockclock).Pipeline("user-repo")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should retry through the breaker and stop once it is open", func() {
+		p := CNP.NewPipeline("test").
+			WithRetry(cnp.RetryPolicy{Retries: 5}).
+			WithCircuitBreaker(cnp.BreakerSettings{ConsecutiveFailures: 2, CoolDown: time.Minute}).
+			WithBulkhead(cnp.BulkheadSettings{MaxConcurrent: 1})
+
+		calls := 0
+		err := p.Wrap(func(ctx context.Context) error {
+			calls++
+			return dummyError
+		})(context.Background())
+
+		// The breaker opens after 2 attempts, and retrying an open breaker is pointless
+		Expect(err).To(MatchError(cnp.ErrCircuitOpen))
+		Expect(calls).To(Equal(2))
+		Expect(p.Breaker().State()).To(Equal(cnp.StateOpen))
+		Expect(p.Bulkhead().InFlight()).To(Equal(0))
+	})
+
+	It("should not count the errors that the classifier does not retry as failures of the breaker", func() {
+		notFound := errors.New("not found")
+		classifier := func(err error) bool { return !errors.Is(err, notFound) }
+
+		// The classifier applies to the breaker whether it is set before or after it
+		for _, p := range []*cnp.Pipeline{
+			CNP.NewPipeline("after").
+				WithRetry(cnp.RetryPolicy{Retries: 1}).
+				WithCircuitBreaker(cnp.BreakerSettings{ConsecutiveFailures: 2, CoolDown: time.Minute}).
+				WithClassifier(classifier),
+			CNP.NewPipeline("before").
+				WithClassifier(classifier).
+				WithRetry(cnp.RetryPolicy{Retries: 1}).
+				WithCircuitBreaker(cnp.BreakerSettings{ConsecutiveFailures: 2, CoolDown: time.Minute}),
+		} {
+			calls := 0
+			fn := p.Wrap(func(ctx context.Context) error {
+				calls++
+				return notFound
+			})
+
+			for i := 0; i < 5; i++ {
+				Expect(fn(context.Background())).To(MatchError(notFound))
+			}
+			Expect(calls).To(Equal(5))
+			Expect(p.Breaker().State()).To(Equal(cnp.StateClosed))
+
+			// The retryable errors still open it
+			Expect(p.Wrap(func(ctx context.Context) error {
+				return dummyError
+			})(context.Background())).To(MatchError(dummyError))
+			Expect(p.Breaker().State()).To(Equal(cnp.StateOpen))
+		}
+	})
+
+	It("should not retry the calls wrapped with WrapOnce", func() {
+		p := CNP.NewPipeline("test").
+			WithRetry(cnp.RetryPolicy{Retries: 3}).
+			WithCircuitBreaker(cnp.BreakerSettings{ConsecutiveFailures: 2, CoolDown: time.Minute})
+
+		calls := 0
+		_, err := cnp.WrapOnceT(p, func(ctx context.Context) (int, error) {
+			calls++
+			return 0, dummyError
+		})(context.Background())
+
+		Expect(err).To(MatchError(dummyError))
+		Expect(calls).To(Equal(1))
+
+		// The other stages still apply
+		Expect(p.WrapOnce(func(ctx context.Context) error { return dummyError })(context.Background())).To(MatchError(dummyError))
+		Expect(p.Breaker().State()).To(Equal(cnp.StateOpen))
+	})
+
+	It("should call the fallback when the call fails", func() {
+		p := CNP.NewPipeline("test").WithRetry(cnp.RetryPolicy{Retries: 1})
+
+		fn := cnp.WrapWithFallbackT(p, func(ctx context.Context) (string, error) {
+			return "", dummyError
+		}, func(ctx context.Context, err error) (string, error) {
+			return "fallback", nil
+		})
+
+		result, err := fn(context.Background())
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(result).To(Equal("fallback"))
+	})
+
+	It("should hedge only the calls wrapped with WrapHedged", func() {
+		p := CNP.NewPipeline("test").WithHedge(cnp.HedgeSettings{})
+
+		// A zero delay hedges right away, so a call that blocks until cancelled is duplicated
+		var calls int64
+		fn := func(ctx context.Context) error {
+			if atomic.AddInt64(&calls, 1) == 1 {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		}
+
+		Expect(p.WrapHedged(fn)(context.Background())).To(Succeed())
+		Expect(atomic.LoadInt64(&calls)).To(Equal(int64(2)))
+
+		Expect(p.Hedger()).NotTo(BeNil())
+		atomic.StoreInt64(&calls, 1)
+		Expect(p.Wrap(func(ctx context.Context) error {
+			atomic.AddInt64(&calls, 1)
+			return nil
+		})(context.Background())).To(Succeed())
+		Expect(atomic.LoadInt64(&calls)).To(Equal(int64(2)))
+	})
+
+	Context("Config", func() {
+		defaults := cnp.PolicyConfig{
+			Retry: cnp.RetryConfig{
+				Enabled:   true,
+				Retries:   3,
+				Backoff:   "exponential",
+				BaseDelay: time.Second,
+			},
+		}
+
+		AfterEach(func() {
+			os.Unsetenv("CNP_USER_REPO_RETRY_RETRIES")
+			os.Unsetenv("CNP_USER_REPO_TIMEOUT")
+		})
+
+		It("should derive the env prefix from the name", func() {
+			Expect(cnp.EnvPrefix("user-repo")).To(Equal("CNP_USER_REPO_"))
+		})
+
+		It("should return the defaults without a file or env vars", func() {
+			config, err := cnp.LoadPolicyConfig("user-repo", "", defaults)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(config).To(Equal(defaults))
+		})
+
+		It("should override the defaults with the file and then with the env vars", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "policies.yaml")
+			Expect(os.WriteFile(path, []byte(`
+policies:
+  user-repo:
+    timeout: 10s
+    retry:
+      retries: 5
+    bulkhead:
+      enabled: true
+      max_concurrent: 20
+  other:
+    timeout: 1s
+`), 0o600)).To(Succeed())
+
+			os.Setenv("CNP_USER_REPO_RETRY_RETRIES", "7")
+
+			config, err := cnp.LoadPolicyConfig("user-repo", path, defaults)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(config.Timeout).To(Equal(10 * time.Second))
+			Expect(config.Retry.Retries).To(Equal(7))
+			Expect(config.Retry.Backoff).To(Equal("exponential")) // untouched default
+			Expect(config.Bulkhead.Enabled).To(BeTrue())
+			Expect(config.Bulkhead.MaxConcurrent).To(Equal(20))
+		})
+
+		It("should build the enabled stages", func() {
+			config := defaults
+			config.CircuitBreaker = cnp.CircuitBreakerConfig{Enabled: true, ConsecutiveFailures: 1}
+			config.Hedge = cnp.HedgeConfig{Enabled: true, Delay: time.Second}
+
+			p, err := CNP.NewPipelineFromConfig("user-repo", config)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(p.Breaker()).NotTo(BeNil())
+			Expect(p.Bulkhead()).To(BeNil())
+			Expect(p.Hedger().Delay()).To(Equal(time.Second))
+		})
+
+		It("should reject an unknown backoff", func() {
+			config := defaults
+			config.Retry.Backoff = "random"
+
+			_, err := CNP.NewPipelineFromConfig("user-repo", config)
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,145 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned by a function wrapped with RateLimit in RateLimitReject mode when no capacity is left.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// Limiter decides whether a call may proceed.
+type Limiter interface {
+	// Reserve consumes capacity for one call and returns true if there is some left.
+	// Otherwise it returns false and how long to wait before capacity may be available again.
+	Reserve() (ok bool, wait time.Duration)
+}
+
+// RateLimitMode decides what RateLimit does when the limiter has no capacity left.
+type RateLimitMode int
+
+const (
+	// RateLimitReject fails the call right away with ErrRateLimited.
+	RateLimitReject RateLimitMode = iota
+	// RateLimitWait blocks the call until capacity is available or ctx is done.
+	RateLimitWait
+)
+
+// RateLimit wraps cnf so that it is called only when limiter has capacity left.
+// What happens otherwise is decided by mode.
+func (cnp *CNP) RateLimit(cnf CloudNativeFunction, limiter Limiter, mode RateLimitMode) CloudNativeFunction {
+	return func(ctx context.Context) error {
+		for {
+			ok, wait := limiter.Reserve()
+			if ok {
+				return cnf(ctx)
+			}
+
+			if mode == RateLimitReject {
+				return ErrRateLimited
+			}
+
+			timer := cnp.Clock.Timer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// TokenBucket is a Limiter that refills Rate tokens per second up to Burst tokens. Each call takes one token.
+type TokenBucket struct {
+	cnp   *CNP
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full TokenBucket. The refill is measured with cnp.Clock.
+func (cnp *CNP) NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		cnp:    cnp,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   cnp.Clock.Now(),
+	}
+}
+
+func (tb *TokenBucket) Reserve() (bool, time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := tb.cnp.Clock.Now()
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+
+	if tb.rate <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+
+	return false, time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// SlidingWindow is a Limiter that allows at most Limit calls in any Window long period.
+// It remembers the time of the last Limit calls.
+type SlidingWindow struct {
+	cnp    *CNP
+	limit  int
+	window time.Duration
+
+	mu    sync.Mutex
+	calls []time.Time // ring buffer of the last limit calls
+	next  int
+}
+
+// NewSlidingWindow creates an empty SlidingWindow. The window is measured with cnp.Clock.
+func (cnp *CNP) NewSlidingWindow(limit int, window time.Duration) *SlidingWindow {
+	return &SlidingWindow{
+		cnp:    cnp,
+		limit:  limit,
+		window: window,
+		calls:  make([]time.Time, 0, limit),
+	}
+}
+
+func (sw *SlidingWindow) Reserve() (bool, time.Duration) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if sw.limit <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+
+	now := sw.cnp.Clock.Now()
+
+	if len(sw.calls) < sw.limit {
+		sw.calls = append(sw.calls, now)
+		return true, 0
+	}
+
+	// The oldest remembered call is the one that is overwritten next
+	oldest := sw.calls[sw.next]
+	if elapsed := now.Sub(oldest); elapsed < sw.window {
+		return false, sw.window - elapsed
+	}
+
+	sw.calls[sw.next] = now
+	sw.next = (sw.next + 1) % sw.limit
+
+	return true, 0
+}
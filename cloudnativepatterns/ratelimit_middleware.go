@@ -0,0 +1,230 @@
+package cloudnativepatterns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyFunc returns the key that identifies the client of a request, e.g. its IP.
+// Requests with the same key share a limiter. An empty key falls back to KeyByIP.
+// The keys of KeyByIP, KeyByHeader and KeyByJWTSubject are prefixed with their kind ("ip:", "key:" and "sub:"), so
+// that a client can't share the limiter of another one, e.g. by using its IP as an API key: a KeyFunc that mixes
+// several kinds of keys, or falls back to KeyByIP, should prefix its keys too.
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP keys the requests by the IP of the client, prefixed with "ip:".
+// Mount chi's middleware.RealIP before the rate limiter when running behind a proxy.
+func KeyByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// KeyByHeader keys the requests by the value of a header, e.g. an API key in "X-API-Key", prefixed with "key:".
+// The value is a key only once authenticate accepts it: the header is set by the client, which would otherwise get
+// a new limiter, i.e. bypass the limit, by sending a new value with every request. The requests whose value is
+// missing or not accepted are keyed by IP.
+func KeyByHeader(header string, authenticate func(value string) bool) KeyFunc {
+	return func(r *http.Request) string {
+		value := r.Header.Get(header)
+		if value == "" || !authenticate(value) {
+			return ""
+		}
+		return "key:" + value
+	}
+}
+
+// JWTVerifier verifies a JWT and returns its "sub" claim, or false if the token is not valid, e.g. forged or expired.
+type JWTVerifier func(token string) (subject string, ok bool)
+
+// KeyByJWTSubject keys the requests by the "sub" claim of the bearer token in the Authorization header, prefixed with
+// "sub:", once verify accepts the token. Keying on the claims of a token that is not verified would let a client bypass the limit with a
+// new subject in every request. The requests without a valid token are keyed by IP.
+func KeyByJWTSubject(verify JWTVerifier) KeyFunc {
+	return func(r *http.Request) string {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return ""
+		}
+
+		subject, ok := verify(token)
+		if !ok {
+			return ""
+		}
+		return "sub:" + subject
+	}
+}
+
+// NewHS256Verifier returns a JWTVerifier of the tokens signed with HMAC SHA-256 and secret.
+// The "exp" and "nbf" claims, when present, are checked against the clock of cnp.
+// No token is valid while secret is empty, since anybody could sign one.
+func (cnp *CNP) NewHS256Verifier(secret []byte) JWTVerifier {
+	return func(token string) (string, bool) {
+		if len(secret) == 0 {
+			return "", false
+		}
+
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			return "", false
+		}
+
+		var header struct {
+			Algorithm string `json:"alg"`
+		}
+		if !decodeJWTPart(parts[0], &header) || header.Algorithm != "HS256" {
+			return "", false
+		}
+
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return "", false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return "", false
+		}
+
+		var claims struct {
+			Subject   string `json:"sub"`
+			ExpiresAt *int64 `json:"exp"`
+			NotBefore *int64 `json:"nbf"`
+		}
+		if !decodeJWTPart(parts[1], &claims) {
+			return "", false
+		}
+
+		now := cnp.Clock.Now().Unix()
+		if claims.ExpiresAt != nil && now >= *claims.ExpiresAt {
+			return "", false
+		}
+		if claims.NotBefore != nil && now < *claims.NotBefore {
+			return "", false
+		}
+
+		return claims.Subject, true
+	}
+}
+
+// decodeJWTPart decodes the base64url JSON part of a JWT into v.
+func decodeJWTPart(part string, v any) bool {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+// RateLimitMiddlewareSettings configures RateLimitMiddleware.
+type RateLimitMiddlewareSettings struct {
+	// Key identifies the client of a request. Defaults to KeyByIP.
+	Key KeyFunc
+	// NewLimiter creates the limiter of a client the first time it is seen, e.g. a TokenBucket.
+	NewLimiter func() Limiter
+	// IdleTimeout is how long the limiter of a client that sent no requests is remembered. Defaults to 10 minutes.
+	IdleTimeout time.Duration
+	// MaxKeys caps the number of clients whose limiter is remembered. Defaults to 10000.
+	// Once it is reached, the idle clients are forgotten right away, and if there are none, the new clients share
+	// one limiter until some are: they are throttled together rather than let the memory grow without bound.
+	MaxKeys int
+}
+
+type clientLimiter struct {
+	limiter  Limiter
+	lastSeen time.Time
+}
+
+// RateLimitMiddleware returns a chi (net/http) middleware that rejects the requests of clients over their limit
+// with 429 Too Many Requests and a Retry-After header.
+func (cnp *CNP) RateLimitMiddleware(settings RateLimitMiddlewareSettings) func(http.Handler) http.Handler {
+	key := settings.Key
+	if key == nil {
+		key = KeyByIP
+	}
+
+	idleTimeout := settings.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = 10 * time.Minute
+	}
+
+	maxKeys := settings.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = 10000
+	}
+
+	var (
+		mu        sync.Mutex
+		clients   = make(map[string]*clientLimiter)
+		lastSweep = cnp.Clock.Now()
+		overflow  Limiter
+	)
+
+	sweep := func(now time.Time) {
+		for k, c := range clients {
+			if now.Sub(c.lastSeen) >= idleTimeout {
+				delete(clients, k)
+			}
+		}
+		lastSweep = now
+	}
+
+	limiterFor := func(k string) Limiter {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := cnp.Clock.Now()
+
+		// Forget the idle clients once in a while so that the map doesn't grow forever
+		if now.Sub(lastSweep) >= idleTimeout {
+			sweep(now)
+		}
+
+		c, ok := clients[k]
+		if !ok {
+			if len(clients) >= maxKeys {
+				sweep(now)
+			}
+			if len(clients) >= maxKeys {
+				if overflow == nil {
+					overflow = settings.NewLimiter()
+				}
+				return overflow
+			}
+
+			c = &clientLimiter{limiter: settings.NewLimiter()}
+			clients[k] = c
+		}
+		c.lastSeen = now
+
+		return c.limiter
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k := key(r)
+			if k == "" {
+				k = KeyByIP(r)
+			}
+
+			if ok, wait := limiterFor(k).Reserve(); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("RateLimit", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+	)
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+	})
+
+	noop := func(ctx context.Context) error { return nil }
+
+	Context("TokenBucket", func() {
+		It("should allow a burst and then refill over time", func() {
+			tb := CNP.NewTokenBucket(2, 3) // 2 tokens per second, burst of 3
+
+			for i := 0; i < 3; i++ {
+				ok, _ := tb.Reserve()
+				Expect(ok).To(BeTrue())
+			}
+
+			ok, wait := tb.Reserve()
+			Expect(ok).To(BeFalse())
+			Expect(wait).To(Equal(500 * time.Millisecond))
+
+			mockclock.Add(500 * time.Millisecond)
+			ok, _ = tb.Reserve()
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("SlidingWindow", func() {
+		It("should allow at most limit calls in any window", func() {
+			sw := CNP.NewSlidingWindow(2, time.Minute)
+
+			ok, _ := sw.Reserve()
+			Expect(ok).To(BeTrue())
+			mockclock.Add(20 * time.Second)
+			ok, _ = sw.Reserve()
+			Expect(ok).To(BeTrue())
+
+			ok, wait := sw.Reserve()
+			Expect(ok).To(BeFalse())
+			Expect(wait).To(Equal(40 * time.Second))
+
+			mockclock.Add(40 * time.Second)
+			ok, _ = sw.Reserve()
+			Expect(ok).To(BeTrue())
+
+			// The second call is still in the window
+			ok, wait = sw.Reserve()
+			Expect(ok).To(BeFalse())
+			Expect(wait).To(Equal(20 * time.Second))
+		})
+	})
+
+	Context("RateLimit", func() {
+		It("should reject calls in reject mode", func() {
+			r := CNP.RateLimit(noop, CNP.NewTokenBucket(1, 1), cnp.RateLimitReject)
+
+			Expect(r(context.Background())).To(Succeed())
+			Expect(r(context.Background())).To(MatchError(cnp.ErrRateLimited))
+		})
+
+		It("should wait for capacity in wait mode", func() {
+			r := CNP.RateLimit(noop, CNP.NewTokenBucket(1, 1), cnp.RateLimitWait)
+			Expect(r(context.Background())).To(Succeed())
+
+			errCh := make(chan error)
+			go func() { errCh <- r(context.Background()) }()
+			Consistently(errCh).ShouldNot(Receive())
+
+			mockclock.Add(time.Second)
+			Eventually(errCh).Should(Receive(BeNil()))
+		})
+
+		It("should stop waiting when the context is cancelled", func() {
+			r := CNP.RateLimit(noop, CNP.NewTokenBucket(1, 1), cnp.RateLimitWait)
+			Expect(r(context.Background())).To(Succeed())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			errCh := make(chan error)
+			go func() { errCh <- r(ctx) }()
+
+			cancel()
+			Eventually(errCh).Should(Receive(MatchError(context.Canceled)))
+		})
+	})
+
+	Context("RateLimitMiddleware", func() {
+		var ts *httptest.Server
+
+		BeforeEach(func() {
+			mw := CNP.RateLimitMiddleware(cnp.RateLimitMiddlewareSettings{
+				Key: cnp.KeyByHeader("X-API-Key", func(value string) bool {
+					return value == "a" || value == "b"
+				}),
+				NewLimiter: func() cnp.Limiter {
+					return CNP.NewTokenBucket(1, 1)
+				},
+				MaxKeys: 3,
+			})
+			ts = httptest.NewServer(mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})))
+		})
+
+		AfterEach(func() {
+			ts.Close()
+		})
+
+		get := func(apiKey string) *http.Response {
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("X-API-Key", apiKey)
+
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			res.Body.Close()
+
+			return res
+		}
+
+		It("should reject the requests of a client over its limit with 429", func() {
+			Expect(get("a").StatusCode).To(Equal(http.StatusOK))
+
+			res := get("a")
+			Expect(res.StatusCode).To(Equal(http.StatusTooManyRequests))
+			Expect(res).To(HaveHTTPHeaderWithValue("Retry-After", "1"))
+
+			// Other clients have their own limiter
+			Expect(get("b").StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("should key the requests with an unknown API key by IP", func() {
+			// A new key per request doesn't get a new limiter
+			Expect(get("forged-1").StatusCode).To(Equal(http.StatusOK))
+			Expect(get("forged-2").StatusCode).To(Equal(http.StatusTooManyRequests))
+			Expect(get("").StatusCode).To(Equal(http.StatusTooManyRequests))
+
+			Expect(get("a").StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("should not share the limiter of an IP with an API key equal to it", func() {
+			mw := CNP.RateLimitMiddleware(cnp.RateLimitMiddlewareSettings{
+				Key: cnp.KeyByHeader("X-API-Key", func(value string) bool { return true }),
+				NewLimiter: func() cnp.Limiter {
+					return CNP.NewTokenBucket(1, 1)
+				},
+			})
+			handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			status := func(apiKey string) int {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = "192.0.2.1:1234"
+				if apiKey != "" {
+					req.Header.Set("X-API-Key", apiKey)
+				}
+
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				return rec.Code
+			}
+
+			Expect(status("")).To(Equal(http.StatusOK))
+			Expect(status("192.0.2.1")).To(Equal(http.StatusOK))
+			Expect(status("")).To(Equal(http.StatusTooManyRequests))
+		})
+
+		It("should share a limiter between the new clients once MaxKeys clients are remembered", func() {
+			mw := CNP.RateLimitMiddleware(cnp.RateLimitMiddlewareSettings{
+				Key: func(r *http.Request) string { return r.URL.Query().Get("client") },
+				NewLimiter: func() cnp.Limiter {
+					return CNP.NewTokenBucket(1, 1)
+				},
+				IdleTimeout: time.Minute,
+				MaxKeys:     2,
+			})
+			handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			status := func(client string) int {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?client="+client, nil))
+				return rec.Code
+			}
+
+			Expect(status("a")).To(Equal(http.StatusOK))
+			Expect(status("b")).To(Equal(http.StatusOK))
+
+			// c and d share the overflow limiter
+			Expect(status("c")).To(Equal(http.StatusOK))
+			Expect(status("d")).To(Equal(http.StatusTooManyRequests))
+
+			// Once the clients are idle, they are forgotten to make room for the new ones
+			mockclock.Add(time.Minute)
+			Expect(status("e")).To(Equal(http.StatusOK))
+			Expect(status("f")).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("KeyByJWTSubject", func() {
+		secret := []byte("secret")
+
+		sign := func(secret []byte, claims string) string {
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+			payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+			mac := hmac.New(sha256.New, secret)
+			mac.Write([]byte(header + "." + payload))
+			return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+		}
+
+		key := func(token string) string {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			return cnp.KeyByJWTSubject(CNP.NewHS256Verifier(secret))(req)
+		}
+
+		It("should return the subject of a valid bearer token", func() {
+			Expect(key(sign(secret, `{"sub":"user-1"}`))).To(Equal("sub:user-1"))
+		})
+
+		It("should not accept any token without a secret", func() {
+			_, ok := CNP.NewHS256Verifier(nil)(sign(nil, `{"sub":"user-1"}`))
+			Expect(ok).To(BeFalse())
+		})
+
+		DescribeTable("should return an empty key, i.e. key by IP, without a valid bearer token",
+			func(token func() string) {
+				Expect(key(token())).To(Equal(""))
+			},
+			Entry("no token", func() string { return "" }),
+			Entry("not a JWT", func() string { return "token" }),
+			Entry("forged", func() string { return sign([]byte("other"), `{"sub":"user-1"}`) }),
+			Entry("unsigned", func() string {
+				header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+				payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-1"}`))
+				return header + "." + payload + "."
+			}),
+			Entry("expired", func() string {
+				return sign(secret, fmt.Sprintf(`{"sub":"user-1","exp":%d}`, mockclock.Now().Unix()))
+			}),
+			Entry("not yet valid", func() string {
+				return sign(secret, fmt.Sprintf(`{"sub":"user-1","nbf":%d}`, mockclock.Now().Add(time.Hour).Unix()))
+			}),
+		)
+	})
+})
@@ -6,26 +6,111 @@ import (
 	"time"
 )
 
+// RetryPolicy configures RetryWithPolicy.
+type RetryPolicy struct {
+	// Name identifies the retried operation in the events sent to the listener (see CNP.WithListener).
+	Name string
+	// Retries is the number of retries after the first attempt.
+	Retries int
+	// Backoff decides the wait between attempts. Defaults to no wait.
+	Backoff Backoff
+	// Classifier decides which errors are retried. Defaults to DefaultClassifier.
+	Classifier Classifier
+	// Budget, if set, is consulted before every retry and shared by every function retried with it.
+	Budget *RetryBudget
+	// AttemptTimeout bounds every attempt (see Timeout), so that a single hung attempt cannot use up
+	// the whole deadline of the call. 0 does not bound the attempts.
+	AttemptTimeout time.Duration
+}
+
+// Retry retries cnf up to retries times with a fixed delay between attempts.
+// It is a shorthand for RetryWithPolicy with a ConstantBackoff.
 func (cnp *CNP) Retry(cnf CloudNativeFunction, retries int, delay time.Duration) CloudNativeFunction {
+	return cnp.RetryWithPolicy(cnf, RetryPolicy{
+		Retries: retries,
+		Backoff: ConstantBackoff{Interval: delay},
+	})
+}
+
+// RetryWithPolicy retries cnf up to policy.Retries times, waiting between the attempts as decided by policy.Backoff.
+// The waits use cnp.Clock so that they can be skipped in tests with a mock clock.
+//
+// Errors that policy.Classifier does not consider retryable are returned as they are, without retrying.
+// Once the retries are exhausted, the returned error wraps both ErrRetriesExhausted and the last error.
+// When policy.Budget does not allow another retry, it wraps both ErrRetryBudgetExhausted and the last error.
+//
+// Retry does not wait for a retry that cannot finish before the deadline of ctx, i.e. when the delay plus the duration
+// of the last attempt exceed the time left. It gives up right away with an error wrapping both ErrRetryDeadline
+// and the last error, instead of waiting and failing with context.DeadlineExceeded.
+//
+// Every attempt, retry and give-up is reported to the listener of cnp, see Listener.
+func (cnp *CNP) RetryWithPolicy(cnf CloudNativeFunction, policy RetryPolicy) CloudNativeFunction {
+	backoff := policy.Backoff
+	if backoff == nil {
+		backoff = ConstantBackoff{}
+	}
+
+	classifier := policy.Classifier
+	if classifier == nil {
+		classifier = DefaultClassifier
+	}
+
+	cnf = cnp.Timeout(cnf, policy.AttemptTimeout)
+
 	return func(ctx context.Context) error {
+		var delay time.Duration
+
+		if policy.Budget != nil {
+			policy.Budget.recordCall()
+		}
+
 		for r := 0; ; r++ {
+			attempt := r + 1
+
+			cnp.emit(ctx, Event{Type: EventAttemptStarted, Operation: policy.Name, Attempt: attempt})
+
+			start := cnp.Clock.Now()
 			err := cnf(ctx)
+			elapsed := cnp.Clock.Since(start)
 
 			if err == nil {
+				cnp.emit(ctx, Event{Type: EventAttemptSucceeded, Operation: policy.Name, Attempt: attempt, Duration: elapsed})
 				return nil
 			}
 
-			if r >= retries {
-				return fmt.Errorf("exceeded maximum number of retries: %d", retries)
+			cnp.emit(ctx, Event{Type: EventAttemptFailed, Operation: policy.Name, Attempt: attempt, Err: err, Duration: elapsed})
+
+			if !classifier(err) {
+				return cnp.giveUp(ctx, policy, attempt, err)
+			}
+
+			if r >= policy.Retries {
+				return cnp.giveUp(ctx, policy, attempt, fmt.Errorf("%w: %d: %w", ErrRetriesExhausted, policy.Retries, err))
+			}
+
+			if policy.Budget != nil && !policy.Budget.withdraw() {
+				return cnp.giveUp(ctx, policy, attempt, fmt.Errorf("%w: %w", ErrRetryBudgetExhausted, err))
+			}
+
+			delay = backoff.Delay(attempt, delay)
+
+			// The duration of the last attempt is the best guess of the duration of the next one
+			if deadline, ok := ctx.Deadline(); ok && deadline.Sub(cnp.Clock.Now()) < delay+elapsed {
+				return cnp.giveUp(ctx, policy, attempt, fmt.Errorf("%w: %w", ErrRetryDeadline, err))
 			}
 
-			fmt.Printf("Attempt %d failed at %v; retrying in %v\n", r+1, cnp.Clock.Now(), delay)
+			cnp.emit(ctx, Event{Type: EventRetryScheduled, Operation: policy.Name, Attempt: attempt + 1, Delay: delay})
 
 			select {
 			case <-cnp.Clock.After(delay):
 			case <-ctx.Done():
-				return ctx.Err()
+				return cnp.giveUp(ctx, policy, attempt, ctx.Err())
 			}
 		}
 	}
 }
+
+func (cnp *CNP) giveUp(ctx context.Context, policy RetryPolicy, attempt int, err error) error {
+	cnp.emit(ctx, Event{Type: EventGaveUp, Operation: policy.Name, Attempt: attempt, Err: err})
+	return err
+}
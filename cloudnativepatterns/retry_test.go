@@ -0,0 +1,191 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("Retry", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+		doneCh    chan struct{}
+	)
+
+	dummyError := errors.New("dummy error")
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+		doneCh = make(chan struct{})
+
+		// Run a separate goroutine to increase the time
+		go func(doneCh chan struct{}, mockclock *clock.Mock) {
+			for {
+				select {
+				case <-doneCh:
+					return
+				default:
+					mockclock.Add(100 * time.Millisecond)
+				}
+			}
+		}(doneCh, mockclock)
+	})
+
+	AfterEach(func() {
+		close(doneCh)
+	})
+
+	It("should stop retrying once the function succeeds", func() {
+		calls := 0
+		r := CNP.Retry(func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return dummyError
+			}
+			return nil
+		}, 5, time.Second)
+
+		Expect(r(context.Background())).To(Succeed())
+		Expect(calls).To(Equal(3))
+	})
+
+	It("should wait as decided by the backoff policy", func() {
+		var attempts []time.Time
+		r := CNP.RetryWithPolicy(func(ctx context.Context) error {
+			attempts = append(attempts, mockclock.Now())
+			return dummyError
+		}, cnp.RetryPolicy{
+			Retries: 3,
+			Backoff: cnp.ExponentialBackoff{Base: time.Second},
+		})
+
+		Expect(r(context.Background())).To(HaveOccurred())
+		Expect(attempts).To(HaveLen(4))
+		Expect(attempts[1].Sub(attempts[0])).To(BeNumerically(">=", 1*time.Second))
+		Expect(attempts[2].Sub(attempts[1])).To(BeNumerically(">=", 2*time.Second))
+		Expect(attempts[3].Sub(attempts[2])).To(BeNumerically(">=", 4*time.Second))
+	})
+	It("should not retry a permanent error", func() {
+		calls := 0
+		r := CNP.Retry(func(ctx context.Context) error {
+			calls++
+			return cnp.Permanent(dummyError)
+		}, 3, time.Second)
+
+		err := r(context.Background())
+		Expect(err).To(MatchError(dummyError))
+		Expect(cnp.IsPermanent(err)).To(BeTrue())
+		Expect(calls).To(Equal(1))
+	})
+
+	It("should not retry an error rejected by the classifier", func() {
+		calls := 0
+		r := CNP.RetryWithPolicy(func(ctx context.Context) error {
+			calls++
+			return dummyError
+		}, cnp.RetryPolicy{
+			Retries:    3,
+			Classifier: func(err error) bool { return !errors.Is(err, dummyError) },
+		})
+
+		Expect(r(context.Background())).To(MatchError(dummyError))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("should wrap the last error once the retries are exhausted", func() {
+		r := CNP.Retry(func(ctx context.Context) error {
+			return dummyError
+		}, 2, time.Second)
+
+		err := r(context.Background())
+		Expect(err).To(MatchError(cnp.ErrRetriesExhausted))
+		Expect(err).To(MatchError(dummyError))
+	})
+})
+
+var _ = Describe("Retry with a deadline", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+		ctx       context.Context
+		cancel    context.CancelFunc
+	)
+
+	dummyError := errors.New("dummy error")
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+	})
+
+	AfterEach(func() {
+		if cancel != nil {
+			cancel()
+		}
+	})
+
+	It("should give up with the last error when the deadline is before the next attempt", func() {
+		ctx, cancel = mockclock.WithTimeout(context.Background(), 500*time.Millisecond)
+
+		calls := 0
+		err := CNP.Retry(func(ctx context.Context) error {
+			calls++
+			return dummyError
+		}, 3, time.Second)(ctx)
+
+		Expect(err).To(MatchError(cnp.ErrRetryDeadline))
+		Expect(err).To(MatchError(dummyError))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("should account for the duration of the last attempt", func() {
+		ctx, cancel = mockclock.WithTimeout(context.Background(), 1500*time.Millisecond)
+
+		calls := 0
+		err := CNP.Retry(func(ctx context.Context) error {
+			calls++
+			// 900ms are left after this attempt, not enough for 1s of delay and another 600ms attempt
+			mockclock.Add(600 * time.Millisecond)
+			return dummyError
+		}, 3, time.Second)(ctx)
+
+		Expect(err).To(MatchError(cnp.ErrRetryDeadline))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("should time out a hung attempt and retry it", func() {
+		var calls int64
+		started := make(chan struct{})
+
+		r := cnp.RetryWithPolicyT(CNP, func(ctx context.Context) (string, error) {
+			if atomic.AddInt64(&calls, 1) == 1 {
+				close(started)
+				<-ctx.Done()
+				return "", ctx.Err()
+			}
+			return "done", nil
+		}, cnp.RetryPolicy{Retries: 1, AttemptTimeout: time.Second})
+
+		resCh := make(chan string)
+		go func() {
+			defer GinkgoRecover()
+			v, err := r(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			resCh <- v
+		}()
+
+		<-started
+		mockclock.Add(time.Second)
+
+		Eventually(resCh).Should(Receive(Equal("done")))
+		Expect(atomic.LoadInt64(&calls)).To(Equal(int64(2)))
+	})
+})
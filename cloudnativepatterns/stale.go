@@ -0,0 +1,152 @@
+package cloudnativepatterns
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// StaleCacheSettings configures a StaleCache.
+type StaleCacheSettings struct {
+	// Name identifies the cache in the events sent to the listener, e.g. "user".
+	Name string
+	// TTL is how long a result can be served stale after it was remembered. Defaults to 1m.
+	TTL time.Duration
+	// MaxEntries bounds the number of remembered results, the least recently used ones are evicted first. Defaults to 1000.
+	MaxEntries int
+	// IsFailure decides which errors are masked with a stale result.
+	// Defaults to every error that is neither permanent (see Permanent) nor context.Canceled.
+	IsFailure func(err error) bool
+}
+
+// StaleCache remembers the last successful result per key, so that it can be served when the dependency fails.
+// See ServeStale.
+type StaleCache struct {
+	settings StaleCacheSettings
+	cnp      *CNP
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type staleEntry struct {
+	key      string
+	value    any
+	storedAt time.Time
+}
+
+// NewStaleCache creates an empty StaleCache whose TTL is measured with cnp.Clock.
+func (cnp *CNP) NewStaleCache(settings StaleCacheSettings) *StaleCache {
+	if settings.TTL <= 0 {
+		settings.TTL = time.Minute
+	}
+
+	if settings.MaxEntries <= 0 {
+		settings.MaxEntries = 1000
+	}
+
+	if settings.IsFailure == nil {
+		settings.IsFailure = func(err error) bool {
+			return !IsPermanent(err) && !errors.Is(err, context.Canceled)
+		}
+	}
+
+	return &StaleCache{
+		settings: settings,
+		cnp:      cnp,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Set remembers value under key.
+func (c *StaleCache) Set(key string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &staleEntry{key: key, value: value, storedAt: c.cnp.Clock.Now()}
+
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+
+	if c.lru.Len() > c.settings.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Get returns the value remembered under key, unless it is older than the TTL.
+func (c *StaleCache) Get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*staleEntry)
+	if c.cnp.Clock.Since(entry.storedAt) > c.settings.TTL {
+		c.remove(e)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+	return entry.value, true
+}
+
+// Delete forgets the value remembered under key, e.g. once it has been deleted from the dependency.
+func (c *StaleCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+// Len returns the number of remembered values, expired ones included.
+func (c *StaleCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// remove must be called with c.mu held.
+func (c *StaleCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*staleEntry).key)
+}
+
+// ServeStale wraps fn so that its successful result is remembered in cache under key,
+// and served instead of the error when fn fails with an error for which StaleCacheSettings.IsFailure returns true.
+// Without a remembered result, the error is returned. Serving a stale result is reported to the listener, see Listener.
+func ServeStale[T any](cache *StaleCache, key string, fn TypedFunction[T]) TypedFunction[T] {
+	return FallbackT(func(ctx context.Context) (T, error) {
+		v, err := fn(ctx)
+		if err == nil {
+			cache.Set(key, v)
+		}
+		return v, err
+	}, func(ctx context.Context, err error) (T, error) {
+		if cache.settings.IsFailure(err) {
+			if v, ok := cache.Get(key); ok {
+				if stale, ok := v.(T); ok {
+					cache.cnp.emit(ctx, Event{Type: EventStaleServed, Operation: cache.settings.Name, Err: err})
+					return stale, nil
+				}
+			}
+		}
+
+		var zero T
+		return zero, err
+	})
+}
@@ -0,0 +1,44 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTimeout is returned by a function wrapped with Timeout when it did not return in time.
+// Unlike the context.DeadlineExceeded of the caller's own context, it is retried by DefaultClassifier.
+var ErrTimeout = errors.New("timed out")
+
+// Timeout wraps cnf so that it returns ErrTimeout once timeout has elapsed on cnp.Clock.
+// The context passed to cnf is cancelled at that point. If cnf does not honour its context,
+// it is abandoned and keeps running in the background, so cnf must not write to shared state
+// (see TypedFunction). A zero timeout returns cnf as it is.
+func (cnp *CNP) Timeout(cnf CloudNativeFunction, timeout time.Duration) CloudNativeFunction {
+	if timeout <= 0 {
+		return cnf
+	}
+
+	return func(ctx context.Context) error {
+		tctx, cancel := cnp.Clock.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		// Buffered, so that an abandoned call can still send its result and exit
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- cnf(tctx)
+		}()
+
+		select {
+		case err := <-errCh:
+			return err
+		case <-tctx.Done():
+			// The caller gave up (or its own deadline passed) before our timeout
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("%w after %v", ErrTimeout, timeout)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("Timeout", func() {
+	var (
+		mockclock *clock.Mock
+		CNP       *cnp.CNP
+	)
+
+	BeforeEach(func() {
+		mockclock = clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+	})
+
+	It("should return ErrTimeout and cancel the context once the timeout has elapsed", func() {
+		cancelled := make(chan struct{})
+		t := CNP.Timeout(func(ctx context.Context) error {
+			<-ctx.Done()
+			close(cancelled)
+			return ctx.Err()
+		}, time.Second)
+
+		errCh := make(chan error)
+		go func() { errCh <- t(context.Background()) }()
+
+		Consistently(errCh).ShouldNot(Receive())
+		mockclock.Add(time.Second)
+
+		Eventually(errCh).Should(Receive(MatchError(cnp.ErrTimeout)))
+		Eventually(cancelled).Should(BeClosed())
+	})
+
+	It("should not wait for a function that ignores its context", func() {
+		block := make(chan struct{})
+		defer close(block)
+
+		t := CNP.Timeout(func(ctx context.Context) error {
+			<-block
+			return nil
+		}, time.Second)
+
+		errCh := make(chan error)
+		go func() { errCh <- t(context.Background()) }()
+
+		Consistently(errCh).ShouldNot(Receive())
+		mockclock.Add(time.Second)
+
+		Eventually(errCh).Should(Receive(MatchError(cnp.ErrTimeout)))
+	})
+
+	It("should return the error of the caller's context when it is done first", func() {
+		t := CNP.Timeout(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, time.Minute)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		Expect(t(ctx)).To(MatchError(context.Canceled))
+	})
+})
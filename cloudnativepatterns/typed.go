@@ -0,0 +1,106 @@
+package cloudnativepatterns
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TypedFunction is a CloudNativeFunction that also returns a result.
+//
+// Wrapping a TypedFunction with the *T variants of the patterns (RetryT, CircuitBreakerT etc.) returns the result of
+// the successful attempt, instead of having the function write it into a variable captured by its closure.
+// Such a variable is shared by every attempt, which is racy once attempts run concurrently (e.g. when timed out).
+type TypedFunction[T any] func(context.Context) (T, error)
+
+// typed adapts a pattern written for CloudNativeFunction to a TypedFunction.
+// Every call of the returned function keeps its own result: the first successful attempt publishes its result,
+// later attempts (e.g. an abandoned attempt that succeeds after the pattern has returned) are ignored.
+func typed[T any](fn TypedFunction[T], wrap func(CloudNativeFunction) CloudNativeFunction) TypedFunction[T] {
+	return func(ctx context.Context) (T, error) {
+		var (
+			mu        sync.Mutex
+			result    T
+			published bool
+		)
+
+		err := wrap(func(ctx context.Context) error {
+			v, err := fn(ctx)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !published {
+				result = v
+				published = true
+			}
+
+			return nil
+		})(ctx)
+
+		mu.Lock()
+		defer mu.Unlock()
+		// No attempt may publish once the pattern has returned
+		published = true
+
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+
+		return result, nil
+	}
+}
+
+// TimeoutT is the TypedFunction variant of CNP.Timeout.
+// The result of an abandoned call, which returns after the timeout, is dropped.
+func TimeoutT[T any](cnp CloudNativePatterns, fn TypedFunction[T], timeout time.Duration) TypedFunction[T] {
+	return typed(fn, func(cnf CloudNativeFunction) CloudNativeFunction {
+		return cnp.Timeout(cnf, timeout)
+	})
+}
+
+// RetryT is the TypedFunction variant of CNP.Retry.
+func RetryT[T any](cnp CloudNativePatterns, fn TypedFunction[T], retries int, delay time.Duration) TypedFunction[T] {
+	return typed(fn, func(cnf CloudNativeFunction) CloudNativeFunction {
+		return cnp.Retry(cnf, retries, delay)
+	})
+}
+
+// RetryWithPolicyT is the TypedFunction variant of CNP.RetryWithPolicy.
+func RetryWithPolicyT[T any](cnp CloudNativePatterns, fn TypedFunction[T], policy RetryPolicy) TypedFunction[T] {
+	return typed(fn, func(cnf CloudNativeFunction) CloudNativeFunction {
+		return cnp.RetryWithPolicy(cnf, policy)
+	})
+}
+
+// CircuitBreakerT is the TypedFunction variant of CNP.CircuitBreaker.
+func CircuitBreakerT[T any](cnp CloudNativePatterns, fn TypedFunction[T], breaker *Breaker) TypedFunction[T] {
+	return typed(fn, func(cnf CloudNativeFunction) CloudNativeFunction {
+		return cnp.CircuitBreaker(cnf, breaker)
+	})
+}
+
+// BulkheadT is the TypedFunction variant of CNP.Bulkhead.
+func BulkheadT[T any](cnp CloudNativePatterns, fn TypedFunction[T], bulkhead *Bulkhead) TypedFunction[T] {
+	return typed(fn, func(cnf CloudNativeFunction) CloudNativeFunction {
+		return cnp.Bulkhead(cnf, bulkhead)
+	})
+}
+
+// RateLimitT is the TypedFunction variant of CNP.RateLimit.
+func RateLimitT[T any](cnp CloudNativePatterns, fn TypedFunction[T], limiter Limiter, mode RateLimitMode) TypedFunction[T] {
+	return typed(fn, func(cnf CloudNativeFunction) CloudNativeFunction {
+		return cnp.RateLimit(cnf, limiter, mode)
+	})
+}
+
+// HedgeT is the TypedFunction variant of CNP.Hedge.
+// The result of the first successful attempt is returned, the results of the losers are dropped.
+func HedgeT[T any](cnp CloudNativePatterns, fn TypedFunction[T], hedger *Hedger) TypedFunction[T] {
+	return typed(fn, func(cnf CloudNativeFunction) CloudNativeFunction {
+		return cnp.Hedge(cnf, hedger)
+	})
+}
@@ -0,0 +1,131 @@
+package cloudnativepatterns_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+var _ = Describe("TypedFunction", func() {
+	var CNP *cnp.CNP
+
+	dummyError := errors.New("dummy error")
+
+	BeforeEach(func() {
+		// Timer(0) fires right away on a mock clock, so the retries below don't wait
+		CNP = cnp.NewCloudNativePatterns(clock.NewMock())
+	})
+
+	It("should return the result of the successful attempt", func() {
+		calls := 0
+		r := cnp.RetryT(CNP, func(ctx context.Context) (int, error) {
+			calls++
+			if calls < 3 {
+				return -1, dummyError
+			}
+			return calls * 10, nil
+		}, 3, 0)
+
+		result, err := r(context.Background())
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(result).To(Equal(30))
+	})
+
+	It("should return the zero value and the error when every attempt fails", func() {
+		r := cnp.RetryT(CNP, func(ctx context.Context) (string, error) {
+			return "partial", dummyError
+		}, 2, 0)
+
+		result, err := r(context.Background())
+		Expect(err).To(MatchError(dummyError))
+		Expect(result).To(BeZero())
+	})
+
+	It("should compose the patterns", func() {
+		breaker := CNP.NewBreaker(cnp.BreakerSettings{ConsecutiveFailures: 1, CoolDown: time.Minute})
+		bulkhead := CNP.NewBulkhead(cnp.BulkheadSettings{Name: "typed", MaxConcurrent: 1})
+
+		fn := cnp.TypedFunction[string](func(ctx context.Context) (string, error) {
+			return "ok", nil
+		})
+		fn = cnp.BulkheadT(CNP, fn, bulkhead)
+		fn = cnp.RetryWithPolicyT(CNP, fn, cnp.RetryPolicy{Retries: 1})
+		fn = cnp.CircuitBreakerT(CNP, fn, breaker)
+
+		result, err := fn(context.Background())
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(result).To(Equal("ok"))
+	})
+
+	It("should return the zero value once the timeout has elapsed, and drop the result of the abandoned call", func() {
+		mockclock := clock.NewMock()
+		CNP = cnp.NewCloudNativePatterns(mockclock)
+
+		block := make(chan struct{})
+		returned := make(chan struct{})
+		t := cnp.TimeoutT(CNP, func(ctx context.Context) (int, error) {
+			defer close(returned)
+			<-block
+			return 42, nil
+		}, time.Second)
+
+		type outcome struct {
+			result int
+			err    error
+		}
+		outcomes := make(chan outcome, 1)
+		go func() {
+			result, err := t(context.Background())
+			outcomes <- outcome{result, err}
+		}()
+
+		Consistently(outcomes).ShouldNot(Receive())
+		mockclock.Add(time.Second)
+
+		var o outcome
+		Eventually(outcomes).Should(Receive(&o))
+		Expect(o.err).To(MatchError(cnp.ErrTimeout))
+		Expect(o.result).To(BeZero())
+
+		// The abandoned call still returns its result, too late to be published
+		close(block)
+		Eventually(returned).Should(BeClosed())
+	})
+
+	It("should return the result of a call that completes in time", func() {
+		t := cnp.TimeoutT(CNP, func(ctx context.Context) (string, error) {
+			return "ok", nil
+		}, time.Second)
+
+		result, err := t(context.Background())
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(result).To(Equal("ok"))
+	})
+
+	It("should keep the results of concurrent calls apart", func() {
+		r := cnp.RetryT(CNP, func(ctx context.Context) (int, error) {
+			return ctx.Value(keyType{}).(int), nil
+		}, 0, 0)
+
+		results := make(chan [2]int, 10)
+		for i := 0; i < 10; i++ {
+			go func(i int) {
+				result, _ := r(context.WithValue(context.Background(), keyType{}, i))
+				results <- [2]int{i, result}
+			}(i)
+		}
+
+		for i := 0; i < 10; i++ {
+			var pair [2]int
+			Eventually(results).Should(Receive(&pair))
+			Expect(pair[1]).To(Equal(pair[0]))
+		}
+	})
+})
+
+type keyType struct{}
@@ -2,6 +2,7 @@ package cloudnativepatterns
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/benbjohnson/clock"
@@ -11,25 +12,41 @@ type CloudNativeFunction func(context.Context) error
 
 type CloudNativePatterns interface {
 	Retry(cnf CloudNativeFunction, retries int, delay time.Duration) CloudNativeFunction
+	RetryWithPolicy(cnf CloudNativeFunction, policy RetryPolicy) CloudNativeFunction
+	NewRetryBudget(settings RetryBudgetSettings) *RetryBudget
+	NewBreaker(settings BreakerSettings) *Breaker
+	CircuitBreaker(cnf CloudNativeFunction, breaker *Breaker) CloudNativeFunction
+	NewBulkhead(settings BulkheadSettings) *Bulkhead
+	Bulkhead(cnf CloudNativeFunction, bulkhead *Bulkhead) CloudNativeFunction
+	RateLimit(cnf CloudNativeFunction, limiter Limiter, mode RateLimitMode) CloudNativeFunction
+	NewAdaptiveLimiter(settings AdaptiveLimiterSettings) *AdaptiveLimiter
+	AdaptiveLimit(cnf CloudNativeFunction, limiter *AdaptiveLimiter) CloudNativeFunction
+	Timeout(cnf CloudNativeFunction, timeout time.Duration) CloudNativeFunction
+	NewHedger(settings HedgeSettings) *Hedger
+	Hedge(cnf CloudNativeFunction, hedger *Hedger) CloudNativeFunction
+	Fallback(cnf CloudNativeFunction, fallback FallbackFunc) CloudNativeFunction
+	NewStaleCache(settings StaleCacheSettings) *StaleCache
+	NewCoalescer(name string) *Coalescer
+	Coalesce(cnf CloudNativeFunction, coalescer *Coalescer, key string) CloudNativeFunction
+	NewPipeline(name string) *Pipeline
+	NewPipelineFromConfig(name string, config PolicyConfig) (*Pipeline, error)
+	Pipeline(name string) (*Pipeline, bool)
 }
 
 type CNP struct {
 	Clock clock.Clock
-}
-
-var cnp *CNP
 
-func NewCloudNativePatterns(clock clock.Clock) *CNP {
-	if cnp == nil {
-		cnp = &CNP{
-			Clock: clock,
-		}
-	}
-	return cnp
+	listener  Listener
+	mu        sync.Mutex
+	bulkheads map[string]*Bulkhead
+	pipelines map[string]*Pipeline
 }
 
-func DiscardCloudNativePatterns() {
-	if cnp != nil {
-		cnp = nil
+// NewCloudNativePatterns creates a CNP using clock for every wait, timeout and time measurement.
+// Bulkhead compartments and pipelines are registered per CNP, so every CNP is independent:
+// pass the same CNP around to share them.
+func NewCloudNativePatterns(clock clock.Clock) *CNP {
+	return &CNP{
+		Clock: clock,
 	}
 }
@@ -1,15 +1,41 @@
 package app
 
 import (
+	"context"
+	"time"
+
+	"github.com/benbjohnson/clock"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 	"github.com/go-chi/httplog"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/patilchinmay/go-experiments/cloudnativepatterns/observability"
 	custommiddlewares "github.com/patilchinmay/go-experiments/go-chi-server/app/middlewares"
 	"github.com/rs/zerolog"
+	"github.com/sethvargo/go-envconfig"
 	"gorm.io/gorm"
 )
 
+type RateLimitConfig struct {
+	Enabled   bool     `env:"RATELIMIT_ENABLED,overwrite,default=false"`
+	RPS       float64  `env:"RATELIMIT_RPS,overwrite,default=100"`        // requests per second allowed per client
+	Burst     int      `env:"RATELIMIT_BURST,overwrite,default=200"`      // requests a client can send at once
+	Key       string   `env:"RATELIMIT_KEY,overwrite,default=ip"`         // how clients are identified: ip, apikey (X-API-Key header) or jwt (subject of the bearer token)
+	APIKeys   []string `env:"RATELIMIT_API_KEYS,overwrite"`               // comma separated API keys accepted with RATELIMIT_KEY=apikey, the others are keyed by IP
+	JWTSecret string   `env:"RATELIMIT_JWT_SECRET,overwrite"`             // secret of the HS256 bearer tokens accepted with RATELIMIT_KEY=jwt, the others are keyed by IP
+	MaxKeys   int      `env:"RATELIMIT_MAX_KEYS,overwrite,default=10000"` // clients whose limiter is remembered, the new ones share a limiter beyond
+}
+
+type AdaptiveLimitConfig struct {
+	Enabled          bool          `env:"ADAPTIVE_LIMIT_ENABLED,overwrite,default=false"`
+	Algorithm        string        `env:"ADAPTIVE_LIMIT_ALGORITHM,overwrite,default=gradient"`   // aimd or gradient
+	InitialLimit     int           `env:"ADAPTIVE_LIMIT_INITIAL,overwrite,default=20"`           // concurrent requests allowed before any latency was measured
+	MinLimit         int           `env:"ADAPTIVE_LIMIT_MIN,overwrite,default=1"`                // lower bound of the limit
+	MaxLimit         int           `env:"ADAPTIVE_LIMIT_MAX,overwrite,default=1000"`             // upper bound of the limit
+	LatencyThreshold time.Duration `env:"ADAPTIVE_LIMIT_LATENCY_THRESHOLD,overwrite,default=1s"` // latency above which aimd decreases the limit
+}
+
 type App struct {
 	logger     zerolog.Logger
 	Router     *chi.Mux
@@ -60,6 +86,88 @@ func (a *App) SetupMiddlewares() *App {
 	return a
 }
 
+// SetupRateLimiter sets up a per-client token bucket rate limiter, configured with RATELIMIT_* env vars.
+// It must be called after SetupMiddlewares, so that rejected requests are logged and carry a Request-Id,
+// and before any route is defined.
+func (a *App) SetupRateLimiter() *App {
+	// Uses https://github.com/sethvargo/go-envconfig
+	var config RateLimitConfig
+	if err := envconfig.Process(context.Background(), &config); err != nil {
+		a.logger.Fatal().Err(err).Msg("Failed to override from env vars")
+	}
+
+	if !config.Enabled {
+		return a
+	}
+
+	CNP := cnp.NewCloudNativePatterns(clock.New())
+
+	// The identities sent by the clients are only trusted once authenticated, the others are keyed by IP
+	var key cnp.KeyFunc
+	switch config.Key {
+	case "apikey":
+		apiKeys := make(map[string]bool, len(config.APIKeys))
+		for _, apiKey := range config.APIKeys {
+			apiKeys[apiKey] = true
+		}
+		key = cnp.KeyByHeader("X-API-Key", func(value string) bool { return apiKeys[value] })
+	case "jwt":
+		key = cnp.KeyByJWTSubject(CNP.NewHS256Verifier([]byte(config.JWTSecret)))
+	default:
+		key = cnp.KeyByIP
+	}
+
+	a.Router.Use(CNP.RateLimitMiddleware(cnp.RateLimitMiddlewareSettings{
+		Key: key,
+		NewLimiter: func() cnp.Limiter {
+			return CNP.NewTokenBucket(config.RPS, config.Burst)
+		},
+		IdleTimeout: 10 * time.Minute,
+		MaxKeys:     config.MaxKeys,
+	}))
+
+	a.logger.Debug().Str("key", config.Key).Float64("rps", config.RPS).Int("burst", config.Burst).Msg("Enabled rate limiter")
+
+	return a
+}
+
+// SetupAdaptiveLimiter sets up a concurrency limiter for the whole router whose limit adapts to the latency of the
+// requests, configured with ADAPTIVE_LIMIT_* env vars. The requests over the limit are rejected with 503.
+// Like SetupRateLimiter, it must be called after SetupMiddlewares and before any route is defined.
+func (a *App) SetupAdaptiveLimiter() *App {
+	// Uses https://github.com/sethvargo/go-envconfig
+	var config AdaptiveLimitConfig
+	if err := envconfig.Process(context.Background(), &config); err != nil {
+		a.logger.Fatal().Err(err).Msg("Failed to override from env vars")
+	}
+
+	if !config.Enabled {
+		return a
+	}
+
+	algorithm := cnp.AdaptiveGradient
+	if config.Algorithm == "aimd" {
+		algorithm = cnp.AdaptiveAIMD
+	}
+
+	CNP := cnp.NewCloudNativePatterns(clock.New()).WithListener(observability.NewZerologListener(a.logger, middleware.GetReqID))
+
+	limiter := CNP.NewAdaptiveLimiter(cnp.AdaptiveLimiterSettings{
+		Name:             "http",
+		Algorithm:        algorithm,
+		InitialLimit:     config.InitialLimit,
+		MinLimit:         config.MinLimit,
+		MaxLimit:         config.MaxLimit,
+		LatencyThreshold: config.LatencyThreshold,
+	})
+
+	a.Router.Use(CNP.AdaptiveLimitMiddleware(limiter))
+
+	a.logger.Debug().Str("algorithm", config.Algorithm).Int("initial", config.InitialLimit).Msg("Enabled adaptive concurrency limiter")
+
+	return a
+}
+
 // SetupCORS sets up the CORS middleware
 func (a *App) SetupCORS() *App {
 	// Basic CORS
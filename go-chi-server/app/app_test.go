@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -84,4 +85,108 @@ var _ = Describe("App", func() {
 
 	})
 
+	// Rate limiter
+	Context("Rate limiter", func() {
+		BeforeEach(func() {
+			// Rebuild the app with the rate limiter enabled
+			ts.Close()
+			app.Discard()
+
+			os.Setenv("RATELIMIT_ENABLED", "true")
+			os.Setenv("RATELIMIT_RPS", "1")
+			os.Setenv("RATELIMIT_BURST", "2")
+
+			App = app.GetOrCreate().WithLogger(zerolog.Nop()).SetupCORS().SetupMiddlewares().SetupRateLimiter().SetupNotFoundHandler()
+			ts = httptest.NewServer(App.Router)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("RATELIMIT_ENABLED")
+			os.Unsetenv("RATELIMIT_RPS")
+			os.Unsetenv("RATELIMIT_BURST")
+		})
+
+		It("should return http 429 once the client is over its limit", func() {
+			// DoRequest replaces the context of the options, so create them for every request
+			// /health is answered by the Heartbeat middleware before reaching the rate limiter, so use another path
+			newOpt := func() *testhelpers.HttpOptions {
+				to := time.Duration(10)
+				return &testhelpers.HttpOptions{
+					Ctx:    context.Background(),
+					Url:    ts.URL + "/404",
+					TO:     &to,
+					Method: http.MethodGet,
+				}
+			}
+
+			for i := 0; i < 2; i++ {
+				res, _ := testhelpers.DoRequest(newOpt())
+				Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+			}
+
+			res, _ := testhelpers.DoRequest(newOpt())
+			Expect(res.StatusCode).To(Equal(http.StatusTooManyRequests))
+			Expect(res).To(HaveHTTPHeaderWithValue("Retry-After", "1"))
+		})
+	})
+
+	// Adaptive concurrency limiter
+	Context("Adaptive limiter", func() {
+		var gate chan struct{}
+
+		BeforeEach(func() {
+			// Rebuild the app with the adaptive limiter enabled, and a limit that stays at 1
+			ts.Close()
+			app.Discard()
+
+			os.Setenv("ADAPTIVE_LIMIT_ENABLED", "true")
+			os.Setenv("ADAPTIVE_LIMIT_INITIAL", "1")
+			os.Setenv("ADAPTIVE_LIMIT_MAX", "1")
+
+			App = app.GetOrCreate().WithLogger(zerolog.Nop()).SetupCORS().SetupMiddlewares().SetupAdaptiveLimiter().SetupNotFoundHandler()
+
+			// A route that blocks until the gate is closed, so that a request stays in flight
+			gate = make(chan struct{})
+			g := gate
+			App.Router.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+				<-g
+				w.WriteHeader(http.StatusOK)
+			})
+
+			ts = httptest.NewServer(App.Router)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("ADAPTIVE_LIMIT_ENABLED")
+			os.Unsetenv("ADAPTIVE_LIMIT_INITIAL")
+			os.Unsetenv("ADAPTIVE_LIMIT_MAX")
+		})
+
+		It("should return http 503 once the requests in flight reach the limit", func() {
+			first := make(chan int, 1)
+			go func() {
+				defer GinkgoRecover()
+				res, err := http.Get(ts.URL + "/slow")
+				Expect(err).ShouldNot(HaveOccurred())
+				res.Body.Close()
+				first <- res.StatusCode
+			}()
+
+			// Wait for the first request to be in flight
+			Eventually(func() int {
+				res, err := http.Get(ts.URL + "/404")
+				Expect(err).ShouldNot(HaveOccurred())
+				res.Body.Close()
+				return res.StatusCode
+			}).Should(Equal(http.StatusServiceUnavailable))
+
+			res, err := http.Get(ts.URL + "/404")
+			Expect(err).ShouldNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res).To(HaveHTTPHeaderWithValue("Retry-After", "1"))
+
+			close(gate)
+			Eventually(first).Should(Receive(Equal(http.StatusOK)))
+		})
+	})
 })
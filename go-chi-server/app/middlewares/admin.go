@@ -0,0 +1,32 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/patilchinmay/go-experiments/go-chi-server/utils/problem"
+)
+
+// AdminTokenHeader is the header in which the admins send the ADMIN_TOKEN.
+const AdminTokenHeader = "X-Admin-Token"
+
+// IsAdmin reports whether r was sent by an admin, i.e. carries token in the X-Admin-Token header.
+// No request is an admin's while token is empty.
+func IsAdmin(r *http.Request, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(AdminTokenHeader)), []byte(token)) == 1
+}
+
+// AdminOnly returns a middleware that answers 403 Forbidden to the requests that were not sent by an admin
+// (see IsAdmin), so every request is forbidden while token is empty.
+func AdminOnly(token string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !IsAdmin(r, token) {
+				problem.Write(w, r, problem.New(http.StatusForbidden, "forbidden"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,369 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/patilchinmay/go-experiments/go-chi-server/utils/problem"
+	"github.com/rs/zerolog"
+	"github.com/sethvargo/go-envconfig"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IdempotencyKeyHeader is the header a client sets to make a request idempotent.
+// https://datatracker.ietf.org/doc/draft-ietf-httpapi-idempotency-key-header/
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength is the maximum length of an idempotency key, e.g. a UUID is 36 characters long.
+const maxIdempotencyKeyLength = 255
+
+type IdempotencyConfig struct {
+	TTL           time.Duration `env:"IDEMPOTENCY_TTL,overwrite,default=24h"`                // how long the response to a key is replayed
+	LockTimeout   time.Duration `env:"IDEMPOTENCY_LOCK_TIMEOUT,overwrite,default=1m"`        // how long a request holds its key before a retry can take it over, longer than the slowest request
+	MaxBodyBytes  int64         `env:"IDEMPOTENCY_MAX_BODY_BYTES,overwrite,default=1048576"` // the largest request body that is hashed, 413 above
+	PurgeInterval time.Duration `env:"IDEMPOTENCY_PURGE_INTERVAL,overwrite,default=1h"`      // how often the expired keys are deleted, 0 for never
+}
+
+// IdempotencyRecord is a request made with an idempotency key, and its response once completed.
+type IdempotencyRecord struct {
+	Key         string    `gorm:"column:idempotency_key;primaryKey;size:255"`
+	RequestHash string    `gorm:"not null"`
+	Completed   bool      `gorm:"not null;default:false"`
+	LockedUntil time.Time // the end of the lease of the request in progress, see Idempotency.LockTimeout
+	StatusCode  int
+	Header      []byte // JSON-encoded http.Header
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time `gorm:"not null;index"`
+}
+
+func (IdempotencyRecord) TableName() string {
+	return "idempotency_keys"
+}
+
+// Idempotency is a middleware that makes the requests with an Idempotency-Key header safe to retry: the response to
+// the first request is stored with the key, and replayed to the next requests with the same key, without calling the
+// handler again. The requests without the header are passed through.
+type Idempotency struct {
+	*IdempotencyConfig
+	db     *gorm.DB
+	clock  clock.Clock
+	logger zerolog.Logger
+}
+
+// NewIdempotency creates the Idempotency middleware, configured with IDEMPOTENCY_* env vars.
+// The keys are stored in db, whose table is migrated if automigrate is true.
+func NewIdempotency(db *gorm.DB, automigrate bool) *Idempotency {
+	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+
+	// Set defaults with env vars
+	// Uses https://github.com/sethvargo/go-envconfig
+	config := &IdempotencyConfig{}
+	if err := envconfig.Process(context.Background(), config); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to override from env vars")
+	}
+
+	if automigrate {
+		// automigrate the idempotency_keys table
+		db.AutoMigrate(&IdempotencyRecord{})
+	}
+
+	return &Idempotency{
+		IdempotencyConfig: config,
+		db:                db,
+		clock:             clock.New(),
+		logger:            logger,
+	}
+}
+
+// WithLogger sets the logger using builder pattern
+func (i *Idempotency) WithLogger(logger zerolog.Logger) *Idempotency {
+	i.logger = logger
+	return i
+}
+
+// WithClock sets the clock the keys expire with using builder pattern
+func (i *Idempotency) WithClock(clock clock.Clock) *Idempotency {
+	i.clock = clock
+	return i
+}
+
+// WithTTL sets how long the response to a key is replayed using builder pattern
+func (i *Idempotency) WithTTL(ttl time.Duration) *Idempotency {
+	i.TTL = ttl
+	return i
+}
+
+// WithLockTimeout sets how long a request holds its key using builder pattern
+func (i *Idempotency) WithLockTimeout(lockTimeout time.Duration) *Idempotency {
+	i.LockTimeout = lockTimeout
+	return i
+}
+
+// WithMaxBodyBytes sets the largest request body with a key using builder pattern
+func (i *Idempotency) WithMaxBodyBytes(maxBodyBytes int64) *Idempotency {
+	i.MaxBodyBytes = maxBodyBytes
+	return i
+}
+
+// Run deletes the expired keys every PurgeInterval, until ctx is done. It returns right away if PurgeInterval is 0.
+// It is blocking, so run it on a separate goroutine.
+func (i *Idempotency) Run(ctx context.Context) {
+	if i.PurgeInterval <= 0 {
+		return
+	}
+
+	ticker := i.clock.Ticker(i.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// A failed purge is retried at the next tick
+			_, _ = i.PurgeExpired(ctx)
+		}
+	}
+}
+
+// PurgeExpired deletes the expired keys, and returns how many were deleted.
+// An expired key is forgotten when it is reused anyway, so this only keeps the table from growing.
+func (i *Idempotency) PurgeExpired(ctx context.Context) (int64, error) {
+	result := i.db.WithContext(ctx).Where("expires_at <= ?", i.clock.Now()).Delete(&IdempotencyRecord{})
+	if result.Error != nil {
+		i.logger.Error().Err(result.Error).Msg("Failed to purge the expired idempotency keys")
+		return 0, result.Error
+	}
+
+	i.logger.Debug().Int64("purged", result.RowsAffected).Msg("Purged the expired idempotency keys")
+
+	return result.RowsAffected, nil
+}
+
+// Handler is the middleware. A repeated key is answered with:
+//   - the stored response, with an Idempotent-Replayed header, if the first request has completed
+//   - 409 Conflict if the first request is still in progress
+//   - the response of the handler, called again, if the first request is in progress for longer than LockTimeout,
+//     i.e. it will likely never complete (e.g. the process crashed), so that the key can still be retried before its TTL
+//   - 422 Unprocessable Entity if the request (method, path and body) differs from the first one
+//
+// A body larger than MaxBodyBytes is answered with 413 Request Entity Too Large, since it is read in memory to be hashed.
+//
+// A 5xx response is not stored, so that the request can be retried with the same key.
+func (i *Idempotency) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			problem.Write(w, r, problem.New(http.StatusBadRequest, "Idempotency-Key is too long"))
+			return
+		}
+
+		// The body is hashed, and given back to the handler
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, i.MaxBodyBytes))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				problem.Write(w, r, problem.New(http.StatusRequestEntityTooLarge, fmt.Sprintf("the request body is larger than %d bytes", maxBytesErr.Limit)))
+				return
+			}
+			problem.Write(w, r, problem.New(http.StatusBadRequest, "failed to read the request body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := requestHash(r, body)
+
+		record, claimed, err := i.claim(r.Context(), key, hash)
+		if err != nil {
+			i.logger.Error().Err(err).Str("key", key).Msg("Failed to claim the idempotency key")
+			problem.Write(w, r, problem.New(http.StatusInternalServerError, ""))
+			return
+		}
+
+		if !claimed {
+			i.replay(w, r, record, hash)
+			return
+		}
+
+		// The response is stored even if the client has gone away meanwhile, since its retry would be replayed
+		ctx := context.WithoutCancel(r.Context())
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			// The handler failed or panicked: release the key, so that the request can be retried
+			if !completed {
+				i.release(ctx, key)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status >= http.StatusInternalServerError {
+			return
+		}
+
+		if err := i.complete(ctx, key, rec); err != nil {
+			i.logger.Error().Err(err).Str("key", key).Msg("Failed to store the response of the idempotency key")
+			return
+		}
+		completed = true
+	})
+}
+
+// claim stores key as in progress, unless it is already stored, in which case it returns the stored record.
+// The same request takes over a key whose lease has expired.
+func (i *Idempotency) claim(ctx context.Context, key, hash string) (IdempotencyRecord, bool, error) {
+	db := i.db.WithContext(ctx)
+	now := i.clock.Now()
+
+	// Forget the key if it has expired, so that it can be reused. The other expired keys are deleted by Run.
+	if err := db.Where("idempotency_key = ? AND expires_at <= ?", key, now).Delete(&IdempotencyRecord{}).Error; err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	record := IdempotencyRecord{
+		Key:         key,
+		RequestHash: hash,
+		LockedUntil: now.Add(i.LockTimeout),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(i.TTL),
+	}
+
+	// Concurrent requests with the same key race on the primary key: only one inserts the record
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	if result.Error != nil {
+		return IdempotencyRecord{}, false, result.Error
+	}
+
+	if result.RowsAffected == 1 {
+		return record, true, nil
+	}
+
+	// The request in progress may never complete, e.g. if the process crashed: once its lease has expired, the
+	// same request takes the key over. Concurrent retries race on the lease: only one renews it.
+	result = db.Model(&IdempotencyRecord{}).
+		Where("idempotency_key = ? AND request_hash = ? AND completed = ? AND locked_until <= ?", key, hash, false, now).
+		Update("locked_until", record.LockedUntil)
+	if result.Error != nil {
+		return IdempotencyRecord{}, false, result.Error
+	}
+
+	var existing IdempotencyRecord
+	if err := db.First(&existing, "idempotency_key = ?", key).Error; err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	if result.RowsAffected == 1 {
+		i.logger.Warn().Str("key", key).Msg("Took over an idempotency key whose request did not complete in time")
+		return existing, true, nil
+	}
+
+	return existing, false, nil
+}
+
+// replay answers r with the response stored in record.
+func (i *Idempotency) replay(w http.ResponseWriter, r *http.Request, record IdempotencyRecord, hash string) {
+	if record.RequestHash != hash {
+		problem.Write(w, r, problem.New(http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request"))
+		return
+	}
+
+	if !record.Completed {
+		w.Header().Set("Retry-After", "1")
+		problem.Write(w, r, problem.New(http.StatusConflict, "a request with the same Idempotency-Key is in progress"))
+		return
+	}
+
+	var header http.Header
+	if err := json.Unmarshal(record.Header, &header); err != nil {
+		i.logger.Error().Err(err).Str("key", record.Key).Msg("Failed to decode the stored response")
+		problem.Write(w, r, problem.New(http.StatusInternalServerError, ""))
+		return
+	}
+
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.StatusCode)
+	w.Write(record.Body)
+}
+
+// complete stores the response recorded by rec with key.
+func (i *Idempotency) complete(ctx context.Context, key string, rec *responseRecorder) error {
+	// The Request-ID is the one of the first request, not of the replays
+	header := rec.Header().Clone()
+	header.Del("Request-ID")
+
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	return i.db.WithContext(ctx).Model(&IdempotencyRecord{}).Where("idempotency_key = ?", key).Updates(map[string]any{
+		"completed":   true,
+		"status_code": rec.status,
+		"header":      encoded,
+		"body":        rec.body.Bytes(),
+	}).Error
+}
+
+// release forgets key.
+func (i *Idempotency) release(ctx context.Context, key string) {
+	if err := i.db.WithContext(ctx).Where("idempotency_key = ?", key).Delete(&IdempotencyRecord{}).Error; err != nil {
+		i.logger.Error().Err(err).Str("key", key).Msg("Failed to release the idempotency key")
+	}
+}
+
+// requestHash identifies a request by its method, path and body.
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder writes the response through, and records its status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying http.ResponseWriter.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,218 @@
+package middlewares_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/middlewares"
+	"github.com/rs/zerolog"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var _ = Describe("Idempotency", func() {
+	var (
+		ts          *httptest.Server
+		idempotency *middlewares.Idempotency
+		gdb         *gorm.DB
+		mockclock   *clock.Mock
+		calls       atomic.Int32
+		status      int
+		gate        chan struct{}
+		started     chan struct{}
+	)
+
+	BeforeEach(func() {
+		// When the name of the database file handed to sqlite3_open() or to ATTACH is an empty string, then a new temporary file is created to hold the database.
+		// https://www.sqlite.org/inmemorydb.html
+		var err error
+		gdb, err = gorm.Open(sqlite.Open(""), &gorm.Config{})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		mockclock = clock.NewMock()
+		calls.Store(0)
+		status = http.StatusCreated
+		gate = nil
+		started = make(chan struct{}, 1)
+
+		idempotency = middlewares.NewIdempotency(gdb, true).WithLogger(zerolog.Nop()).WithClock(mockclock).WithTTL(time.Hour).WithLockTimeout(time.Minute)
+
+		// The handler echoes the body, and counts its calls
+		ts = httptest.NewServer(idempotency.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// A gated request waits in the handler, as if it were slow
+			if gate != nil {
+				started <- struct{}{}
+				<-gate
+			}
+			n := calls.Add(1)
+			body, _ := io.ReadAll(r.Body)
+
+			w.Header().Set("X-Call", string(rune('0'+n)))
+			w.WriteHeader(status)
+			w.Write(body)
+		})))
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	// post sends body with key, and returns the response and its body
+	post := func(key, body string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/user", strings.NewReader(body))
+		Expect(err).ShouldNot(HaveOccurred())
+		if key != "" {
+			req.Header.Set(middlewares.IdempotencyKeyHeader, key)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer res.Body.Close()
+
+		b, err := io.ReadAll(res.Body)
+		Expect(err).ShouldNot(HaveOccurred())
+		return res, string(b)
+	}
+
+	It("should replay the stored response to a repeated key", func() {
+		res, body := post("key-1", `{"firstname": "abc"}`)
+		Expect(res.StatusCode).To(Equal(http.StatusCreated))
+		Expect(body).To(Equal(`{"firstname": "abc"}`))
+
+		res, body = post("key-1", `{"firstname": "abc"}`)
+		Expect(res.StatusCode).To(Equal(http.StatusCreated))
+		Expect(body).To(Equal(`{"firstname": "abc"}`))
+		Expect(res).To(HaveHTTPHeaderWithValue("X-Call", "1"))
+		Expect(res).To(HaveHTTPHeaderWithValue("Idempotent-Replayed", "true"))
+
+		Expect(calls.Load()).To(Equal(int32(1)))
+	})
+
+	It("should pass the requests without a key through", func() {
+		post("", `{}`)
+		post("", `{}`)
+		Expect(calls.Load()).To(Equal(int32(2)))
+	})
+
+	It("should return 422 when a key is reused with a different body", func() {
+		post("key-1", `{"firstname": "abc"}`)
+
+		res, _ := post("key-1", `{"firstname": "xyz"}`)
+		Expect(res.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+		Expect(calls.Load()).To(Equal(int32(1)))
+	})
+
+	It("should return 409 while the first request with a key is in progress", func() {
+		gate = make(chan struct{})
+
+		first := make(chan int, 1)
+		go func() {
+			defer GinkgoRecover()
+			res, _ := post("key-1", `{}`)
+			first <- res.StatusCode
+		}()
+
+		Eventually(started).Should(Receive())
+
+		res, _ := post("key-1", `{}`)
+		Expect(res.StatusCode).To(Equal(http.StatusConflict))
+		Expect(res).To(HaveHTTPHeaderWithValue("Retry-After", "1"))
+
+		close(gate)
+		Eventually(first).Should(Receive(Equal(http.StatusCreated)))
+	})
+
+	It("should let the same request take over a key whose first request did not complete in time", func() {
+		gate = make(chan struct{})
+		started = make(chan struct{}, 2)
+
+		// The first request hangs, as if its process had crashed
+		first := make(chan int, 1)
+		go func() {
+			defer GinkgoRecover()
+			res, _ := post("key-1", `{}`)
+			first <- res.StatusCode
+		}()
+		Eventually(started).Should(Receive())
+
+		// A different request can't take it over
+		mockclock.Add(time.Minute)
+		res, _ := post("key-1", `{"firstname": "xyz"}`)
+		Expect(res.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+
+		second := make(chan int, 1)
+		go func() {
+			defer GinkgoRecover()
+			res, _ := post("key-1", `{}`)
+			second <- res.StatusCode
+		}()
+		Eventually(started).Should(Receive())
+
+		// The lease was renewed by the second request
+		res, _ = post("key-1", `{}`)
+		Expect(res.StatusCode).To(Equal(http.StatusConflict))
+
+		close(gate)
+		Eventually(first).Should(Receive(Equal(http.StatusCreated)))
+		Eventually(second).Should(Receive(Equal(http.StatusCreated)))
+		Expect(calls.Load()).To(Equal(int32(2)))
+	})
+
+	It("should not store a server error, so that the request can be retried", func() {
+		status = http.StatusInternalServerError
+		res, _ := post("key-1", `{}`)
+		Expect(res.StatusCode).To(Equal(http.StatusInternalServerError))
+
+		status = http.StatusCreated
+		res, _ = post("key-1", `{}`)
+		Expect(res.StatusCode).To(Equal(http.StatusCreated))
+		Expect(calls.Load()).To(Equal(int32(2)))
+	})
+
+	It("should forget the keys after the TTL", func() {
+		post("key-1", `{"firstname": "abc"}`)
+
+		mockclock.Add(time.Hour)
+
+		res, _ := post("key-1", `{"firstname": "xyz"}`)
+		Expect(res.StatusCode).To(Equal(http.StatusCreated))
+		Expect(calls.Load()).To(Equal(int32(2)))
+	})
+
+	It("should only forget the reused key on a request, and the other expired keys on a purge", func() {
+		post("key-1", `{}`)
+		post("key-2", `{}`)
+
+		mockclock.Add(time.Hour)
+		post("key-3", `{}`)
+
+		count := func() int64 {
+			var n int64
+			Expect(gdb.Model(&middlewares.IdempotencyRecord{}).Count(&n).Error).ShouldNot(HaveOccurred())
+			return n
+		}
+		Expect(count()).To(Equal(int64(3)))
+
+		Expect(idempotency.PurgeExpired(context.Background())).To(Equal(int64(2)))
+		Expect(count()).To(Equal(int64(1)))
+	})
+
+	It("should return 413 for a body larger than the limit, without calling the handler", func() {
+		idempotency.WithMaxBodyBytes(16)
+
+		res, _ := post("key-1", strings.Repeat("a", 17))
+		Expect(res.StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(calls.Load()).To(Equal(int32(0)))
+
+		res, _ = post("key-1", strings.Repeat("a", 16))
+		Expect(res.StatusCode).To(Equal(http.StatusCreated))
+	})
+})
@@ -0,0 +1,13 @@
+package middlewares_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestMiddlewares(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Middlewares Suite")
+}
@@ -0,0 +1,357 @@
+package user
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/sethvargo/go-envconfig"
+	"gorm.io/gorm"
+)
+
+type UserCacheConfig struct {
+	Enabled      bool          `env:"USER_CACHE_ENABLED,overwrite,default=false"`
+	RedisAddr    string        `env:"USER_CACHE_REDIS_ADDR,overwrite,default=localhost:6379"` // empty for the in-memory cache only
+	RedisTimeout time.Duration `env:"USER_CACHE_REDIS_TIMEOUT,overwrite,default=100ms"`       // the maximum duration of a single Redis command
+	KeyPrefix    string        `env:"USER_CACHE_KEY_PREFIX,overwrite,default=user:"`          // the prefix of the keys, followed by the user id
+	TTL          time.Duration `env:"USER_CACHE_TTL,overwrite,default=5m"`                    // how long a user is cached
+	TTLJitter    float64       `env:"USER_CACHE_TTL_JITTER,overwrite,default=0.1"`            // the fraction of the TTL added or removed at random
+	NegativeTTL  time.Duration `env:"USER_CACHE_NEGATIVE_TTL,overwrite,default=30s"`          // how long a missing user is cached, 0 for never
+	MaxEntries   int           `env:"USER_CACHE_MAX_ENTRIES,overwrite,default=10000"`         // the size of the in-memory fallback
+	MemoryTTL    time.Duration `env:"USER_CACHE_MEMORY_TTL,overwrite,default=10s"`            // how long a user is cached in memory at most, 0 for the TTL
+}
+
+// notFoundEntry is the cache entry of a missing user (negative caching).
+var notFoundEntry = []byte("null")
+
+// CachedUserRepository is a UserRepository that caches the users of another one (usually a UserRepo) in Redis,
+// encoded as JSON. Get reads through the cache, and remembers the missing users too, so that the requests for an
+// unknown id don't all reach the database. The changes of a user invalidate its entry.
+//
+// The TTLs are jittered, so that the users cached together (e.g. after a deploy) don't expire together.
+// While Redis is unavailable, the users are cached in an in-memory LRU instead: the Redis commands go through a
+// circuit breaker, so that a dead Redis costs a single failed command per cool-down rather than one per request.
+//
+// An entry can be stale for up to its TTL if a Get reads the user before a concurrent change commits, and caches it
+// after the change has invalidated its entry, or if Redis fails to invalidate it. So the TTL bounds the staleness.
+// The in-memory LRU is local to each replica, so while Redis is unavailable, a change only invalidates the entry of
+// the replica that made it, and the other replicas serve the user they cached until it expires. That is why the
+// in-memory entries live for MemoryTTL at most, which bounds the staleness instead.
+type CachedUserRepository struct {
+	*UserCacheConfig
+	next    UserRepository
+	redis   redis.UniversalClient
+	memory  *memoryCache
+	cnp     *cnp.CNP
+	breaker *cnp.Breaker
+	logger  zerolog.Logger
+}
+
+// NewCachedUserRepository creates a CachedUserRepository of next, configured with USER_CACHE_* env vars,
+// whose in-memory TTLs and circuit breaker are measured with clock.
+func NewCachedUserRepository(next UserRepository, clock clock.Clock) *CachedUserRepository {
+	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+
+	// Set defaults with env vars
+	// Uses https://github.com/sethvargo/go-envconfig
+	config := &UserCacheConfig{}
+	if err := envconfig.Process(context.Background(), config); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to override from env vars")
+	}
+
+	CNP := cnp.NewCloudNativePatterns(clock)
+
+	c := &CachedUserRepository{
+		UserCacheConfig: config,
+		next:            next,
+		memory:          newMemoryCache(config.MaxEntries, clock),
+		cnp:             CNP,
+		breaker: CNP.NewBreaker(cnp.BreakerSettings{
+			Name:                "user-cache",
+			ConsecutiveFailures: 3,
+			CoolDown:            10 * time.Second,
+		}),
+		logger: logger,
+	}
+
+	// The client is only created when the cache is used, it connects lazily
+	if config.Enabled && config.RedisAddr != "" {
+		c.redis = redis.NewClient(&redis.Options{Addr: config.RedisAddr})
+	}
+
+	return c
+}
+
+// WithRedis sets the Redis client using builder pattern. A nil client caches in memory only.
+func (c *CachedUserRepository) WithRedis(client redis.UniversalClient) *CachedUserRepository {
+	c.redis = client
+	return c
+}
+
+// WithLogger sets the logger using builder pattern
+func (c *CachedUserRepository) WithLogger(logger zerolog.Logger) *CachedUserRepository {
+	c.logger = logger
+	return c
+}
+
+func (c *CachedUserRepository) Get(ctx context.Context, id uint) (User, error) {
+	key := c.key(id)
+
+	if data, ok := c.get(ctx, key); ok {
+		if bytes.Equal(data, notFoundEntry) {
+			return User{}, gorm.ErrRecordNotFound
+		}
+
+		var user User
+		if err := json.Unmarshal(data, &user); err == nil {
+			return user, nil
+		}
+
+		// A corrupted entry is replaced by the user read from the repository
+		c.logger.Warn().Str("key", key).Msg("Failed to decode the cached user")
+	}
+
+	user, err := c.next.Get(ctx, id)
+	switch {
+	case err == nil:
+		if data, err := json.Marshal(user); err == nil {
+			c.set(ctx, key, data, c.jitter(c.TTL))
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound) && c.NegativeTTL > 0:
+		c.set(ctx, key, notFoundEntry, c.jitter(c.NegativeTTL))
+	}
+
+	return user, err
+}
+
+func (c *CachedUserRepository) Add(ctx context.Context, user User) (uint, error) {
+	id, err := c.next.Add(ctx, user)
+	if err == nil {
+		// The id may have been cached as missing
+		c.invalidate(ctx, id)
+	}
+	return id, err
+}
+
+func (c *CachedUserRepository) Delete(ctx context.Context, id uint, version uint) error {
+	defer c.invalidate(ctx, id)
+	return c.next.Delete(ctx, id, version)
+}
+
+func (c *CachedUserRepository) Update(ctx context.Context, id uint, version uint, input User) error {
+	defer c.invalidate(ctx, id)
+	return c.next.Update(ctx, id, version, input)
+}
+
+func (c *CachedUserRepository) Replace(ctx context.Context, id uint, version uint, input User) error {
+	defer c.invalidate(ctx, id)
+	return c.next.Replace(ctx, id, version, input)
+}
+
+// List is not cached: its results depend on the query, and would have to be invalidated by every change.
+func (c *CachedUserRepository) List(ctx context.Context, query UserQuery) ([]User, error) {
+	return c.next.List(ctx, query)
+}
+
+func (c *CachedUserRepository) Restore(ctx context.Context, id uint) error {
+	defer c.invalidate(ctx, id)
+	return c.next.Restore(ctx, id)
+}
+
+func (c *CachedUserRepository) Purge(ctx context.Context, id uint) error {
+	defer c.invalidate(ctx, id)
+	return c.next.Purge(ctx, id)
+}
+
+// PurgeDeleted does not invalidate anything: the users it removes were already deleted, so they are either not
+// cached, or cached as missing.
+func (c *CachedUserRepository) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	return c.next.PurgeDeleted(ctx, before)
+}
+
+// key returns the cache key of the user id.
+func (c *CachedUserRepository) key(id uint) string {
+	return c.KeyPrefix + strconv.FormatUint(uint64(id), 10)
+}
+
+// jitter returns ttl plus or minus up to TTLJitter of it, at random.
+func (c *CachedUserRepository) jitter(ttl time.Duration) time.Duration {
+	if c.TTLJitter <= 0 {
+		return ttl
+	}
+
+	return ttl + time.Duration((rand.Float64()*2-1)*c.TTLJitter*float64(ttl))
+}
+
+// get returns the entry of key from Redis, or from memory if Redis is unavailable.
+func (c *CachedUserRepository) get(ctx context.Context, key string) ([]byte, bool) {
+	if c.redis != nil {
+		var (
+			data  []byte
+			found bool
+		)
+		err := c.redisDo(ctx, func(ctx context.Context) error {
+			var err error
+			data, err = c.redis.Get(ctx, key).Bytes()
+			if errors.Is(err, redis.Nil) {
+				// A miss is an answer, not a failure of Redis
+				return nil
+			}
+			found = err == nil
+			return err
+		})
+		if err == nil {
+			return data, found
+		}
+	}
+
+	return c.memory.Get(key)
+}
+
+// set caches data under key for ttl, in Redis, or in memory if Redis is unavailable.
+func (c *CachedUserRepository) set(ctx context.Context, key string, data []byte, ttl time.Duration) {
+	if c.redis != nil {
+		err := c.redisDo(ctx, func(ctx context.Context) error {
+			return c.redis.Set(ctx, key, data, ttl).Err()
+		})
+		if err == nil {
+			return
+		}
+	}
+
+	if c.MemoryTTL > 0 && ttl > c.MemoryTTL {
+		ttl = c.MemoryTTL
+	}
+	c.memory.Set(key, data, ttl)
+}
+
+// invalidate removes the entry of the user id, from memory and from Redis.
+func (c *CachedUserRepository) invalidate(ctx context.Context, id uint) {
+	key := c.key(id)
+	c.memory.Delete(key)
+
+	if c.redis == nil {
+		return
+	}
+
+	// The entry is removed even if the request was cancelled meanwhile, as the change may have been committed
+	err := c.redisDo(context.WithoutCancel(ctx), func(ctx context.Context) error {
+		return c.redis.Del(ctx, key).Err()
+	})
+	if err != nil {
+		c.logger.Warn().Err(err).Str("key", key).Msg("Failed to invalidate the cached user, it may be stale until its TTL")
+	}
+}
+
+// redisDo runs a Redis command, bounded by RedisTimeout, through the circuit breaker.
+func (c *CachedUserRepository) redisDo(ctx context.Context, command func(ctx context.Context) error) error {
+	err := c.cnp.CircuitBreaker(func(ctx context.Context) error {
+		if c.RedisTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = c.cnp.Clock.WithTimeout(ctx, c.RedisTimeout)
+			defer cancel()
+		}
+		return command(ctx)
+	}, c.breaker)(ctx)
+
+	if err != nil {
+		c.logger.Debug().Err(err).Msg("Redis is unavailable, using the in-memory cache")
+	}
+
+	return err
+}
+
+// memoryCache is an LRU cache whose entries expire, the fallback of CachedUserRepository.
+type memoryCache struct {
+	maxEntries int
+	clock      clock.Clock
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type memoryEntry struct {
+	key       string
+	data      []byte
+	expiresAt time.Time
+}
+
+func newMemoryCache(maxEntries int, clock clock.Clock) *memoryCache {
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+
+	return &memoryCache{
+		maxEntries: maxEntries,
+		clock:      clock,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Set caches data under key for ttl, evicting the least recently used entry if the cache is full.
+func (m *memoryCache) Set(key string, data []byte, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := &memoryEntry{key: key, data: data, expiresAt: m.clock.Now().Add(ttl)}
+
+	if e, ok := m.entries[key]; ok {
+		e.Value = entry
+		m.lru.MoveToFront(e)
+		return
+	}
+
+	m.entries[key] = m.lru.PushFront(entry)
+
+	if m.lru.Len() > m.maxEntries {
+		m.remove(m.lru.Back())
+	}
+}
+
+// Get returns the data cached under key, unless it has expired.
+func (m *memoryCache) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*memoryEntry)
+	if !m.clock.Now().Before(entry.expiresAt) {
+		m.remove(e)
+		return nil, false
+	}
+
+	m.lru.MoveToFront(e)
+	return entry.data, true
+}
+
+func (m *memoryCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[key]; ok {
+		m.remove(e)
+	}
+}
+
+// remove must be called with m.mu held.
+func (m *memoryCache) remove(e *list.Element) {
+	m.lru.Remove(e)
+	delete(m.entries, e.Value.(*memoryEntry).key)
+}
@@ -0,0 +1,283 @@
+package user_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/user"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/user/mocks"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"go.uber.org/mock/gomock"
+	"gorm.io/gorm"
+)
+
+var _ = Describe("CachedUserRepository", func() {
+	var (
+		ctrl        *gomock.Controller
+		usrrepomock *mocks.MockUserRepository
+		mr          *miniredis.Miniredis
+		client      *redis.Client
+		mockclock   *clock.Mock
+		cached      *user.CachedUserRepository
+	)
+
+	usr := user.User{ID: 1, Version: 2, FirstName: "abc", LastName: "xyz", Age: 30, Email: "abc@test.com"}
+
+	BeforeEach(func() {
+		ctrl = gomock.NewController(GinkgoT())
+		usrrepomock = mocks.NewMockUserRepository(ctrl)
+
+		mr = miniredis.RunT(GinkgoT())
+		client = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+		// The timeouts of the Redis commands are measured with mockclock, and go-redis turns them into the
+		// deadlines of its connections, which must not be in the past
+		mockclock = clock.NewMock()
+		mockclock.Set(time.Now())
+
+		cached = user.NewCachedUserRepository(usrrepomock, mockclock).
+			WithRedis(client).
+			WithLogger(zerolog.Nop())
+	})
+
+	AfterEach(func() {
+		client.Close()
+	})
+
+	Context("Get", func() {
+		It("should read through the cache", func() {
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(usr, nil).Times(1)
+
+			for i := 0; i < 3; i++ {
+				got, err := cached.Get(context.Background(), 1)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(got).To(Equal(usr))
+			}
+
+			// The user is cached as JSON, with a jittered TTL
+			data, err := mr.Get("user:1")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(data).To(MatchJSON(mustMarshal(usr)))
+			Expect(mr.TTL("user:1")).To(BeNumerically("~", 5*time.Minute, 30*time.Second))
+		})
+
+		It("should spread the TTLs", func() {
+			for id := uint(1); id <= 20; id++ {
+				usrrepomock.EXPECT().Get(gomock.Any(), id).Return(user.User{ID: id}, nil)
+				_, err := cached.Get(context.Background(), id)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+
+			ttls := map[time.Duration]bool{}
+			for _, key := range mr.Keys() {
+				ttls[mr.TTL(key)] = true
+			}
+			Expect(len(ttls)).To(BeNumerically(">", 1))
+		})
+
+		It("should cache the missing users", func() {
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(user.User{}, gorm.ErrRecordNotFound).Times(1)
+
+			for i := 0; i < 3; i++ {
+				_, err := cached.Get(context.Background(), 1)
+				Expect(err).To(MatchError(gorm.ErrRecordNotFound))
+			}
+
+			Expect(mr.TTL("user:1")).To(BeNumerically("~", 30*time.Second, 3*time.Second))
+		})
+
+		It("should not cache the missing users without a negative TTL", func() {
+			cached.NegativeTTL = 0
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(user.User{}, gorm.ErrRecordNotFound).Times(2)
+
+			for i := 0; i < 2; i++ {
+				_, err := cached.Get(context.Background(), 1)
+				Expect(err).To(MatchError(gorm.ErrRecordNotFound))
+			}
+		})
+
+		It("should not cache the errors", func() {
+			failure := errors.New("connection refused")
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(user.User{}, failure)
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(usr, nil)
+
+			_, err := cached.Get(context.Background(), 1)
+			Expect(err).To(MatchError(failure))
+
+			got, err := cached.Get(context.Background(), 1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(got).To(Equal(usr))
+		})
+
+		It("should replace a corrupted entry", func() {
+			Expect(mr.Set("user:1", "{not json")).To(Succeed())
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(usr, nil).Times(1)
+
+			got, err := cached.Get(context.Background(), 1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(got).To(Equal(usr))
+
+			data, err := mr.Get("user:1")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(data).To(MatchJSON(mustMarshal(usr)))
+		})
+	})
+
+	Context("Invalidation", func() {
+		BeforeEach(func() {
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(usr, nil)
+			_, err := cached.Get(context.Background(), 1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(mr.Exists("user:1")).To(BeTrue())
+		})
+
+		It("should invalidate the user on Update", func() {
+			usrrepomock.EXPECT().Update(gomock.Any(), uint(1), uint(2), user.User{Age: 31}).Return(nil)
+
+			Expect(cached.Update(context.Background(), 1, 2, user.User{Age: 31})).To(Succeed())
+			Expect(mr.Exists("user:1")).To(BeFalse())
+
+			// The next Get reads the updated user
+			updated := usr
+			updated.Age, updated.Version = 31, 3
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(updated, nil)
+
+			got, err := cached.Get(context.Background(), 1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(got).To(Equal(updated))
+		})
+
+		It("should invalidate the user on Delete", func() {
+			usrrepomock.EXPECT().Delete(gomock.Any(), uint(1), uint(0)).Return(nil)
+
+			Expect(cached.Delete(context.Background(), 1, 0)).To(Succeed())
+			Expect(mr.Exists("user:1")).To(BeFalse())
+		})
+
+		It("should invalidate the user on Replace, Restore and Purge", func() {
+			usrrepomock.EXPECT().Replace(gomock.Any(), uint(1), uint(2), usr).Return(nil)
+			Expect(cached.Replace(context.Background(), 1, 2, usr)).To(Succeed())
+			Expect(mr.Exists("user:1")).To(BeFalse())
+
+			Expect(mr.Set("user:1", mustMarshal(usr))).To(Succeed())
+			usrrepomock.EXPECT().Restore(gomock.Any(), uint(1)).Return(nil)
+			Expect(cached.Restore(context.Background(), 1)).To(Succeed())
+			Expect(mr.Exists("user:1")).To(BeFalse())
+
+			Expect(mr.Set("user:1", mustMarshal(usr))).To(Succeed())
+			usrrepomock.EXPECT().Purge(gomock.Any(), uint(1)).Return(nil)
+			Expect(cached.Purge(context.Background(), 1)).To(Succeed())
+			Expect(mr.Exists("user:1")).To(BeFalse())
+		})
+
+		It("should invalidate the user on a failed Update", func() {
+			usrrepomock.EXPECT().Update(gomock.Any(), uint(1), uint(1), user.User{Age: 31}).Return(user.ErrVersionMismatch)
+
+			Expect(cached.Update(context.Background(), 1, 1, user.User{Age: 31})).To(MatchError(user.ErrVersionMismatch))
+			Expect(mr.Exists("user:1")).To(BeFalse())
+		})
+
+		It("should invalidate a missing user once added", func() {
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(2)).Return(user.User{}, gorm.ErrRecordNotFound)
+			_, err := cached.Get(context.Background(), 2)
+			Expect(err).To(MatchError(gorm.ErrRecordNotFound))
+
+			usrrepomock.EXPECT().Add(gomock.Any(), gomock.Any()).Return(uint(2), nil)
+			Expect(cached.Add(context.Background(), user.User{FirstName: "def"})).To(Equal(uint(2)))
+
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(2)).Return(user.User{ID: 2, FirstName: "def"}, nil)
+			got, err := cached.Get(context.Background(), 2)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(got.FirstName).To(Equal("def"))
+		})
+	})
+
+	Context("Redis is unavailable", func() {
+		BeforeEach(func() {
+			mr.SetError("LOADING Redis is loading the dataset in memory")
+		})
+
+		It("should cache the users in memory", func() {
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(usr, nil).Times(1)
+
+			for i := 0; i < 5; i++ {
+				got, err := cached.Get(context.Background(), 1)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(got).To(Equal(usr))
+			}
+
+			// The in-memory entries expire sooner, as the other replicas can't invalidate them
+			mockclock.Add(10 * time.Second)
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(usr, nil).Times(1)
+
+			_, err := cached.Get(context.Background(), 1)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should invalidate the users in memory", func() {
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(usr, nil).Times(2)
+			usrrepomock.EXPECT().Delete(gomock.Any(), uint(1), uint(0)).Return(nil)
+
+			_, err := cached.Get(context.Background(), 1)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(cached.Delete(context.Background(), 1, 0)).To(Succeed())
+
+			_, err = cached.Get(context.Background(), 1)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should use Redis again once it recovers", func() {
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(usr, nil).Times(2)
+
+			_, err := cached.Get(context.Background(), 1)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// The breaker lets a trial command through after its cool-down
+			mr.SetError("")
+			mockclock.Add(6 * time.Minute)
+
+			_, err = cached.Get(context.Background(), 1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(mr.Exists("user:1")).To(BeTrue())
+		})
+	})
+
+	Context("Without Redis", func() {
+		It("should cache the users in memory", func() {
+			cached.WithRedis(nil)
+			usrrepomock.EXPECT().Get(gomock.Any(), uint(1)).Return(usr, nil).Times(1)
+
+			for i := 0; i < 3; i++ {
+				_, err := cached.Get(context.Background(), 1)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+
+			Expect(mr.Keys()).To(BeEmpty())
+		})
+	})
+
+	It("should pass List and PurgeDeleted through", func() {
+		query := user.UserQuery{Limit: 10}
+		usrrepomock.EXPECT().List(gomock.Any(), query).Return([]user.User{usr}, nil).Times(2)
+		usrrepomock.EXPECT().PurgeDeleted(gomock.Any(), gomock.Any()).Return(int64(1), nil)
+
+		for i := 0; i < 2; i++ {
+			Expect(cached.List(context.Background(), query)).To(Equal([]user.User{usr}))
+		}
+		Expect(cached.PurgeDeleted(context.Background(), time.Now())).To(Equal(int64(1)))
+	})
+})
+
+func mustMarshal(v any) string {
+	data, err := json.Marshal(v)
+	Expect(err).ShouldNot(HaveOccurred())
+	return string(data)
+}
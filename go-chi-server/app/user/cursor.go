@@ -0,0 +1,43 @@
+package user
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrInvalidCursor is returned when the cursor of a listing can't be decoded, or was issued for another sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// DefaultListLimit is the size of a page of users when the request does not set one.
+const DefaultListLimit = 20
+
+// UserCursor is the position of the last user of a page. It is opaque to the clients,
+// who get it base64 encoded (see EncodeCursor).
+type UserCursor struct {
+	Sort      string    `json:"s"`
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"ca"`
+}
+
+// EncodeCursor returns the opaque cursor of the users after user in the sort order.
+func EncodeCursor(sort string, user User) string {
+	b, _ := json.Marshal(UserCursor{Sort: sort, ID: user.ID, CreatedAt: user.CreatedAt})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor decodes a cursor returned by EncodeCursor, and checks that it was issued for sort.
+func DecodeCursor(sort string, cursor string) (*UserCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c UserCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Sort != sort {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
@@ -0,0 +1,125 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/patilchinmay/go-experiments/go-chi-server/utils/problem"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrUserNotFound is returned when the user does not exist, or was deleted.
+	ErrUserNotFound = errors.New("user not found")
+
+	// ErrUserExists is returned when a user conflicts with an existing one, e.g. a user added with the id of another.
+	ErrUserExists = errors.New("user already exists")
+
+	// ErrVersionMismatch is returned when a user was modified since the version the request was based on.
+	ErrVersionMismatch = errors.New("user was modified since the given version")
+
+	// ErrUserNotDeleted is returned when restoring a user that is not deleted.
+	ErrUserNotDeleted = errors.New("user is not deleted")
+
+	// ErrForbidden is returned when the client is not allowed to make the request, e.g. a purge by a non-admin.
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrBadRequest is wrapped by the errors of the requests that can't be parsed, e.g. an invalid id or body.
+	ErrBadRequest = errors.New("bad request")
+)
+
+// ValidationError is returned when the input of the UserService fails validation.
+type ValidationError struct {
+	Violations []problem.Violation
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Field+": "+v.Message)
+	}
+	return "invalid input: " + strings.Join(msgs, ", ")
+}
+
+// newValidationError converts the error of validator.Validate.Struct into a ValidationError.
+// An *validator.InvalidValidationError is a bug, not an invalid input, and is returned as is.
+func newValidationError(err error) error {
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return err
+	}
+
+	violations := make([]problem.Violation, 0, len(verrs))
+	for _, fe := range verrs {
+		rule := fe.Tag()
+		if fe.Param() != "" {
+			rule += "=" + fe.Param()
+		}
+
+		violations = append(violations, problem.Violation{
+			Field:   fe.Field(),
+			Rule:    rule,
+			Message: "failed on the '" + rule + "' rule",
+		})
+	}
+
+	return &ValidationError{Violations: violations}
+}
+
+// repoError translates the gorm errors returned by the repository into the errors of the user package.
+// The gorm error stays in the chain.
+func repoError(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return fmt.Errorf("%w: %w", ErrUserNotFound, err)
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return fmt.Errorf("%w: %w", ErrUserExists, err)
+	}
+	return err
+}
+
+// writeError is the single place where the errors of the user API become responses: it writes err as an
+// RFC 7807 problem. The details of unexpected errors are not leaked to the client, they are logged by the handlers.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var (
+		p    *problem.Problem
+		verr *ValidationError
+	)
+
+	switch {
+	case errors.As(err, &verr):
+		p = problem.New(http.StatusUnprocessableEntity, "The request failed validation.")
+		p.Violations = verr.Violations
+	case errors.Is(err, ErrBadRequest), errors.Is(err, ErrInvalidCursor):
+		p = problem.New(http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrUnsupportedMediaType):
+		p = problem.New(http.StatusUnsupportedMediaType, err.Error())
+	case errors.Is(err, ErrInvalidPatch):
+		p = problem.New(http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, ErrUserNotFound):
+		p = problem.New(http.StatusNotFound, ErrUserNotFound.Error())
+	case errors.Is(err, ErrUserExists):
+		p = problem.New(http.StatusConflict, ErrUserExists.Error())
+	case errors.Is(err, ErrUserNotDeleted):
+		p = problem.New(http.StatusConflict, ErrUserNotDeleted.Error())
+	case errors.Is(err, ErrForbidden):
+		p = problem.New(http.StatusForbidden, ErrForbidden.Error())
+	case errors.Is(err, ErrVersionMismatch):
+		p = problem.New(http.StatusPreconditionFailed, ErrVersionMismatch.Error())
+	case cnp.IsRejection(err), errors.Is(err, cnp.ErrRetryBudgetExhausted):
+		// The database is failing or overloaded, and the resilience patterns shed the request
+		w.Header().Set("Retry-After", "1")
+		p = problem.New(http.StatusServiceUnavailable, "The service is temporarily unavailable.")
+	case errors.Is(err, context.DeadlineExceeded):
+		p = problem.New(http.StatusGatewayTimeout, "The request timed out.")
+	default:
+		p = problem.New(http.StatusInternalServerError, "")
+	}
+
+	problem.Write(w, r, p)
+}
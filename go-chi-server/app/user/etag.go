@@ -0,0 +1,73 @@
+package user
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etag returns the ETag of the version of a user.
+func etag(version uint) string {
+	return `"` + strconv.FormatUint(uint64(version), 10) + `"`
+}
+
+// ifMatchVersion returns the version required by the If-Match header of r, or 0 when any version matches
+// (no header, or "*"). The header is a list of ETags, compared with the strong comparison of RFC 9110: the weak ETags,
+// and the strong ones that are not a version as returned by GET /user/{id}, never match, and ErrVersionMismatch is
+// returned if no ETag is left. Since the version of a user only increases, only the highest of the versions left can
+// still be current, and it is returned.
+func ifMatchVersion(r *http.Request) (uint, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return 0, nil
+	}
+
+	var version uint64
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return 0, nil
+		}
+
+		// A list may have empty elements (RFC 9110 §5.6.1)
+		if candidate == "" {
+			continue
+		}
+
+		weak := strings.HasPrefix(candidate, "W/")
+		opaque, ok := strings.CutPrefix(strings.TrimPrefix(candidate, "W/"), `"`)
+		if ok {
+			opaque, ok = strings.CutSuffix(opaque, `"`)
+		}
+
+		if !ok || strings.Contains(opaque, `"`) {
+			return 0, fmt.Errorf("%w: invalid If-Match %s", ErrBadRequest, header)
+		}
+
+		if weak {
+			continue
+		}
+
+		if v, err := strconv.ParseUint(opaque, 10, 64); err == nil && v > version {
+			version = v
+		}
+	}
+
+	if version == 0 {
+		return 0, fmt.Errorf("%w: no strong ETag in If-Match %s", ErrVersionMismatch, header)
+	}
+
+	return uint(version), nil
+}
+
+// noneMatch reports whether the If-None-Match header of r matches tag, with the weak comparison of RFC 9110.
+func noneMatch(r *http.Request, tag string) bool {
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -2,16 +2,20 @@ package user
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httplog"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/middlewares"
 )
 
 type UserHandler struct {
-	usrsvc *UserService
+	usrsvc     *UserService
+	adminToken string
 }
 
 var userHandler *UserHandler
@@ -25,6 +29,25 @@ func NewUserHandler(usrsvc *UserService) *UserHandler {
 	return userHandler
 }
 
+// WithAdminToken sets the token that the admins send in the X-Admin-Token header using builder pattern.
+// The admin-only requests (e.g. purge) are forbidden while it is empty.
+func (u *UserHandler) WithAdminToken(token string) *UserHandler {
+	u.adminToken = token
+	return u
+}
+
+// isAdmin reports whether r was sent by an admin.
+func (u *UserHandler) isAdmin(r *http.Request) bool {
+	return middlewares.IsAdmin(r, u.adminToken)
+}
+
+// DiscardUserHandler will remove the reference to userHandler so that it can be garbage collected. In other words, it deletes the singleton instance of *UserHandler.
+func DiscardUserHandler() {
+	if userHandler != nil {
+		userHandler = nil
+	}
+}
+
 // Get is the handler for GET /user/{id}
 func (u *UserHandler) Get(w http.ResponseWriter, r *http.Request) {
 	oplog := httplog.LogEntry(r.Context())
@@ -33,7 +56,7 @@ func (u *UserHandler) Get(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the path param of id. id is string here.
 	id := chi.URLParam(r, "id")
 	if id == "" {
-		http.Error(w, "Missing id", http.StatusBadRequest)
+		writeError(w, r, fmt.Errorf("%w: missing id", ErrBadRequest))
 		oplog.Error().Msg("Missing id")
 		return
 	}
@@ -41,7 +64,7 @@ func (u *UserHandler) Get(w http.ResponseWriter, r *http.Request) {
 	// Convert id to uint (as required by service layer)
 	u64, err := strconv.ParseUint(id, 10, 64)
 	if err != nil {
-		http.Error(w, "Invalid id", http.StatusBadRequest)
+		writeError(w, r, fmt.Errorf("%w: invalid id", ErrBadRequest))
 		oplog.Error().Msg("Invalid id")
 		return
 	}
@@ -50,11 +73,19 @@ func (u *UserHandler) Get(w http.ResponseWriter, r *http.Request) {
 	// Call the service layer and retrieve the user
 	user, err := u.usrsvc.Get(r.Context(), idu64)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		oplog.Error().Err(err).Msg("Failed to get user")
 		return
 	}
 
+	// The version of the user is its ETag, the client already has this version if it sent it in If-None-Match
+	tag := etag(user.Version)
+	w.Header().Set("ETag", tag)
+	if noneMatch(r, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(user)
@@ -68,7 +99,7 @@ func (u *UserHandler) Add(w http.ResponseWriter, r *http.Request) {
 	// Read body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, fmt.Errorf("%w: %w", ErrBadRequest, err))
 		oplog.Error().Err(err).Msg("Failed to read request body")
 		return
 	}
@@ -77,8 +108,9 @@ func (u *UserHandler) Add(w http.ResponseWriter, r *http.Request) {
 	var user User
 	if err := json.Unmarshal(body, &user); err != nil {
 		// Parse []byte to go struct pointer
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, fmt.Errorf("%w: %w", ErrBadRequest, err))
 		oplog.Error().Err(err).Msg("Failed to parse body as json")
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -86,8 +118,8 @@ func (u *UserHandler) Add(w http.ResponseWriter, r *http.Request) {
 	// Call the service layer
 	resp, err := u.usrsvc.Add(r.Context(), user)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		oplog.Error().Err(err).Msg("Body failed validation")
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Failed to add user")
 		return
 	}
 
@@ -104,7 +136,7 @@ func (u *UserHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the path param of id. id is string here.
 	id := chi.URLParam(r, "id")
 	if id == "" {
-		http.Error(w, "Missing id", http.StatusBadRequest)
+		writeError(w, r, fmt.Errorf("%w: missing id", ErrBadRequest))
 		oplog.Error().Msg("Missing id")
 		return
 	}
@@ -112,16 +144,43 @@ func (u *UserHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	// Convert id to uint (as required by service layer)
 	u64, err := strconv.ParseUint(id, 10, 64)
 	if err != nil {
-		http.Error(w, "Invalid id", http.StatusBadRequest)
+		writeError(w, r, fmt.Errorf("%w: invalid id", ErrBadRequest))
 		oplog.Error().Msg("Invalid id")
 		return
 	}
 	idu64 := uint(u64)
 
-	// Call the service layer and retrieve the user
-	err = u.usrsvc.Delete(r.Context(), idu64)
+	// DELETE /user/{id}?purge=true permanently removes the user, and is only allowed to admins
+	if r.URL.Query().Get("purge") == "true" {
+		if !u.isAdmin(r) {
+			writeError(w, r, ErrForbidden)
+			oplog.Error().Msg("Purge by a non-admin")
+			return
+		}
+
+		if err := u.usrsvc.Purge(r.Context(), idu64); err != nil {
+			writeError(w, r, err)
+			oplog.Error().Err(err).Msg("Failed to purge user")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Only delete the version of the user in If-Match, if any
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Invalid If-Match")
+		return
+	}
+
+	// Call the service layer and delete the user
+	err = u.usrsvc.Delete(r.Context(), idu64, version)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		oplog.Error().Err(err).Msg("Failed to delete user")
 		return
 	}
@@ -130,17 +189,65 @@ func (u *UserHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// Restore is the handler for POST /user/{id}/restore. It undoes the soft delete of the user.
+func (u *UserHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	oplog := httplog.LogEntry(r.Context())
+	oplog.Debug().Msg("Restore User")
+
+	// Retrieve the path param of id. id is string here.
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, r, fmt.Errorf("%w: missing id", ErrBadRequest))
+		oplog.Error().Msg("Missing id")
+		return
+	}
+
+	// Convert id to uint (as required by service layer)
+	u64, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("%w: invalid id", ErrBadRequest))
+		oplog.Error().Msg("Invalid id")
+		return
+	}
+	idu64 := uint(u64)
+
+	// Call the service layer and restore the user
+	err = u.usrsvc.Restore(r.Context(), idu64)
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Failed to restore user")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
 // Update is the handler for PATCH /user/{id}
 func (u *UserHandler) Update(w http.ResponseWriter, r *http.Request) {
 	oplog := httplog.LogEntry(r.Context())
 	oplog.Debug().Msg("Update User")
 
+	// The format of the body is chosen by its Content-Type: a JSON Merge Patch or a JSON Patch is applied to the
+	// current user, a plain JSON body only updates the fields that are not zero (see UpdateUserInput)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case MergePatchContentType, JSONPatchContentType:
+		u.patch(w, r, mediaType)
+		return
+	case "", "application/json":
+	default:
+		writeError(w, r, fmt.Errorf("%w: %s", ErrUnsupportedMediaType, mediaType))
+		oplog.Error().Str("contentType", mediaType).Msg("Unsupported media type")
+		return
+	}
+
 	// Parse the incoming payload into json
 
 	var input UpdateUserInput
 	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, fmt.Errorf("%w: %w", ErrBadRequest, err))
 		oplog.Error().Err(err).Msg("Failed to parse request body")
 		return
 	}
@@ -150,7 +257,7 @@ func (u *UserHandler) Update(w http.ResponseWriter, r *http.Request) {
 	oplog.Debug().Str("id", id).Msg("Id")
 
 	if id == "" {
-		http.Error(w, "Missing id", http.StatusBadRequest)
+		writeError(w, r, fmt.Errorf("%w: missing id", ErrBadRequest))
 		oplog.Error().Msg("Missing id")
 		return
 	}
@@ -158,16 +265,24 @@ func (u *UserHandler) Update(w http.ResponseWriter, r *http.Request) {
 	// Convert id to uint (as required by service layer)
 	u64, err := strconv.ParseUint(id, 10, 64)
 	if err != nil {
-		http.Error(w, "Invalid id", http.StatusBadRequest)
+		writeError(w, r, fmt.Errorf("%w: invalid id", ErrBadRequest))
 		oplog.Error().Msg("Invalid id")
 		return
 	}
 	idu64 := uint(u64)
 
+	// Only update the version of the user in If-Match, if any
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Invalid If-Match")
+		return
+	}
+
 	// Call the service layer
-	err = u.usrsvc.Update(r.Context(), idu64, input)
+	err = u.usrsvc.Update(r.Context(), idu64, version, input)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		oplog.Error().Err(err).Msg("Failed to update user")
 		return
 	}
@@ -175,3 +290,133 @@ func (u *UserHandler) Update(w http.ResponseWriter, r *http.Request) {
 	// Return the response
 	w.WriteHeader(http.StatusOK)
 }
+
+// patch handles PATCH /user/{id} with a JSON Merge Patch or a JSON Patch body, of the media type contentType.
+// It returns the patched user and its ETag.
+func (u *UserHandler) patch(w http.ResponseWriter, r *http.Request, contentType string) {
+	oplog := httplog.LogEntry(r.Context())
+
+	// Read body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("%w: %w", ErrBadRequest, err))
+		oplog.Error().Err(err).Msg("Failed to read request body")
+		return
+	}
+
+	// Retrieve the path param of id. id is string here.
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, r, fmt.Errorf("%w: missing id", ErrBadRequest))
+		oplog.Error().Msg("Missing id")
+		return
+	}
+
+	// Convert id to uint (as required by service layer)
+	u64, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("%w: invalid id", ErrBadRequest))
+		oplog.Error().Msg("Invalid id")
+		return
+	}
+	idu64 := uint(u64)
+
+	// Only patch the version of the user in If-Match, if any
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Invalid If-Match")
+		return
+	}
+
+	// Call the service layer
+	user, err := u.usrsvc.Patch(r.Context(), idu64, version, contentType, body)
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Failed to patch user")
+		return
+	}
+
+	w.Header().Set("ETag", etag(user.Version))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+// List is the handler for GET /user
+//
+// Query parameters: email, name_prefix, min_age, max_age, sort (id, created_at, -id or -created_at),
+// include_deleted, limit and cursor. The cursor of the next page is returned in the body and in a Link header.
+func (u *UserHandler) List(w http.ResponseWriter, r *http.Request) {
+	oplog := httplog.LogEntry(r.Context())
+	oplog.Debug().Msg("List Users")
+
+	q := r.URL.Query()
+	input := ListUsersInput{
+		Email:      q.Get("email"),
+		NamePrefix: q.Get("name_prefix"),
+		Sort:       q.Get("sort"),
+		Cursor:     q.Get("cursor"),
+	}
+
+	var err error
+	if input.MinAge, err = parseAge(q.Get("min_age")); err != nil {
+		writeError(w, r, fmt.Errorf("%w: invalid min_age", ErrBadRequest))
+		oplog.Error().Err(err).Msg("Invalid min_age")
+		return
+	}
+
+	if input.MaxAge, err = parseAge(q.Get("max_age")); err != nil {
+		writeError(w, r, fmt.Errorf("%w: invalid max_age", ErrBadRequest))
+		oplog.Error().Err(err).Msg("Invalid max_age")
+		return
+	}
+
+	if v := q.Get("include_deleted"); v != "" {
+		if input.IncludeDeleted, err = strconv.ParseBool(v); err != nil {
+			writeError(w, r, fmt.Errorf("%w: invalid include_deleted", ErrBadRequest))
+			oplog.Error().Err(err).Msg("Invalid include_deleted")
+			return
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		if input.Limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, r, fmt.Errorf("%w: invalid limit", ErrBadRequest))
+			oplog.Error().Err(err).Msg("Invalid limit")
+			return
+		}
+	}
+
+	// Call the service layer and retrieve the page
+	page, err := u.usrsvc.List(r.Context(), input)
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Failed to list users")
+		return
+	}
+
+	if page.NextCursor != "" {
+		q.Set("cursor", page.NextCursor)
+		w.Header().Set("Link", "<"+r.URL.Path+"?"+q.Encode()+`>; rel="next"`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
+
+// parseAge parses an optional age query parameter.
+func parseAge(s string) (*uint8, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	u64, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	age := uint8(u64)
+	return &age, nil
+}
@@ -2,15 +2,19 @@ package user_test
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/patilchinmay/go-experiments/go-chi-server/app"
 	"github.com/patilchinmay/go-experiments/go-chi-server/app/user"
+	"github.com/patilchinmay/go-experiments/go-chi-server/utils/problem"
 	"github.com/patilchinmay/go-experiments/go-chi-server/utils/testhelpers"
 	"github.com/rs/zerolog"
 	"gorm.io/driver/sqlite"
@@ -28,7 +32,7 @@ var _ = Describe("User Handlers", Serial, func() {
 		// When the name of the database file handed to sqlite3_open() or to ATTACH is an empty string, then a new temporary file is created to hold the database.
 		// https://www.sqlite.org/inmemorydb.html
 		var err error
-		gdb, err = gorm.Open(sqlite.Open(""), &gorm.Config{})
+		gdb, err = gorm.Open(sqlite.Open(""), &gorm.Config{TranslateError: true})
 		Expect(err).ShouldNot(HaveOccurred())
 
 		// logger
@@ -49,6 +53,10 @@ var _ = Describe("User Handlers", Serial, func() {
 	AfterEach(func() {
 		ts.Close()
 		app.Discard()
+		// SetupSubrouter creates the user singletons, discard them so that they don't leak into other specs
+		user.DiscardUserHandler()
+		user.DiscardUserService()
+		user.DiscardUserRepository()
 		gdb = nil
 		ts = nil
 	})
@@ -77,7 +85,7 @@ var _ = Describe("User Handlers", Serial, func() {
 
 		// GET /user
 		When("User ID is of non-existent user", func() {
-			It("Should return http 500 error", func() {
+			It("Should return http 404 error as a problem", func() {
 				to := time.Duration(10)
 				opt := &testhelpers.HttpOptions{
 					Ctx:    context.Background(),
@@ -86,11 +94,18 @@ var _ = Describe("User Handlers", Serial, func() {
 					Method: http.MethodGet,
 				}
 
-				res, _ := testhelpers.DoRequest(opt)
+				res, bodystring := testhelpers.DoRequest(opt)
 
-				Expect(res.StatusCode).To(Equal(http.StatusInternalServerError))
-				// Expect(bodystring).To(ContainSubstring(`"Ping":"Pong"`))
-				// Expect(res).To(HaveHTTPHeaderWithValue("Content-Type", "application/json"))
+				Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+				Expect(res).To(HaveHTTPHeaderWithValue("Content-Type", problem.ContentType))
+
+				var p problem.Problem
+				Expect(json.Unmarshal([]byte(bodystring), &p)).To(Succeed())
+				Expect(p.Status).To(Equal(http.StatusNotFound))
+				Expect(p.Title).To(Equal("Not Found"))
+				Expect(p.Instance).To(Equal(path + "/12345"))
+				Expect(p.RequestID).To(Equal(res.Header.Get("Request-ID")))
+				Expect(p.RequestID).NotTo(BeEmpty())
 			})
 		})
 	})
@@ -125,6 +140,34 @@ var _ = Describe("User Handlers", Serial, func() {
 			})
 		})
 
+		// POST /user
+		When("The request is retried with the same Idempotency-Key", func() {
+			It("Should add the user only once", func() {
+				body := []byte(`{"firstname": "abc", "lastname": "xyz", "age": 29, "email": "abcxyz@test.com"}`)
+
+				ids := make([]string, 0, 2)
+				for i := 0; i < 2; i++ {
+					to := time.Duration(10)
+					res, bodystring := testhelpers.DoRequest(&testhelpers.HttpOptions{
+						Ctx:     context.Background(),
+						Url:     ts.URL + path,
+						TO:      &to,
+						Method:  http.MethodPost,
+						Headers: map[string]string{"Idempotency-Key": "add-abc"},
+						Data:    body,
+					})
+					Expect(res.StatusCode).To(Equal(http.StatusCreated))
+					ids = append(ids, bodystring)
+				}
+
+				Expect(ids[1]).To(Equal(ids[0]))
+
+				var count int64
+				gdb.Model(&user.User{}).Count(&count)
+				Expect(count).To(Equal(int64(1)))
+			})
+		})
+
 		// POST /user
 		When("Malformed body is present", func() {
 			It("Should return a 400 error", func() {
@@ -154,7 +197,7 @@ var _ = Describe("User Handlers", Serial, func() {
 
 		// POST /user
 		When("Incorrect body param is present", func() {
-			It("Should return a 500 error", func() {
+			It("Should return a 422 error with the violations", func() {
 				// age is incorrect. Should be 0 >= age >= 130
 				body := []byte(`{
 					"firstname": "abc",
@@ -171,11 +214,405 @@ var _ = Describe("User Handlers", Serial, func() {
 					Data:   body,
 				}
 
+				res, bodystring := testhelpers.DoRequest(opt)
+
+				Expect(res.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+				Expect(res).To(HaveHTTPHeaderWithValue("Content-Type", problem.ContentType))
+
+				var p problem.Problem
+				Expect(json.Unmarshal([]byte(bodystring), &p)).To(Succeed())
+				Expect(p.Violations).To(ConsistOf(problem.Violation{Field: "age", Rule: "lte=130", Message: "failed on the 'lte=130' rule"}))
+			})
+		})
+
+		// POST /user
+		When("The id of an existing user is present", func() {
+			It("Should return a 409 error", func() {
+				body := []byte(`{
+					"id": 42,
+					"firstname": "abc",
+					"lastname": "xyz",
+					"age": 29,
+					"email": "abcxyz@test.com"
+				}`)
+				to := time.Duration(10)
+
+				for _, status := range []int{http.StatusCreated, http.StatusConflict} {
+					opt := &testhelpers.HttpOptions{
+						Ctx:    context.Background(),
+						Url:    ts.URL + path,
+						TO:     &to,
+						Method: http.MethodPost,
+						Data:   body,
+					}
+
+					res, _ := testhelpers.DoRequest(opt)
+
+					Expect(res.StatusCode).To(Equal(status))
+				}
+			})
+		})
+	})
+
+	Context("Conditional requests", func() {
+		var id string
+
+		// do sends a request with the headers, and returns its response
+		do := func(method, url string, headers map[string]string, body []byte) *http.Response {
+			to := time.Duration(10)
+			res, _ := testhelpers.DoRequest(&testhelpers.HttpOptions{
+				Ctx:     context.Background(),
+				Url:     url,
+				TO:      &to,
+				Method:  method,
+				Headers: headers,
+				Data:    body,
+			})
+			return res
+		}
+
+		BeforeEach(func() {
+			to := time.Duration(10)
+			res, bodystring := testhelpers.DoRequest(&testhelpers.HttpOptions{
+				Ctx:    context.Background(),
+				Url:    ts.URL + path,
+				TO:     &to,
+				Method: http.MethodPost,
+				Data:   []byte(`{"firstname": "abc", "lastname": "xyz", "age": 29, "email": "abcxyz@test.com"}`),
+			})
+			Expect(res.StatusCode).To(Equal(http.StatusCreated))
+			id = bodystring
+		})
+
+		// GET /user/{id}
+		It("Should return the version as ETag, and 304 when it matches If-None-Match", func() {
+			res := do(http.MethodGet, ts.URL+path+"/"+id, nil, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res).To(HaveHTTPHeaderWithValue("ETag", `"1"`))
+
+			res = do(http.MethodGet, ts.URL+path+"/"+id, map[string]string{"If-None-Match": `W/"1"`}, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusNotModified))
+			Expect(res).To(HaveHTTPHeaderWithValue("ETag", `"1"`))
+		})
+
+		// PATCH /user/{id}
+		It("Should return 412 when the user was modified since the version in If-Match", func() {
+			body := []byte(`{"lastname": "updated"}`)
+
+			res := do(http.MethodPatch, ts.URL+path+"/"+id, map[string]string{"If-Match": `"1"`}, body)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			// The first update has bumped the version
+			res = do(http.MethodPatch, ts.URL+path+"/"+id, map[string]string{"If-Match": `"1"`}, body)
+			Expect(res.StatusCode).To(Equal(http.StatusPreconditionFailed))
+			Expect(res).To(HaveHTTPHeaderWithValue("Content-Type", problem.ContentType))
+
+			res = do(http.MethodGet, ts.URL+path+"/"+id, nil, nil)
+			Expect(res).To(HaveHTTPHeaderWithValue("ETag", `"2"`))
+		})
+
+		// DELETE /user/{id}
+		It("Should only delete the version in If-Match", func() {
+			res := do(http.MethodDelete, ts.URL+path+"/"+id, map[string]string{"If-Match": `"2"`}, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusPreconditionFailed))
+
+			res = do(http.MethodDelete, ts.URL+path+"/"+id, map[string]string{"If-Match": "invalid"}, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+
+			res = do(http.MethodDelete, ts.URL+path+"/"+id, map[string]string{"If-Match": `"1"`}, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("Should only match the strong ETags of the If-Match list", func() {
+			// A weak ETag never matches with the strong comparison
+			res := do(http.MethodDelete, ts.URL+path+"/"+id, map[string]string{"If-Match": `W/"1"`}, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusPreconditionFailed))
+
+			res = do(http.MethodDelete, ts.URL+path+"/"+id, map[string]string{"If-Match": `W/"1", "abc", "0"`}, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusPreconditionFailed))
+
+			res = do(http.MethodDelete, ts.URL+path+"/"+id, map[string]string{"If-Match": `"1", "abc`}, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+
+			res = do(http.MethodDelete, ts.URL+path+"/"+id, map[string]string{"If-Match": `W/"1", "abc", "1",`}, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("Patch documents", func() {
+		var id string
+
+		// patch sends a patch of the media type contentType, and returns its response and body
+		patch := func(contentType string, headers map[string]string, body string) (*http.Response, string) {
+			to := time.Duration(10)
+			h := map[string]string{"Content-Type": contentType}
+			for k, v := range headers {
+				h[k] = v
+			}
+			return testhelpers.DoRequest(&testhelpers.HttpOptions{
+				Ctx:     context.Background(),
+				Url:     ts.URL + path + "/" + id,
+				TO:      &to,
+				Method:  http.MethodPatch,
+				Headers: h,
+				Data:    []byte(body),
+			})
+		}
+
+		BeforeEach(func() {
+			to := time.Duration(10)
+			res, bodystring := testhelpers.DoRequest(&testhelpers.HttpOptions{
+				Ctx:    context.Background(),
+				Url:    ts.URL + path,
+				TO:     &to,
+				Method: http.MethodPost,
+				Data:   []byte(`{"firstname": "abc", "lastname": "xyz", "age": 29, "email": "abcxyz@test.com"}`),
+			})
+			Expect(res.StatusCode).To(Equal(http.StatusCreated))
+			id = bodystring
+		})
+
+		It("Should apply a JSON Merge Patch, and set a field to its zero value", func() {
+			res, body := patch(user.MergePatchContentType, nil, `{"age": 0, "lastname": "patched"}`)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res).To(HaveHTTPHeaderWithValue("ETag", `"2"`))
+
+			var patched user.User
+			Expect(json.Unmarshal([]byte(body), &patched)).To(Succeed())
+			Expect(patched.Age).To(BeZero())
+			Expect(patched.LastName).To(Equal("patched"))
+			Expect(patched.FirstName).To(Equal("abc"))
+
+			var usr user.User
+			err := gdb.First(&usr, id).Error
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(usr.Age).To(BeZero())
+			Expect(usr.LastName).To(Equal("patched"))
+		})
+
+		It("Should apply a JSON Patch", func() {
+			res, _ := patch(user.JSONPatchContentType, map[string]string{"If-Match": `"1"`},
+				`[{"op": "test", "path": "/age", "value": 29}, {"op": "replace", "path": "/age", "value": 30}]`)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			var usr user.User
+			err := gdb.First(&usr, id).Error
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(usr.Age).To(Equal(uint8(30)))
+		})
+
+		It("Should return a 422 error when the patch can't be applied", func() {
+			// A failed test operation
+			res, _ := patch(user.JSONPatchContentType, nil, `[{"op": "test", "path": "/age", "value": 99}]`)
+			Expect(res.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+			Expect(res).To(HaveHTTPHeaderWithValue("Content-Type", problem.ContentType))
+
+			// The id is not part of the patched document
+			res, _ = patch(user.MergePatchContentType, nil, `{"id": 12345}`)
+			Expect(res.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+		})
+
+		It("Should return a 422 error with the violations of the patched user", func() {
+			res, body := patch(user.MergePatchContentType, nil, `{"firstname": null}`)
+			Expect(res.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+
+			var p problem.Problem
+			Expect(json.Unmarshal([]byte(body), &p)).To(Succeed())
+			Expect(p.Violations).To(ConsistOf(HaveField("Field", "firstname")))
+		})
+
+		It("Should return a 400 error for a malformed patch", func() {
+			res, _ := patch(user.MergePatchContentType, nil, `{"age":`)
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+
+		It("Should return a 412 error when the user was modified since the version in If-Match", func() {
+			res, _ := patch(user.MergePatchContentType, map[string]string{"If-Match": `"2"`}, `{"age": 30}`)
+			Expect(res.StatusCode).To(Equal(http.StatusPreconditionFailed))
+		})
+
+		It("Should return a 415 error for an unsupported media type", func() {
+			res, _ := patch("text/plain", nil, `age=30`)
+			Expect(res.StatusCode).To(Equal(http.StatusUnsupportedMediaType))
+			Expect(res).To(HaveHTTPHeaderWithValue("Content-Type", problem.ContentType))
+		})
+	})
+
+	Context("Soft-delete lifecycle", func() {
+		var id string
+
+		// do sends a request with the headers, and returns its response
+		do := func(method, url string, headers map[string]string) *http.Response {
+			to := time.Duration(10)
+			res, _ := testhelpers.DoRequest(&testhelpers.HttpOptions{
+				Ctx:     context.Background(),
+				Url:     url,
+				TO:      &to,
+				Method:  method,
+				Headers: headers,
+			})
+			return res
+		}
+
+		BeforeEach(func() {
+			// NewUserHandler returns the singleton created by SetupSubrouter
+			user.NewUserHandler(nil).WithAdminToken("secret")
+
+			to := time.Duration(10)
+			res, bodystring := testhelpers.DoRequest(&testhelpers.HttpOptions{
+				Ctx:    context.Background(),
+				Url:    ts.URL + path,
+				TO:     &to,
+				Method: http.MethodPost,
+				Data:   []byte(`{"firstname": "abc", "lastname": "xyz", "age": 29, "email": "abcxyz@test.com"}`),
+			})
+			Expect(res.StatusCode).To(Equal(http.StatusCreated))
+			id = bodystring
+		})
+
+		// POST /user/{id}/restore
+		It("Should restore a deleted user", func() {
+			res := do(http.MethodPost, ts.URL+path+"/"+id+"/restore", nil)
+			Expect(res.StatusCode).To(Equal(http.StatusConflict))
+
+			res = do(http.MethodDelete, ts.URL+path+"/"+id, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			res = do(http.MethodGet, ts.URL+path+"/"+id, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+
+			res = do(http.MethodPost, ts.URL+path+"/"+id+"/restore", nil)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			res = do(http.MethodGet, ts.URL+path+"/"+id, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		// DELETE /user/{id}?purge=true
+		It("Should only let the admins purge a user", func() {
+			res := do(http.MethodDelete, ts.URL+path+"/"+id+"?purge=true", nil)
+			Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+
+			res = do(http.MethodDelete, ts.URL+path+"/"+id+"?purge=true", map[string]string{"X-Admin-Token": "wrong"})
+			Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+
+			res = do(http.MethodDelete, ts.URL+path+"/"+id+"?purge=true", map[string]string{"X-Admin-Token": "secret"})
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			// A purged user can't be restored
+			res = do(http.MethodPost, ts.URL+path+"/"+id+"/restore", nil)
+			Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Context("List Users Handler", func() {
+
+		// GET /user
+		When("There are more users than the limit", func() {
+			It("Should return pages linked by a cursor", func() {
+				to := time.Duration(10)
+				for _, name := range []string{"abc", "def", "ghi"} {
+					opt := &testhelpers.HttpOptions{
+						Ctx:    context.Background(),
+						Url:    ts.URL + path,
+						TO:     &to,
+						Method: http.MethodPost,
+						Data:   []byte(`{"firstname": "` + name + `", "lastname": "xyz", "age": 29, "email": "` + name + `@test.com"}`),
+					}
+					res, _ := testhelpers.DoRequest(opt)
+					Expect(res.StatusCode).To(Equal(http.StatusCreated))
+				}
+
+				opt := &testhelpers.HttpOptions{
+					Ctx:    context.Background(),
+					Url:    ts.URL + path + "?name_prefix=xyz&limit=2",
+					TO:     &to,
+					Method: http.MethodGet,
+				}
+				res, bodystring := testhelpers.DoRequest(opt)
+
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(res).To(HaveHTTPHeaderWithValue("Content-Type", "application/json"))
+
+				var page user.UserPage
+				Expect(json.Unmarshal([]byte(bodystring), &page)).To(Succeed())
+				Expect(page.Users).To(HaveLen(2))
+				Expect(page.NextCursor).NotTo(BeEmpty())
+				Expect(res).To(HaveHTTPHeaderWithValue("Link", `<`+path+`?cursor=`+page.NextCursor+`&limit=2&name_prefix=xyz>; rel="next"`))
+
+				opt = &testhelpers.HttpOptions{
+					Ctx:    context.Background(),
+					Url:    ts.URL + path + "?limit=2&cursor=" + page.NextCursor,
+					TO:     &to,
+					Method: http.MethodGet,
+				}
+				res, bodystring = testhelpers.DoRequest(opt)
+
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(res.Header.Get("Link")).To(BeEmpty())
+
+				page = user.UserPage{}
+				Expect(json.Unmarshal([]byte(bodystring), &page)).To(Succeed())
+				Expect(page.Users).To(HaveLen(1))
+				Expect(page.Users[0].FirstName).To(Equal("ghi"))
+				Expect(page.NextCursor).To(BeEmpty())
+			})
+		})
+
+		// GET /user
+		When("The name prefix has punctuation or LIKE wildcards", func() {
+			It("Should match it literally", func() {
+				to := time.Duration(10)
+				for _, name := range []string{"Jean-Luc", "Jeanne"} {
+					opt := &testhelpers.HttpOptions{
+						Ctx:    context.Background(),
+						Url:    ts.URL + path,
+						TO:     &to,
+						Method: http.MethodPost,
+						Data:   []byte(`{"firstname": "` + name + `", "lastname": "xyz", "age": 29, "email": "` + strings.ToLower(name) + `@test.com"}`),
+					}
+					res, _ := testhelpers.DoRequest(opt)
+					Expect(res.StatusCode).To(Equal(http.StatusCreated))
+				}
+
+				list := func(prefix string) []user.User {
+					opt := &testhelpers.HttpOptions{
+						Ctx:    context.Background(),
+						Url:    ts.URL + path + "?name_prefix=" + url.QueryEscape(prefix),
+						TO:     &to,
+						Method: http.MethodGet,
+					}
+					res, bodystring := testhelpers.DoRequest(opt)
+					Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+					var page user.UserPage
+					Expect(json.Unmarshal([]byte(bodystring), &page)).To(Succeed())
+					return page.Users
+				}
+
+				users := list("Jean-")
+				Expect(users).To(HaveLen(1))
+				Expect(users[0].FirstName).To(Equal("Jean-Luc"))
+
+				Expect(list("Jea%")).To(BeEmpty())
+				Expect(list("Jean_")).To(BeEmpty())
+			})
+		})
+
+		// GET /user
+		When("The sort field is not allowed", func() {
+			It("Should return http 422 error", func() {
+				to := time.Duration(10)
+				opt := &testhelpers.HttpOptions{
+					Ctx:    context.Background(),
+					Url:    ts.URL + path + "?sort=email",
+					TO:     &to,
+					Method: http.MethodGet,
+				}
+
 				res, _ := testhelpers.DoRequest(opt)
 
-				Expect(res.StatusCode).To(Equal(http.StatusInternalServerError))
-				// Expect(bodystring).To(ContainSubstring(`"Ping":"Pong"`))
-				// Expect(res).To(HaveHTTPHeaderWithValue("Content-Type", "application/json"))
+				Expect(res.StatusCode).To(Equal(http.StatusUnprocessableEntity))
 			})
 		})
 	})
@@ -317,7 +754,7 @@ var _ = Describe("User Handlers", Serial, func() {
 
 		// PATCH /user
 		When("User ID is of non-existent user", func() {
-			It("Should return http 500 error", func() {
+			It("Should return http 404 error", func() {
 				body := []byte(`{
 					"firstname": "updatefn",
 					"lastname": "updateln",
@@ -335,7 +772,7 @@ var _ = Describe("User Handlers", Serial, func() {
 
 				res, _ := testhelpers.DoRequest(opt)
 
-				Expect(res.StatusCode).To(Equal(http.StatusInternalServerError))
+				Expect(res.StatusCode).To(Equal(http.StatusNotFound))
 			})
 		})
 
@@ -390,7 +827,7 @@ var _ = Describe("User Handlers", Serial, func() {
 
 		// PATCH /user
 		When("Incorrect body param is present", func() {
-			It("Should return a 500 error", func() {
+			It("Should return a 422 error", func() {
 				body := []byte(`{
 					"firstname": "abc",
 					"lastname": "xyz",
@@ -433,7 +870,7 @@ var _ = Describe("User Handlers", Serial, func() {
 
 				res, _ = testhelpers.DoRequest(opt)
 
-				Expect(res.StatusCode).To(Equal(http.StatusInternalServerError))
+				Expect(res.StatusCode).To(Equal(http.StatusUnprocessableEntity))
 			})
 		})
 
@@ -12,6 +12,8 @@ type User struct {
 	CreatedAt time.Time      `json:"created_at,omitempty"`
 	UpdatedAt time.Time      `json:"updated_at,omitempty"`
 	DeletedAt gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
+	// Version is incremented by every update, for optimistic concurrency control. It is the ETag of the user.
+	Version uint `json:"version,omitempty" gorm:"not null;default:1"`
 
 	FirstName string `json:"firstname,omitempty" validate:"required"`
 	LastName  string `json:"lastname,omitempty" validate:"required"`
@@ -27,3 +29,39 @@ type UpdateUserInput struct {
 	Age       uint8  `json:"age,omitempty" validate:"omitempty,gte=0,lte=130"`
 	Email     string `json:"email,omitempty" validate:"omitempty,email"`
 }
+
+// ListUsersInput holds the query parameters of GET /user. The json tags name the fields in the validation errors.
+type ListUsersInput struct {
+	Email      string `json:"email" validate:"omitempty,email"`
+	NamePrefix string `json:"name_prefix" validate:"omitempty,max=100"` // prefix of the first or the last name, whose LIKE wildcards are escaped
+	MinAge     *uint8 `json:"min_age" validate:"omitempty,lte=130"`
+	MaxAge     *uint8 `json:"max_age" validate:"omitempty,lte=130"`
+	// Sort is "id" or "created_at", prefixed with "-" for a descending order. Defaults to "id".
+	// The sort field is a key of the cursor, so a new one must be indexed and ordered together with the id.
+	Sort           string `json:"sort" validate:"omitempty,oneof=id -id created_at -created_at"`
+	IncludeDeleted bool   `json:"include_deleted"`
+	// Limit is the size of the page. Defaults to DefaultListLimit.
+	Limit  int    `json:"limit" validate:"omitempty,gte=1,lte=100"`
+	Cursor string `json:"cursor"`
+}
+
+// UserQuery is what UserRepository.List looks for: the users matching the filters, in the order of SortField,
+// after the user of the cursor (keyset pagination), at most Limit of them.
+type UserQuery struct {
+	Email          string
+	NamePrefix     string
+	MinAge         *uint8
+	MaxAge         *uint8
+	SortField      string
+	Descending     bool
+	IncludeDeleted bool
+	After          *UserCursor
+	Limit          int
+}
+
+// UserPage is the response of GET /user.
+type UserPage struct {
+	Users []User `json:"users"`
+	// NextCursor is passed as the cursor query parameter to get the next page. Empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
@@ -0,0 +1,69 @@
+package user
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserEventType is the type of a UserEvent.
+type UserEventType string
+
+const (
+	UserCreated UserEventType = "user.created"
+	// UserUpdated is also recorded when a deleted user is restored.
+	UserUpdated UserEventType = "user.updated"
+	UserDeleted UserEventType = "user.deleted"
+)
+
+// UserEventStatus is the delivery status of a UserEvent.
+type UserEventStatus string
+
+const (
+	// EventPending events are waiting to be published, or to be retried after a failed attempt.
+	EventPending UserEventStatus = "pending"
+	// EventPublished events were published.
+	EventPublished UserEventStatus = "published"
+	// EventDead events failed to be published too many times, or with a permanent error. They are not retried.
+	EventDead UserEventStatus = "dead"
+)
+
+// UserEvent is a change of a user, recorded in the outbox table in the same transaction as the change itself,
+// so that the event is recorded if and only if the change is committed (transactional outbox pattern).
+// The OutboxRelay publishes it afterwards.
+type UserEvent struct {
+	ID     uint          `json:"id" gorm:"primarykey"`
+	Type   UserEventType `json:"type" gorm:"not null"`
+	UserID uint          `json:"user_id" gorm:"not null;index"`
+	// Data is the user after the change, or as it was deleted.
+	Data       json.RawMessage `json:"data"`
+	OccurredAt time.Time       `json:"occurred_at" gorm:"not null"`
+
+	// Delivery state, see OutboxRelay
+	Status        UserEventStatus `json:"-" gorm:"not null;default:pending;index:idx_user_events_due,priority:1"`
+	NextAttemptAt time.Time       `json:"-" gorm:"not null;index:idx_user_events_due,priority:2"`
+	Attempts      int             `json:"-" gorm:"not null;default:0"`
+	LastError     string          `json:"-"`
+	PublishedAt   *time.Time      `json:"-"`
+}
+
+// recordEvent adds an event of eventType for user to the outbox, with tx, the transaction of the change.
+// The event is dated with the clock of ur.
+func (ur *UserRepo) recordEvent(tx *gorm.DB, eventType UserEventType, user User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	now := ur.clock.Now()
+
+	return tx.Create(&UserEvent{
+		Type:          eventType,
+		UserID:        user.ID,
+		Data:          data,
+		OccurredAt:    now,
+		Status:        EventPending,
+		NextAttemptAt: now,
+	}).Error
+}
@@ -0,0 +1,90 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+)
+
+// The media types of the patches of PATCH /user/{id}, besides application/json (see UpdateUserInput).
+const (
+	// MergePatchContentType is a JSON Merge Patch (RFC 7396): the fields of the patch replace the ones of the user,
+	// and a null removes (zeroes) a field.
+	MergePatchContentType = "application/merge-patch+json"
+	// JSONPatchContentType is a JSON Patch (RFC 6902): a list of operations (add, remove, replace, move, copy, test)
+	// on the fields of the user.
+	JSONPatchContentType = "application/json-patch+json"
+)
+
+var (
+	// ErrUnsupportedMediaType is returned for a patch whose media type is none of the supported ones.
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+	// ErrInvalidPatch is returned when a patch can't be applied to the user, e.g. a failed "test" operation,
+	// or when the patched user can't be decoded, e.g. a patched id.
+	ErrInvalidPatch = errors.New("patch can't be applied to the user")
+)
+
+// patchDocument is the document a patch applies to: the mutable fields of a user.
+// The other fields (id, version, timestamps) are not part of it, so a patch can't change them.
+type patchDocument struct {
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	Age       uint8  `json:"age"`
+	Email     string `json:"email"`
+}
+
+// applyPatch applies patch, of the media type contentType, to the mutable fields of user.
+// The patched user is not validated.
+func applyPatch(user User, contentType string, patch []byte) (User, error) {
+	if !json.Valid(patch) {
+		return User{}, fmt.Errorf("%w: the patch is not valid JSON", ErrBadRequest)
+	}
+
+	doc, err := json.Marshal(patchDocument{
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Age:       user.Age,
+		Email:     user.Email,
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	var patched []byte
+	switch contentType {
+	case MergePatchContentType:
+		patched, err = jsonpatch.MergePatch(doc, patch)
+	case JSONPatchContentType:
+		var ops jsonpatch.Patch
+		ops, err = jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return User{}, fmt.Errorf("%w: %w", ErrBadRequest, err)
+		}
+		patched, err = ops.Apply(doc)
+	default:
+		return User{}, fmt.Errorf("%w: %s", ErrUnsupportedMediaType, contentType)
+	}
+
+	if err != nil {
+		return User{}, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+	}
+
+	// A field that is not in patchDocument, e.g. "id", can't be patched
+	var result patchDocument
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&result); err != nil {
+		return User{}, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+	}
+
+	user.FirstName = result.FirstName
+	user.LastName = result.LastName
+	user.Age = result.Age
+	user.Email = result.Email
+
+	return user, nil
+}
@@ -0,0 +1,168 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/redis/go-redis/v9"
+)
+
+// Publisher publishes the user events to downstream systems. Publish may be called more than once for the same event
+// (at-least-once delivery), so the consumers should deduplicate the events by id.
+// An error wrapped with cnp.Permanent is not retried: the event is dead-lettered right away.
+type Publisher interface {
+	Publish(ctx context.Context, event UserEvent) error
+}
+
+// WriterPublisher writes every event as a line of JSON to a writer, e.g. os.Stdout.
+type WriterPublisher struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterPublisher(w io.Writer) *WriterPublisher {
+	return &WriterPublisher{w: w}
+}
+
+// NewStdoutPublisher creates a WriterPublisher writing to os.Stdout.
+func NewStdoutPublisher() *WriterPublisher {
+	return NewWriterPublisher(os.Stdout)
+}
+
+func (p *WriterPublisher) Publish(ctx context.Context, event UserEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return cnp.Permanent(err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err = p.w.Write(append(line, '\n'))
+	return err
+}
+
+// FilePublisher appends every event as a line of JSON to a file (JSON Lines).
+type FilePublisher struct {
+	*WriterPublisher
+	file *os.File
+}
+
+// NewFilePublisher creates a FilePublisher appending to the file at path, created if needed.
+func NewFilePublisher(path string) (*FilePublisher, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FilePublisher{
+		WriterPublisher: NewWriterPublisher(file),
+		file:            file,
+	}, nil
+}
+
+func (p *FilePublisher) Publish(ctx context.Context, event UserEvent) error {
+	if err := p.WriterPublisher.Publish(ctx, event); err != nil {
+		return err
+	}
+
+	// The event is published once it is on disk
+	return p.file.Sync()
+}
+
+// Close closes the file.
+func (p *FilePublisher) Close() error {
+	return p.file.Close()
+}
+
+// WebhookPublisher POSTs every event as JSON to a URL. A 2xx response means that the event was received.
+type WebhookPublisher struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookPublisher creates a WebhookPublisher posting to url with client (http.DefaultClient if nil).
+func NewWebhookPublisher(url string, client *http.Client) *WebhookPublisher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &WebhookPublisher{url: url, client: client}
+}
+
+func (p *WebhookPublisher) Publish(ctx context.Context, event UserEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return cnp.Permanent(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return cnp.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Id", strconv.FormatUint(uint64(event.ID), 10))
+	req.Header.Set("X-Event-Type", string(event.Type))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	return WebhookStatusError(res.StatusCode)
+}
+
+// WebhookStatusError returns the error of a webhook response status: nil for 2xx, a permanent error for the 3xx and
+// 4xx that won't succeed if retried (a redirect is a 3xx when it is not followed), and a retryable error otherwise
+// (timeouts, throttling, server errors). It classifies the responses of the webhook.Dispatcher too.
+func WebhookStatusError(status int) error {
+	switch {
+	case status >= 200 && status < 300:
+		return nil
+	case status == http.StatusRequestTimeout, status == http.StatusTooManyRequests:
+		return fmt.Errorf("webhook responded %d", status)
+	case status >= 300 && status < 500:
+		return cnp.Permanent(fmt.Errorf("webhook responded %d", status))
+	default:
+		return fmt.Errorf("webhook responded %d", status)
+	}
+}
+
+// RedisStreamPublisher adds every event to a Redis stream (XADD). The consumers read it with consumer groups.
+type RedisStreamPublisher struct {
+	client redis.UniversalClient
+	stream string
+	maxLen int64
+}
+
+// NewRedisStreamPublisher creates a RedisStreamPublisher adding to stream with client.
+// The stream is trimmed to about maxLen entries, 0 for no trimming.
+func NewRedisStreamPublisher(client redis.UniversalClient, stream string, maxLen int64) *RedisStreamPublisher {
+	return &RedisStreamPublisher{client: client, stream: stream, maxLen: maxLen}
+}
+
+func (p *RedisStreamPublisher) Publish(ctx context.Context, event UserEvent) error {
+	return p.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: p.stream,
+		MaxLen: p.maxLen,
+		Approx: p.maxLen > 0,
+		Values: map[string]any{
+			"id":          event.ID,
+			"type":        string(event.Type),
+			"user_id":     event.UserID,
+			"occurred_at": event.OccurredAt.Format(time.RFC3339Nano),
+			"data":        string(event.Data),
+		},
+	}).Err()
+}
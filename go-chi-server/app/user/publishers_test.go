@@ -0,0 +1,130 @@
+package user_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/user"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Publishers", func() {
+	event := user.UserEvent{
+		ID:         7,
+		Type:       user.UserCreated,
+		UserID:     42,
+		Data:       json.RawMessage(`{"id":42,"firstname":"abc"}`),
+		OccurredAt: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	It("should write the events as JSON lines", func() {
+		var buf bytes.Buffer
+		publisher := user.NewWriterPublisher(&buf)
+
+		Expect(publisher.Publish(context.Background(), event)).To(Succeed())
+		Expect(buf.String()).To(MatchJSON(`{"id":7,"type":"user.created","user_id":42,"data":{"id":42,"firstname":"abc"},"occurred_at":"2023-01-01T00:00:00Z"}`))
+		Expect(buf.String()).To(HaveSuffix("\n"))
+	})
+
+	It("should append the events to a file", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "events.jsonl")
+		publisher, err := user.NewFilePublisher(path)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer publisher.Close()
+
+		Expect(publisher.Publish(context.Background(), event)).To(Succeed())
+		Expect(publisher.Publish(context.Background(), event)).To(Succeed())
+
+		file, err := os.Open(path)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+
+		lines := 0
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			Expect(scanner.Text()).To(ContainSubstring(`"type":"user.created"`))
+			lines++
+		}
+		Expect(lines).To(Equal(2))
+	})
+
+	Context("WebhookPublisher", func() {
+		It("should post the event", func() {
+			received := make(chan *http.Request, 1)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- r
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer ts.Close()
+
+			Expect(user.NewWebhookPublisher(ts.URL, nil).Publish(context.Background(), event)).To(Succeed())
+
+			var r *http.Request
+			Eventually(received).Should(Receive(&r))
+			Expect(r.Method).To(Equal(http.MethodPost))
+			Expect(r.Header.Get("X-Event-Id")).To(Equal("7"))
+			Expect(r.Header.Get("X-Event-Type")).To(Equal("user.created"))
+		})
+
+		It("should only retry the errors that may succeed later", func() {
+			status := http.StatusServiceUnavailable
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			}))
+			defer ts.Close()
+
+			publisher := user.NewWebhookPublisher(ts.URL, nil)
+
+			err := publisher.Publish(context.Background(), event)
+			Expect(err).Should(HaveOccurred())
+			Expect(cnp.IsPermanent(err)).To(BeFalse())
+
+			status = http.StatusBadRequest
+			err = publisher.Publish(context.Background(), event)
+			Expect(err).Should(HaveOccurred())
+			Expect(cnp.IsPermanent(err)).To(BeTrue())
+		})
+
+		DescribeTable("should classify the response statuses",
+			func(status int, failed, permanent bool) {
+				err := user.WebhookStatusError(status)
+				Expect(err != nil).To(Equal(failed))
+				Expect(cnp.IsPermanent(err)).To(Equal(permanent))
+			},
+			Entry("200", http.StatusOK, false, false),
+			Entry("204", http.StatusNoContent, false, false),
+			Entry("a redirect that was not followed", http.StatusFound, true, true),
+			Entry("400", http.StatusBadRequest, true, true),
+			Entry("408", http.StatusRequestTimeout, true, false),
+			Entry("429", http.StatusTooManyRequests, true, false),
+			Entry("500", http.StatusInternalServerError, true, false),
+			Entry("503", http.StatusServiceUnavailable, true, false),
+		)
+	})
+
+	It("should add the events to a Redis stream", func() {
+		mr := miniredis.RunT(GinkgoT())
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		defer client.Close()
+
+		Expect(user.NewRedisStreamPublisher(client, "user-events", 0).Publish(context.Background(), event)).To(Succeed())
+
+		entries, err := client.XRange(context.Background(), "user-events", "-", "+").Result()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Values).To(HaveKeyWithValue("type", "user.created"))
+		Expect(entries[0].Values).To(HaveKeyWithValue("user_id", "42"))
+		Expect(entries[0].Values).To(HaveKeyWithValue("data", `{"id":42,"firstname":"abc"}`))
+	})
+})
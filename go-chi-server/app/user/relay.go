@@ -0,0 +1,238 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/sethvargo/go-envconfig"
+	"gorm.io/gorm"
+)
+
+type OutboxRelayConfig struct {
+	Enabled        bool          `env:"OUTBOX_RELAY_ENABLED,overwrite,default=false"`
+	Interval       time.Duration `env:"OUTBOX_RELAY_INTERVAL,overwrite,default=1s"`           // how often the outbox is polled
+	BatchSize      int           `env:"OUTBOX_RELAY_BATCH_SIZE,overwrite,default=100"`        // the maximum number of events published per poll
+	MaxAttempts    int           `env:"OUTBOX_RELAY_MAX_ATTEMPTS,overwrite,default=10"`       // attempts before an event is dead-lettered
+	PublishTimeout time.Duration `env:"OUTBOX_RELAY_PUBLISH_TIMEOUT,overwrite,default=5s"`    // the maximum duration of a single publish
+	BaseDelay      time.Duration `env:"OUTBOX_RELAY_BASE_DELAY,overwrite,default=1s"`         // the backoff after the first failed attempt
+	MaxDelay       time.Duration `env:"OUTBOX_RELAY_MAX_DELAY,overwrite,default=10m"`         // the maximum backoff
+	Publisher      string        `env:"OUTBOX_PUBLISHER,overwrite,default=stdout"`            // stdout, file, webhook, redis, or webhooks for the /webhook subscriptions (see main)
+	FilePath       string        `env:"OUTBOX_FILE_PATH,overwrite,default=user-events.jsonl"` // the file of the file publisher
+	WebhookURL     string        `env:"OUTBOX_WEBHOOK_URL,overwrite"`                         // the URL of the webhook publisher
+	RedisAddr      string        `env:"OUTBOX_REDIS_ADDR,overwrite,default=localhost:6379"`   // the Redis server of the redis publisher
+	RedisStream    string        `env:"OUTBOX_REDIS_STREAM,overwrite,default=user-events"`    // the stream of the redis publisher
+}
+
+// OutboxRelay publishes the events of the outbox (see UserEvent) with a Publisher, in the order they were recorded
+// (an event that failed is retried after the next ones).
+//
+// The delivery is at-least-once: an event is marked as published only after Publish has returned,
+// so it is published again if the relay stops in between. A failed event is retried with an exponential backoff
+// with jitter, and dead-lettered (EventDead) after MaxAttempts attempts or a permanent error (see cnp.Permanent).
+//
+// Run a single relay: several relays would publish the same events concurrently (which is still at-least-once).
+type OutboxRelay struct {
+	*OutboxRelayConfig
+	db        *gorm.DB
+	publisher Publisher
+	cnp       *cnp.CNP
+	backoff   cnp.Backoff
+	logger    zerolog.Logger
+}
+
+// NewOutboxRelay creates an OutboxRelay of the outbox in db, configured with OUTBOX_* env vars,
+// whose interval and backoff are measured with clock. It returns an error if the env vars are not valid.
+func NewOutboxRelay(db *gorm.DB, clock clock.Clock) (*OutboxRelay, error) {
+	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+
+	// Set defaults with env vars
+	// Uses https://github.com/sethvargo/go-envconfig
+	config := &OutboxRelayConfig{}
+	if err := envconfig.Process(context.Background(), config); err != nil {
+		return nil, err
+	}
+
+	// The ticker of Run panics with an interval that is not positive
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("OUTBOX_RELAY_INTERVAL must be positive, got %s", config.Interval)
+	}
+
+	return &OutboxRelay{
+		OutboxRelayConfig: config,
+		db:                db,
+		cnp:               cnp.NewCloudNativePatterns(clock),
+		backoff:           cnp.FullJitterBackoff{Base: config.BaseDelay, Max: config.MaxDelay},
+		logger:            logger,
+	}, nil
+}
+
+// WithLogger sets the logger using builder pattern
+func (o *OutboxRelay) WithLogger(logger zerolog.Logger) *OutboxRelay {
+	o.logger = logger
+	return o
+}
+
+// WithPublisher sets the publisher using builder pattern. Without it, Run creates the one of OUTBOX_PUBLISHER.
+func (o *OutboxRelay) WithPublisher(publisher Publisher) *OutboxRelay {
+	o.publisher = publisher
+	return o
+}
+
+// WithBackoff sets the backoff between the attempts of an event using builder pattern
+func (o *OutboxRelay) WithBackoff(backoff cnp.Backoff) *OutboxRelay {
+	o.backoff = backoff
+	return o
+}
+
+// NewPublisher creates the Publisher named by config.Publisher.
+func NewPublisher(config *OutboxRelayConfig) (Publisher, error) {
+	switch config.Publisher {
+	case "stdout":
+		return NewStdoutPublisher(), nil
+	case "file":
+		return NewFilePublisher(config.FilePath)
+	case "webhook":
+		if config.WebhookURL == "" {
+			return nil, errors.New("OUTBOX_WEBHOOK_URL is required by the webhook publisher")
+		}
+		return NewWebhookPublisher(config.WebhookURL, &http.Client{Timeout: config.PublishTimeout}), nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{Addr: config.RedisAddr})
+		return NewRedisStreamPublisher(client, config.RedisStream, 0), nil
+	}
+
+	return nil, fmt.Errorf("unknown publisher %q", config.Publisher)
+}
+
+// Run relays the events every interval, until ctx is done. It returns right away if the relay is not enabled.
+// It is blocking, so run it on a separate goroutine.
+func (o *OutboxRelay) Run(ctx context.Context) {
+	if !o.Enabled {
+		return
+	}
+
+	if o.publisher == nil {
+		publisher, err := NewPublisher(o.OutboxRelayConfig)
+		if err != nil {
+			o.logger.Error().Err(err).Msg("Failed to create the outbox publisher")
+			return
+		}
+		o.publisher = publisher
+	}
+
+	o.logger.Info().Str("publisher", o.Publisher).Dur("interval", o.Interval).Msg("Started outbox relay")
+
+	ticker := o.cnp.Clock.Ticker(o.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			o.logger.Info().Msg("Stopped outbox relay")
+			return
+		case <-ticker.C:
+			// A failed relay is retried at the next tick
+			_, _ = o.Relay(ctx)
+		}
+	}
+}
+
+// Relay publishes the events that are due, up to BatchSize, and returns how many were published.
+func (o *OutboxRelay) Relay(ctx context.Context) (int, error) {
+	var events []UserEvent
+	err := o.db.WithContext(ctx).
+		Where("status = ? AND next_attempt_at <= ?", EventPending, o.cnp.Clock.Now()).
+		Order("id").
+		Limit(o.BatchSize).
+		Find(&events).Error
+	if err != nil {
+		o.logger.Error().Err(err).Msg("Failed to read the outbox")
+		return 0, err
+	}
+
+	published := 0
+	for _, event := range events {
+		if ctx.Err() != nil {
+			return published, ctx.Err()
+		}
+
+		ok, err := o.relay(ctx, event)
+		if err != nil {
+			return published, err
+		}
+
+		if ok {
+			published++
+		}
+	}
+
+	return published, nil
+}
+
+// AttemptOutcome is what becomes of a message after an attempt to deliver it, see NextAttempt.
+type AttemptOutcome int
+
+const (
+	AttemptSucceeded AttemptOutcome = iota // the message was delivered
+	AttemptRetried                         // the message is attempted again after a backoff
+	AttemptGaveUp                          // the message is not attempted again
+)
+
+// NextAttempt returns the outcome of the attempts-th attempt to deliver a message, which failed with err (nil if it
+// succeeded): a failed attempt is retried, unless err is permanent (see cnp.Permanent) or it was the maxAttempts-th.
+// The OutboxRelay and the webhook.Dispatcher share it, so that their messages are retried alike.
+func NextAttempt(err error, attempts, maxAttempts int) AttemptOutcome {
+	switch {
+	case err == nil:
+		return AttemptSucceeded
+	case cnp.IsPermanent(err) || attempts >= maxAttempts:
+		return AttemptGaveUp
+	default:
+		return AttemptRetried
+	}
+}
+
+// relay publishes event, records the outcome in the outbox, and reports whether it was published.
+// Only the failures to record the outcome are returned.
+func (o *OutboxRelay) relay(ctx context.Context, event UserEvent) (bool, error) {
+	publish := o.cnp.Timeout(func(ctx context.Context) error {
+		return o.publisher.Publish(ctx, event)
+	}, o.PublishTimeout)
+
+	err := publish(ctx)
+	now := o.cnp.Clock.Now()
+	attempts := event.Attempts + 1
+
+	columns := map[string]any{"attempts": attempts}
+	switch NextAttempt(err, attempts, o.MaxAttempts) {
+	case AttemptSucceeded:
+		columns["status"] = EventPublished
+		columns["published_at"] = now
+		columns["last_error"] = ""
+	case AttemptGaveUp:
+		columns["status"] = EventDead
+		columns["last_error"] = err.Error()
+		o.logger.Error().Err(err).Uint("eventID", event.ID).Int("attempts", attempts).Msg("Dead-lettered user event")
+	case AttemptRetried:
+		columns["next_attempt_at"] = now.Add(o.backoff.Delay(attempts, 0))
+		columns["last_error"] = err.Error()
+		o.logger.Warn().Err(err).Uint("eventID", event.ID).Int("attempts", attempts).Msg("Failed to publish user event")
+	}
+
+	// The outcome is recorded even if ctx was cancelled meanwhile, otherwise a published event would be published again
+	result := o.db.WithContext(context.WithoutCancel(ctx)).Model(&UserEvent{}).Where("id = ?", event.ID).Updates(columns)
+	if result.Error != nil {
+		o.logger.Error().Err(result.Error).Uint("eventID", event.ID).Msg("Failed to update the outbox")
+		return false, result.Error
+	}
+
+	return err == nil, nil
+}
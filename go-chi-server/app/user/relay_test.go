@@ -0,0 +1,209 @@
+package user_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/user"
+	"github.com/rs/zerolog"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// fakePublisher records the published events, and fails with err if set.
+type fakePublisher struct {
+	mu     sync.Mutex
+	err    error
+	calls  int
+	events []user.UserEvent
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, event user.UserEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.calls++
+	if p.err != nil {
+		return p.err
+	}
+	p.events = append(p.events, event)
+	return nil
+}
+
+var _ = Describe("Outbox", func() {
+	var (
+		gdb       *gorm.DB
+		usrrepo   user.UserRepository
+		mockclock *clock.Mock
+		publisher *fakePublisher
+		relay     *user.OutboxRelay
+	)
+
+	// outbox returns the events of the outbox, in order
+	outbox := func() []user.UserEvent {
+		var events []user.UserEvent
+		Expect(gdb.Order("id").Find(&events).Error).ShouldNot(HaveOccurred())
+		return events
+	}
+
+	BeforeEach(func() {
+		// When the name of the database file handed to sqlite3_open() or to ATTACH is an empty string, then a new temporary file is created to hold the database.
+		// https://www.sqlite.org/inmemorydb.html
+		var err error
+		gdb, err = gorm.Open(sqlite.Open(""), &gorm.Config{})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		// The events are dated with the clock of the relay
+		mockclock = clock.NewMock()
+
+		automigrateUser := true
+		usrrepo = user.NewUserRepository(gdb, automigrateUser).WithClock(mockclock)
+
+		publisher = &fakePublisher{}
+		relay, err = user.NewOutboxRelay(gdb, mockclock)
+		Expect(err).ShouldNot(HaveOccurred())
+		relay = relay.
+			WithLogger(zerolog.Nop()).
+			WithPublisher(publisher).
+			WithBackoff(cnp.ConstantBackoff{Interval: time.Minute})
+		relay.MaxAttempts = 3
+	})
+
+	AfterEach(func() {
+		user.DiscardUserRepository()
+		gdb = nil
+	})
+
+	Context("UserRepo", func() {
+		It("should record an event with every change of a user", func() {
+			id, err := usrrepo.Add(context.Background(), user.User{FirstName: "abc", LastName: "xyz", Email: "abc@test.com"})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(usrrepo.Update(context.Background(), id, 1, user.User{Age: 30})).To(Succeed())
+			Expect(usrrepo.Delete(context.Background(), id, 0)).To(Succeed())
+
+			events := outbox()
+			Expect(events).To(HaveLen(3))
+			Expect(events).To(HaveEach(HaveField("UserID", id)))
+			Expect(events).To(HaveEach(HaveField("Status", user.EventPending)))
+			Expect(events).To(HaveEach(HaveField("OccurredAt", BeTemporally("==", mockclock.Now()))))
+			Expect(events).To(HaveEach(HaveField("NextAttemptAt", BeTemporally("==", mockclock.Now()))))
+			Expect([]user.UserEventType{events[0].Type, events[1].Type, events[2].Type}).To(Equal(
+				[]user.UserEventType{user.UserCreated, user.UserUpdated, user.UserDeleted}))
+
+			// The event carries the user after the change
+			var updated user.User
+			Expect(json.Unmarshal(events[1].Data, &updated)).To(Succeed())
+			Expect(updated.Age).To(Equal(uint8(30)))
+			Expect(updated.Version).To(Equal(uint(2)))
+		})
+
+		It("should not record an event for a change that is rolled back", func() {
+			id, err := usrrepo.Add(context.Background(), user.User{FirstName: "abc", LastName: "xyz", Email: "abc@test.com"})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(usrrepo.Update(context.Background(), id, 2, user.User{Age: 30})).To(MatchError(user.ErrVersionMismatch))
+			Expect(usrrepo.Delete(context.Background(), id+1, 0)).To(MatchError(gorm.ErrRecordNotFound))
+
+			Expect(outbox()).To(HaveLen(1))
+		})
+
+		It("should record a single deleted event for a user that is purged", func() {
+			purged, err := usrrepo.Add(context.Background(), user.User{FirstName: "abc", LastName: "xyz", Email: "abc@test.com"})
+			Expect(err).ShouldNot(HaveOccurred())
+			deleted, err := usrrepo.Add(context.Background(), user.User{FirstName: "def", LastName: "xyz", Email: "def@test.com"})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// A user that is not deleted is announced as deleted by Purge, a soft-deleted one was already by Delete
+			Expect(usrrepo.Purge(context.Background(), purged)).To(Succeed())
+			Expect(usrrepo.Delete(context.Background(), deleted, 0)).To(Succeed())
+			Expect(usrrepo.Purge(context.Background(), deleted)).To(Succeed())
+
+			events := outbox()
+			Expect(events).To(HaveLen(4))
+			Expect(events[2]).To(And(HaveField("Type", user.UserDeleted), HaveField("UserID", purged)))
+			Expect(events[3]).To(And(HaveField("Type", user.UserDeleted), HaveField("UserID", deleted)))
+		})
+	})
+
+	Context("OutboxRelay", func() {
+		DescribeTable("should refuse an interval that is not positive",
+			func(interval string) {
+				GinkgoT().Setenv("OUTBOX_RELAY_INTERVAL", interval)
+
+				_, err := user.NewOutboxRelay(gdb, mockclock)
+				Expect(err).To(MatchError(ContainSubstring("OUTBOX_RELAY_INTERVAL")))
+			},
+			Entry("zero", "0s"),
+			Entry("negative", "-1s"),
+		)
+
+		BeforeEach(func() {
+			for _, name := range []string{"first", "second"} {
+				_, err := usrrepo.Add(context.Background(), user.User{FirstName: name, LastName: "xyz", Email: name + "@test.com"})
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+		})
+
+		It("should publish the pending events in order, and only once", func() {
+			published, err := relay.Relay(context.Background())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(published).To(Equal(2))
+
+			Expect(publisher.events).To(HaveLen(2))
+			Expect(publisher.events[0].ID).To(BeNumerically("<", publisher.events[1].ID))
+			Expect(outbox()).To(HaveEach(HaveField("Status", user.EventPublished)))
+
+			published, err = relay.Relay(context.Background())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(published).To(BeZero())
+			Expect(publisher.calls).To(Equal(2))
+		})
+
+		It("should retry a failed event after the backoff, and dead-letter it after the last attempt", func() {
+			publisher.err = errors.New("downstream is unavailable")
+
+			for attempt := 1; attempt <= 3; attempt++ {
+				published, err := relay.Relay(context.Background())
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(published).To(BeZero())
+				Expect(outbox()).To(HaveEach(HaveField("Attempts", attempt)))
+
+				// Not retried before the backoff
+				_, err = relay.Relay(context.Background())
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(publisher.calls).To(Equal(2 * attempt))
+
+				mockclock.Add(time.Minute)
+			}
+
+			Expect(outbox()).To(HaveEach(And(
+				HaveField("Status", user.EventDead),
+				HaveField("LastError", "downstream is unavailable"),
+			)))
+
+			_, err := relay.Relay(context.Background())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(publisher.calls).To(Equal(6))
+		})
+
+		It("should dead-letter an event that failed with a permanent error right away", func() {
+			publisher.err = cnp.Permanent(errors.New("invalid event"))
+
+			_, err := relay.Relay(context.Background())
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(outbox()).To(HaveEach(And(
+				HaveField("Status", user.EventDead),
+				HaveField("Attempts", 1),
+			)))
+		})
+	})
+})
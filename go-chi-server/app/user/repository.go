@@ -2,38 +2,120 @@ package user
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/benbjohnson/clock"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/patilchinmay/go-experiments/go-chi-server/utils/logger"
+	"github.com/sethvargo/go-envconfig"
 	"gorm.io/gorm"
 )
 
 // go generate mockgen -destination=mocks/repository_mock.go -package mocks . UserRepository
+//
+// The changes of the users (Add, Delete, Update, Replace, Restore, Purge) record a UserEvent in the outbox,
+// in the same transaction.
 type UserRepository interface {
 	Get(ctx context.Context, id uint) (User, error)
 	Add(ctx context.Context, user User) (uint, error)
-	Delete(ctx context.Context, id uint) error
-	Update(ctx context.Context, id uint, input User) error
+	// Delete and Update only change the user if its version is still version, and return ErrVersionMismatch
+	// otherwise. A version of 0 matches any version.
+	Delete(ctx context.Context, id uint, version uint) error
+	Update(ctx context.Context, id uint, version uint, input User) error
+	// Replace is Update for every mutable field of input, zero values included.
+	Replace(ctx context.Context, id uint, version uint, input User) error
+	List(ctx context.Context, query UserQuery) ([]User, error)
+	// Restore undoes the soft delete of the user id, and returns ErrUserNotDeleted if it is not deleted.
+	Restore(ctx context.Context, id uint) error
+	// Purge permanently removes the user id, deleted or not. Like PurgeDeleted, it records no event for a user that
+	// is already soft-deleted, whose UserDeleted was recorded by Delete.
+	Purge(ctx context.Context, id uint) error
+	// PurgeDeleted permanently removes the users soft-deleted before before, and returns how many were removed.
+	// It removes them in batches, each in its own query, and returns how many were removed until a batch failed.
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+}
+
+type UserRepoConfig struct {
+	QueryTimeout   time.Duration `env:"USER_REPO_QUERY_TIMEOUT,overwrite,default=5s"`      // the maximum duration of a single query, 0 for none
+	PurgeBatchSize int           `env:"USER_REPO_PURGE_BATCH_SIZE,overwrite,default=1000"` // the maximum number of users removed by a single query of PurgeDeleted
 }
 
 type UserRepo struct {
-	db *gorm.DB
+	*UserRepoConfig
+	db    *gorm.DB
+	clock clock.Clock
 }
 
 var usrrepo *UserRepo
 
 func NewUserRepository(db *gorm.DB, automigrate bool) *UserRepo {
 	if usrrepo == nil {
+		// Set defaults with env vars
+		// Uses https://github.com/sethvargo/go-envconfig
+		config := &UserRepoConfig{}
+		if err := envconfig.Process(context.Background(), config); err != nil {
+			logger.Logger.Fatal().Err(err).Msg("Failed to override from env vars")
+		}
+
 		usrrepo = &UserRepo{
-			db: db,
+			UserRepoConfig: config,
+			db:             db,
+			clock:          clock.New(),
 		}
 
 		if automigrate {
-			// automigrate the user table
-			usrrepo.db.AutoMigrate(&User{})
+			// automigrate the user table, and its outbox
+			usrrepo.db.AutoMigrate(&User{}, &UserEvent{})
 		}
 	}
 	return usrrepo
 }
 
+// WithQueryTimeout sets the maximum duration of a single query using builder pattern
+func (ur *UserRepo) WithQueryTimeout(timeout time.Duration) *UserRepo {
+	ur.QueryTimeout = timeout
+	return ur
+}
+
+// WithPurgeBatchSize sets the maximum number of users removed by a single query of PurgeDeleted using builder pattern
+func (ur *UserRepo) WithPurgeBatchSize(size int) *UserRepo {
+	ur.PurgeBatchSize = size
+	return ur
+}
+
+// WithClock sets the clock that dates the events of the outbox using builder pattern.
+// It must be the clock of the OutboxRelay, which compares their NextAttemptAt with its own time.
+func (ur *UserRepo) WithClock(clock clock.Clock) *UserRepo {
+	ur.clock = clock
+	return ur
+}
+
+// session returns the db bound to ctx, so that a cancelled request (client disconnect, deadline, cancelled retry)
+// cancels its query, and that the query carries the request id (see db.SQLCommenter).
+// The query is also bounded by QueryTimeout. cancel must be called once the query is done.
+func (ur *UserRepo) session(ctx context.Context) (*gorm.DB, context.CancelFunc) {
+	cancel := context.CancelFunc(func() {})
+	if ur.QueryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, ur.QueryTimeout)
+	}
+
+	return ur.db.WithContext(ctx), cancel
+}
+
+// queryError returns the error of a query run with the session of ctx. A query that ran out of QueryTimeout fails with
+// a bare context.DeadlineExceeded, which is also how the queries of an expired request fail, and is not retried:
+// while ctx is still alive, it is turned into cnp.ErrTimeout, so that a hung database is retried and trips the breaker
+// (see db.IsRetryable).
+func (ur *UserRepo) queryError(ctx context.Context, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("%w: the query did not complete within %v", cnp.ErrTimeout, ur.QueryTimeout)
+	}
+	return err
+}
+
 // DiscardUserRepository will remove the reference to usrrepo so that it can be garbage collected. In other words, it deletes the singleton instance of *UserRepo.
 func DiscardUserRepository() {
 	if usrrepo != nil {
@@ -42,55 +124,321 @@ func DiscardUserRepository() {
 }
 
 func (ur *UserRepo) Get(ctx context.Context, id uint) (User, error) {
+	db, cancel := ur.session(ctx)
+	defer cancel()
+
 	var user User
 
-	result := ur.db.First(&user, id)
-	// result := ur.db.Debug().Omit("Age").First(&user, id) // Example of printing the query and ignoring a field
+	result := db.First(&user, id)
+	// result := db.Debug().Omit("Age").First(&user, id) // Example of printing the query and ignoring a field
 
 	if result.Error != nil {
-		return user, result.Error
+		return user, ur.queryError(ctx, result.Error)
 	}
 
 	return user, nil
 }
 
 func (ur *UserRepo) Add(ctx context.Context, user User) (uint, error) {
-	result := ur.db.Create(&user)
+	db, cancel := ur.session(ctx)
+	defer cancel()
 
-	if result.Error != nil {
-		return 0, result.Error
+	user.Version = 1
+
+	// The user and its event are committed together, see UserEvent
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+
+		return ur.recordEvent(tx, UserCreated, user)
+	})
+
+	if err != nil {
+		return 0, ur.queryError(ctx, err)
 	}
 
 	return user.ID, nil
 }
 
-func (ur *UserRepo) Delete(ctx context.Context, id uint) error {
-	result := ur.db.Delete(&User{}, id) // this is soft delete
-	// result := ur.db.Unscoped().Delete(&User{}, id) // this is hard delete
+func (ur *UserRepo) Delete(ctx context.Context, id uint, version uint) error {
+	db, cancel := ur.session(ctx)
+	defer cancel()
+
+	return ur.queryError(ctx, db.Transaction(func(tx *gorm.DB) error {
+		del := tx
+		if version != 0 {
+			del = del.Where("version = ?", version)
+		}
+
+		result := del.Delete(&User{}, id) // this is soft delete
+		// result := tx.Unscoped().Delete(&User{}, id) // this is hard delete
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ur.missingOrModified(tx, id)
+		}
+
+		// The event carries the user as it was deleted
+		var user User
+		if err := tx.Unscoped().First(&user, id).Error; err != nil {
+			return err
+		}
+
+		return ur.recordEvent(tx, UserDeleted, user)
+	}))
+}
+
+func (ur *UserRepo) Update(ctx context.Context, id uint, version uint, input User) error {
+	db, cancel := ur.session(ctx)
+	defer cancel()
+
+	// Only fields passed in the input will be updated. Rest will be left untouched.
+	return ur.queryError(ctx, ur.update(db, id, version, updatedColumns(input)))
+}
+
+func (ur *UserRepo) Replace(ctx context.Context, id uint, version uint, input User) error {
+	db, cancel := ur.session(ctx)
+	defer cancel()
+
+	return ur.queryError(ctx, ur.update(db, id, version, map[string]any{
+		"first_name": input.FirstName,
+		"last_name":  input.LastName,
+		"age":        input.Age,
+		"email":      input.Email,
+	}))
+}
+
+// update sets columns of the user id, increments its version, and records a UserUpdated event.
+func (ur *UserRepo) update(db *gorm.DB, id uint, version uint, columns map[string]any) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// The version is checked and incremented by the UPDATE itself, so that two concurrent updates of the same
+		// version can't both succeed.
+		upd := tx.Model(&User{}).Where("id = ?", id)
+		if version != 0 {
+			upd = upd.Where("version = ?", version)
+		}
+
+		columns["version"] = gorm.Expr("version + 1")
+		result := upd.Updates(columns)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ur.missingOrModified(tx, id)
+		}
+
+		return ur.recordUpdated(tx, id)
+	})
+}
+
+// recordUpdated records a UserUpdated event carrying the user id as updated by tx.
+func (ur *UserRepo) recordUpdated(tx *gorm.DB, id uint) error {
+	var user User
+	if err := tx.First(&user, id).Error; err != nil {
+		return err
+	}
+
+	return ur.recordEvent(tx, UserUpdated, user)
+}
+
+func (ur *UserRepo) Restore(ctx context.Context, id uint) error {
+	db, cancel := ur.session(ctx)
+	defer cancel()
+
+	return ur.queryError(ctx, db.Transaction(func(tx *gorm.DB) error {
+		// Unscoped, otherwise gorm would only look for the users that are not deleted
+		result := tx.Unscoped().Model(&User{}).
+			Where("id = ? AND deleted_at IS NOT NULL", id).
+			Updates(map[string]any{
+				"deleted_at": nil,
+				"version":    gorm.Expr("version + 1"),
+			})
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			// Either the user does not exist at all, or it is not deleted
+			var user User
+			if err := tx.Unscoped().Select("id").First(&user, id).Error; err != nil {
+				return err
+			}
 
+			return ErrUserNotDeleted
+		}
+
+		return ur.recordUpdated(tx, id)
+	}))
+}
+
+func (ur *UserRepo) Purge(ctx context.Context, id uint) error {
+	db, cancel := ur.session(ctx)
+	defer cancel()
+
+	return ur.queryError(ctx, db.Transaction(func(tx *gorm.DB) error {
+		// The event carries the user as it was purged
+		var user User
+		if err := tx.Unscoped().First(&user, id).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Unscoped().Delete(&User{}, id).Error; err != nil { // this is hard delete
+			return err
+		}
+
+		// A soft-deleted user was already announced as deleted by Delete
+		if user.DeletedAt.Valid {
+			return nil
+		}
+
+		return ur.recordEvent(tx, UserDeleted, user)
+	}))
+}
+
+func (ur *UserRepo) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	size := ur.PurgeBatchSize
+	if size < 1 {
+		size = 1
+	}
+
+	var purged int64
+	for {
+		selected, removed, err := ur.purgeBatch(ctx, before, size)
+		purged += removed
+
+		if err != nil || selected < size {
+			return purged, err
+		}
+	}
+}
+
+// purgeBatch permanently removes at most size of the users soft-deleted before before, those with the lowest ids,
+// so that a large backlog is removed by several queries that each complete within QueryTimeout. It returns how many
+// users it selected, and how many it removed.
+func (ur *UserRepo) purgeBatch(ctx context.Context, before time.Time, size int) (int, int64, error) {
+	db, cancel := ur.session(ctx)
+	defer cancel()
+
+	expired := db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", before)
+
+	// The ids are selected first, since MySQL does not support a LIMIT in an IN subquery
+	var ids []uint
+	if err := expired.Session(&gorm.Session{}).Model(&User{}).Order("id").Limit(size).Pluck("id", &ids).Error; err != nil {
+		return 0, 0, ur.queryError(ctx, err)
+	}
+
+	if len(ids) == 0 {
+		return 0, 0, nil
+	}
+
+	// The condition is checked again, in case a user was restored in the meantime
+	result := expired.Session(&gorm.Session{}).Delete(&User{}, ids)
 	if result.Error != nil {
-		return result.Error
+		return len(ids), 0, ur.queryError(ctx, result.Error)
 	}
 
-	return nil
+	return len(ids), result.RowsAffected, nil
 }
 
-func (ur *UserRepo) Update(ctx context.Context, id uint, input User) error {
+// missingOrModified tells why a write of the user id affected no row: either the user does not exist
+// (gorm.ErrRecordNotFound), or its version did not match (ErrVersionMismatch).
+func (ur *UserRepo) missingOrModified(db *gorm.DB, id uint) error {
 	var user User
-	result := ur.db.First(&user, id)
+	if err := db.Select("id").First(&user, id).Error; err != nil {
+		return err
+	}
 
-	if result.Error != nil {
-		return result.Error
+	return ErrVersionMismatch
+}
+
+// updatedColumns returns the columns to update from the non-zero fields of input, like Updates does with a struct
+// (https://gorm.io/docs/update.html#Updates-multiple-columns).
+func updatedColumns(input User) map[string]any {
+	columns := map[string]any{}
+
+	if input.FirstName != "" {
+		columns["first_name"] = input.FirstName
 	}
 
-	// Updates supports updating with struct or map[string]interface{}, when updating with struct it will only update non-zero fields by default
-	// https://gorm.io/docs/update.html#Updates-multiple-columns
-	// Only fields passed in the input will be updated. Rest will be left untouched.
-	result = ur.db.Model(&user).Updates(input)
+	if input.LastName != "" {
+		columns["last_name"] = input.LastName
+	}
+
+	if input.Age != 0 {
+		columns["age"] = input.Age
+	}
+
+	if input.Email != "" {
+		columns["email"] = input.Email
+	}
+
+	return columns
+}
+
+func (ur *UserRepo) List(ctx context.Context, query UserQuery) ([]User, error) {
+	db, cancel := ur.session(ctx)
+	defer cancel()
+
+	tx := db
+	if query.IncludeDeleted {
+		tx = tx.Unscoped()
+	}
+
+	if query.Email != "" {
+		tx = tx.Where("email = ?", query.Email)
+	}
+
+	if query.NamePrefix != "" {
+		prefix := likeEscaper.Replace(query.NamePrefix) + "%"
+		tx = tx.Where("(first_name LIKE ? ESCAPE '!' OR last_name LIKE ? ESCAPE '!')", prefix, prefix)
+	}
+
+	if query.MinAge != nil {
+		tx = tx.Where("age >= ?", *query.MinAge)
+	}
+
+	if query.MaxAge != nil {
+		tx = tx.Where("age <= ?", *query.MaxAge)
+	}
+
+	// Keyset pagination: the rows after the cursor in the sort order, the id breaking the ties
+	cmp, order := ">", "ASC"
+	if query.Descending {
+		cmp, order = "<", "DESC"
+	}
+
+	if query.After != nil {
+		switch query.SortField {
+		case "created_at":
+			tx = tx.Where("(created_at "+cmp+" ? OR (created_at = ? AND id "+cmp+" ?))",
+				query.After.CreatedAt, query.After.CreatedAt, query.After.ID)
+		default:
+			tx = tx.Where("id "+cmp+" ?", query.After.ID)
+		}
+	}
+
+	if query.SortField == "created_at" {
+		tx = tx.Order("created_at " + order)
+	}
+	tx = tx.Order("id " + order)
+
+	var users []User
+	result := tx.Limit(query.Limit).Find(&users)
 
 	if result.Error != nil {
-		return result.Error
+		return nil, ur.queryError(ctx, result.Error)
 	}
 
-	return nil
+	return users, nil
 }
+
+// likeEscaper escapes the wildcards of a LIKE pattern with '!', which unlike '\' is not an escape character of the
+// MySQL string literals.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
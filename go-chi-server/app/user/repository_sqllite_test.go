@@ -4,13 +4,18 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"sync/atomic"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
 	"github.com/patilchinmay/go-experiments/go-chi-server/app/user"
+	"github.com/patilchinmay/go-experiments/go-chi-server/db"
 )
 
 var _ = Describe("UserRepository with SQLite", func() {
@@ -97,7 +102,7 @@ var _ = Describe("UserRepository with SQLite", func() {
 			gdb.Create(user)
 
 			// Should delete the user
-			err := usrrepo.Delete(context.Background(), user.ID)
+			err := usrrepo.Delete(context.Background(), user.ID, 0)
 			Expect(err).ShouldNot(HaveOccurred())
 
 			// Should not get deleted user
@@ -129,7 +134,7 @@ var _ = Describe("UserRepository with SQLite", func() {
 			Expect(dbUserID).Should(Equal(usr.ID))
 
 			// Update the user
-			err = usrrepo.Update(context.Background(), usr.ID, *toBeUpdated)
+			err = usrrepo.Update(context.Background(), usr.ID, 0, *toBeUpdated)
 			Expect(err).ShouldNot(HaveOccurred())
 
 			// Get the updated user
@@ -177,7 +182,7 @@ var _ = Describe("UserRepository with SQLite", func() {
 			Expect(dbUserID).Should(Equal(usr.ID))
 
 			// Update the user
-			err = usrrepo.Update(context.Background(), usr.ID, *toBeUpdated)
+			err = usrrepo.Update(context.Background(), usr.ID, 0, *toBeUpdated)
 			Expect(err).ShouldNot(HaveOccurred())
 
 			// Get the updated user
@@ -200,4 +205,315 @@ var _ = Describe("UserRepository with SQLite", func() {
 			Expect(updatedUser.UpdatedAt).ShouldNot(Equal(updatedUser.CreatedAt))
 		})
 	})
+
+	Context("Optimistic concurrency", func() {
+		var usr user.User
+
+		BeforeEach(func() {
+			usr = user.User{
+				ID:        uint(rand.Uint32()),
+				FirstName: "test_firstname",
+				LastName:  "test_lastname",
+				Age:       30,
+				Email:     "test@test.com",
+			}
+			_, err := usrrepo.Add(context.Background(), usr)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should increment the version on update, and only update the given version", func() {
+			err := usrrepo.Update(context.Background(), usr.ID, 1, user.User{Age: 31})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			updatedUser, err := usrrepo.Get(context.Background(), usr.ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(updatedUser.Version).Should(Equal(uint(2)))
+			Expect(updatedUser.Age).Should(Equal(uint8(31)))
+
+			err = usrrepo.Update(context.Background(), usr.ID, 1, user.User{Age: 32})
+			Expect(err).Should(MatchError(user.ErrVersionMismatch))
+
+			err = usrrepo.Delete(context.Background(), usr.ID, 1)
+			Expect(err).Should(MatchError(user.ErrVersionMismatch))
+		})
+
+		It("should replace every field, zero values included", func() {
+			err := usrrepo.Replace(context.Background(), usr.ID, 1, user.User{FirstName: "replaced_firstname", Email: "replaced@test.com"})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			replacedUser, err := usrrepo.Get(context.Background(), usr.ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(replacedUser.Version).Should(Equal(uint(2)))
+			Expect(replacedUser.FirstName).Should(Equal("replaced_firstname"))
+			Expect(replacedUser.LastName).Should(BeEmpty())
+			Expect(replacedUser.Age).Should(BeZero())
+			Expect(replacedUser.Email).Should(Equal("replaced@test.com"))
+
+			err = usrrepo.Replace(context.Background(), usr.ID, 1, usr)
+			Expect(err).Should(MatchError(user.ErrVersionMismatch))
+		})
+
+		It("should tell a missing user from a modified one", func() {
+			err := usrrepo.Update(context.Background(), usr.ID+1, 1, user.User{Age: 31})
+			Expect(err).Should(MatchError(gorm.ErrRecordNotFound))
+
+			err = usrrepo.Delete(context.Background(), usr.ID+1, 0)
+			Expect(err).Should(MatchError(gorm.ErrRecordNotFound))
+		})
+	})
+
+	Context("Context", func() {
+		It("should not run the queries of a cancelled request", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := usrrepo.Get(ctx, 1)
+			Expect(err).Should(MatchError(context.Canceled))
+
+			_, err = usrrepo.Add(ctx, user.User{FirstName: "test_firstname"})
+			Expect(err).Should(MatchError(context.Canceled))
+		})
+
+		It("should bound every query by the query timeout", func() {
+			usrrepo.(*user.UserRepo).WithQueryTimeout(time.Nanosecond)
+
+			// The request is still alive, so the database is the one that timed out
+			_, err := usrrepo.List(context.Background(), user.UserQuery{Limit: 10})
+			Expect(err).Should(MatchError(cnp.ErrTimeout))
+			Expect(db.IsRetryable(err)).To(BeTrue())
+		})
+
+		It("should not mistake an expired request for a query timeout", func() {
+			usrrepo.(*user.UserRepo).WithQueryTimeout(time.Minute)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+			defer cancel()
+			<-ctx.Done()
+
+			_, err := usrrepo.List(ctx, user.UserQuery{Limit: 10})
+			Expect(err).Should(MatchError(context.DeadlineExceeded))
+			Expect(err).ShouldNot(MatchError(cnp.ErrTimeout))
+		})
+
+		It("should retry a hung database, and trip the breaker, when the query timeout is below the attempt timeout", func() {
+			usrrepo.(*user.UserRepo).WithQueryTimeout(10 * time.Millisecond)
+
+			// Every query hangs until its context is done
+			var queries atomic.Int32
+			Expect(gdb.Callback().Query().Before("gorm:query").Register("hang", func(tx *gorm.DB) {
+				queries.Add(1)
+				<-tx.Statement.Context.Done()
+				tx.AddError(tx.Statement.Context.Err())
+			})).To(Succeed())
+
+			p := cnp.NewCloudNativePatterns(clock.New()).NewPipeline("test").
+				WithTimeout(time.Minute).
+				WithRetry(cnp.RetryPolicy{Retries: 2, AttemptTimeout: time.Second}).
+				WithCircuitBreaker(cnp.BreakerSettings{ConsecutiveFailures: 3, CoolDown: time.Minute}).
+				WithClassifier(db.IsRetryable)
+
+			_, err := cnp.WrapT(p, func(ctx context.Context) (user.User, error) {
+				return usrrepo.Get(ctx, 1)
+			})(context.Background())
+
+			Expect(err).Should(MatchError(cnp.ErrTimeout))
+			Expect(queries.Load()).To(Equal(int32(3)))
+			Expect(p.Breaker().State()).To(Equal(cnp.StateOpen))
+		})
+	})
+
+	Context("Soft-delete lifecycle", func() {
+		var usr user.User
+
+		BeforeEach(func() {
+			usr = user.User{
+				ID:        uint(rand.Uint32()),
+				FirstName: "test_firstname",
+				LastName:  "test_lastname",
+				Age:       30,
+				Email:     "test@test.com",
+			}
+			_, err := usrrepo.Add(context.Background(), usr)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should restore a soft-deleted user only", func() {
+			err := usrrepo.Restore(context.Background(), usr.ID)
+			Expect(err).Should(MatchError(user.ErrUserNotDeleted))
+
+			err = usrrepo.Delete(context.Background(), usr.ID, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			err = usrrepo.Restore(context.Background(), usr.ID)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			restoredUser, err := usrrepo.Get(context.Background(), usr.ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(restoredUser.Version).Should(Equal(uint(2)))
+
+			err = usrrepo.Restore(context.Background(), usr.ID+1)
+			Expect(err).Should(MatchError(gorm.ErrRecordNotFound))
+		})
+
+		It("should purge a user, deleted or not", func() {
+			err := usrrepo.Purge(context.Background(), usr.ID)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			var count int64
+			gdb.Unscoped().Model(&user.User{}).Where("id = ?", usr.ID).Count(&count)
+			Expect(count).Should(BeZero())
+
+			err = usrrepo.Purge(context.Background(), usr.ID)
+			Expect(err).Should(MatchError(gorm.ErrRecordNotFound))
+		})
+
+		It("should only purge the users deleted before the given time", func() {
+			other := usr
+			other.ID = usr.ID + 1
+			_, err := usrrepo.Add(context.Background(), other)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// usr was deleted long ago, other just now
+			longAgo := time.Now().Add(-48 * time.Hour)
+			gdb.Model(&user.User{}).Where("id = ?", usr.ID).Update("deleted_at", longAgo)
+			err = usrrepo.Delete(context.Background(), other.ID, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			purged, err := usrrepo.PurgeDeleted(context.Background(), time.Now().Add(-24*time.Hour))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(purged).Should(Equal(int64(1)))
+
+			err = usrrepo.Restore(context.Background(), other.ID)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should purge the deleted users in batches", func() {
+			usrrepo.(*user.UserRepo).WithPurgeBatchSize(2)
+
+			var deletes atomic.Int32
+			gdb.Callback().Delete().Before("gorm:delete").Register("count", func(*gorm.DB) {
+				deletes.Add(1)
+			})
+
+			// usr and 4 others were deleted long ago
+			longAgo := time.Now().Add(-48 * time.Hour)
+			for i := uint(1); i <= 4; i++ {
+				other := usr
+				other.ID = usr.ID + i
+				_, err := usrrepo.Add(context.Background(), other)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+			gdb.Model(&user.User{}).Where("id >= ?", usr.ID).Update("deleted_at", longAgo)
+
+			purged, err := usrrepo.PurgeDeleted(context.Background(), time.Now().Add(-24*time.Hour))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(purged).Should(Equal(int64(5)))
+			Expect(deletes.Load()).Should(Equal(int32(3)))
+
+			var count int64
+			gdb.Unscoped().Model(&user.User{}).Count(&count)
+			Expect(count).Should(BeZero())
+		})
+	})
+
+	Context("List Users", func() {
+		var created time.Time
+
+		BeforeEach(func() {
+			created = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+			// Users 2 and 3 are created at the same time, to check that the id breaks the tie
+			for _, u := range []user.User{
+				{ID: 1, FirstName: "alice", LastName: "smith", Age: 20, Email: "alice@test.com", CreatedAt: created.Add(3 * time.Hour)},
+				{ID: 2, FirstName: "bob", LastName: "smith", Age: 30, Email: "bob@test.com", CreatedAt: created.Add(time.Hour)},
+				{ID: 3, FirstName: "carol", LastName: "alison", Age: 40, Email: "carol@test.com", CreatedAt: created.Add(time.Hour)},
+				{ID: 4, FirstName: "dave", LastName: "jones", Age: 50, Email: "dave@test.com", CreatedAt: created},
+			} {
+				u := u
+				Expect(gdb.Create(&u).Error).ShouldNot(HaveOccurred())
+			}
+		})
+
+		ids := func(users []user.User) []uint {
+			var ids []uint
+			for _, u := range users {
+				ids = append(ids, u.ID)
+			}
+			return ids
+		}
+
+		It("should filter by email, name prefix and age range", func() {
+			users, err := usrrepo.List(context.Background(), user.UserQuery{Email: "bob@test.com", Limit: 10})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ids(users)).Should(Equal([]uint{2}))
+
+			// The prefix matches the first or the last name
+			users, err = usrrepo.List(context.Background(), user.UserQuery{NamePrefix: "al", Limit: 10})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ids(users)).Should(Equal([]uint{1, 3}))
+
+			minAge, maxAge := uint8(30), uint8(40)
+			users, err = usrrepo.List(context.Background(), user.UserQuery{MinAge: &minAge, MaxAge: &maxAge, Limit: 10})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ids(users)).Should(Equal([]uint{2, 3}))
+		})
+
+		It("should match the wildcards of the name prefix literally", func() {
+			for _, u := range []user.User{
+				{ID: 5, FirstName: "a_b", LastName: "x", Email: "ab@test.com"},
+				{ID: 6, FirstName: "50%!", LastName: "x", Email: "fifty@test.com"},
+			} {
+				u := u
+				Expect(gdb.Create(&u).Error).ShouldNot(HaveOccurred())
+			}
+
+			// "a_" would match "al" if the underscore were a wildcard
+			users, err := usrrepo.List(context.Background(), user.UserQuery{NamePrefix: "a_", Limit: 10})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ids(users)).Should(Equal([]uint{5}))
+
+			users, err = usrrepo.List(context.Background(), user.UserQuery{NamePrefix: "50%!", Limit: 10})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ids(users)).Should(Equal([]uint{6}))
+
+			users, err = usrrepo.List(context.Background(), user.UserQuery{NamePrefix: "%", Limit: 10})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(users).Should(BeEmpty())
+		})
+
+		It("should page by id after the cursor", func() {
+			users, err := usrrepo.List(context.Background(), user.UserQuery{SortField: "id", Limit: 2})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ids(users)).Should(Equal([]uint{1, 2}))
+
+			users, err = usrrepo.List(context.Background(), user.UserQuery{SortField: "id", Limit: 2, After: &user.UserCursor{ID: 2}})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ids(users)).Should(Equal([]uint{3, 4}))
+		})
+
+		It("should page by descending created_at, breaking the ties with the id", func() {
+			query := user.UserQuery{SortField: "created_at", Descending: true, Limit: 2}
+
+			users, err := usrrepo.List(context.Background(), query)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ids(users)).Should(Equal([]uint{1, 3}))
+
+			query.After = &user.UserCursor{ID: users[1].ID, CreatedAt: users[1].CreatedAt}
+			users, err = usrrepo.List(context.Background(), query)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ids(users)).Should(Equal([]uint{2, 4}))
+		})
+
+		It("should include the soft-deleted users only when asked to", func() {
+			Expect(usrrepo.Delete(context.Background(), 1, 0)).To(Succeed())
+
+			users, err := usrrepo.List(context.Background(), user.UserQuery{Limit: 10})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ids(users)).Should(Equal([]uint{2, 3, 4}))
+
+			users, err = usrrepo.List(context.Background(), user.UserQuery{IncludeDeleted: true, Limit: 10})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ids(users)).Should(Equal([]uint{1, 2, 3, 4}))
+		})
+	})
 })
@@ -0,0 +1,125 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/rs/zerolog"
+	"github.com/sethvargo/go-envconfig"
+)
+
+type RetentionConfig struct {
+	Enabled  bool          `env:"USER_RETENTION_ENABLED,overwrite,default=false"`
+	Days     int           `env:"USER_RETENTION_DAYS,overwrite,default=30"`     // how long a soft-deleted user can be restored before it is purged
+	Interval time.Duration `env:"USER_RETENTION_INTERVAL,overwrite,default=1h"` // how often the soft-deleted users are purged
+}
+
+// RetentionJob periodically hard-deletes the users that were soft-deleted more than RetentionConfig.Days days ago.
+// Until then, they can be restored (see UserService.Restore).
+type RetentionJob struct {
+	*RetentionConfig
+	usrrepo UserRepository
+	clock   clock.Clock
+	logger  zerolog.Logger
+}
+
+// NewRetentionJob creates a RetentionJob configured with USER_RETENTION_* env vars, whose interval and
+// retention period are measured with clock. It returns an error if the env vars are not valid.
+func NewRetentionJob(usrrepo UserRepository, clock clock.Clock) (*RetentionJob, error) {
+	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+
+	// Set defaults with env vars
+	// Uses https://github.com/sethvargo/go-envconfig
+	config := &RetentionConfig{}
+	if err := envconfig.Process(context.Background(), config); err != nil {
+		return nil, err
+	}
+
+	// The ticker of Run panics with an interval that is not positive
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("USER_RETENTION_INTERVAL must be positive, got %s", config.Interval)
+	}
+
+	// Less than a day would purge the users as soon as they are deleted, before they can be restored
+	if config.Days < 1 {
+		return nil, fmt.Errorf("USER_RETENTION_DAYS must be at least 1, got %d", config.Days)
+	}
+
+	return &RetentionJob{
+		RetentionConfig: config,
+		usrrepo:         usrrepo,
+		clock:           clock,
+		logger:          logger,
+	}, nil
+}
+
+// WithLogger sets the logger using builder pattern
+func (j *RetentionJob) WithLogger(logger zerolog.Logger) *RetentionJob {
+	j.logger = logger
+	return j
+}
+
+// WithDays sets the retention period in days using builder pattern
+func (j *RetentionJob) WithDays(days int) *RetentionJob {
+	j.Days = days
+	return j
+}
+
+// WithInterval sets the interval between two purges using builder pattern
+func (j *RetentionJob) WithInterval(interval time.Duration) *RetentionJob {
+	j.Interval = interval
+	return j
+}
+
+// Run purges the expired users every interval, until ctx is done. It returns right away if the job is not enabled,
+// or if its interval or days, e.g. set with WithInterval or WithDays, are not valid (see NewRetentionJob).
+// It is blocking, so run it on a separate goroutine.
+func (j *RetentionJob) Run(ctx context.Context) {
+	if !j.Enabled {
+		return
+	}
+
+	if j.Interval <= 0 {
+		j.logger.Error().Dur("interval", j.Interval).Msg("Not starting the user retention job, its interval must be positive")
+		return
+	}
+
+	if j.Days < 1 {
+		j.logger.Error().Int("days", j.Days).Msg("Not starting the user retention job, its days must be at least 1")
+		return
+	}
+
+	j.logger.Info().Int("days", j.Days).Dur("interval", j.Interval).Msg("Started user retention job")
+
+	ticker := j.clock.Ticker(j.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			j.logger.Info().Msg("Stopped user retention job")
+			return
+		case <-ticker.C:
+			// A failed purge is retried at the next tick
+			_, _ = j.Purge(ctx)
+		}
+	}
+}
+
+// Purge hard-deletes the users soft-deleted more than Days days ago, and returns how many were deleted.
+func (j *RetentionJob) Purge(ctx context.Context) (int64, error) {
+	before := j.clock.Now().Add(-time.Duration(j.Days) * 24 * time.Hour)
+
+	purged, err := j.usrrepo.PurgeDeleted(ctx, before)
+	if err != nil {
+		j.logger.Error().Err(err).Msg("Failed to purge the deleted users")
+		return 0, err
+	}
+
+	j.logger.Debug().Int64("purged", purged).Time("before", before).Msg("Purged the deleted users")
+
+	return purged, nil
+}
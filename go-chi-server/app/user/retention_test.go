@@ -0,0 +1,120 @@
+package user_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/user"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/user/mocks"
+	"github.com/rs/zerolog"
+	"go.uber.org/mock/gomock"
+)
+
+var _ = Describe("Retention Job", func() {
+	var (
+		ctrl        *gomock.Controller
+		usrrepomock *mocks.MockUserRepository
+		mockclock   *clock.Mock
+		job         *user.RetentionJob
+	)
+
+	BeforeEach(func() {
+		ctrl = gomock.NewController(GinkgoT())
+		usrrepomock = mocks.NewMockUserRepository(ctrl)
+		mockclock = clock.NewMock()
+
+		var err error
+		job, err = user.NewRetentionJob(usrrepomock, mockclock)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		job = job.WithLogger(zerolog.Nop()).WithDays(30).WithInterval(time.Hour)
+		job.Enabled = true
+	})
+
+	AfterEach(func() {
+		ctrl.Finish()
+	})
+
+	It("should purge the users deleted more than the retention period ago at every interval", func() {
+		purged := make(chan time.Time, 2)
+		usrrepomock.
+			EXPECT().
+			PurgeDeleted(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, before time.Time) (int64, error) {
+				purged <- before
+				return 1, nil
+			}).
+			Times(2)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			job.Run(ctx)
+		}()
+
+		// Nothing is purged before the first interval
+		Consistently(purged, 50*time.Millisecond).ShouldNot(Receive())
+
+		for i := 1; i <= 2; i++ {
+			mockclock.Add(time.Hour)
+
+			var before time.Time
+			Eventually(purged).Should(Receive(&before))
+			Expect(before).To(Equal(mockclock.Now().Add(-30 * 24 * time.Hour)))
+		}
+
+		cancel()
+		Eventually(done).Should(BeClosed())
+	})
+
+	DescribeTable("should refuse an invalid config",
+		func(name, value string) {
+			GinkgoT().Setenv(name, value)
+
+			_, err := user.NewRetentionJob(usrrepomock, mockclock)
+			Expect(err).To(MatchError(ContainSubstring(name)))
+		},
+		Entry("a zero interval", "USER_RETENTION_INTERVAL", "0s"),
+		Entry("a negative interval", "USER_RETENTION_INTERVAL", "-1h"),
+		Entry("zero days", "USER_RETENTION_DAYS", "0"),
+		Entry("negative days", "USER_RETENTION_DAYS", "-1"),
+	)
+
+	It("should not run with an interval that is not positive, or less than a day", func() {
+		job.WithInterval(0)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			job.Run(context.Background())
+		}()
+
+		Eventually(done).Should(BeClosed())
+
+		job.WithInterval(time.Hour).WithDays(0)
+
+		done = make(chan struct{})
+		go func() {
+			defer close(done)
+			job.Run(context.Background())
+		}()
+
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("should not run when it is not enabled", func() {
+		job.Enabled = false
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			job.Run(context.Background())
+		}()
+
+		Eventually(done).Should(BeClosed())
+	})
+})
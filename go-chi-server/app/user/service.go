@@ -2,27 +2,47 @@ package user
 
 import (
 	"context"
+	"errors"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-playground/validator/v10"
 	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/patilchinmay/go-experiments/go-chi-server/db"
 	"github.com/patilchinmay/go-experiments/go-chi-server/utils/logger"
 	v "github.com/patilchinmay/go-experiments/go-chi-server/utils/validator"
+	"gorm.io/gorm"
 )
 
 type UserService struct {
-	usrrepo UserRepository
-	cnp     cnp.CloudNativePatterns
+	usrrepo   UserRepository
+	pipeline  *cnp.Pipeline
+	stale     *cnp.StaleCache
+	coalescer *cnp.Coalescer
 }
 
 var usrsvc *UserService
 
+// NewUserService creates the UserService. The repository calls go through the pipeline registered
+// on cnp under UserRepoPipeline (see NewUserRepoPipeline), or through one built from DefaultUserRepoPolicy.
 func NewUserService(usrrepo UserRepository, cnp cnp.CloudNativePatterns) *UserService {
 	if usrsvc == nil {
+		pipeline, ok := cnp.Pipeline(UserRepoPipeline)
+		if !ok {
+			var err error
+			pipeline, err = NewUserRepoPipeline(cnp, DefaultUserRepoPolicy)
+			if err != nil {
+				logger.Logger.Fatal().Err(err).Msg("Failed to create the user repository pipeline")
+			}
+		}
+
 		usrsvc = &UserService{
-			usrrepo: usrrepo,
-			cnp:     cnp,
+			usrrepo:   usrrepo,
+			pipeline:  pipeline,
+			stale:     cnp.NewStaleCache(UserStaleCacheSettings),
+			coalescer: cnp.NewCoalescer("user"),
 		}
 	}
 	return usrsvc
@@ -35,38 +55,102 @@ func DiscardUserService() {
 	}
 }
 
-const maxRetries = 3
-const retryInterval = 2 * time.Second
+// UserRepoPipeline is the name of the pipeline guarding the user repository.
+// Its policy can be tuned with CNP_USER_REPO_* env vars (see cnp.LoadPolicyConfig).
+const UserRepoPipeline = "user-repo"
+
+// DefaultUserRepoPolicy is the policy of the user-repo pipeline unless it is overridden from config.
+var DefaultUserRepoPolicy = cnp.PolicyConfig{
+	// Jittered backoff, so that several replicas retrying the database don't do it in lockstep.
+	// The budget caps the retries to 20% of the calls, so that a failing database does not get 4 calls per request,
+	// and the attempt timeout keeps a single hung query from using up the whole request deadline.
+	Retry: cnp.RetryConfig{
+		Enabled:        true,
+		Retries:        3,
+		Backoff:        "decorrelated-jitter",
+		BaseDelay:      500 * time.Millisecond,
+		MaxDelay:       5 * time.Second,
+		AttemptTimeout: 2 * time.Second,
+		Budget: cnp.RetryBudgetConfig{
+			Enabled:    true,
+			Ratio:      0.2,
+			MinRetries: 10,
+			Window:     10 * time.Second,
+		},
+	},
+	// The breaker is shared by all the methods, so that a dead database fails fast instead of every request retrying it.
+	CircuitBreaker: cnp.CircuitBreakerConfig{
+		Enabled:             true,
+		ConsecutiveFailures: 5,
+		FailureRate:         0.5,
+		MinRequests:         10,
+		Interval:            time.Minute,
+		CoolDown:            30 * time.Second,
+	},
+	// Reads are hedged, so that an occasionally slow replica does not make the p99 latency of GET /user/{id}.
+	// The hedge delay is learned from the p95 latency of the recent reads.
+	Hedge: cnp.HedgeConfig{
+		Enabled:    true,
+		Delay:      50 * time.Millisecond,
+		Percentile: 0.95,
+		Window:     100,
+		MinSamples: 20,
+		MaxHedges:  1,
+	},
+	// The user repository gets its own compartment of the connection pool,
+	// so that it cannot exhaust the pool for other repositories (and vice versa).
+	Bulkhead: cnp.BulkheadConfig{
+		Enabled:       true,
+		MaxConcurrent: db.MaxOpenConns / 2,
+		MaxQueue:      db.MaxOpenConns,
+		QueueTimeout:  time.Second,
+	},
+}
+
+// UserStaleCacheSettings configures the cache of the last known users, served by Get while the database is failing,
+// e.g. during a Postgres failover: a slightly stale user is better than a 500.
+var UserStaleCacheSettings = cnp.StaleCacheSettings{
+	Name:       "user",
+	TTL:        5 * time.Minute,
+	MaxEntries: 10000,
+	IsFailure:  isUnavailable,
+}
+
+// isUnavailable reports whether err means that the database could not answer.
+// A missing user is an answer, and a cancelled request does not need one.
+func isUnavailable(err error) bool {
+	return !errors.Is(err, gorm.ErrRecordNotFound) && !errors.Is(err, context.Canceled)
+}
+
+// NewUserRepoPipeline creates the user-repo pipeline from config and registers it on cnp.
+// Only transient database errors are retried, e.g. a missing user is returned right away.
+func NewUserRepoPipeline(cnp cnp.CloudNativePatterns, config cnp.PolicyConfig) (*cnp.Pipeline, error) {
+	pipeline, err := cnp.NewPipelineFromConfig(UserRepoPipeline, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return pipeline.WithClassifier(db.IsRetryable).Register(), nil
+}
 
 func (u *UserService) Get(ctx context.Context, id uint) (User, error) {
 	logger := logger.Logger.With().Str("requestID", middleware.GetReqID(ctx)).Logger()
 	logger.Debug().Msg("User Service : Get")
 
-	var (
-		user User
-		err  error
-	)
-
 	// Retry-able function
-	var userRepoGet cnp.CloudNativeFunction = func(ctx context.Context) error {
+	userRepoGet := func(ctx context.Context) (User, error) {
 		// Call the repository layer
-		user, err = u.usrrepo.Get(ctx, id)
-		if err != nil {
-			return err
-		}
-
-		return nil
+		return u.usrrepo.Get(ctx, id)
 	}
 
-	r := u.cnp.Retry(userRepoGet, maxRetries, retryInterval)
+	// A read is idempotent, so a slow one can be hedged,
+	// the concurrent reads of the same user (and their retries) are collapsed into one,
+	// and the last known user is served if the database is unavailable
+	key := userKey(id)
+	get := cnp.CoalesceT(cnp.WrapHedgedT(u.pipeline, userRepoGet), u.coalescer, key)
 
-	err = r(ctx)
-
-	if err != nil {
-		return user, err
-	}
-
-	return user, nil
+	user, err := cnp.ServeStale(u.stale, key, get)(ctx)
+	return user, repoError(err)
 }
 
 func (u *UserService) Add(ctx context.Context, user User) (uint, error) {
@@ -90,64 +174,83 @@ func (u *UserService) Add(ctx context.Context, user User) (uint, error) {
 			logger.Error().Err(err).Msg(err.Error())
 		}
 
-		// from here you can create your own error messages in whatever language you wish
-		return 0, err
+		// The violations are returned to the client, see writeError
+		return 0, newValidationError(err)
+	}
+
+	// Not retried: an insert that timed out or lost its connection may have been committed anyway,
+	// and running it again would add a second user or fail with a spurious conflict.
+	// The clients retry with an Idempotency-Key instead (see middlewares.NewIdempotency).
+	userRepoAdd := func(ctx context.Context) (uint, error) {
+		// Call the repository layer
+		return u.usrrepo.Add(ctx, user)
 	}
 
-	var id uint
+	// return the response
+	id, err := cnp.WrapOnceT(u.pipeline, userRepoAdd)(ctx)
+	return id, repoError(err)
+}
+
+// Delete deletes the user id if its version is still version (see UserRepository), any version if 0.
+func (u *UserService) Delete(ctx context.Context, id uint, version uint) error {
+	logger := logger.Logger.With().Str("requestID", middleware.GetReqID(ctx)).Logger()
+	logger.Debug().Msg("User Service : Delete")
 
 	// Retry-able function
-	var userRepoAdd cnp.CloudNativeFunction = func(ctx context.Context) error {
+	userRepoDelete := func(ctx context.Context) (struct{}, error) {
 		// Call the repository layer
-		id, err = u.usrrepo.Add(ctx, user)
-		if err != nil {
-			return err
-		}
+		return struct{}{}, conflictIsPermanent(u.usrrepo.Delete(ctx, id, version))
+	}
 
-		return nil
+	_, err := cnp.WrapT(u.pipeline, userRepoDelete)(ctx)
+	if err == nil {
+		u.stale.Delete(userKey(id))
 	}
 
-	r := u.cnp.Retry(userRepoAdd, maxRetries, retryInterval)
+	return repoError(err)
+}
 
-	err = r(ctx)
+// Restore undoes the soft delete of the user id.
+func (u *UserService) Restore(ctx context.Context, id uint) error {
+	logger := logger.Logger.With().Str("requestID", middleware.GetReqID(ctx)).Logger()
+	logger.Debug().Msg("User Service : Restore")
 
-	if err != nil {
-		return 0, err
+	// Retry-able function. A user that is not deleted won't be after a retry either.
+	userRepoRestore := func(ctx context.Context) (struct{}, error) {
+		// Call the repository layer
+		err := u.usrrepo.Restore(ctx, id)
+		if errors.Is(err, ErrUserNotDeleted) {
+			err = cnp.Permanent(err)
+		}
+		return struct{}{}, err
 	}
 
-	// return the response
-	return id, nil
+	_, err := cnp.WrapT(u.pipeline, userRepoRestore)(ctx)
+
+	return repoError(err)
 }
 
-func (u *UserService) Delete(ctx context.Context, id uint) error {
+// Purge permanently removes the user id, deleted or not.
+func (u *UserService) Purge(ctx context.Context, id uint) error {
 	logger := logger.Logger.With().Str("requestID", middleware.GetReqID(ctx)).Logger()
-	logger.Debug().Msg("User Service : Delete")
-
-	var err error
+	logger.Debug().Msg("User Service : Purge")
 
 	// Retry-able function
-	var userRepoDelete cnp.CloudNativeFunction = func(ctx context.Context) error {
+	userRepoPurge := func(ctx context.Context) (struct{}, error) {
 		// Call the repository layer
-		err = u.usrrepo.Delete(ctx, id)
-		if err != nil {
-			return err
-		}
-
-		return nil
+		return struct{}{}, u.usrrepo.Purge(ctx, id)
 	}
 
-	r := u.cnp.Retry(userRepoDelete, maxRetries, retryInterval)
-
-	err = r(ctx)
-
-	if err != nil {
-		return err
+	_, err := cnp.WrapT(u.pipeline, userRepoPurge)(ctx)
+	if err == nil {
+		u.stale.Delete(userKey(id))
 	}
 
-	return nil
+	return repoError(err)
 }
 
-func (u *UserService) Update(ctx context.Context, id uint, input UpdateUserInput) error {
+// Update updates the user id if its version is still version (see UserRepository), any version if 0.
+func (u *UserService) Update(ctx context.Context, id uint, version uint, input UpdateUserInput) error {
 	logger := logger.Logger.With().Str("requestID", middleware.GetReqID(ctx)).Logger()
 	logger.Debug().Msg("User Service : Update")
 
@@ -167,8 +270,8 @@ func (u *UserService) Update(ctx context.Context, id uint, input UpdateUserInput
 			logger.Error().Err(err).Msg(err.Error())
 		}
 
-		// from here you can create your own error messages in whatever language you wish
-		return err
+		// The violations are returned to the client, see writeError
+		return newValidationError(err)
 	}
 
 	var user = User{
@@ -179,23 +282,164 @@ func (u *UserService) Update(ctx context.Context, id uint, input UpdateUserInput
 	}
 
 	// Retry-able function
-	var userRepoUpdate cnp.CloudNativeFunction = func(ctx context.Context) error {
+	userRepoUpdate := func(ctx context.Context) (struct{}, error) {
 		// Call the repository layer
-		err = u.usrrepo.Update(ctx, id, user)
+		return struct{}{}, conflictIsPermanent(u.usrrepo.Update(ctx, id, version, user))
+	}
+
+	_, err = cnp.WrapT(u.pipeline, userRepoUpdate)(ctx)
+	if err == nil {
+		u.stale.Delete(userKey(id))
+	}
+
+	return repoError(err)
+}
+
+// maxPatchAttempts is how many times Patch reads, patches and writes a user that keeps being updated concurrently.
+const maxPatchAttempts = 3
+
+// Patch applies patch, a JSON Merge Patch or a JSON Patch (see MergePatchContentType and JSONPatchContentType),
+// to the user id if its version is still version (any version if 0), validates the patched user and persists it.
+// It returns the patched user.
+func (u *UserService) Patch(ctx context.Context, id uint, version uint, contentType string, patch []byte) (User, error) {
+	logger := logger.Logger.With().Str("requestID", middleware.GetReqID(ctx)).Logger()
+	logger.Debug().Msg("User Service : Patch")
+
+	// Retry-able function. The current user is read from the repository, never from the stale cache of the service.
+	// With a CachedUserRepository it may still be an out of date entry of the cache: Replace then finds that its
+	// version does not match, so a stale user is never written back.
+	userRepoGet := func(ctx context.Context) (User, error) {
+		// Call the repository layer
+		return u.usrrepo.Get(ctx, id)
+	}
+
+	for attempt := 1; ; attempt++ {
+		current, err := cnp.WrapT(u.pipeline, userRepoGet)(ctx)
 		if err != nil {
-			return err
+			return User{}, repoError(err)
+		}
+
+		if version != 0 && current.Version != version {
+			return User{}, ErrVersionMismatch
+		}
+
+		patched, err := applyPatch(current, contentType, patch)
+		if err != nil {
+			return User{}, err
+		}
+
+		// Validate the patched user
+		if err := v.Validator.Struct(patched); err != nil {
+			logger.Error().Err(err).Msg("Failed validation")
+
+			// The violations are returned to the client, see writeError
+			return User{}, newValidationError(err)
+		}
+
+		// Retry-able function. The user is only written if it is still the version that was patched.
+		userRepoReplace := func(ctx context.Context) (struct{}, error) {
+			// Call the repository layer
+			return struct{}{}, conflictIsPermanent(u.usrrepo.Replace(ctx, id, current.Version, patched))
 		}
 
-		return nil
+		_, err = cnp.WrapT(u.pipeline, userRepoReplace)(ctx)
+		if errors.Is(err, ErrVersionMismatch) && version == 0 && attempt < maxPatchAttempts {
+			// The user was updated since it was read, patch the new version
+			continue
+		}
+		if err != nil {
+			return User{}, repoError(err)
+		}
+
+		u.stale.Delete(userKey(id))
+
+		patched.Version = current.Version + 1
+		return patched, nil
 	}
+}
 
-	r := u.cnp.Retry(userRepoUpdate, maxRetries, retryInterval)
+// List returns a page of the users matching input, and the cursor of the next page if there is one.
+func (u *UserService) List(ctx context.Context, input ListUsersInput) (UserPage, error) {
+	logger := logger.Logger.With().Str("requestID", middleware.GetReqID(ctx)).Logger()
+	logger.Debug().Msg("User Service : List")
 
-	err = r(ctx)
+	// Validate the input
+	err := v.Validator.Struct(input)
+	if err != nil {
+		if _, ok := err.(*validator.InvalidValidationError); ok {
+			logger.Error().Err(err).Msg("Failed validation")
+			return UserPage{}, err
+		}
 
+		for _, err := range err.(validator.ValidationErrors) {
+			logger.Error().Err(err).Msg(err.Error())
+		}
+
+		return UserPage{}, newValidationError(err)
+	}
+
+	if input.Sort == "" {
+		input.Sort = "id"
+	}
+
+	if input.Limit == 0 {
+		input.Limit = DefaultListLimit
+	}
+
+	query := UserQuery{
+		Email:          input.Email,
+		NamePrefix:     input.NamePrefix,
+		MinAge:         input.MinAge,
+		MaxAge:         input.MaxAge,
+		SortField:      strings.TrimPrefix(input.Sort, "-"),
+		Descending:     strings.HasPrefix(input.Sort, "-"),
+		IncludeDeleted: input.IncludeDeleted,
+		// One more user than the page tells whether there is a next page
+		Limit: input.Limit + 1,
+	}
+
+	if input.Cursor != "" {
+		query.After, err = DecodeCursor(input.Sort, input.Cursor)
+		if err != nil {
+			return UserPage{}, err
+		}
+	}
+
+	// Retry-able function
+	userRepoList := func(ctx context.Context) ([]User, error) {
+		// Call the repository layer
+		return u.usrrepo.List(ctx, query)
+	}
+
+	// A read is idempotent, so a slow one can be hedged
+	users, err := cnp.WrapHedgedT(u.pipeline, userRepoList)(ctx)
 	if err != nil {
-		return err
+		return UserPage{}, repoError(err)
+	}
+
+	page := UserPage{Users: users}
+	if page.Users == nil {
+		page.Users = []User{}
 	}
 
-	return nil
+	if len(users) > input.Limit {
+		page.Users = users[:input.Limit]
+		page.NextCursor = EncodeCursor(input.Sort, page.Users[input.Limit-1])
+	}
+
+	return page, nil
+}
+
+// conflictIsPermanent marks ErrVersionMismatch as permanent: retrying a write based on an old version
+// can only fail again, and the database is fine.
+func conflictIsPermanent(err error) error {
+	if errors.Is(err, ErrVersionMismatch) {
+		return cnp.Permanent(err)
+	}
+	return err
+}
+
+// userKey is the key of the user id in the stale cache.
+func userKey(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
 }
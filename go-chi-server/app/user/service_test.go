@@ -9,6 +9,7 @@ package user_test
 
 import (
 	"context"
+	"database/sql/driver"
 	"errors"
 	"math/rand"
 	"time"
@@ -20,6 +21,7 @@ import (
 	"github.com/patilchinmay/go-experiments/go-chi-server/app/user"
 	"github.com/patilchinmay/go-experiments/go-chi-server/app/user/mocks"
 	"go.uber.org/mock/gomock"
+	"gorm.io/gorm"
 )
 
 var _ = Describe("User Service", func() {
@@ -58,6 +60,14 @@ var _ = Describe("User Service", func() {
 			}
 		}(doneCh, mockclock)
 
+		// The clock is advanced continuously, which would fire the hedge delay and the attempt timeout at random.
+		// Hedging is tested on its own clock below.
+		policy := user.DefaultUserRepoPolicy
+		policy.Hedge.Enabled = false
+		policy.Retry.AttemptTimeout = 0
+		_, err := user.NewUserRepoPipeline(CNP, policy)
+		Expect(err).ShouldNot(HaveOccurred())
+
 		// Instantiate UserService
 		usrsvc = user.NewUserService(usrrepomock, CNP)
 	})
@@ -65,7 +75,6 @@ var _ = Describe("User Service", func() {
 	AfterEach(func() {
 		ctrl.Finish()
 		user.DiscardUserService()
-		cnp.DiscardCloudNativePatterns()
 		close(doneCh)
 		Eventually(doneCh).Should(BeClosed())
 	})
@@ -93,7 +102,7 @@ var _ = Describe("User Service", func() {
 			Expect(expectedUserID).Should(Equal(usr.ID))
 		})
 
-		It("should retry 3 times for adding a single user when an error occurs", func() {
+		It("should not retry adding a single user, which may have been committed, when an error occurs", func() {
 			usr := user.User{
 				ID:        uint(rand.Uint32()),
 				FirstName: "test_firstname",
@@ -103,12 +112,12 @@ var _ = Describe("User Service", func() {
 			}
 
 			// Define mock expe
-			dummyError := errors.New("")
+			dummyError := driver.ErrBadConn // a transient error, which the other methods retry
 			usrrepomock.
 				EXPECT().
 				Add(context.Background(), usr).
 				Return(uint(0), dummyError).
-				Times(4)
+				Times(1)
 
 			_, err := usrsvc.Add(context.Background(), usr)
 
@@ -138,11 +147,11 @@ var _ = Describe("User Service", func() {
 			// Define mock expectation
 			usrrepomock.
 				EXPECT().
-				Delete(context.Background(), userID).
+				Delete(context.Background(), userID, uint(0)).
 				Return(nil).
 				Times(1)
 
-			err := usrsvc.Delete(context.Background(), userID)
+			err := usrsvc.Delete(context.Background(), userID, 0)
 
 			Expect(err).ShouldNot(HaveOccurred())
 		})
@@ -151,14 +160,14 @@ var _ = Describe("User Service", func() {
 			userID := uint(rand.Uint32())
 
 			// Define mock expectation
-			dummyError := errors.New("dummy error")
+			dummyError := driver.ErrBadConn // a transient error, which is retried
 			usrrepomock.
 				EXPECT().
-				Delete(context.Background(), userID).
+				Delete(context.Background(), userID, uint(0)).
 				Return(dummyError).
 				Times(4)
 
-			err := usrsvc.Delete(context.Background(), userID)
+			err := usrsvc.Delete(context.Background(), userID, 0)
 
 			Expect(err).Should(HaveOccurred())
 		})
@@ -175,7 +184,7 @@ var _ = Describe("User Service", func() {
 			}
 			// Define mock expectation
 			usrrepomock.
-				EXPECT().Get(context.Background(), usr.ID).
+				EXPECT().Get(gomock.Any(), usr.ID).
 				Return(usr, nil).
 				Times(1)
 
@@ -189,12 +198,12 @@ var _ = Describe("User Service", func() {
 			userID := uint(rand.Uint32())
 
 			// Define mock expectation
-			dummyError := errors.New("")
+			dummyError := driver.ErrBadConn // a transient error, which is retried
 			var usr user.User
 
 			usrrepomock.
 				EXPECT().
-				Get(context.Background(), userID).
+				Get(gomock.Any(), userID).
 				Return(usr, dummyError).
 				Times(4)
 
@@ -203,6 +212,238 @@ var _ = Describe("User Service", func() {
 			Expect(err).Should(HaveOccurred())
 			Expect(getUserResult).To(Equal(usr))
 		})
+
+		It("should not retry when the user is not found", func() {
+			userID := uint(rand.Uint32())
+
+			// Define mock expectation
+			var usr user.User
+
+			usrrepomock.
+				EXPECT().
+				Get(gomock.Any(), userID).
+				Return(usr, gorm.ErrRecordNotFound).
+				Times(1)
+
+			_, err := usrsvc.Get(context.Background(), userID)
+
+			Expect(err).Should(MatchError(gorm.ErrRecordNotFound))
+			Expect(err).Should(MatchError(user.ErrUserNotFound))
+		})
+
+		It("should hedge a slow read and return the first result", func() {
+			usr := user.User{
+				ID:        uint(rand.Uint32()),
+				FirstName: "test_firstname",
+				LastName:  "test_lastname",
+				Age:       25,
+				Email:     "test@test.com",
+			}
+
+			// A clock that only moves when told to
+			hedgeclock := clock.NewMock()
+			user.DiscardUserService()
+			usrsvc = user.NewUserService(usrrepomock, cnp.NewCloudNativePatterns(hedgeclock))
+
+			started := make(chan struct{})
+			gomock.InOrder(
+				// The slow replica, until the hedged read cancels it
+				usrrepomock.
+					EXPECT().Get(gomock.Any(), usr.ID).
+					DoAndReturn(func(ctx context.Context, id uint) (user.User, error) {
+						close(started)
+						<-ctx.Done()
+						return user.User{}, ctx.Err()
+					}),
+				usrrepomock.
+					EXPECT().Get(gomock.Any(), usr.ID).
+					Return(usr, nil),
+			)
+
+			resultCh := make(chan user.User)
+			go func() {
+				defer GinkgoRecover()
+				getUserResult, err := usrsvc.Get(context.Background(), usr.ID)
+				Expect(err).ShouldNot(HaveOccurred())
+				resultCh <- getUserResult
+			}()
+
+			<-started
+			hedgeclock.Add(user.DefaultUserRepoPolicy.Hedge.Delay)
+
+			Eventually(resultCh).Should(Receive(Equal(usr)))
+		})
+
+		It("should make a single repository call for concurrent reads of the same user", func() {
+			usr := user.User{
+				ID:        uint(rand.Uint32()),
+				FirstName: "test_firstname",
+				LastName:  "test_lastname",
+				Age:       25,
+				Email:     "test@test.com",
+			}
+
+			// Tells when the second read has joined the first one
+			joined := make(chan struct{}, 1)
+			CNP := cnp.NewCloudNativePatterns(clock.NewMock()).
+				WithListener(cnp.ListenerFunc(func(ctx context.Context, event cnp.Event) {
+					if event.Type == cnp.EventCoalesced {
+						joined <- struct{}{}
+					}
+				}))
+
+			user.DiscardUserService()
+			usrsvc = user.NewUserService(usrrepomock, CNP)
+
+			release := make(chan struct{})
+			usrrepomock.
+				EXPECT().Get(gomock.Any(), usr.ID).
+				DoAndReturn(func(ctx context.Context, id uint) (user.User, error) {
+					<-release
+					return usr, nil
+				}).
+				Times(1)
+
+			resultCh := make(chan user.User, 2)
+			for i := 0; i < 2; i++ {
+				go func() {
+					defer GinkgoRecover()
+					getUserResult, err := usrsvc.Get(context.Background(), usr.ID)
+					Expect(err).ShouldNot(HaveOccurred())
+					resultCh <- getUserResult
+				}()
+			}
+
+			Eventually(joined).Should(Receive())
+			close(release)
+
+			Eventually(resultCh).Should(Receive(Equal(usr)))
+			Eventually(resultCh).Should(Receive(Equal(usr)))
+		})
+
+		It("should serve the last known user while the database is unavailable", func() {
+			usr := user.User{
+				ID:        uint(rand.Uint32()),
+				FirstName: "test_firstname",
+				LastName:  "test_lastname",
+				Age:       25,
+				Email:     "test@test.com",
+			}
+
+			// A clock that does not expire the stale user, without retries that would wait on it
+			staleclock := clock.NewMock()
+			CNP := cnp.NewCloudNativePatterns(staleclock)
+			policy := user.DefaultUserRepoPolicy
+			policy.Retry.Enabled = false
+			policy.Hedge.Enabled = false
+			_, err := user.NewUserRepoPipeline(CNP, policy)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			user.DiscardUserService()
+			usrsvc = user.NewUserService(usrrepomock, CNP)
+
+			gomock.InOrder(
+				usrrepomock.
+					EXPECT().Get(gomock.Any(), usr.ID).
+					Return(usr, nil),
+				usrrepomock.
+					EXPECT().Get(gomock.Any(), usr.ID).
+					Return(user.User{}, errors.New("connection refused")),
+			)
+
+			_, err = usrsvc.Get(context.Background(), usr.ID)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			getUserResult, err := usrsvc.Get(context.Background(), usr.ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(getUserResult).To(Equal(usr))
+		})
+	})
+
+	Context("Circuit breaker", func() {
+		It("should not open on missing users, conflicts and version mismatches", func() {
+			// A clock that does not end the cool-down of an open breaker
+			breakerclock := clock.NewMock()
+			CNP := cnp.NewCloudNativePatterns(breakerclock)
+			policy := user.DefaultUserRepoPolicy
+			policy.Hedge.Enabled = false
+			pipeline, err := user.NewUserRepoPipeline(CNP, policy)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			user.DiscardUserService()
+			usrsvc = user.NewUserService(usrrepomock, CNP)
+
+			usr := user.User{FirstName: "firstname", LastName: "lastname", Age: 25, Email: "test@test.com"}
+			input := user.UpdateUserInput{FirstName: usr.FirstName, LastName: usr.LastName, Age: usr.Age, Email: usr.Email}
+
+			// Each of them is an answer of the database, returned right away, and far more than the breaker tolerates
+			calls := 4 * policy.CircuitBreaker.ConsecutiveFailures
+			usrrepomock.EXPECT().Get(gomock.Any(), gomock.Any()).Return(user.User{}, gorm.ErrRecordNotFound).Times(calls)
+			usrrepomock.EXPECT().Add(gomock.Any(), usr).Return(uint(0), gorm.ErrDuplicatedKey).Times(calls)
+			usrrepomock.EXPECT().Update(gomock.Any(), uint(1), uint(1), usr).Return(user.ErrVersionMismatch).Times(calls)
+
+			for i := 0; i < calls; i++ {
+				_, err := usrsvc.Get(context.Background(), uint(i+1))
+				Expect(err).To(MatchError(user.ErrUserNotFound))
+
+				_, err = usrsvc.Add(context.Background(), usr)
+				Expect(err).To(MatchError(user.ErrUserExists))
+
+				Expect(usrsvc.Update(context.Background(), 1, 1, input)).To(MatchError(user.ErrVersionMismatch))
+			}
+
+			Expect(pipeline.Breaker().State()).To(Equal(cnp.StateClosed))
+
+			usrrepomock.EXPECT().Get(gomock.Any(), usr.ID).Return(usr, nil)
+			Expect(usrsvc.Get(context.Background(), usr.ID)).To(Equal(usr))
+		})
+	})
+
+	Context("List Users", func() {
+		It("should return a page and the cursor of the next one", func() {
+			// The repository is asked for one more user than the page, to know whether there is a next page
+			usrrepomock.
+				EXPECT().
+				List(gomock.Any(), user.UserQuery{SortField: "created_at", Descending: true, Limit: 3}).
+				Return([]user.User{{ID: 3}, {ID: 2}, {ID: 1}}, nil).
+				Times(1)
+
+			page, err := usrsvc.List(context.Background(), user.ListUsersInput{Sort: "-created_at", Limit: 2})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(page.Users).Should(HaveLen(2))
+
+			cursor, err := user.DecodeCursor("-created_at", page.NextCursor)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(cursor.ID).Should(Equal(uint(2)))
+		})
+
+		It("should not return a cursor on the last page", func() {
+			usrrepomock.
+				EXPECT().
+				List(gomock.Any(), gomock.Any()).
+				Return([]user.User{{ID: 1}}, nil).
+				Times(1)
+
+			page, err := usrsvc.List(context.Background(), user.ListUsersInput{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(page.Users).Should(HaveLen(1))
+			Expect(page.NextCursor).Should(BeEmpty())
+		})
+
+		It("should reject a cursor issued for another sort order", func() {
+			cursor := user.EncodeCursor("id", user.User{ID: 1})
+
+			_, err := usrsvc.List(context.Background(), user.ListUsersInput{Sort: "created_at", Cursor: cursor})
+			Expect(err).Should(MatchError(user.ErrInvalidCursor))
+		})
+
+		It("should reject a sort field that is not allowed", func() {
+			_, err := usrsvc.List(context.Background(), user.ListUsersInput{Sort: "password"})
+
+			var verr *user.ValidationError
+			Expect(errors.As(err, &verr)).Should(BeTrue())
+			Expect(verr.Violations).Should(ConsistOf(HaveField("Field", "sort")))
+		})
 	})
 
 	Context("Update User", func() {
@@ -225,11 +466,11 @@ var _ = Describe("User Service", func() {
 
 			// Define mock expectation
 			usrrepomock.
-				EXPECT().Update(context.Background(), userID, usr).
+				EXPECT().Update(context.Background(), userID, uint(0), usr).
 				Return(nil).
 				Times(1)
 
-			err := usrsvc.Update(context.Background(), userID, input)
+			err := usrsvc.Update(context.Background(), userID, 0, input)
 
 			Expect(err).ShouldNot(HaveOccurred())
 		})
@@ -244,10 +485,107 @@ var _ = Describe("User Service", func() {
 				Email:     "update@test.com",
 			}
 
-			err := usrsvc.Update(context.Background(), userID, input)
+			err := usrsvc.Update(context.Background(), userID, 0, input)
 
-			Expect(err).Should(HaveOccurred())
-			Expect(err.Error()).Should(ContainSubstring("validation for 'Age' failed"))
+			var verr *user.ValidationError
+			Expect(errors.As(err, &verr)).Should(BeTrue())
+			Expect(verr.Violations).Should(ConsistOf(HaveField("Field", "age")))
+		})
+
+		It("should not retry when the user was modified since the given version", func() {
+			userID := uint(rand.Uint32())
+
+			usrrepomock.
+				EXPECT().Update(gomock.Any(), userID, uint(3), gomock.Any()).
+				Return(user.ErrVersionMismatch).
+				Times(1)
+
+			err := usrsvc.Update(context.Background(), userID, 3, user.UpdateUserInput{Age: 31})
+
+			Expect(err).Should(MatchError(user.ErrVersionMismatch))
+		})
+
+		It("should apply a merge patch to the current user, zero values included", func() {
+			usr := user.User{
+				ID:        uint(rand.Uint32()),
+				FirstName: "test_firstname",
+				LastName:  "test_lastname",
+				Age:       30,
+				Email:     "test@test.com",
+				Version:   2,
+			}
+
+			patched := usr
+			patched.Age = 0
+			patched.LastName = "patched_lastname"
+
+			gomock.InOrder(
+				usrrepomock.EXPECT().Get(gomock.Any(), usr.ID).Return(usr, nil).Times(1),
+				usrrepomock.EXPECT().Replace(gomock.Any(), usr.ID, uint(2), patched).Return(nil).Times(1),
+			)
+
+			result, err := usrsvc.Patch(context.Background(), usr.ID, 2, user.MergePatchContentType, []byte(`{"age": null, "lastname": "patched_lastname"}`))
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result.Age).Should(BeZero())
+			Expect(result.LastName).Should(Equal("patched_lastname"))
+			Expect(result.Version).Should(Equal(uint(3)))
+		})
+
+		It("should patch the new version when the user was modified concurrently and no version was given", func() {
+			usr := user.User{
+				ID:        uint(rand.Uint32()),
+				FirstName: "test_firstname",
+				LastName:  "test_lastname",
+				Age:       30,
+				Email:     "test@test.com",
+				Version:   1,
+			}
+			modified := usr
+			modified.Version = 2
+
+			gomock.InOrder(
+				usrrepomock.EXPECT().Get(gomock.Any(), usr.ID).Return(usr, nil).Times(1),
+				usrrepomock.EXPECT().Replace(gomock.Any(), usr.ID, uint(1), gomock.Any()).Return(user.ErrVersionMismatch).Times(1),
+				usrrepomock.EXPECT().Get(gomock.Any(), usr.ID).Return(modified, nil).Times(1),
+				usrrepomock.EXPECT().Replace(gomock.Any(), usr.ID, uint(2), gomock.Any()).Return(nil).Times(1),
+			)
+
+			patch := []byte(`[{"op": "replace", "path": "/age", "value": 31}]`)
+			result, err := usrsvc.Patch(context.Background(), usr.ID, 0, user.JSONPatchContentType, patch)
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result.Age).Should(Equal(uint8(31)))
+			Expect(result.Version).Should(Equal(uint(3)))
+		})
+
+		It("should validate the patched user before persisting it", func() {
+			usr := user.User{
+				ID:        uint(rand.Uint32()),
+				FirstName: "test_firstname",
+				LastName:  "test_lastname",
+				Age:       30,
+				Email:     "test@test.com",
+				Version:   1,
+			}
+
+			usrrepomock.EXPECT().Get(gomock.Any(), usr.ID).Return(usr, nil).Times(1)
+
+			_, err := usrsvc.Patch(context.Background(), usr.ID, 0, user.MergePatchContentType, []byte(`{"email": "not-an-email"}`))
+
+			var verr *user.ValidationError
+			Expect(errors.As(err, &verr)).Should(BeTrue())
+			Expect(verr.Violations).Should(ConsistOf(HaveField("Field", "email")))
+		})
+
+		It("should not patch a user modified since the given version", func() {
+			usr := user.User{ID: uint(rand.Uint32()), Version: 2}
+
+			usrrepomock.EXPECT().Get(gomock.Any(), usr.ID).Return(usr, nil).Times(1)
+
+			_, err := usrsvc.Patch(context.Background(), usr.ID, 1, user.MergePatchContentType, []byte(`{"age": 31}`))
+
+			Expect(err).Should(MatchError(user.ErrVersionMismatch))
 		})
 
 		It("should retry 3 times and return an error when failed to update a single user due to repo error", func() {
@@ -268,15 +606,15 @@ var _ = Describe("User Service", func() {
 			}
 
 			// Define mock expectation
-			dummyError := errors.New("")
+			dummyError := driver.ErrBadConn // a transient error, which is retried
 
 			// Define mock expectation
 			usrrepomock.
-				EXPECT().Update(context.Background(), userID, usr).
+				EXPECT().Update(context.Background(), userID, uint(0), usr).
 				Return(dummyError).
 				Times(4)
 
-			err := usrsvc.Update(context.Background(), userID, input)
+			err := usrsvc.Update(context.Background(), userID, 0, input)
 
 			Expect(err).Should(HaveOccurred())
 		})
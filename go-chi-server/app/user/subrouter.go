@@ -1,17 +1,23 @@
 package user
 
 import (
+	"os"
+
 	"github.com/benbjohnson/clock"
+	"github.com/go-chi/chi/v5/middleware"
 	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/patilchinmay/go-experiments/cloudnativepatterns/observability"
 	"github.com/patilchinmay/go-experiments/go-chi-server/app"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/middlewares"
 	"github.com/rs/zerolog"
 	"gorm.io/gorm"
 )
 
 // SetupSubrouter initializes the subrouter, defines the routes & handlers, and
 // appends it to the []app.Subrouters.
+// It returns the Idempotency middleware of POST /user, whose expired keys are purged by its Run.
 // This function is called in main
-func SetupSubrouter(db *gorm.DB, logger zerolog.Logger) {
+func SetupSubrouter(db *gorm.DB, logger zerolog.Logger) *middlewares.Idempotency {
 	path := "/user"
 
 	// Create subrouter with routes
@@ -21,24 +27,50 @@ func SetupSubrouter(db *gorm.DB, logger zerolog.Logger) {
 	automigrateUser := true
 	usrrepo := NewUserRepository(db, automigrateUser)
 
-	// Initiate CNP which is required by the UserService
+	// Initiate CNP which is required by the UserService.
+	// Its events (retries, breaker state changes...) are logged with the request ID set by httplog.
 	clock := clock.New()
-	cnp := cnp.NewCloudNativePatterns(clock)
+	CNP := cnp.NewCloudNativePatterns(clock).
+		WithListener(observability.NewZerologListener(logger, middleware.GetReqID))
+
+	// Register the pipeline guarding the user repository.
+	// Its policy can be tuned from the YAML file in CNP_POLICIES_FILE and with CNP_USER_REPO_* env vars.
+	config, err := cnp.LoadPolicyConfig(UserRepoPipeline, os.Getenv("CNP_POLICIES_FILE"), DefaultUserRepoPolicy)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load the user repository policy")
+	}
+	if _, err := NewUserRepoPipeline(CNP, config); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create the user repository pipeline")
+	}
+
+	// Cache the users in Redis (or in memory while Redis is unavailable) if USER_CACHE_ENABLED is set
+	var repo UserRepository = usrrepo
+	if cached := NewCachedUserRepository(usrrepo, clock).WithLogger(logger); cached.Enabled {
+		repo = cached
+	}
 
 	// Initiate User Service
-	usrsvc := NewUserService(usrrepo, cnp)
+	usrsvc := NewUserService(repo, CNP)
 
 	// Initiate User handler
-	usrhandler := NewUserHandler(usrsvc)
+	// The admin-only requests (e.g. DELETE /user/{id}?purge=true) are authenticated with ADMIN_TOKEN
+	usrhandler := NewUserHandler(usrsvc).WithAdminToken(os.Getenv("ADMIN_TOKEN"))
+
+	// Retried POST /user requests with the same Idempotency-Key don't create duplicate users
+	idempotency := middlewares.NewIdempotency(db, automigrateUser).WithLogger(logger)
 
 	// Define the routes on subrouter
 	// All the routes here have a prefix of
 	// path defined above.
+	sr.Subrouter.Get("/", usrhandler.List)
 	sr.Subrouter.Get("/{id}", usrhandler.Get)
-	sr.Subrouter.Post("/", usrhandler.Add)
-	sr.Subrouter.Delete("/{id}", usrhandler.Delete)
+	sr.Subrouter.With(idempotency.Handler).Post("/", usrhandler.Add)
+	sr.Subrouter.Delete("/{id}", usrhandler.Delete) // soft delete, or hard delete with ?purge=true
+	sr.Subrouter.Post("/{id}/restore", usrhandler.Restore)
 	sr.Subrouter.Patch("/{id}", usrhandler.Update) // partial update
 
 	// Append to app
 	app.GetOrCreate().AppendSubrouter(sr)
+
+	return idempotency
 }
@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+)
+
+// ErrForbiddenAddress is returned when a delivery would connect to an address of the internal network.
+var ErrForbiddenAddress = errors.New("the address is not public")
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which is not public either.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// NewDeliveryClient returns the HTTP client of the deliveries.
+//
+// The subscription URLs are chosen by the integrators, so unless allowPrivateNetworks is true, the client refuses to
+// connect to the loopback, private, link-local (e.g. the cloud metadata endpoint) and other non-public addresses,
+// which would let anyone make the server send requests inside its network. The address is checked once resolved,
+// at connection time, so a public name that resolves to a private address is refused too.
+// The redirects are not followed, for the same reason: a 3xx response fails the delivery.
+func NewDeliveryClient(allowPrivateNetworks bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if !allowPrivateNetworks {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			return checkPublicAddress(address)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// A proxy would connect on our behalf, to an address that is not checked
+	transport.Proxy = nil
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// checkPublicAddress returns a permanent ErrForbiddenAddress if address, an "ip:port", is not a public address.
+func checkPublicAddress(address string) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return cnp.Permanent(fmt.Errorf("%w: %s", ErrForbiddenAddress, address))
+	}
+
+	// The global unicast addresses exclude the loopback, link-local, multicast and unspecified ones, not the private ones
+	ip := addrPort.Addr().Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) {
+		return cnp.Permanent(fmt.Errorf("%w: %s", ErrForbiddenAddress, ip))
+	}
+
+	return nil
+}
@@ -0,0 +1,317 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/user"
+	"github.com/rs/zerolog"
+	"github.com/sethvargo/go-envconfig"
+)
+
+// maxDrainBytes is the most of a response body that is read, and discarded, after a delivery.
+const maxDrainBytes = 64 << 10
+
+type DispatcherConfig struct {
+	Enabled              bool          `env:"WEBHOOK_DELIVERY_ENABLED,overwrite,default=false"`
+	Interval             time.Duration `env:"WEBHOOK_DELIVERY_INTERVAL,overwrite,default=1s"`                  // how often the due deliveries are sent
+	BatchSize            int           `env:"WEBHOOK_DELIVERY_BATCH_SIZE,overwrite,default=100"`               // the maximum number of deliveries sent per poll
+	Concurrency          int           `env:"WEBHOOK_DELIVERY_CONCURRENCY,overwrite,default=10"`               // the subscriptions delivered to at the same time
+	MaxAttempts          int           `env:"WEBHOOK_DELIVERY_MAX_ATTEMPTS,overwrite,default=10"`              // attempts before a delivery fails
+	Timeout              time.Duration `env:"WEBHOOK_DELIVERY_TIMEOUT,overwrite,default=10s"`                  // the maximum duration of a single attempt, 0 for none
+	BaseDelay            time.Duration `env:"WEBHOOK_DELIVERY_BASE_DELAY,overwrite,default=1s"`                // the backoff after the first failed attempt
+	MaxDelay             time.Duration `env:"WEBHOOK_DELIVERY_MAX_DELAY,overwrite,default=1h"`                 // the maximum backoff
+	AllowPrivateNetworks bool          `env:"WEBHOOK_DELIVERY_ALLOW_PRIVATE_NETWORKS,overwrite,default=false"` // e.g. a receiver on localhost in development, see NewDeliveryClient
+}
+
+// Dispatcher delivers the user events to the subscriptions.
+//
+// It is a user.Publisher: Publish records a Delivery of the event for every subscription that wants it, and Run sends
+// the pending deliveries in the background. A delivery is a POST of the event as JSON, signed with the secret of the
+// subscription (see Sign). A failed delivery is retried with an exponential backoff with jitter, and fails
+// (DeliveryFailed) after MaxAttempts attempts or a 4xx response that won't succeed if retried.
+type Dispatcher struct {
+	*DispatcherConfig
+	repo    *WebhookRepo
+	client  *http.Client
+	cnp     *cnp.CNP
+	backoff cnp.Backoff
+	logger  zerolog.Logger
+}
+
+// NewDispatcher creates a Dispatcher of the subscriptions in repo, configured with WEBHOOK_DELIVERY_* env vars,
+// whose interval, backoff and signatures are timed with clock. It returns an error if the env vars are not valid.
+func NewDispatcher(repo *WebhookRepo, clock clock.Clock) (*Dispatcher, error) {
+	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+
+	// Set defaults with env vars
+	// Uses https://github.com/sethvargo/go-envconfig
+	config := &DispatcherConfig{}
+	if err := envconfig.Process(context.Background(), config); err != nil {
+		return nil, err
+	}
+
+	// The ticker of Run panics with an interval that is not positive
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("WEBHOOK_DELIVERY_INTERVAL must be positive, got %s", config.Interval)
+	}
+
+	return &Dispatcher{
+		DispatcherConfig: config,
+		repo:             repo,
+		client:           NewDeliveryClient(config.AllowPrivateNetworks),
+		cnp:              cnp.NewCloudNativePatterns(clock),
+		backoff:          cnp.FullJitterBackoff{Base: config.BaseDelay, Max: config.MaxDelay},
+		logger:           logger,
+	}, nil
+}
+
+// WithLogger sets the logger using builder pattern
+func (d *Dispatcher) WithLogger(logger zerolog.Logger) *Dispatcher {
+	d.logger = logger
+	return d
+}
+
+// WithClient sets the HTTP client of the deliveries using builder pattern.
+// It replaces the client of NewDeliveryClient, and with it the checks of the addresses and redirects.
+func (d *Dispatcher) WithClient(client *http.Client) *Dispatcher {
+	d.client = client
+	return d
+}
+
+// WithBackoff sets the backoff between the attempts of a delivery using builder pattern
+func (d *Dispatcher) WithBackoff(backoff cnp.Backoff) *Dispatcher {
+	d.backoff = backoff
+	return d
+}
+
+// Publish records the deliveries of event to the subscriptions that want it. They are sent by Run.
+func (d *Dispatcher) Publish(ctx context.Context, event user.UserEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return cnp.Permanent(err)
+	}
+
+	subs, err := d.repo.ListSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := d.cnp.Clock.Now()
+
+	var deliveries []Delivery
+	for _, sub := range subs {
+		if !sub.Wants(event.Type) {
+			continue
+		}
+
+		deliveries = append(deliveries, Delivery{
+			SubscriptionID: sub.ID,
+			EventID:        event.ID,
+			EventType:      event.Type,
+			Payload:        payload,
+			Status:         DeliveryPending,
+			NextAttemptAt:  now,
+		})
+	}
+
+	return d.repo.AddDeliveries(ctx, deliveries)
+}
+
+// Run sends the due deliveries every interval, until ctx is done. It returns right away if it is not enabled.
+// It is blocking, so run it on a separate goroutine.
+func (d *Dispatcher) Run(ctx context.Context) {
+	if !d.Enabled {
+		return
+	}
+
+	d.logger.Info().Dur("interval", d.Interval).Msg("Started webhook dispatcher")
+
+	ticker := d.cnp.Clock.Ticker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			d.logger.Info().Msg("Stopped webhook dispatcher")
+			return
+		case <-ticker.C:
+			// A failed dispatch is retried at the next tick
+			_, _ = d.Dispatch(ctx)
+		}
+	}
+}
+
+// Dispatch sends the deliveries that are due, up to BatchSize, and returns how many succeeded.
+//
+// The deliveries of a subscription are sent in order, and the subscriptions concurrently, up to Concurrency at a time,
+// so that a slow receiver only delays its own deliveries. Once an attempt to a subscription fails and is to be
+// retried, the rest of its deliveries wait for the next poll: a receiver that hangs until the Timeout costs a single
+// Timeout per poll, not one per delivery.
+func (d *Dispatcher) Dispatch(ctx context.Context) (int, error) {
+	deliveries, err := d.repo.DueDeliveries(ctx, d.cnp.Clock.Now(), d.BatchSize)
+	if err != nil {
+		d.logger.Error().Err(err).Msg("Failed to read the due deliveries")
+		return 0, err
+	}
+
+	// The deliveries of every subscription, in the order of the batch
+	var subIDs []uint
+	bySub := map[uint][]Delivery{}
+	for _, delivery := range deliveries {
+		if _, ok := bySub[delivery.SubscriptionID]; !ok {
+			subIDs = append(subIDs, delivery.SubscriptionID)
+		}
+		bySub[delivery.SubscriptionID] = append(bySub[delivery.SubscriptionID], delivery)
+	}
+
+	concurrency := d.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		slots     = make(chan struct{}, concurrency)
+		succeeded int
+		firstErr  error
+	)
+
+	for _, subID := range subIDs {
+		slots <- struct{}{}
+		wg.Add(1)
+
+		go func(subID uint, deliveries []Delivery) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			n, err := d.dispatchSubscription(ctx, subID, deliveries)
+
+			mu.Lock()
+			defer mu.Unlock()
+			succeeded += n
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(subID, bySub[subID])
+	}
+
+	wg.Wait()
+
+	return succeeded, firstErr
+}
+
+// dispatchSubscription sends deliveries, all of the subscription subID, in order, and returns how many succeeded.
+// It stops at the first attempt that is to be retried.
+func (d *Dispatcher) dispatchSubscription(ctx context.Context, subID uint, deliveries []Delivery) (int, error) {
+	sub, err := d.repo.GetSubscription(ctx, subID)
+	if errors.Is(err, ErrSubscriptionNotFound) {
+		// The subscription was deleted after the batch was read, along with its deliveries
+		return 0, nil
+	}
+	if err != nil {
+		d.logger.Error().Err(err).Uint("subscriptionID", subID).Msg("Failed to read the subscription")
+		return 0, err
+	}
+
+	succeeded := 0
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return succeeded, ctx.Err()
+		}
+
+		outcome, err := d.deliver(ctx, sub, delivery)
+		if err != nil {
+			return succeeded, err
+		}
+
+		switch outcome {
+		case user.AttemptSucceeded:
+			succeeded++
+		case user.AttemptRetried:
+			// The receiver is unavailable, the next deliveries would likely fail too
+			return succeeded, nil
+		}
+	}
+
+	return succeeded, nil
+}
+
+// deliver sends delivery to sub, records the outcome in the delivery log, and returns it.
+// Only the failures to record the outcome are returned.
+func (d *Dispatcher) deliver(ctx context.Context, sub Subscription, delivery Delivery) (user.AttemptOutcome, error) {
+	// The request honours its context, so the attempt is bounded without running it on another goroutine
+	sctx, cancel := ctx, context.CancelFunc(func() {})
+	if d.Timeout > 0 {
+		sctx, cancel = d.cnp.Clock.WithTimeout(ctx, d.Timeout)
+	}
+	status, err := d.send(sctx, sub, delivery)
+	cancel()
+
+	now := d.cnp.Clock.Now()
+	attempts := delivery.Attempts + 1
+
+	// A delivery is retried like an event of the outbox
+	columns := map[string]any{"attempts": attempts, "response_status": status}
+	outcome := user.NextAttempt(err, attempts, d.MaxAttempts)
+	switch outcome {
+	case user.AttemptSucceeded:
+		columns["status"] = DeliverySucceeded
+		columns["delivered_at"] = now
+		columns["last_error"] = ""
+	case user.AttemptGaveUp:
+		columns["status"] = DeliveryFailed
+		columns["last_error"] = err.Error()
+		d.logger.Error().Err(err).Uint("deliveryID", delivery.ID).Int("attempts", attempts).Msg("Failed webhook delivery")
+	case user.AttemptRetried:
+		columns["next_attempt_at"] = now.Add(d.backoff.Delay(attempts, 0))
+		columns["last_error"] = err.Error()
+		d.logger.Warn().Err(err).Uint("deliveryID", delivery.ID).Int("attempts", attempts).Msg("Failed to deliver webhook")
+	}
+
+	// Recorded even if ctx was cancelled meanwhile, so that a delivery that succeeded is not sent again
+	if err := d.repo.UpdateDelivery(context.WithoutCancel(ctx), delivery.ID, columns); err != nil {
+		d.logger.Error().Err(err).Uint("deliveryID", delivery.ID).Msg("Failed to update the delivery log")
+		return outcome, err
+	}
+
+	return outcome, nil
+}
+
+// send POSTs the payload of delivery to sub, signed with its secret, and returns the response status.
+func (d *Dispatcher) send(ctx context.Context, sub Subscription, delivery Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, cnp.Permanent(err)
+	}
+
+	timestamp := d.cnp.Clock.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(EventHeader, string(delivery.EventType))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, timestamp, delivery.Payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	// Draining the body lets the connection be reused, but the receiver could send it forever:
+	// past maxDrainBytes, the connection is closed instead
+	io.Copy(io.Discard, io.LimitReader(res.Body, maxDrainBytes))
+
+	return res.StatusCode, user.WebhookStatusError(res.StatusCode)
+}
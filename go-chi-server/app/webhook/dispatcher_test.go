@@ -0,0 +1,509 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/user"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/webhook"
+	"github.com/rs/zerolog"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// receiver is a webhook subscriber that verifies the signature of the deliveries, and responds with status.
+type receiver struct {
+	*httptest.Server
+	secret string
+	clock  clock.Clock
+
+	mu         sync.Mutex
+	status     int
+	deliveries []http.Header
+	bodies     [][]byte
+}
+
+func newReceiver(secret string, clock clock.Clock) *receiver {
+	r := &receiver{secret: secret, clock: clock, status: http.StatusOK}
+
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		signature := req.Header.Get(webhook.SignatureHeader)
+		timestamp := req.Header.Get(webhook.TimestampHeader)
+		if !webhook.Verify(r.secret, signature, timestamp, body, r.clock.Now(), time.Minute) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		r.deliveries = append(r.deliveries, req.Header)
+		r.bodies = append(r.bodies, body)
+		w.WriteHeader(r.status)
+	}))
+
+	return r
+}
+
+func (r *receiver) respond(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func (r *receiver) rotate(secret string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secret = secret
+}
+
+// received returns the headers and the body of the i-th accepted delivery.
+func (r *receiver) received(i int) (http.Header, []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deliveries[i], r.bodies[i]
+}
+
+func (r *receiver) calls() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.deliveries)
+}
+
+// newDispatcher returns a Dispatcher of repo timed with clock, that doesn't log.
+func newDispatcher(repo *webhook.WebhookRepo, clock clock.Clock) *webhook.Dispatcher {
+	dispatcher, err := webhook.NewDispatcher(repo, clock)
+	Expect(err).ShouldNot(HaveOccurred())
+	return dispatcher.WithLogger(zerolog.Nop())
+}
+
+var _ = Describe("Dispatcher", func() {
+	var (
+		gdb        *gorm.DB
+		repo       *webhook.WebhookRepo
+		mockclock  *clock.Mock
+		dispatcher *webhook.Dispatcher
+		rcv        *receiver
+		sub        webhook.Subscription
+	)
+
+	secret := "0123456789abcdef"
+	event := user.UserEvent{
+		ID:         1,
+		Type:       user.UserCreated,
+		UserID:     7,
+		Data:       json.RawMessage(`{"id":7,"firstname":"abc"}`),
+		OccurredAt: time.Unix(1700000000, 0).UTC(),
+	}
+
+	// deliveries returns the delivery log of sub, the most recent first
+	deliveries := func() []webhook.Delivery {
+		deliveries, err := repo.ListDeliveries(context.Background(), webhook.DeliveryQuery{SubscriptionID: sub.ID, Limit: 10})
+		Expect(err).ShouldNot(HaveOccurred())
+		return deliveries
+	}
+
+	BeforeEach(func() {
+		// When the name of the database file handed to sqlite3_open() or to ATTACH is an empty string, then a new temporary file is created to hold the database.
+		// https://www.sqlite.org/inmemorydb.html
+		var err error
+		gdb, err = gorm.Open(sqlite.Open(""), &gorm.Config{})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		automigrateWebhook := true
+		repo = webhook.NewWebhookRepository(gdb, automigrateWebhook)
+
+		mockclock = clock.NewMock()
+		mockclock.Set(time.Unix(1700000000, 0))
+
+		// The receivers listen on the loopback
+		GinkgoT().Setenv("WEBHOOK_DELIVERY_ALLOW_PRIVATE_NETWORKS", "true")
+
+		dispatcher, err = webhook.NewDispatcher(repo, mockclock)
+		Expect(err).ShouldNot(HaveOccurred())
+		dispatcher = dispatcher.
+			WithLogger(zerolog.Nop()).
+			WithBackoff(cnp.ConstantBackoff{Interval: time.Minute})
+		dispatcher.MaxAttempts = 3
+
+		rcv = newReceiver(secret, mockclock)
+
+		sub = webhook.Subscription{URL: rcv.URL, Events: []user.UserEventType{user.UserCreated, user.UserDeleted}, Secret: secret}
+		Expect(repo.AddSubscription(context.Background(), &sub)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		rcv.Close()
+		gdb = nil
+	})
+
+	Context("Publish", func() {
+		It("should record a delivery for the subscriptions that want the event", func() {
+			other := webhook.Subscription{URL: rcv.URL, Events: []user.UserEventType{user.UserUpdated}, Secret: secret}
+			Expect(repo.AddSubscription(context.Background(), &other)).To(Succeed())
+
+			Expect(dispatcher.Publish(context.Background(), event)).To(Succeed())
+
+			log := deliveries()
+			Expect(log).To(HaveLen(1))
+			Expect(log[0].EventID).To(Equal(event.ID))
+			Expect(log[0].EventType).To(Equal(user.UserCreated))
+			Expect(log[0].Status).To(Equal(webhook.DeliveryPending))
+
+			otherLog, err := repo.ListDeliveries(context.Background(), webhook.DeliveryQuery{SubscriptionID: other.ID, Limit: 10})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(otherLog).To(BeEmpty())
+		})
+
+		It("should record an event published twice once", func() {
+			Expect(dispatcher.Publish(context.Background(), event)).To(Succeed())
+			Expect(dispatcher.Publish(context.Background(), event)).To(Succeed())
+
+			Expect(deliveries()).To(HaveLen(1))
+		})
+	})
+
+	Context("Dispatch", func() {
+		BeforeEach(func() {
+			Expect(dispatcher.Publish(context.Background(), event)).To(Succeed())
+		})
+
+		It("should POST the event signed with the secret of the subscription", func() {
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(1))
+
+			// The receiver only accepts the deliveries whose signature it verified
+			Expect(rcv.calls()).To(Equal(1))
+			header, body := rcv.received(0)
+			Expect(header.Get(webhook.EventHeader)).To(Equal("user.created"))
+			Expect(header.Get("Content-Type")).To(Equal("application/json"))
+
+			var received user.UserEvent
+			Expect(json.Unmarshal(body, &received)).To(Succeed())
+			Expect(received.ID).To(Equal(event.ID))
+			Expect(received.UserID).To(Equal(event.UserID))
+			Expect(received.Data).To(MatchJSON(event.Data))
+
+			log := deliveries()
+			Expect(log[0].Status).To(Equal(webhook.DeliverySucceeded))
+			Expect(log[0].Attempts).To(Equal(1))
+			Expect(log[0].ResponseStatus).To(Equal(http.StatusOK))
+			Expect(log[0].DeliveredAt).NotTo(BeNil())
+
+			// Nothing is due anymore
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(0))
+			Expect(rcv.calls()).To(Equal(1))
+		})
+
+		It("should not be accepted by a receiver with another secret", func() {
+			rcv.rotate("another secret!!")
+
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(0))
+
+			// 401 won't succeed if retried
+			log := deliveries()
+			Expect(log[0].Status).To(Equal(webhook.DeliveryFailed))
+			Expect(log[0].ResponseStatus).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should retry a failed delivery after the backoff", func() {
+			rcv.respond(http.StatusServiceUnavailable)
+
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(0))
+
+			log := deliveries()
+			Expect(log[0].Status).To(Equal(webhook.DeliveryPending))
+			Expect(log[0].Attempts).To(Equal(1))
+			Expect(log[0].ResponseStatus).To(Equal(http.StatusServiceUnavailable))
+			Expect(log[0].LastError).To(ContainSubstring("503"))
+
+			// Not due before the backoff
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(0))
+			Expect(rcv.calls()).To(Equal(1))
+
+			rcv.respond(http.StatusNoContent)
+			mockclock.Add(time.Minute)
+
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(1))
+			Expect(rcv.calls()).To(Equal(2))
+
+			// Both attempts are the same delivery
+			first, _ := rcv.received(0)
+			second, _ := rcv.received(1)
+			Expect(second.Get(webhook.DeliveryHeader)).To(Equal(first.Get(webhook.DeliveryHeader)))
+
+			log = deliveries()
+			Expect(log[0].Status).To(Equal(webhook.DeliverySucceeded))
+			Expect(log[0].Attempts).To(Equal(2))
+			Expect(log[0].LastError).To(BeEmpty())
+		})
+
+		It("should fail a delivery after MaxAttempts attempts", func() {
+			rcv.respond(http.StatusInternalServerError)
+
+			for i := 0; i < 3; i++ {
+				Expect(dispatcher.Dispatch(context.Background())).To(Equal(0))
+				mockclock.Add(time.Minute)
+			}
+
+			log := deliveries()
+			Expect(log[0].Status).To(Equal(webhook.DeliveryFailed))
+			Expect(log[0].Attempts).To(Equal(3))
+
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(0))
+			Expect(rcv.calls()).To(Equal(3))
+		})
+
+		It("should fail a delivery right away on a permanent error", func() {
+			rcv.respond(http.StatusGone)
+
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(0))
+
+			log := deliveries()
+			Expect(log[0].Status).To(Equal(webhook.DeliveryFailed))
+			Expect(log[0].Attempts).To(Equal(1))
+		})
+
+		It("should send a replayed delivery again", func() {
+			rcv.respond(http.StatusBadRequest)
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(0))
+			Expect(deliveries()[0].Status).To(Equal(webhook.DeliveryFailed))
+
+			// The subscriber fixed its bug, and replays the failed delivery
+			rcv.respond(http.StatusOK)
+			id := deliveries()[0].ID
+			Expect(repo.ReplayDelivery(context.Background(), sub.ID, id, mockclock.Now())).To(Succeed())
+
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(1))
+			Expect(rcv.calls()).To(Equal(2))
+
+			log := deliveries()
+			Expect(log[0].Status).To(Equal(webhook.DeliverySucceeded))
+			Expect(log[0].Attempts).To(Equal(1))
+		})
+
+		It("should not replay the delivery of another subscription", func() {
+			id := deliveries()[0].ID
+
+			Expect(repo.ReplayDelivery(context.Background(), sub.ID+1, id, mockclock.Now())).To(MatchError(webhook.ErrDeliveryNotFound))
+		})
+
+		It("should refuse to deliver to the internal network by default", func() {
+			dispatcher.WithClient(webhook.NewDeliveryClient(false))
+
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(0))
+			Expect(rcv.calls()).To(Equal(0))
+
+			// The address won't become public if retried
+			log := deliveries()
+			Expect(log[0].Status).To(Equal(webhook.DeliveryFailed))
+			Expect(log[0].LastError).To(ContainSubstring(webhook.ErrForbiddenAddress.Error()))
+		})
+
+		It("should not follow the redirects", func() {
+			target := newReceiver(secret, mockclock)
+			defer target.Close()
+			redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+			defer redirect.Close()
+
+			Expect(gdb.Model(&webhook.Subscription{}).Where("id = ?", sub.ID).Update("url", redirect.URL).Error).To(Succeed())
+
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(0))
+			Expect(target.calls()).To(Equal(0))
+
+			log := deliveries()
+			Expect(log[0].Status).To(Equal(webhook.DeliveryFailed))
+			Expect(log[0].ResponseStatus).To(Equal(http.StatusFound))
+		})
+
+		It("should give up an attempt after the timeout", func() {
+			blocked := make(chan struct{})
+			slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-blocked
+			}))
+			defer slow.Close()
+			defer close(blocked)
+
+			Expect(gdb.Model(&webhook.Subscription{}).Where("id = ?", sub.ID).Update("url", slow.URL).Error).To(Succeed())
+
+			// The real clock times the attempt
+			dispatcher = newDispatcher(repo, clock.New())
+			dispatcher.Timeout = 50 * time.Millisecond
+
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(0))
+
+			log := deliveries()
+			Expect(log[0].Status).To(Equal(webhook.DeliveryPending))
+			Expect(log[0].LastError).To(ContainSubstring("deadline exceeded"))
+		})
+	})
+
+	DescribeTable("should refuse an interval that is not positive",
+		func(interval string) {
+			GinkgoT().Setenv("WEBHOOK_DELIVERY_INTERVAL", interval)
+
+			_, err := webhook.NewDispatcher(repo, mockclock)
+			Expect(err).To(MatchError(ContainSubstring("WEBHOOK_DELIVERY_INTERVAL")))
+		},
+		Entry("zero", "0s"),
+		Entry("negative", "-1s"),
+	)
+
+	Context("A receiver that hangs", func() {
+		var (
+			blocked chan struct{}
+			hung    atomic.Int32
+			slowSub webhook.Subscription
+		)
+
+		BeforeEach(func() {
+			blocked = make(chan struct{})
+			hung.Store(0)
+			unblock := blocked
+			slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hung.Add(1)
+				<-unblock
+			}))
+			DeferCleanup(slow.Close)
+
+			slowSub = webhook.Subscription{URL: slow.URL, Events: []user.UserEventType{user.UserCreated}, Secret: secret}
+			Expect(repo.AddSubscription(context.Background(), &slowSub)).To(Succeed())
+
+			for id := uint(1); id <= 3; id++ {
+				e := event
+				e.ID = id
+				Expect(dispatcher.Publish(context.Background(), e)).To(Succeed())
+			}
+		})
+
+		It("should not delay the deliveries to the other subscriptions", func() {
+			dispatcher.Timeout = 0
+
+			done := make(chan int, 1)
+			go func() {
+				defer GinkgoRecover()
+				succeeded, err := dispatcher.Dispatch(context.Background())
+				Expect(err).ShouldNot(HaveOccurred())
+				done <- succeeded
+			}()
+
+			// The other subscription gets its deliveries while the first delivery to the slow one hangs
+			Eventually(rcv.calls).Should(Equal(3))
+			Expect(hung.Load()).To(Equal(int32(1)))
+			Consistently(done, 50*time.Millisecond).ShouldNot(Receive())
+
+			close(blocked)
+			Eventually(done).Should(Receive(Equal(6)))
+		})
+
+		It("should leave the next deliveries of the subscription to the next poll once an attempt timed out", func() {
+			defer close(blocked)
+
+			// The real clock times the attempt, and the signatures, which the receiver verifies with mockclock
+			dispatcher = newDispatcher(repo, clock.New())
+			dispatcher.Timeout = 50 * time.Millisecond
+			mockclock.Set(time.Now())
+
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(3))
+			Expect(hung.Load()).To(Equal(int32(1)))
+
+			log, err := repo.ListDeliveries(context.Background(), webhook.DeliveryQuery{SubscriptionID: slowSub.ID, Limit: 10})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(log).To(HaveLen(3))
+			Expect(log).To(HaveEach(HaveField("Status", webhook.DeliveryPending)))
+			Expect(log).To(ContainElement(HaveField("Attempts", 1)))
+			Expect(log).To(ContainElement(HaveField("Attempts", 0)))
+		})
+	})
+
+	Context("A receiver streaming its response forever", func() {
+		It("should not read more than a small part of it", func() {
+			endless := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				chunk := make([]byte, 32<<10)
+				for {
+					if _, err := w.Write(chunk); err != nil {
+						return
+					}
+					w.(http.Flusher).Flush()
+				}
+			}))
+			defer endless.Close()
+
+			Expect(gdb.Model(&webhook.Subscription{}).Where("id = ?", sub.ID).Update("url", endless.URL).Error).To(Succeed())
+			Expect(dispatcher.Publish(context.Background(), event)).To(Succeed())
+
+			// Without a timeout, only the size of what is read bounds the attempt
+			dispatcher.Timeout = 0
+
+			done := make(chan int, 1)
+			go func() {
+				defer GinkgoRecover()
+				succeeded, err := dispatcher.Dispatch(context.Background())
+				Expect(err).ShouldNot(HaveOccurred())
+				done <- succeeded
+			}()
+
+			Eventually(done, 5*time.Second).Should(Receive(Equal(1)))
+		})
+	})
+
+	Context("With the outbox relay", func() {
+		AfterEach(func() {
+			user.DiscardUserRepository()
+		})
+
+		It("should deliver the user events", func() {
+			automigrateUser := true
+			usrrepo := user.NewUserRepository(gdb, automigrateUser)
+
+			id, err := usrrepo.Add(context.Background(), user.User{FirstName: "abc", LastName: "xyz", Email: "abc@test.com"})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(usrrepo.Update(context.Background(), id, 0, user.User{Age: 30})).To(Succeed())
+
+			// The events are recorded at the real time
+			relay, err := user.NewOutboxRelay(gdb, clock.New())
+			Expect(err).ShouldNot(HaveOccurred())
+			relay.WithLogger(zerolog.Nop()).WithPublisher(dispatcher)
+			Expect(relay.Relay(context.Background())).To(Equal(2))
+
+			// The subscription only wants user.created
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(1))
+			Expect(rcv.calls()).To(Equal(1))
+
+			_, body := rcv.received(0)
+			var received user.UserEvent
+			Expect(json.Unmarshal(body, &received)).To(Succeed())
+			Expect(received.Type).To(Equal(user.UserCreated))
+			Expect(received.UserID).To(Equal(id))
+		})
+	})
+})
+
+var _ = Describe("NewDeliveryClient", func() {
+	DescribeTable("should refuse to connect to the internal network",
+		func(url string) {
+			_, err := webhook.NewDeliveryClient(false).Get(url)
+			Expect(err).To(MatchError(webhook.ErrForbiddenAddress))
+			Expect(cnp.IsPermanent(err)).To(BeTrue())
+		},
+		Entry("loopback", "http://127.0.0.1:1/"),
+		Entry("IPv6 loopback", "http://[::1]:1/"),
+		Entry("localhost", "http://localhost:1/"),
+		Entry("cloud metadata", "http://169.254.169.254/latest/meta-data/"),
+		Entry("RFC 1918", "http://10.0.0.1/"),
+		Entry("IPv4-mapped RFC 1918", "http://[::ffff:192.168.1.1]/"),
+		Entry("carrier-grade NAT", "http://100.64.0.1/"),
+		Entry("unspecified", "http://0.0.0.0:1/"),
+	)
+})
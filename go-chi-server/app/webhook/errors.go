@@ -0,0 +1,71 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/patilchinmay/go-experiments/go-chi-server/utils/problem"
+)
+
+var (
+	// ErrSubscriptionNotFound is returned when the subscription does not exist.
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+
+	// ErrDeliveryNotFound is returned when the delivery does not exist, or belongs to another subscription.
+	ErrDeliveryNotFound = errors.New("delivery not found")
+
+	// ErrBadRequest is wrapped by the errors of the requests that can't be parsed, e.g. an invalid id or body.
+	ErrBadRequest = errors.New("bad request")
+)
+
+// violations converts the error of validator.Validate.Struct into the violations of a problem, or returns nil if err
+// is not a validation error.
+func violations(err error) []problem.Violation {
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return nil
+	}
+
+	violations := make([]problem.Violation, 0, len(verrs))
+	for _, fe := range verrs {
+		rule := fe.Tag()
+		if fe.Param() != "" {
+			rule += "=" + fe.Param()
+		}
+
+		violations = append(violations, problem.Violation{
+			Field:   fe.Field(),
+			Rule:    rule,
+			Message: "failed on the '" + rule + "' rule",
+		})
+	}
+
+	return violations
+}
+
+// writeError writes err as an RFC 7807 problem, like the user API does. The details of unexpected errors are not
+// leaked to the client, they are logged by the handlers.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var p *problem.Problem
+
+	if v := violations(err); v != nil {
+		p = problem.New(http.StatusUnprocessableEntity, "The request failed validation.")
+		p.Violations = v
+		problem.Write(w, r, p)
+		return
+	}
+
+	switch {
+	case errors.Is(err, ErrBadRequest):
+		p = problem.New(http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrSubscriptionNotFound):
+		p = problem.New(http.StatusNotFound, ErrSubscriptionNotFound.Error())
+	case errors.Is(err, ErrDeliveryNotFound):
+		p = problem.New(http.StatusNotFound, ErrDeliveryNotFound.Error())
+	default:
+		p = problem.New(http.StatusInternalServerError, "")
+	}
+
+	problem.Write(w, r, p)
+}
@@ -0,0 +1,250 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
+	"github.com/patilchinmay/go-experiments/go-chi-server/utils/validator"
+)
+
+// defaultDeliveriesLimit and maxDeliveriesLimit bound the number of deliveries returned by ListDeliveries.
+const (
+	defaultDeliveriesLimit = 50
+	maxDeliveriesLimit     = 500
+)
+
+type WebhookHandler struct {
+	repo *WebhookRepo
+	now  func() time.Time
+}
+
+// NewWebhookHandler creates the handlers of the subscriptions in repo. now times the replays.
+func NewWebhookHandler(repo *WebhookRepo, now func() time.Time) *WebhookHandler {
+	return &WebhookHandler{repo: repo, now: now}
+}
+
+// Add is the handler for POST /webhook. The response carries the secret of the subscription, which is not returned
+// afterwards.
+func (h *WebhookHandler) Add(w http.ResponseWriter, r *http.Request) {
+	oplog := httplog.LogEntry(r.Context())
+	oplog.Debug().Msg("Add Subscription")
+
+	var input Subscription
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, fmt.Errorf("%w: %w", ErrBadRequest, err))
+		oplog.Error().Err(err).Msg("Failed to parse body as json")
+		return
+	}
+
+	// Only the url, events and secret are set by the client
+	sub := Subscription{URL: input.URL, Events: input.Events, Secret: input.Secret}
+	if err := validator.Validator.Struct(sub); err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Invalid subscription")
+		return
+	}
+
+	if sub.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			writeError(w, r, err)
+			oplog.Error().Err(err).Msg("Failed to generate the secret")
+			return
+		}
+		sub.Secret = secret
+	}
+
+	if err := h.repo.AddSubscription(r.Context(), &sub); err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Failed to add subscription")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", r.URL.Path+"/"+strconv.FormatUint(uint64(sub.ID), 10))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sub)
+}
+
+// List is the handler for GET /webhook
+func (h *WebhookHandler) List(w http.ResponseWriter, r *http.Request) {
+	oplog := httplog.LogEntry(r.Context())
+	oplog.Debug().Msg("List Subscriptions")
+
+	subs, err := h.repo.ListSubscriptions(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Failed to list subscriptions")
+		return
+	}
+
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(subs)
+}
+
+// Get is the handler for GET /webhook/{id}
+func (h *WebhookHandler) Get(w http.ResponseWriter, r *http.Request) {
+	oplog := httplog.LogEntry(r.Context())
+	oplog.Debug().Msg("Get Subscription")
+
+	id, err := parseID(r, "id")
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Invalid id")
+		return
+	}
+
+	sub, err := h.repo.GetSubscription(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Failed to get subscription")
+		return
+	}
+	sub.Secret = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sub)
+}
+
+// Delete is the handler for DELETE /webhook/{id}. The delivery log of the subscription is deleted too.
+func (h *WebhookHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	oplog := httplog.LogEntry(r.Context())
+	oplog.Debug().Msg("Delete Subscription")
+
+	id, err := parseID(r, "id")
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Invalid id")
+		return
+	}
+
+	if err := h.repo.DeleteSubscription(r.Context(), id); err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Failed to delete subscription")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListDeliveries is the handler for GET /webhook/{id}/deliveries?status=&limit=, the delivery log of a subscription,
+// the most recent deliveries first.
+func (h *WebhookHandler) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	oplog := httplog.LogEntry(r.Context())
+	oplog.Debug().Msg("List Deliveries")
+
+	id, err := parseID(r, "id")
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Invalid id")
+		return
+	}
+
+	query := DeliveryQuery{SubscriptionID: id, Limit: defaultDeliveriesLimit}
+
+	switch status := DeliveryStatus(r.URL.Query().Get("status")); status {
+	case "", DeliveryPending, DeliverySucceeded, DeliveryFailed:
+		query.Status = status
+	default:
+		writeError(w, r, fmt.Errorf("%w: invalid status", ErrBadRequest))
+		oplog.Error().Str("status", string(status)).Msg("Invalid status")
+		return
+	}
+
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if query.Limit, err = strconv.Atoi(v); err != nil || query.Limit < 1 || query.Limit > maxDeliveriesLimit {
+			writeError(w, r, fmt.Errorf("%w: limit must be between 1 and %d", ErrBadRequest, maxDeliveriesLimit))
+			oplog.Error().Str("limit", v).Msg("Invalid limit")
+			return
+		}
+	}
+
+	// The subscription must exist, so that its empty log is not mistaken for an unknown subscription
+	if _, err := h.repo.GetSubscription(r.Context(), id); err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Failed to get subscription")
+		return
+	}
+
+	deliveries, err := h.repo.ListDeliveries(r.Context(), query)
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Failed to list deliveries")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// Replay is the handler for POST /webhook/{id}/deliveries/{deliveryID}/replay. The delivery is sent again by the
+// Dispatcher, with the same delivery id, so the subscribers can deduplicate it.
+func (h *WebhookHandler) Replay(w http.ResponseWriter, r *http.Request) {
+	oplog := httplog.LogEntry(r.Context())
+	oplog.Debug().Msg("Replay Delivery")
+
+	id, err := parseID(r, "id")
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Invalid id")
+		return
+	}
+
+	deliveryID, err := parseID(r, "deliveryID")
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Invalid delivery id")
+		return
+	}
+
+	if err := h.repo.ReplayDelivery(r.Context(), id, deliveryID, h.now()); err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Failed to replay delivery")
+		return
+	}
+
+	delivery, err := h.repo.GetDelivery(r.Context(), id, deliveryID)
+	if err != nil {
+		writeError(w, r, err)
+		oplog.Error().Err(err).Msg("Failed to get delivery")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(delivery)
+}
+
+// parseID parses the path param name of r as an id.
+func parseID(r *http.Request, name string) (uint, error) {
+	u64, err := strconv.ParseUint(chi.URLParam(r, name), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %s", ErrBadRequest, name)
+	}
+
+	return uint(u64), nil
+}
+
+// newSecret returns a random secret of 32 bytes, hex-encoded.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,277 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/middlewares"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/user"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/webhook"
+	"github.com/patilchinmay/go-experiments/go-chi-server/utils/problem"
+	"github.com/patilchinmay/go-experiments/go-chi-server/utils/testhelpers"
+	"github.com/rs/zerolog"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var _ = Describe("Webhook Handlers", Serial, func() {
+	var ts *httptest.Server
+	var dispatcher *webhook.Dispatcher
+	var path string = "/webhook"
+
+	// request sends a request with a JSON body to the webhook API
+	request := func(method, url, data string) (*http.Response, string) {
+		to := time.Duration(10)
+		opt := &testhelpers.HttpOptions{
+			Ctx:     context.Background(),
+			Url:     ts.URL + path + url,
+			TO:      &to,
+			Method:  method,
+			Headers: map[string]string{"Content-Type": "application/json", middlewares.AdminTokenHeader: "secret"},
+			Data:    []byte(data),
+		}
+
+		return testhelpers.DoRequest(opt)
+	}
+
+	// subscribe registers a subscription to events, and returns it
+	subscribe := func(events string) webhook.Subscription {
+		res, body := request(http.MethodPost, "", `{"url":"https://example.com/hooks","events":`+events+`}`)
+		Expect(res.StatusCode).To(Equal(http.StatusCreated))
+
+		var sub webhook.Subscription
+		Expect(json.Unmarshal([]byte(body), &sub)).To(Succeed())
+		return sub
+	}
+
+	BeforeEach(func() {
+		// open gorm db
+		// When the name of the database file handed to sqlite3_open() or to ATTACH is an empty string, then a new temporary file is created to hold the database.
+		// https://www.sqlite.org/inmemorydb.html
+		gdb, err := gorm.Open(sqlite.Open(""), &gorm.Config{TranslateError: true})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		// logger
+		logger := zerolog.Nop()
+		// Create app with routes handlers (uses builder pattern)
+		App := app.GetOrCreate().SetupDB(gdb).WithLogger(logger).SetupCORS().SetupMiddlewares().SetupNotFoundHandler()
+
+		// Create and setup webhook subrouter, managed by the admins
+		GinkgoT().Setenv("ADMIN_TOKEN", "secret")
+		dispatcher, err = webhook.SetupSubrouter(gdb, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		// Initialize and register subrouters
+		App.MountSubrouters()
+
+		// Create server to test the app
+		ts = httptest.NewServer(App.Router)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+		app.Discard()
+		ts = nil
+	})
+
+	Context("Subscriptions", func() {
+		It("should only let the admins manage the subscriptions", func() {
+			for _, token := range []string{"", "wrong"} {
+				req, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(`{"url":"https://example.com/hooks","events":["user.created"]}`))
+				Expect(err).ShouldNot(HaveOccurred())
+				req.Header.Set("Content-Type", "application/json")
+				if token != "" {
+					req.Header.Set(middlewares.AdminTokenHeader, token)
+				}
+
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+			}
+
+			res, _ := request(http.MethodGet, "", "")
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("should register a subscription with a generated secret", func() {
+			res, body := request(http.MethodPost, "", `{"url":"https://example.com/hooks","events":["user.created","user.deleted"]}`)
+
+			Expect(res.StatusCode).To(Equal(http.StatusCreated))
+			Expect(res).To(HaveHTTPHeaderWithValue("Content-Type", "application/json"))
+
+			var sub webhook.Subscription
+			Expect(json.Unmarshal([]byte(body), &sub)).To(Succeed())
+			Expect(sub.ID).NotTo(BeZero())
+			Expect(sub.Events).To(Equal([]user.UserEventType{user.UserCreated, user.UserDeleted}))
+			Expect(sub.Secret).To(MatchRegexp(`^[0-9a-f]{64}$`))
+			Expect(res).To(HaveHTTPHeaderWithValue("Location", path+"/"+strconv.FormatUint(uint64(sub.ID), 10)))
+		})
+
+		It("should keep the secret given by the integrator", func() {
+			res, body := request(http.MethodPost, "", `{"url":"https://example.com/hooks","events":["user.updated"],"secret":"0123456789abcdef"}`)
+
+			Expect(res.StatusCode).To(Equal(http.StatusCreated))
+			Expect(body).To(ContainSubstring(`"secret":"0123456789abcdef"`))
+		})
+
+		It("should return http 422 error for an invalid subscription", func() {
+			res, body := request(http.MethodPost, "", `{"url":"not a url","events":["user.renamed"],"secret":"short"}`)
+
+			Expect(res.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+			Expect(res).To(HaveHTTPHeaderWithValue("Content-Type", problem.ContentType))
+
+			var p problem.Problem
+			Expect(json.Unmarshal([]byte(body), &p)).To(Succeed())
+			Expect(p.Violations).To(ConsistOf(
+				HaveField("Field", "url"),
+				HaveField("Field", "events[0]"),
+				HaveField("Field", "secret"),
+			))
+		})
+
+		It("should return http 422 error for a subscription without events", func() {
+			res, _ := request(http.MethodPost, "", `{"url":"https://example.com/hooks","events":[]}`)
+
+			Expect(res.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+		})
+
+		It("should return http 400 error for a malformed body", func() {
+			res, _ := request(http.MethodPost, "", `{"url":`)
+
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should list and get the subscriptions without their secret", func() {
+			sub := subscribe(`["user.created"]`)
+
+			res, body := request(http.MethodGet, "", "")
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			var subs []webhook.Subscription
+			Expect(json.Unmarshal([]byte(body), &subs)).To(Succeed())
+			Expect(subs).To(HaveLen(1))
+			Expect(subs[0].ID).To(Equal(sub.ID))
+			Expect(body).NotTo(ContainSubstring("secret"))
+
+			res, body = request(http.MethodGet, "/"+strconv.FormatUint(uint64(sub.ID), 10), "")
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"url":"https://example.com/hooks"`))
+			Expect(body).NotTo(ContainSubstring("secret"))
+		})
+
+		It("should return http 404 error for an unknown subscription", func() {
+			res, _ := request(http.MethodGet, "/99", "")
+			Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+
+			res, _ = request(http.MethodDelete, "/99", "")
+			Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+
+			res, _ = request(http.MethodGet, "/99/deliveries", "")
+			Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+		})
+
+		It("should delete a subscription", func() {
+			sub := subscribe(`["user.created"]`)
+			id := strconv.FormatUint(uint64(sub.ID), 10)
+
+			res, _ := request(http.MethodDelete, "/"+id, "")
+			Expect(res.StatusCode).To(Equal(http.StatusNoContent))
+
+			res, _ = request(http.MethodGet, "/"+id, "")
+			Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Context("Deliveries", func() {
+		var sub webhook.Subscription
+		var id string
+
+		BeforeEach(func() {
+			sub = subscribe(`["user.created","user.updated"]`)
+			id = strconv.FormatUint(uint64(sub.ID), 10)
+
+			for i, eventType := range []user.UserEventType{user.UserCreated, user.UserUpdated, user.UserDeleted} {
+				event := user.UserEvent{ID: uint(i + 1), Type: eventType, UserID: 1, Data: json.RawMessage(`{"id":1}`)}
+				Expect(dispatcher.Publish(context.Background(), event)).To(Succeed())
+			}
+		})
+
+		It("should list the delivery log, the most recent first", func() {
+			res, body := request(http.MethodGet, "/"+id+"/deliveries", "")
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			var deliveries []webhook.Delivery
+			Expect(json.Unmarshal([]byte(body), &deliveries)).To(Succeed())
+
+			// The subscription does not want user.deleted
+			Expect(deliveries).To(HaveLen(2))
+			Expect(deliveries[0].EventType).To(Equal(user.UserUpdated))
+			Expect(deliveries[1].EventType).To(Equal(user.UserCreated))
+			Expect(deliveries).To(HaveEach(HaveField("Status", webhook.DeliveryPending)))
+			Expect(deliveries[0].Payload).To(MatchJSON(`{"id":2,"type":"user.updated","user_id":1,"data":{"id":1},"occurred_at":"0001-01-01T00:00:00Z"}`))
+		})
+
+		It("should filter the delivery log", func() {
+			res, body := request(http.MethodGet, "/"+id+"/deliveries?status=failed", "")
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`[]`))
+
+			res, body = request(http.MethodGet, "/"+id+"/deliveries?limit=1", "")
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			var deliveries []webhook.Delivery
+			Expect(json.Unmarshal([]byte(body), &deliveries)).To(Succeed())
+			Expect(deliveries).To(HaveLen(1))
+		})
+
+		It("should return http 400 error for an invalid filter", func() {
+			res, _ := request(http.MethodGet, "/"+id+"/deliveries?status=lost", "")
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+
+			res, _ = request(http.MethodGet, "/"+id+"/deliveries?limit=0", "")
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should replay a delivery", func() {
+			res, body := request(http.MethodGet, "/"+id+"/deliveries", "")
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			var deliveries []webhook.Delivery
+			Expect(json.Unmarshal([]byte(body), &deliveries)).To(Succeed())
+			deliveryID := strconv.FormatUint(uint64(deliveries[0].ID), 10)
+
+			res, body = request(http.MethodPost, "/"+id+"/deliveries/"+deliveryID+"/replay", "")
+			Expect(res.StatusCode).To(Equal(http.StatusAccepted))
+
+			var delivery webhook.Delivery
+			Expect(json.Unmarshal([]byte(body), &delivery)).To(Succeed())
+			Expect(delivery.ID).To(Equal(deliveries[0].ID))
+			Expect(delivery.Status).To(Equal(webhook.DeliveryPending))
+			Expect(delivery.Attempts).To(BeZero())
+		})
+
+		It("should return http 404 error when replaying an unknown delivery", func() {
+			res, _ := request(http.MethodPost, "/"+id+"/deliveries/99/replay", "")
+			Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+
+			res, _ = request(http.MethodPost, "/"+id+"/deliveries/abc/replay", "")
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should delete the delivery log with the subscription", func() {
+			res, _ := request(http.MethodDelete, "/"+id, "")
+			Expect(res.StatusCode).To(Equal(http.StatusNoContent))
+
+			Expect(dispatcher.Dispatch(context.Background())).To(Equal(0))
+		})
+	})
+})
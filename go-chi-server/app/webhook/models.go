@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/user"
+)
+
+// Subscription is a URL registered by an integrator to receive the user events of Events.
+type Subscription struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	URL       string    `json:"url" gorm:"not null" validate:"required,http_url"`
+	// Events are the types of the user events delivered to URL.
+	Events []user.UserEventType `json:"events" gorm:"serializer:json;not null" validate:"required,min=1,dive,oneof=user.created user.updated user.deleted"`
+	// Secret signs the deliveries (see Sign). It is generated when not given, and only returned when the
+	// subscription is created.
+	Secret string `json:"secret,omitempty" gorm:"not null" validate:"omitempty,min=16"`
+}
+
+func (Subscription) TableName() string {
+	return "webhook_subscriptions"
+}
+
+// Wants reports whether the events of eventType are delivered to s.
+func (s Subscription) Wants(eventType user.UserEventType) bool {
+	for _, e := range s.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// DeliveryStatus is the status of a Delivery.
+type DeliveryStatus string
+
+const (
+	// DeliveryPending deliveries are waiting to be sent, or to be retried after a failed attempt.
+	DeliveryPending DeliveryStatus = "pending"
+	// DeliverySucceeded deliveries were acknowledged by the subscriber with a 2xx response.
+	DeliverySucceeded DeliveryStatus = "succeeded"
+	// DeliveryFailed deliveries failed too many times, or with a permanent error. They are only sent again if replayed.
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// Delivery is the delivery of a user event to a Subscription. The deliveries form the delivery log of the
+// subscription, that can be queried and replayed.
+type Delivery struct {
+	ID             uint               `json:"id" gorm:"primarykey"`
+	CreatedAt      time.Time          `json:"created_at"`
+	SubscriptionID uint               `json:"subscription_id" gorm:"not null;uniqueIndex:idx_webhook_deliveries_event,priority:1"`
+	EventID        uint               `json:"event_id" gorm:"not null;uniqueIndex:idx_webhook_deliveries_event,priority:2"`
+	EventType      user.UserEventType `json:"event_type" gorm:"not null"`
+	// Payload is the body of the requests, i.e. the user event as JSON.
+	Payload json.RawMessage `json:"payload"`
+
+	Status         DeliveryStatus `json:"status" gorm:"not null;default:pending;index:idx_webhook_deliveries_due,priority:1"`
+	NextAttemptAt  time.Time      `json:"next_attempt_at" gorm:"not null;index:idx_webhook_deliveries_due,priority:2"`
+	Attempts       int            `json:"attempts" gorm:"not null;default:0"`
+	ResponseStatus int            `json:"response_status,omitempty"` // the status of the last response, if any
+	LastError      string         `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time     `json:"delivered_at,omitempty"`
+}
+
+func (Delivery) TableName() string {
+	return "webhook_deliveries"
+}
@@ -0,0 +1,161 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// WebhookRepo stores the subscriptions and their delivery log.
+type WebhookRepo struct {
+	db *gorm.DB
+}
+
+func NewWebhookRepository(db *gorm.DB, automigrate bool) *WebhookRepo {
+	repo := &WebhookRepo{db: db}
+
+	if automigrate {
+		// automigrate the subscriptions, and their deliveries
+		repo.db.AutoMigrate(&Subscription{}, &Delivery{})
+	}
+
+	return repo
+}
+
+func (wr *WebhookRepo) AddSubscription(ctx context.Context, sub *Subscription) error {
+	return wr.db.WithContext(ctx).Create(sub).Error
+}
+
+func (wr *WebhookRepo) GetSubscription(ctx context.Context, id uint) (Subscription, error) {
+	var sub Subscription
+
+	err := wr.db.WithContext(ctx).First(&sub, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return sub, ErrSubscriptionNotFound
+	}
+
+	return sub, err
+}
+
+func (wr *WebhookRepo) ListSubscriptions(ctx context.Context) ([]Subscription, error) {
+	var subs []Subscription
+
+	if err := wr.db.WithContext(ctx).Order("id").Find(&subs).Error; err != nil {
+		return nil, err
+	}
+
+	return subs, nil
+}
+
+// DeleteSubscription removes the subscription id and its delivery log.
+func (wr *WebhookRepo) DeleteSubscription(ctx context.Context, id uint) error {
+	return wr.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&Subscription{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrSubscriptionNotFound
+		}
+
+		return tx.Where("subscription_id = ?", id).Delete(&Delivery{}).Error
+	})
+}
+
+// AddDeliveries records deliveries. The delivery of an event that is already recorded for a subscription is ignored,
+// so that an event published twice by the outbox relay is delivered once.
+func (wr *WebhookRepo) AddDeliveries(ctx context.Context, deliveries []Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	return wr.db.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "subscription_id"}, {Name: "event_id"}},
+			DoNothing: true,
+		}).
+		Create(&deliveries).Error
+}
+
+// DeliveryQuery filters the delivery log of a subscription.
+type DeliveryQuery struct {
+	SubscriptionID uint
+	Status         DeliveryStatus // empty for any status
+	Limit          int
+}
+
+// ListDeliveries returns the deliveries matching query, the most recent first.
+func (wr *WebhookRepo) ListDeliveries(ctx context.Context, query DeliveryQuery) ([]Delivery, error) {
+	tx := wr.db.WithContext(ctx).Where("subscription_id = ?", query.SubscriptionID)
+
+	if query.Status != "" {
+		tx = tx.Where("status = ?", query.Status)
+	}
+
+	var deliveries []Delivery
+	if err := tx.Order("id DESC").Limit(query.Limit).Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// GetDelivery returns the delivery id of the subscription subscriptionID.
+func (wr *WebhookRepo) GetDelivery(ctx context.Context, subscriptionID, id uint) (Delivery, error) {
+	var delivery Delivery
+
+	err := wr.db.WithContext(ctx).Where("subscription_id = ?", subscriptionID).First(&delivery, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return delivery, ErrDeliveryNotFound
+	}
+
+	return delivery, err
+}
+
+// DueDeliveries returns the pending deliveries whose next attempt is before now, up to limit, the oldest first.
+func (wr *WebhookRepo) DueDeliveries(ctx context.Context, now time.Time, limit int) ([]Delivery, error) {
+	var deliveries []Delivery
+
+	err := wr.db.WithContext(ctx).
+		Where("status = ? AND next_attempt_at <= ?", DeliveryPending, now).
+		Order("id").
+		Limit(limit).
+		Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// UpdateDelivery sets columns of the delivery id.
+func (wr *WebhookRepo) UpdateDelivery(ctx context.Context, id uint, columns map[string]any) error {
+	return wr.db.WithContext(ctx).Model(&Delivery{}).Where("id = ?", id).Updates(columns).Error
+}
+
+// ReplayDelivery makes the delivery id of the subscription subscriptionID pending again, due at now, with a fresh
+// count of attempts.
+func (wr *WebhookRepo) ReplayDelivery(ctx context.Context, subscriptionID, id uint, now time.Time) error {
+	result := wr.db.WithContext(ctx).Model(&Delivery{}).
+		Where("id = ? AND subscription_id = ?", id, subscriptionID).
+		Updates(map[string]any{
+			"status":          DeliveryPending,
+			"next_attempt_at": now,
+			"attempts":        0,
+			"last_error":      "",
+		})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrDeliveryNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the signature of a delivery, "sha256=" followed by the hex HMAC-SHA256, see Sign.
+	SignatureHeader = "X-Webhook-Signature"
+	// TimestampHeader carries the Unix time at which a delivery was signed.
+	TimestampHeader = "X-Webhook-Timestamp"
+	// DeliveryHeader carries the id of the delivery. It is the same for all the attempts of a delivery.
+	DeliveryHeader = "X-Webhook-Delivery"
+	// EventHeader carries the type of the user event.
+	EventHeader = "X-Webhook-Event"
+)
+
+// Sign returns the value of SignatureHeader for body signed at timestamp with secret: the HMAC-SHA256 of
+// "<timestamp>.<body>". The timestamp is signed so that a captured delivery can't be replayed later by a third party.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the signature of body at timestamp with secret, and whether timestamp is within
+// tolerance of now (0 for no check). This is what a subscriber does with the headers of a delivery.
+func Verify(secret, signature, timestamp string, body []byte, now time.Time, tolerance time.Duration) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	if tolerance > 0 {
+		if age := now.Sub(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+			return false
+		}
+	}
+
+	return hmac.Equal([]byte(signature), []byte(Sign(secret, ts, body)))
+}
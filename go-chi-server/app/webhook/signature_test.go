@@ -0,0 +1,43 @@
+package webhook_test
+
+import (
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/webhook"
+)
+
+var _ = Describe("Signature", func() {
+	secret := "0123456789abcdef"
+	body := []byte(`{"id":1,"type":"user.created"}`)
+	now := time.Unix(1700000000, 0)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	It("should sign with the HMAC-SHA256 of the timestamp and the body", func() {
+		signature := webhook.Sign(secret, now.Unix(), body)
+
+		Expect(signature).To(MatchRegexp(`^sha256=[0-9a-f]{64}$`))
+		Expect(webhook.Sign(secret, now.Unix(), body)).To(Equal(signature))
+		Expect(webhook.Sign(secret, now.Unix()+1, body)).NotTo(Equal(signature))
+		Expect(webhook.Sign("another secret!!", now.Unix(), body)).NotTo(Equal(signature))
+	})
+
+	It("should verify the signature of the body", func() {
+		signature := webhook.Sign(secret, now.Unix(), body)
+
+		Expect(webhook.Verify(secret, signature, timestamp, body, now, time.Minute)).To(BeTrue())
+		Expect(webhook.Verify(secret, signature, timestamp, []byte(`{"id":2}`), now, time.Minute)).To(BeFalse())
+		Expect(webhook.Verify("another secret!!", signature, timestamp, body, now, time.Minute)).To(BeFalse())
+		Expect(webhook.Verify(secret, "md5=abc", timestamp, body, now, time.Minute)).To(BeFalse())
+		Expect(webhook.Verify(secret, signature, "abc", body, now, time.Minute)).To(BeFalse())
+	})
+
+	It("should reject the signatures outside of the tolerance", func() {
+		signature := webhook.Sign(secret, now.Unix(), body)
+
+		Expect(webhook.Verify(secret, signature, timestamp, body, now.Add(2*time.Minute), time.Minute)).To(BeFalse())
+		Expect(webhook.Verify(secret, signature, timestamp, body, now.Add(2*time.Minute), 0)).To(BeTrue())
+	})
+})
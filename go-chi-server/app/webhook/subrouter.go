@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"os"
+
+	"github.com/benbjohnson/clock"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/middlewares"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// SetupSubrouter initializes the subrouter, defines the routes & handlers, and
+// appends it to the []app.Subrouters.
+// It returns the Dispatcher of the subscriptions, to be fed with the user events and run,
+// or an error if its WEBHOOK_DELIVERY_* env vars are not valid.
+// This function is called in main
+func SetupSubrouter(db *gorm.DB, logger zerolog.Logger) (*Dispatcher, error) {
+	path := "/webhook"
+
+	// Create subrouter with routes
+	sr := app.NewSubrouter(path)
+
+	// Initiate Webhook Repository Layer
+	automigrateWebhook := true
+	repo := NewWebhookRepository(db, automigrateWebhook)
+
+	clock := clock.New()
+
+	// Initiate Webhook handler
+	handler := NewWebhookHandler(repo, clock.Now)
+
+	// The subscriptions make the server send requests, so they are managed by the admins only,
+	// authenticated with ADMIN_TOKEN (see middlewares.AdminOnly)
+	sr.Subrouter.Use(middlewares.AdminOnly(os.Getenv("ADMIN_TOKEN")))
+
+	// Define the routes on subrouter
+	// All the routes here have a prefix of
+	// path defined above.
+	sr.Subrouter.Get("/", handler.List)
+	sr.Subrouter.Post("/", handler.Add)
+	sr.Subrouter.Get("/{id}", handler.Get)
+	sr.Subrouter.Delete("/{id}", handler.Delete)
+	sr.Subrouter.Get("/{id}/deliveries", handler.ListDeliveries) // the delivery log
+	sr.Subrouter.Post("/{id}/deliveries/{deliveryID}/replay", handler.Replay)
+
+	// Append to app
+	app.GetOrCreate().AppendSubrouter(sr)
+
+	dispatcher, err := NewDispatcher(repo, clock)
+	if err != nil {
+		return nil, err
+	}
+
+	return dispatcher.WithLogger(logger), nil
+}
@@ -2,81 +2,242 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/go-chi/chi/v5/middleware"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/patilchinmay/go-experiments/cloudnativepatterns/observability"
 	"github.com/rs/zerolog"
 	"github.com/sethvargo/go-envconfig"
+	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
+// MaxOpenConns is the size of the connection pool shared by every repository.
+// Repositories should cap their concurrency (e.g. with a bulkhead) below it,
+// so that one slow dependency cannot take all the connections.
+const MaxOpenConns = 100
+
+// ErrInvalidConfig is returned when the database config is incomplete or unknown, e.g. an unknown DB_DRIVER.
+var ErrInvalidConfig = errors.New("invalid database config")
+
 type DatabaseConfig struct {
-	Host     string `env:"DB_HOST,required"`
-	Port     string `env:"DB_PORT,required"`
-	User     string `env:"DB_USER,required"`
-	Password string `env:"DB_PASS,required"`
-	DBName   string `env:"DB_NAME,required"`
+	Driver string `env:"DB_DRIVER,overwrite,default=postgres"` // postgres, sqlite or mysql
+	// DSN is the data source name of the driver, e.g. "file:app.db" or ":memory:" for sqlite (the default).
+	// For postgres and mysql, it is built from DB_HOST, DB_PORT, DB_USER, DB_PASS and DB_NAME when empty.
+	DSN      string `env:"DB_DSN,overwrite"`
+	Host     string `env:"DB_HOST,overwrite"`
+	Port     string `env:"DB_PORT,overwrite"`
+	User     string `env:"DB_USER,overwrite"`
+	Password string `env:"DB_PASS,overwrite"`
+	DBName   string `env:"DB_NAME,overwrite"`
+
+	ConnectRetries   int           `env:"DB_CONNECT_RETRIES,overwrite,default=5"`        // the retries of the connection at startup
+	ConnectBaseDelay time.Duration `env:"DB_CONNECT_BASE_DELAY,overwrite,default=500ms"` // the backoff after the first failed connection
+	ConnectMaxDelay  time.Duration `env:"DB_CONNECT_MAX_DELAY,overwrite,default=10s"`    // the maximum backoff
+}
+
+// Dialector returns the gorm dialector of Driver, connecting to DSN.
+func (c DatabaseConfig) Dialector() (gorm.Dialector, error) {
+	switch c.Driver {
+	case "postgres":
+		dsn := c.DSN
+		if dsn == "" {
+			if err := c.requireCredentials(); err != nil {
+				return nil, err
+			}
+			dsn = fmt.Sprintf("postgres://%s:%s@%s:%s/%s", c.User, c.Password, c.Host, c.Port, c.DBName)
+		}
+
+		return postgres.New(postgres.Config{
+			DSN:                  dsn,
+			PreferSimpleProtocol: true, // disables implicit prepared statement usage
+		}), nil
+	case "mysql":
+		dsn := c.DSN
+		if dsn == "" {
+			if err := c.requireCredentials(); err != nil {
+				return nil, err
+			}
+			// parseTime scans the DATETIME columns into time.Time
+			dsn = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true", c.User, c.Password, c.Host, c.Port, c.DBName)
+		}
+
+		return mysql.Open(dsn), nil
+	case "sqlite":
+		dsn := c.DSN
+		if dsn == "" {
+			dsn = ":memory:"
+		}
+
+		return sqlite.Open(dsn), nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown DB_DRIVER %q, expected postgres, sqlite or mysql", ErrInvalidConfig, c.Driver)
+}
+
+// InMemory reports whether the database is an in-memory SQLite database.
+func (c DatabaseConfig) InMemory() bool {
+	return c.Driver == "sqlite" && (c.DSN == "" || strings.Contains(c.DSN, ":memory:") || strings.Contains(c.DSN, "mode=memory"))
+}
+
+// requireCredentials returns an error naming the env vars that the DSN of a server is missing.
+func (c DatabaseConfig) requireCredentials() error {
+	var missing []string
+	for name, value := range map[string]string{
+		"DB_HOST": c.Host,
+		"DB_PORT": c.Port,
+		"DB_USER": c.User,
+		"DB_PASS": c.Password,
+		"DB_NAME": c.DBName,
+	} {
+		if value == "" {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("%w: DB_DSN or %s required by the %s driver", ErrInvalidConfig, strings.Join(missing, ", "), c.Driver)
+	}
+
+	return nil
 }
 
 type Database struct {
 	databaseConfig DatabaseConfig
 	logger         zerolog.Logger
+	cnp            *cnp.CNP
 	DB             *gorm.DB
 }
 
 var database *Database
 
-func New(logger zerolog.Logger) *Database {
+// New connects to the database of DB_DRIVER, configured with DB_* env vars. The connection is retried with a jittered
+// backoff until DB_CONNECT_RETRIES retries have failed or ctx is done, e.g. while the database is still starting up.
+// The backoff is measured with clock.
+func New(ctx context.Context, logger zerolog.Logger, clock clock.Clock) (*Database, error) {
 	if database == nil {
-		database = &Database{
+		d := &Database{
 			databaseConfig: DatabaseConfig{},
 			logger:         logger,
+			cnp:            cnp.NewCloudNativePatterns(clock).WithListener(observability.NewZerologListener(logger, middleware.GetReqID)),
 		}
 
-		database.loadCredentials()
-		database.connect()
-		database.setupConnectionPool()
+		if err := d.loadCredentials(); err != nil {
+			return nil, err
+		}
+
+		if err := d.connect(ctx); err != nil {
+			return nil, err
+		}
+
+		if err := d.setupConnectionPool(); err != nil {
+			return nil, err
+		}
+
+		database = d
 	}
-	return database
+	return database, nil
 }
 
-func (d *Database) loadCredentials() {
+// Discard will remove the reference to database so that it can be garbage collected. In other words, it deletes the singleton instance of *Database.
+func Discard() {
+	if database != nil {
+		database = nil
+	}
+}
+
+func (d *Database) loadCredentials() error {
 	// Load credentials from env vars
 	// Uses https://github.com/sethvargo/go-envconfig
 	if err := envconfig.Process(context.Background(), &d.databaseConfig); err != nil {
-		d.logger.Fatal().Err(err).Msg("Failed to override from env vars")
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
 	}
+	return nil
 }
 
-func (d *Database) connect() {
-	dbURL := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", d.databaseConfig.User, d.databaseConfig.Password, d.databaseConfig.Host, d.databaseConfig.Port, d.databaseConfig.DBName)
+func (d *Database) connect(ctx context.Context) error {
+	// Fail fast on a config that can't connect, rather than retrying it
+	if _, err := d.databaseConfig.Dialector(); err != nil {
+		return err
+	}
 
-	var err error
-	d.DB, err = gorm.Open(postgres.New(postgres.Config{
-		DSN:                  dbURL,
-		PreferSimpleProtocol: true, // disables implicit prepared statement usage
-	}), &gorm.Config{})
+	open := func(ctx context.Context) error {
+		// A dialector is initialized by gorm.Open, so every attempt gets a new one
+		dialector, err := d.databaseConfig.Dialector()
+		if err != nil {
+			return cnp.Permanent(err)
+		}
 
-	if err != nil {
-		d.logger.Fatal().Err(err).Msg("Failed to connect to database")
+		db, err := gorm.Open(dialector, &gorm.Config{
+			// Translate the driver errors into gorm errors, e.g. a unique violation into gorm.ErrDuplicatedKey
+			TranslateError: true,
+		})
+		if err != nil {
+			// gorm.Open pings the database, and leaves the pool of a failed ping open
+			if db != nil {
+				if sqlDB, dbErr := db.DB(); dbErr == nil {
+					sqlDB.Close()
+				}
+			}
+			return err
+		}
+
+		d.DB = db
+		return nil
+	}
+
+	connect := d.cnp.RetryWithPolicy(open, cnp.RetryPolicy{
+		Name:       "db-connect",
+		Retries:    d.databaseConfig.ConnectRetries,
+		Backoff:    cnp.FullJitterBackoff{Base: d.databaseConfig.ConnectBaseDelay, Max: d.databaseConfig.ConnectMaxDelay},
+		Classifier: IsRetryable,
+	})
+
+	if err := connect(ctx); err != nil {
+		return fmt.Errorf("failed to connect to the %s database: %w", d.databaseConfig.Driver, err)
 	}
 
-	d.logger.Debug().Msg("Connected to database")
+	// Carry the request id into the SQL, see SQLCommenter
+	if err := d.DB.Use(SQLCommenter{}); err != nil {
+		return fmt.Errorf("failed to register the sqlcommenter plugin: %w", err)
+	}
+
+	d.logger.Debug().Str("driver", d.databaseConfig.Driver).Msg("Connected to database")
+	return nil
 }
 
-func (d *Database) setupConnectionPool() {
+func (d *Database) setupConnectionPool() error {
 	sqlDB, err := d.DB.DB()
 	if err != nil {
-		d.logger.Fatal().Err(err).Msg("Failed to get database instance")
+		return fmt.Errorf("failed to get database instance: %w", err)
+	}
+
+	if d.databaseConfig.InMemory() {
+		// Every connection to an in-memory SQLite database has a database of its own,
+		// so the pool keeps a single connection, forever.
+		sqlDB.SetMaxOpenConns(1)
+		sqlDB.SetMaxIdleConns(1)
+		sqlDB.SetConnMaxLifetime(0)
+		return nil
 	}
 
 	// SetMaxIdleConns sets the maximum number of connections in the idle connection pool.
 	sqlDB.SetMaxIdleConns(10)
 
 	// SetMaxOpenConns sets the maximum number of open connections to the database.
-	sqlDB.SetMaxOpenConns(100)
+	sqlDB.SetMaxOpenConns(MaxOpenConns)
 
 	// SetConnMaxLifetime sets the maximum amount of time a connection may be reused.
 	sqlDB.SetConnMaxLifetime(time.Hour)
+
+	return nil
 }
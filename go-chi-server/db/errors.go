@@ -0,0 +1,99 @@
+package db
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"gorm.io/gorm"
+)
+
+// transientPgCodes are the postgres error codes (SQLSTATE) of errors that may succeed when retried.
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+var transientPgCodes = map[string]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"55P03": true, // lock_not_available
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// transientPgClasses are the postgres error classes (first 2 characters of SQLSTATE) of errors that may succeed when retried.
+var transientPgClasses = map[string]bool{
+	"08": true, // connection_exception
+	"53": true, // insufficient_resources
+}
+
+// transientMySQLErrors are the MySQL error numbers of errors that may succeed when retried.
+// https://dev.mysql.com/doc/mysql-errors/8.0/en/server-error-reference.html
+var transientMySQLErrors = map[uint16]bool{
+	1205: true, // ER_LOCK_WAIT_TIMEOUT
+	1213: true, // ER_LOCK_DEADLOCK
+	1040: true, // ER_CON_COUNT_ERROR
+	1053: true, // ER_SERVER_SHUTDOWN
+}
+
+// IsRetryable is a cnp.Classifier for gorm/pgx/mysql errors.
+//
+// It returns true for transient errors (e.g. connection resets, serialization failures, deadlocks, timed out attempts)
+// and false for errors that will fail again no matter how often they are retried
+// (e.g. gorm.ErrRecordNotFound, duplicate keys, constraint violations, syntax errors).
+// Errors it does not know about are not retried, e.g. a validation or marshalling bug would fail again.
+func IsRetryable(err error) bool {
+	if !cnp.DefaultClassifier(err) {
+		return false
+	}
+
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound),
+		errors.Is(err, gorm.ErrDuplicatedKey),
+		errors.Is(err, gorm.ErrForeignKeyViolated),
+		errors.Is(err, gorm.ErrInvalidData),
+		errors.Is(err, gorm.ErrInvalidField),
+		errors.Is(err, gorm.ErrMissingWhereClause),
+		errors.Is(err, gorm.ErrPrimaryKeyRequired):
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return transientPgCodes[pgErr.Code] || (len(pgErr.Code) >= 2 && transientPgClasses[pgErr.Code[:2]])
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return transientMySQLErrors[mysqlErr.Number]
+	}
+
+	switch {
+	case errors.Is(err, cnp.ErrTimeout),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, mysql.ErrInvalidConn),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE):
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// pgconn knows when a query was never sent to the server, e.g. a failed connection
+	if pgconn.SafeToRetry(err) {
+		return true
+	}
+
+	// e.g. "database is locked" from sqlite
+	return strings.Contains(err.Error(), "database is locked")
+}
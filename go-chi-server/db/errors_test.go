@@ -0,0 +1,59 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnp "github.com/patilchinmay/go-experiments/cloudnativepatterns"
+	"github.com/patilchinmay/go-experiments/go-chi-server/db"
+	"gorm.io/gorm"
+)
+
+var _ = Describe("IsRetryable", func() {
+	DescribeTable("should classify the database errors",
+		func(err error, retryable bool) {
+			Expect(db.IsRetryable(err)).To(Equal(retryable))
+			// Wrapping does not change the classification
+			Expect(db.IsRetryable(fmt.Errorf("query failed: %w", err))).To(Equal(retryable))
+		},
+		// postgres codes
+		Entry("serialization_failure", &pgconn.PgError{Code: "40001"}, true),
+		Entry("deadlock_detected", &pgconn.PgError{Code: "40P01"}, true),
+		Entry("cannot_connect_now", &pgconn.PgError{Code: "57P03"}, true),
+		Entry("unique_violation", &pgconn.PgError{Code: "23505"}, false),
+		Entry("syntax_error", &pgconn.PgError{Code: "42601"}, false),
+		// postgres classes
+		Entry("connection_exception class", &pgconn.PgError{Code: "08006"}, true),
+		Entry("insufficient_resources class", &pgconn.PgError{Code: "53300"}, true),
+		Entry("a short code", &pgconn.PgError{Code: "0"}, false),
+		Entry("an empty code", &pgconn.PgError{}, false),
+		// mysql
+		Entry("mysql deadlock", &mysql.MySQLError{Number: 1213}, true),
+		Entry("mysql duplicate entry", &mysql.MySQLError{Number: 1062}, false),
+		Entry("mysql invalid connection", mysql.ErrInvalidConn, true),
+		// gorm
+		Entry("gorm.ErrRecordNotFound", gorm.ErrRecordNotFound, false),
+		Entry("gorm.ErrDuplicatedKey", gorm.ErrDuplicatedKey, false),
+		// network
+		Entry("a net error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")}, true),
+		Entry("a connection reset", syscall.ECONNRESET, true),
+		Entry("an unexpected EOF", io.ErrUnexpectedEOF, true),
+		Entry("a locked sqlite database", errors.New("database is locked (5) (SQLITE_BUSY)"), true),
+		// patterns and context
+		Entry("a timed out attempt", cnp.ErrTimeout, true),
+		Entry("a permanent error", cnp.Permanent(syscall.ECONNRESET), false),
+		Entry("an open breaker", cnp.ErrCircuitOpen, false),
+		Entry("context.Canceled", context.Canceled, false),
+		Entry("context.DeadlineExceeded", context.DeadlineExceeded, false),
+		// anything else
+		Entry("a plain error", errors.New("json: unsupported type"), false),
+	)
+})
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"gorm.io/gorm"
+)
+
+// SQLCommenter is a gorm plugin that appends the request id of the context of every query to its SQL,
+// as a sqlcommenter comment (https://google.github.io/sqlcommenter/spec/), e.g.
+//
+//	SELECT * FROM "users" WHERE "users"."id" = $1 /*request_id='host%2Fabc-000001'*/
+//
+// so that a slow query in the logs of the database can be correlated with the Request-ID header of its request.
+// The queries must be made with gorm.DB.WithContext for their context to be known.
+type SQLCommenter struct{}
+
+func (SQLCommenter) Name() string {
+	return "sqlcommenter"
+}
+
+// Initialize wraps the connection pool of db, so that the comment is added to the SQL right before it is sent,
+// whatever built it (gorm, Raw, Exec...).
+func (SQLCommenter) Initialize(db *gorm.DB) error {
+	pool := &commenterPool{ConnPool: db.ConnPool}
+	db.ConnPool = pool
+	db.Statement.ConnPool = pool
+	return nil
+}
+
+// comment appends the sqlcommenter comment of ctx to query, if ctx carries a request id.
+func comment(ctx context.Context, query string) string {
+	requestID := middleware.GetReqID(ctx)
+	if requestID == "" {
+		return query
+	}
+
+	// The value is URL-encoded, and its quotes escaped
+	value := strings.ReplaceAll(url.PathEscape(requestID), "'", `\'`)
+
+	return query + " /*request_id='" + value + "'*/"
+}
+
+// commenterPool is a gorm.ConnPool that comments the queries.
+type commenterPool struct {
+	gorm.ConnPool
+}
+
+func (p *commenterPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return p.ConnPool.PrepareContext(ctx, comment(ctx, query))
+}
+
+func (p *commenterPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return p.ConnPool.ExecContext(ctx, comment(ctx, query), args...)
+}
+
+func (p *commenterPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return p.ConnPool.QueryContext(ctx, comment(ctx, query), args...)
+}
+
+func (p *commenterPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return p.ConnPool.QueryRowContext(ctx, comment(ctx, query), args...)
+}
+
+// BeginTx starts a transaction whose queries are commented too.
+// gorm runs the writes (Create, Update, Delete) in a transaction by default.
+func (p *commenterPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	var (
+		tx  gorm.ConnPool
+		err error
+	)
+
+	switch beginner := p.ConnPool.(type) {
+	case gorm.TxBeginner:
+		tx, err = beginner.BeginTx(ctx, opts)
+	case gorm.ConnPoolBeginner:
+		tx, err = beginner.BeginTx(ctx, opts)
+	default:
+		return nil, gorm.ErrInvalidTransaction
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &commenterTx{commenterPool: commenterPool{ConnPool: tx}}, nil
+}
+
+// GetDBConn returns the *sql.DB of the wrapped pool, see gorm.DB.DB.
+func (p *commenterPool) GetDBConn() (*sql.DB, error) {
+	switch pool := p.ConnPool.(type) {
+	case *sql.DB:
+		return pool, nil
+	case gorm.GetDBConnector:
+		return pool.GetDBConn()
+	}
+
+	return nil, gorm.ErrInvalidDB
+}
+
+// commenterTx is a transaction started by commenterPool.
+type commenterTx struct {
+	commenterPool
+}
+
+func (tx *commenterTx) Commit() error {
+	committer, ok := tx.ConnPool.(gorm.TxCommitter)
+	if !ok {
+		return gorm.ErrInvalidTransaction
+	}
+	return committer.Commit()
+}
+
+func (tx *commenterTx) Rollback() error {
+	committer, ok := tx.ConnPool.(gorm.TxCommitter)
+	if !ok {
+		return gorm.ErrInvalidTransaction
+	}
+	return committer.Rollback()
+}
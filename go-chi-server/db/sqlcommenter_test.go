@@ -0,0 +1,133 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/go-chi/chi/v5/middleware"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/patilchinmay/go-experiments/go-chi-server/db"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// recordingPool records the SQL sent to the database.
+type recordingPool struct {
+	*sql.DB
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (p *recordingPool) record(query string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queries = append(p.queries, query)
+}
+
+func (p *recordingPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	p.record(query)
+	return p.DB.ExecContext(ctx, query, args...)
+}
+
+func (p *recordingPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	p.record(query)
+	return p.DB.QueryContext(ctx, query, args...)
+}
+
+func (p *recordingPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	p.record(query)
+	return p.DB.QueryRowContext(ctx, query, args...)
+}
+
+func (p *recordingPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	tx, err := p.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingTx{Tx: tx, pool: p}, nil
+}
+
+func (p *recordingPool) GetDBConn() (*sql.DB, error) {
+	return p.DB, nil
+}
+
+// recordingTx records the SQL sent in a transaction started by recordingPool.
+type recordingTx struct {
+	*sql.Tx
+	pool *recordingPool
+}
+
+func (tx *recordingTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	tx.pool.record(query)
+	return tx.Tx.ExecContext(ctx, query, args...)
+}
+
+func (tx *recordingTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	tx.pool.record(query)
+	return tx.Tx.QueryContext(ctx, query, args...)
+}
+
+func (tx *recordingTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	tx.pool.record(query)
+	return tx.Tx.QueryRowContext(ctx, query, args...)
+}
+
+type item struct {
+	ID   uint
+	Name string
+}
+
+var _ = Describe("SQLCommenter", func() {
+	var (
+		gdb  *gorm.DB
+		pool *recordingPool
+	)
+
+	BeforeEach(func() {
+		// When the name of the database file handed to sqlite3_open() or to ATTACH is an empty string, then a new temporary file is created to hold the database.
+		// https://www.sqlite.org/inmemorydb.html
+		var err error
+		gdb, err = gorm.Open(sqlite.Open(""), &gorm.Config{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(gdb.AutoMigrate(&item{})).To(Succeed())
+
+		sqlDB, err := gdb.DB()
+		Expect(err).ShouldNot(HaveOccurred())
+
+		// The recording pool sees the SQL as sent by the plugin
+		pool = &recordingPool{DB: sqlDB}
+		gdb.ConnPool = pool
+		gdb.Statement.ConnPool = pool
+
+		Expect(gdb.Use(db.SQLCommenter{})).To(Succeed())
+	})
+
+	It("should append the request id to the queries, in transactions too", func() {
+		ctx := context.WithValue(context.Background(), middleware.RequestIDKey, "host/abc-000001")
+
+		Expect(gdb.WithContext(ctx).Create(&item{Name: "a"}).Error).To(Succeed())
+
+		var found item
+		Expect(gdb.WithContext(ctx).First(&found).Error).To(Succeed())
+		Expect(found.Name).To(Equal("a"))
+
+		Expect(pool.queries).To(HaveLen(2))
+		Expect(pool.queries).To(HaveEach(HaveSuffix(" /*request_id='host%2Fabc-000001'*/")))
+	})
+
+	It("should not comment the queries without a request id", func() {
+		Expect(gdb.Create(&item{Name: "a"}).Error).To(Succeed())
+
+		Expect(pool.queries).To(HaveLen(1))
+		Expect(pool.queries[0]).NotTo(ContainSubstring("/*"))
+	})
+
+	It("should still give access to the *sql.DB", func() {
+		sqlDB, err := gdb.DB()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(sqlDB.Ping()).To(Succeed())
+	})
+})
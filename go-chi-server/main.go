@@ -6,6 +6,7 @@ import (
 	"os/signal"
 	"runtime"
 
+	"github.com/benbjohnson/clock"
 	"github.com/go-chi/httplog"
 	"github.com/joho/godotenv"
 	"github.com/patilchinmay/go-experiments/go-chi-server/app"
@@ -13,6 +14,7 @@ import (
 	_ "github.com/patilchinmay/go-experiments/go-chi-server/app/ping"
 	"github.com/patilchinmay/go-experiments/go-chi-server/app/user"
 	_ "github.com/patilchinmay/go-experiments/go-chi-server/app/validator"
+	"github.com/patilchinmay/go-experiments/go-chi-server/app/webhook"
 	"github.com/patilchinmay/go-experiments/go-chi-server/db"
 	"github.com/patilchinmay/go-experiments/go-chi-server/server"
 	globallogger "github.com/patilchinmay/go-experiments/go-chi-server/utils/logger"
@@ -53,13 +55,40 @@ func main() {
 	logger.Info().Int("numCPU", numCPU).Msg("Available resources")
 
 	// Initialize Database (for dependency injection)
-	Db := initializeDB(logger)
+	Db := initializeDB(ctx, logger)
 
 	// Create app with routes handlers (uses builder pattern)
-	app := app.GetOrCreate().SetupDB(Db.DB).WithLogger(logger).SetupCORS().SetupMiddlewares().SetupNotFoundHandler()
+	app := app.GetOrCreate().SetupDB(Db.DB).WithLogger(logger).SetupCORS().SetupMiddlewares().SetupRateLimiter().SetupAdaptiveLimiter().SetupNotFoundHandler()
 
-	// Create and setup user subrouter
-	user.SetupSubrouter(app.DB, logger)
+	// Create and setup user subrouter, and purge its expired idempotency keys until the interrupt signal
+	idempotency := user.SetupSubrouter(app.DB, logger)
+	go idempotency.Run(ctx)
+
+	// Purge the users that were soft-deleted long ago, until the interrupt signal
+	retention, err := user.NewRetentionJob(user.NewUserRepository(app.DB, false), clock.New())
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create the user retention job")
+	}
+	go retention.WithLogger(logger).Run(ctx)
+
+	// Create and setup webhook subrouter, and deliver the webhooks until the interrupt signal
+	dispatcher, err := webhook.SetupSubrouter(app.DB, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create the webhook dispatcher")
+	}
+	go dispatcher.Run(ctx)
+
+	// Publish the user events recorded in the outbox, until the interrupt signal
+	relay, err := user.NewOutboxRelay(app.DB, clock.New())
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create the outbox relay")
+	}
+	relay.WithLogger(logger)
+	if relay.Publisher == "webhooks" {
+		// The events are delivered to the subscriptions of /webhook
+		relay.WithPublisher(dispatcher)
+	}
+	go relay.Run(ctx)
 
 	// Mounts subrouters on main app/router
 	app.MountSubrouters()
@@ -81,8 +110,12 @@ func main() {
 	server.Shutdown()
 }
 
-func initializeDB(logger zerolog.Logger) *db.Database {
-	Db := db.New(logger)
+func initializeDB(ctx context.Context, logger zerolog.Logger) *db.Database {
+	// The connection is retried while the database is starting up, and the interrupt signal stops the retries
+	Db, err := db.New(ctx, logger, clock.New())
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to initialize the database")
+	}
 
 	return Db
 }
@@ -0,0 +1,55 @@
+// Package problem writes RFC 7807 problem details responses (application/problem+json).
+// https://www.rfc-editor.org/rfc/rfc7807
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// ContentType is the media type of a problem details response.
+const ContentType = "application/problem+json"
+
+// Violation is a field of the request that failed validation.
+type Violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Problem is the body of a problem details response.
+type Problem struct {
+	// Type is a URI identifying the problem type. "about:blank" means that it is described by Status alone.
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Instance is the path of the request that caused the problem.
+	Instance string `json:"instance,omitempty"`
+
+	// Extension members
+	RequestID  string      `json:"request_id,omitempty"`
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+// New returns the problem of status, titled with its status text.
+func New(status int, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// Write writes p as the response to r. The instance and the request id are taken from r.
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	p.Instance = r.URL.Path
+	p.RequestID = middleware.GetReqID(r.Context())
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
@@ -1,9 +1,23 @@
 package validator
 
-import "github.com/go-playground/validator/v10"
+import (
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
 
 var Validator *validator.Validate
 
 func init() {
 	Validator = validator.New()
+
+	// Name the fields of the validation errors after their json tag, as the clients know them
+	Validator.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
 }